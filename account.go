@@ -0,0 +1,65 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var ErrInvalidAccount = errors.New("Account names can't contain dots or @.")
+
+var accountName string
+
+func init() {
+	commonFlags.StringVar(&accountName, "account", "",
+		"The name of the account to use with plugins, for keeping the options and cookies of several accounts apart.")
+}
+
+// Returns what the plugin's options, credentials and cookies are kept under,
+// which is Plugin@account with an account selected and the plugin name
+// otherwise.
+func accountScope(p plugins.Plugin) string {
+	if accountName == "" {
+		return p.Name()
+	}
+	return p.Name() + "@" + accountName
+}
+
+// Keeps the cookies of each account apart.
+type accountCookieStore struct {
+	plugins.CookieStore
+}
+
+func (s accountCookieStore) Load(plugin string) ([]*http.Cookie, error) {
+	return s.CookieStore.Load(plugin + "@" + accountName)
+}
+
+func (s accountCookieStore) Save(plugin string, cookies []*http.Cookie) error {
+	return s.CookieStore.Save(plugin+"@"+accountName, cookies)
+}
+
+func setupAccount() {
+	if strings.ContainsAny(accountName, ".@") {
+		fatal(ErrInvalidAccount)
+	} else if accountName != "" {
+		log.Debugf("Using the account \"%s\".", accountName)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// The HTTP API of the daemon.
+//
+//	POST   /jobs       Queue a job. Body: {"url": "...", "plugin": "...", "options": {"key": "value"}}
+//	GET    /jobs       List all jobs.
+//	GET    /jobs/<id>  Get a job, including its progress if it's running.
+//	GET    /events     Job status changes and progress as server-sent events. ?job=<id> for a single job.
+//	DELETE /jobs/<id>  Cancel a job.
+//
+//	POST   /schedules       Schedule a source. Body: {"url": "...", "cron": "0 3 * * *", "plugin": "...", "options": {"key": "value"}}
+//	GET    /schedules       List all scheduled sources.
+//	DELETE /schedules/<id>  Remove a scheduled source.
+//
+//	GET    /metrics  Request latency histograms in the Prometheus text format.
+//	GET    /healthz  Whether the daemon is alive. No token needed.
+//	GET    /readyz   Whether the daemon can take jobs. No token needed.
+//
+//	GET    /credentials       List credentials jobs are waiting for. Browsers get a page to enter them on.
+//	POST   /credentials/<id>  Enter a credential. Body: {"value": "...", "save": true}
+type ApiServer struct {
+	queue *JobQueue
+	sched *Scheduler
+	// If set, requests need an "Authorization: Bearer <token>" header, or
+	// the token as the password with basic auth for browsers.
+	token string
+	mux   *http.ServeMux
+}
+
+type apiJobRequest struct {
+	URL       string            `json:"url"`
+	Plugin    string            `json:"plugin"`
+	Options   map[string]string `json:"options"`
+	Directory string            `json:"directory"`
+}
+
+type apiScheduleRequest struct {
+	apiJobRequest
+	Cron         string `json:"cron"`
+	SkipExisting bool   `json:"skip_existing"`
+}
+
+type apiJob struct {
+	Job
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func NewApiServer(queue *JobQueue, sched *Scheduler, token string) *ApiServer {
+	api := &ApiServer{
+		queue: queue,
+		sched: sched,
+		token: token,
+		mux:   http.NewServeMux(),
+	}
+	api.mux.HandleFunc("/jobs", api.handleJobs)
+	api.mux.HandleFunc("/jobs/", api.handleJob)
+	api.mux.HandleFunc("/events", api.handleEvents)
+	api.mux.HandleFunc("/schedules", api.handleSchedules)
+	api.mux.HandleFunc("/schedules/", api.handleSchedule)
+	api.mux.HandleFunc("/metrics", api.handleMetrics)
+	api.mux.HandleFunc("/healthz", api.handleHealthz)
+	api.mux.HandleFunc("/readyz", api.handleReadyz)
+	api.mux.HandleFunc("/credentials", api.handleCredentials)
+	api.mux.HandleFunc("/credentials/", api.handleCredential)
+
+	return api
+}
+
+func (api *ApiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Probes from orchestrators can't be expected to have the token, and
+	// the checks don't give anything away.
+	probe := r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+	if api.token != "" && !probe {
+		auth := []byte(r.Header.Get("Authorization"))
+		_, pass, basic := r.BasicAuth()
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+api.token)) != 1 &&
+			(!basic || subtle.ConstantTimeCompare([]byte(pass), []byte(api.token)) != 1) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mindl"`)
+			writeJSON(w, http.StatusUnauthorized, apiError{"Missing or wrong API token."})
+			return
+		}
+	}
+
+	// Browsers let any page send simple requests to the API, and with no
+	// token on a loopback address, nothing else would stop them.
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+		writeJSON(w, http.StatusForbidden, apiError{"Requests from other origins aren't allowed."})
+		return
+	}
+
+	log.WithFields(map[string]interface{}{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"remote": r.RemoteAddr,
+	}).Debug("API request.")
+	api.mux.ServeHTTP(w, r)
+}
+
+// Returns whether the request came from the API's own origin, or from
+// something other than a browser, which doesn't send an Origin header.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return strings.EqualFold(origin, scheme+"://"+r.Host)
+}
+
+// Decodes a JSON body, writing an error response and returning false if it
+// can't. It has to be sent as application/json, which browsers won't send
+// to another origin without asking first.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, apiError{"The body has to be sent as application/json."})
+		return false
+	} else if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return false
+	}
+
+	return true
+}
+
+func (api *ApiServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jobs := api.queue.Jobs()
+		res := make([]apiJob, len(jobs))
+		for i, job := range jobs {
+			res[i] = api.job(job)
+		}
+		writeJSON(w, http.StatusOK, res)
+	case http.MethodPost:
+		var req apiJobRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		} else if req.URL == "" {
+			writeJSON(w, http.StatusBadRequest, apiError{"No URL given."})
+			return
+		}
+
+		job, err := api.queue.Add(req.URL, req.Plugin, req.Options, req.Directory)
+		if err == ErrNoPlugins || err == ErrJobDirectory {
+			writeJSON(w, http.StatusUnprocessableEntity, apiError{err.Error()})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, api.job(*job))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"Method not allowed."})
+	}
+}
+
+func (api *ApiServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	switch r.Method {
+	case http.MethodGet:
+		job, err := api.queue.Get(id)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, api.job(job))
+	case http.MethodDelete:
+		switch err := api.queue.Cancel(id); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ErrJobNotFound:
+			writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+		case ErrJobFinished:
+			writeJSON(w, http.StatusConflict, apiError{err.Error()})
+		default:
+			writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+		}
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"Method not allowed."})
+	}
+}
+
+func (api *ApiServer) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		srcs := api.sched.Sources()
+		for i := range srcs {
+			srcs[i].Options = nil
+		}
+		writeJSON(w, http.StatusOK, srcs)
+	case http.MethodPost:
+		var req apiScheduleRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		} else if req.URL == "" {
+			writeJSON(w, http.StatusBadRequest, apiError{"No URL given."})
+			return
+		}
+
+		src, err := api.sched.Add(req.URL, req.Cron, req.Plugin, req.Options, req.Directory, req.SkipExisting)
+		if src == nil {
+			writeJSON(w, http.StatusUnprocessableEntity, apiError{err.Error()})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+			return
+		}
+		res := *src
+		res.Options = nil
+		writeJSON(w, http.StatusCreated, res)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"Method not allowed."})
+	}
+}
+
+func (api *ApiServer) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/schedules/")
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"Method not allowed."})
+		return
+	}
+
+	switch err := api.sched.Remove(id); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrScheduleNotFound:
+		writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+	}
+}
+
+// Writes the request latency histograms in the Prometheus text format.
+func (api *ApiServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"Method not allowed."})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP mindl_request_duration_seconds Time until the response headers were received.")
+	fmt.Fprintln(w, "# TYPE mindl_request_duration_seconds histogram")
+	for _, h := range plugins.Latencies() {
+		endpoint := strconv.Quote(h.Endpoint)
+		var count int64
+		for i, n := range h.Counts {
+			count += n
+			le := "+Inf"
+			if i < len(plugins.LatencyBuckets) {
+				le = strconv.FormatFloat(plugins.LatencyBuckets[i].Seconds(), 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "mindl_request_duration_seconds_bucket{endpoint=%s,le=\"%s\"} %d\n", endpoint, le, count)
+		}
+		fmt.Fprintf(w, "mindl_request_duration_seconds_sum{endpoint=%s} %g\n", endpoint, h.Total.Seconds())
+		fmt.Fprintf(w, "mindl_request_duration_seconds_count{endpoint=%s} %d\n", endpoint, h.Count)
+	}
+}
+
+var credentialsPage = template.Must(template.New("credentials").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>mindl</title></head>
+<body>
+{{range .}}
+<form method="post" action="/credentials/{{.ID}}">
+<p><b>{{.Plugin}}</b>: {{.Option}}{{if .Comment}}<br><small>{{.Comment}}</small>{{end}}</p>
+<input type="password" name="value" autocomplete="off" autofocus>
+<label><input type="checkbox" name="save" value="true"> Save in the keyring</label>
+<button>OK</button>
+</form>
+{{else}}
+<p>No jobs are waiting for credentials.</p>
+{{end}}
+</body>
+</html>
+`))
+
+func (api *ApiServer) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"Method not allowed."})
+		return
+	}
+
+	pending := credentialRequests.Pending()
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		writeJSON(w, http.StatusOK, pending)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := credentialsPage.Execute(w, pending); err != nil {
+		log.WithError(err).Debug("Failed to write API response.")
+	}
+}
+
+// Takes JSON from API clients and a form from the credentials page, which is
+// sent back to the page afterwards.
+func (api *ApiServer) handleCredential(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/credentials/")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"Method not allowed."})
+		return
+	}
+
+	var req struct {
+		Value string `json:"value"`
+		Save  bool   `json:"save"`
+	}
+	form := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+	if form {
+		req.Value, req.Save = r.PostFormValue("value"), r.PostFormValue("save") == "true"
+	} else if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Value == "" {
+		writeJSON(w, http.StatusBadRequest, apiError{"No value given."})
+		return
+	} else if !credentialRequests.Answer(id, req.Value, req.Save) {
+		writeJSON(w, http.StatusNotFound, apiError{"No job is waiting for that credential."})
+		return
+	}
+
+	if form {
+		http.Redirect(w, r, "/credentials", http.StatusSeeOther)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (api *ApiServer) job(job Job) apiJob {
+	res := apiJob{Job: job}
+	// Options can contain credentials, so never send them back.
+	res.Options = nil
+	if p, ok := api.queue.Progress(job.ID); ok {
+		res.Progress = &p
+	}
+
+	return res
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Debug("Failed to write API response.")
+	}
+}
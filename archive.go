@@ -0,0 +1,153 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/MinoMino/mindl/i18n"
+)
+
+var ErrArchiveRemove = errors.New("Files can't be removed from an archive that's being uploaded.")
+
+var zipExtension string
+
+func init() {
+	commonFlags.StringVar(&zipExtension, "zip-extension", "zip",
+		"The file extension of ZIP files made with --zip, e.g. cbz for comic book readers.")
+}
+
+// Zips the files into an archive for every top-level directory as they're
+// saved, uploading the archives to another storage as they're written. Files
+// are kept in memory until they're done, so nothing touches the local disk.
+type archiveStorage struct {
+	Storage
+	archives map[string]*streamedArchive
+	m        sync.Mutex
+}
+
+type streamedArchive struct {
+	w   StorageWriter
+	zip *zip.Writer
+	m   sync.Mutex
+}
+
+func newArchiveStorage(s Storage) *archiveStorage {
+	return &archiveStorage{Storage: s, archives: make(map[string]*streamedArchive)}
+}
+
+// Splits a path into the name of its archive and the path inside it.
+func archivePath(path string) (string, string) {
+	split := strings.SplitN(path, "/", 2)
+	if len(split) < 2 {
+		return split[0] + "." + zipExtension, ""
+	}
+
+	return split[0] + "." + zipExtension, split[1]
+}
+
+func (s *archiveStorage) Create(path string) (StorageWriter, error) {
+	return &archiveWriter{storage: s, path: path}, nil
+}
+
+func (s *archiveStorage) Remove(path string) error {
+	return ErrArchiveRemove
+}
+
+func (s *archiveStorage) Location(path string) string {
+	archive, file := archivePath(path)
+	return s.Storage.Location(archive) + "/" + file
+}
+
+// Returns the archive a path goes into, starting the upload if needed.
+func (s *archiveStorage) archive(path string) (*streamedArchive, error) {
+	name, _ := archivePath(path)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if a, ok := s.archives[name]; ok {
+		return a, nil
+	}
+
+	log.Info(i18n.Tf("Zipping files to: %s", s.Storage.Location(name)))
+	w, err := s.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	a := &streamedArchive{w: w, zip: zip.NewWriter(w)}
+	s.archives[name] = a
+	return a, nil
+}
+
+// Finishes the archives, saving them.
+func (s *archiveStorage) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var res error
+	for name, a := range s.archives {
+		if err := a.zip.Close(); err != nil {
+			a.w.Abort()
+			res = err
+		} else if err := a.w.Close(); err != nil {
+			res = err
+		}
+		delete(s.archives, name)
+	}
+
+	return res
+}
+
+// Throws away the archives that haven't been finished.
+func (s *archiveStorage) Abort() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for name, a := range s.archives {
+		a.w.Abort()
+		delete(s.archives, name)
+	}
+}
+
+type archiveWriter struct {
+	bytes.Buffer
+	storage *archiveStorage
+	path    string
+}
+
+func (w *archiveWriter) Close() error {
+	a, err := w.storage.archive(w.path)
+	if err != nil {
+		return err
+	}
+	_, file := archivePath(w.path)
+	a.m.Lock()
+	defer a.m.Unlock()
+	// The header flag 0x800 will indicate UTF-8 filenames, albeit not supported everywhere.
+	fw, err := a.zip.CreateHeader(&zip.FileHeader{Name: file, Method: zip.Deflate, Flags: 0x800})
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteTo(fw)
+	return err
+}
+
+func (w *archiveWriter) Abort() error {
+	w.Reset()
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var ErrAria2Removed = errors.New("The download was removed from aria2.")
+
+var (
+	aria2URL    string
+	aria2Secret string
+	// The aria2 files are handed off to, if any.
+	aria2 *Aria2
+)
+
+func init() {
+	commonFlags.StringVar(&aria2URL, "aria2", "",
+		"Hand the transfer of plain files to a running aria2c through its JSON-RPC at the given URL.")
+	commonFlags.Lookup("aria2").NoOptDefVal = "http://localhost:6800/jsonrpc"
+	commonFlags.StringVar(&aria2Secret, "aria2-secret", "",
+		"The secret token set with aria2c's --rpc-secret.")
+}
+
+// A client for aria2's JSON-RPC interface.
+type Aria2 struct {
+	URL    string
+	Secret string
+	client *http.Client
+}
+
+func NewAria2(url, secret string) *Aria2 {
+	return &Aria2{URL: url, Secret: secret, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+type aria2Response struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Calls the method, decoding the result into res.
+func (a *Aria2) call(method string, res interface{}, params ...interface{}) error {
+	if a.Secret != "" {
+		params = append([]interface{}{"token:" + a.Secret}, params...)
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      "mindl",
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Post(a.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r aria2Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("Invalid response from aria2: %s", err)
+	} else if r.Error != nil {
+		return fmt.Errorf("aria2: %s", r.Error.Message)
+	} else if res != nil {
+		return json.Unmarshal(r.Result, res)
+	}
+
+	return nil
+}
+
+type aria2Status struct {
+	Status          string `json:"status"`
+	CompletedLength string `json:"completedLength"`
+	ErrorMessage    string `json:"errorMessage"`
+}
+
+// Downloads the URL to the path through the proxy if not nil and waits for
+// it to finish, calling progress with the number of new bytes as it goes.
+// Removes it from aria2 if cancel is closed first.
+func (a *Aria2) Download(url, path string, header http.Header, proxy *url.URL, progress func(int64), cancel <-chan struct{}) (int64, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	var headers []string
+	for k, vs := range header {
+		for _, v := range vs {
+			headers = append(headers, k+": "+v)
+		}
+	}
+	opts := map[string]interface{}{
+		"dir":                filepath.Dir(path),
+		"out":                filepath.Base(path),
+		"header":             headers,
+		"allow-overwrite":    "true",
+		"auto-file-renaming": "false",
+	}
+	if proxy != nil {
+		// Otherwise aria2 would use its own proxy settings, if any.
+		opts["all-proxy"] = proxy.String()
+	}
+
+	var gid string
+	if err := a.call("aria2.addUri", &gid, []string{url}, opts); err != nil {
+		return 0, err
+	}
+
+	var done int64
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-cancel:
+			a.call("aria2.remove", nil, gid)
+			return done, ErrCanceled
+		}
+
+		var status aria2Status
+		if err := a.call("aria2.tellStatus", &status, gid,
+			[]string{"status", "completedLength", "errorMessage"}); err != nil {
+			return done, err
+		}
+		if n, err := strconv.ParseInt(status.CompletedLength, 10, 64); err == nil && n > done {
+			progress(n - done)
+			done = n
+		}
+
+		switch status.Status {
+		case "complete":
+			a.call("aria2.removeDownloadResult", nil, gid)
+			return done, nil
+		case "error":
+			a.call("aria2.removeDownloadResult", nil, gid)
+			return done, fmt.Errorf("aria2: %s", status.ErrorMessage)
+		case "removed":
+			return done, ErrAria2Removed
+		}
+	}
+}
+
+func setupAria2() {
+	if aria2URL != "" {
+		aria2 = NewAria2(aria2URL, aria2Secret)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var (
+	ErrCredentialsDecrypt      = errors.New("Wrong passphrase, or the credentials file is corrupted.")
+	ErrCredentialsNoPassphrase = errors.New("The credentials file needs a passphrase. Set --credentials-passphrase or run mindl in a terminal.")
+	ErrCredentialsNoKey        = errors.New("The key of the credentials file isn't in the keyring.")
+	ErrCredentialsVersion      = errors.New("The credentials file is from a newer version of mindl.")
+	ErrNoSuchPluginName        = errors.New("No plugin by that name.")
+)
+
+const (
+	credentialsVersion = 1
+	// Where the key is kept when the file isn't encrypted with a passphrase.
+	credentialsKeyAccount = "mindl.CredentialsKey"
+)
+
+var (
+	credentialsFile       string
+	credentialsPassphrase string
+	// Opened the first time an option is looked up in it.
+	credentials     *CredentialStore
+	credentialsOnce sync.Once
+	// Held while using the opened file, since tokens can be saved to it
+	// while downloading.
+	credentialsM sync.Mutex
+)
+
+var authCommand = &Command{
+	Name:  "auth",
+	Usage: "[flags] <set|rm|list> [<plugin> [<option>]]",
+	Short: "Store plugin options like usernames and passwords in an encrypted file.",
+	Flags: NewCommandFlags("auth"),
+	Setup: SetupNone,
+}
+
+func init() {
+	authCommand.Run = runAuth
+	commonFlags.StringVar(&credentialsFile, "credentials-file", defaultCredentialsFile(),
+		"The encrypted file plugin options are stored in with the auth command.")
+	commonFlags.StringVar(&credentialsPassphrase, "credentials-passphrase", "",
+		"The passphrase of the credentials file. Preferably set with MINDL_CREDENTIALS_PASSPHRASE. "+
+			"Without one, the file's key is kept in the OS keyring.")
+}
+
+func defaultCredentialsFile() string {
+	return storageTokenPath("credentials.json")
+}
+
+// Plugin options kept in a file encrypted with AES-GCM, keyed by Plugin.Key
+// like the keyring. The key is either derived from a passphrase with scrypt,
+// or random and kept in the OS keyring.
+type CredentialStore struct {
+	Path   string
+	values map[string]string
+	// "scrypt" or "keyring". Empty until the key has been picked.
+	kind string
+	salt []byte
+	key  []byte
+}
+
+type credentialsFileData struct {
+	Version int    `json:"version"`
+	Kind    string `json:"kind"`
+	Salt    []byte `json:"salt,omitempty"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Opens and decrypts the store, which is empty if the file doesn't exist.
+func OpenCredentialStore(path string) (*CredentialStore, error) {
+	s := &CredentialStore{Path: path, values: make(map[string]string)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f credentialsFileData
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	} else if f.Version > credentialsVersion {
+		return nil, ErrCredentialsVersion
+	}
+	s.kind, s.salt = f.Kind, f.Salt
+	switch f.Kind {
+	case "keyring":
+		encoded, err := KeyringGet(credentialsKeyAccount)
+		if err != nil {
+			return nil, ErrCredentialsNoKey
+		}
+		if s.key, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, ErrCredentialsNoKey
+		}
+	default:
+		passphrase, err := credentialsPassphraseFor(false)
+		if err != nil {
+			return nil, err
+		}
+		if s.key, err = scrypt.Key([]byte(passphrase), f.Salt, 1<<15, 8, 1, 32); err != nil {
+			return nil, err
+		}
+	}
+
+	gcm, err := newCredentialsCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, f.Nonce, f.Data, nil)
+	if err != nil {
+		return nil, ErrCredentialsDecrypt
+	}
+	if err := json.Unmarshal(plain, &s.values); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func newCredentialsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the passphrase from the flag, or asks for it.
+func credentialsPassphraseFor(create bool) (string, error) {
+	if credentialsPassphrase != "" {
+		return credentialsPassphrase, nil
+	} else if !isTerminal(os.Stdin) {
+		return "", ErrCredentialsNoPassphrase
+	}
+
+	for {
+		if passphrase := promptSecret(i18n.T("Passphrase for the credentials file"), create); passphrase != "" {
+			return passphrase, nil
+		}
+	}
+}
+
+// Picks how the file is encrypted the first time it's saved: with a
+// passphrase if one was given, otherwise with a key in the keyring, falling
+// back on asking for a passphrase.
+func (s *CredentialStore) pickKey() error {
+	if credentialsPassphrase == "" && !noKeyring {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		err := KeyringSet(credentialsKeyAccount, base64.StdEncoding.EncodeToString(key))
+		if err == nil {
+			s.kind, s.key = "keyring", key
+			return nil
+		}
+		log.Debugf("Not keeping the credentials key in the keyring: %s", err)
+	}
+
+	passphrase, err := credentialsPassphraseFor(true)
+	if err != nil {
+		return err
+	}
+	s.salt = make([]byte, 16)
+	if _, err := rand.Read(s.salt); err != nil {
+		return err
+	}
+	s.kind = "scrypt"
+	s.key, err = scrypt.Key([]byte(passphrase), s.salt, 1<<15, 8, 1, 32)
+	return err
+}
+
+func (s *CredentialStore) Get(account string) (string, bool) {
+	v, ok := s.values[account]
+	return v, ok
+}
+
+func (s *CredentialStore) Set(account, value string) {
+	s.values[account] = value
+}
+
+func (s *CredentialStore) Delete(account string) bool {
+	_, ok := s.values[account]
+	delete(s.values, account)
+	return ok
+}
+
+// Returns the stored accounts, optionally only the ones of a plugin,
+// including those of its named accounts.
+func (s *CredentialStore) Accounts(plugin string) []string {
+	var res []string
+	for account := range s.values {
+		scope, _ := splitAccount(account)
+		if plugin == "" || strings.EqualFold(strings.SplitN(scope, "@", 2)[0], plugin) {
+			res = append(res, account)
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// Encrypts and writes the store, replacing the file atomically.
+func (s *CredentialStore) Save() error {
+	if s.key == nil {
+		if err := s.pickKey(); err != nil {
+			return err
+		}
+	}
+	gcm, err := newCredentialsCipher(s.key)
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	f := credentialsFileData{Version: credentialsVersion, Kind: s.kind, Salt: s.salt}
+	f.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return err
+	}
+	f.Data = gcm.Seal(nil, f.Nonce, plain, nil)
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0700); err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// Opens the credentials file the first time it's needed if it exists, and
+// returns it, or nil if it couldn't be. Must be called with credentialsM held.
+func openCredentials() *CredentialStore {
+	credentialsOnce.Do(func() {
+		if _, err := os.Stat(credentialsFile); err != nil {
+			return
+		}
+		var err error
+		if credentials, err = OpenCredentialStore(credentialsFile); err != nil {
+			log.Warnf("Failed to open the credentials file: %s", err)
+		}
+	})
+
+	return credentials
+}
+
+// Looks up an option in the credentials file.
+func storedCredential(p plugins.Plugin, opt plugins.Option) (string, bool) {
+	credentialsM.Lock()
+	defer credentialsM.Unlock()
+	if openCredentials() == nil {
+		return "", false
+	}
+
+	return credentials.Get(credentialAccount(p, opt))
+}
+
+// Splits Plugin.Key or Plugin@account.Key into the scope and key.
+func splitAccount(account string) (string, string) {
+	split := strings.SplitN(account, ".", 2)
+	if len(split) < 2 {
+		return split[0], ""
+	}
+	return split[0], split[1]
+}
+
+func findPlugin(name string) (plugins.Plugin, error) {
+	for _, p := range Plugins {
+		if strings.EqualFold(p.Name(), name) {
+			return p, nil
+		}
+	}
+
+	return nil, ErrNoSuchPluginName
+}
+
+func runAuth(args []string) {
+	if len(args) == 0 || (args[0] != "list" && len(args) < 2) || len(args) > 3 {
+		authCommand.Flags.Usage()
+		os.Exit(ExitUsage)
+	}
+
+	var p plugins.Plugin
+	var err error
+	if len(args) > 1 {
+		if p, err = findPlugin(args[1]); err != nil {
+			fatal(err)
+		}
+	}
+	store, err := OpenCredentialStore(credentialsFile)
+	if err != nil {
+		fatal(err)
+	}
+
+	switch args[0] {
+	case "set":
+		if !authPrompt(store, p, args[2:]) {
+			log.Info(i18n.T("Nothing was changed."))
+			return
+		}
+	case "rm":
+		removed := false
+		for _, account := range store.Accounts(p.Name()) {
+			scope, key := splitAccount(account)
+			if strings.EqualFold(scope, accountScope(p)) && (len(args) < 3 || strings.EqualFold(key, args[2])) {
+				removed = store.Delete(account) || removed
+			}
+		}
+		if !removed {
+			log.Info(i18n.T("Nothing was changed."))
+			return
+		}
+	case "list":
+		name := ""
+		if p != nil {
+			name = p.Name()
+		}
+		for _, account := range store.Accounts(name) {
+			fmt.Println(account)
+		}
+		return
+	default:
+		authCommand.Flags.Usage()
+		os.Exit(ExitUsage)
+	}
+
+	if err := store.Save(); err != nil {
+		fatal(err)
+	}
+	log.Info(i18n.Tf("Saved the credentials to: %s", store.Path))
+}
+
+// Prompts for the plugin's credentials, or only the given option. Those are
+// the options it needs to log in: the required ones and the secret ones.
+// Entering nothing keeps the current value. Returns whether anything changed.
+func authPrompt(store *CredentialStore, p plugins.Plugin, only []string) bool {
+	changed := false
+	for _, opt := range p.Options() {
+		if len(only) > 0 && !strings.EqualFold(only[0], opt.Key()) {
+			continue
+		} else if len(only) == 0 && !opt.IsRequired() && !isSecretOption(opt) {
+			continue
+		}
+
+		account := credentialAccount(p, opt)
+		msg := "    " + opt.Key()
+		if _, ok := store.Get(account); ok {
+			msg += " " + i18n.T("(stored)")
+		}
+		if c := opt.Comment(); c != "" {
+			fmt.Println(c)
+		}
+		var v string
+		if isSecretOption(opt) {
+			v = promptSecret(msg, true)
+		} else {
+			v = prompt(msg)
+		}
+		if v != "" {
+			store.Set(account, v)
+			changed = true
+		}
+	}
+
+	return changed
+}
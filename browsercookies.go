@@ -0,0 +1,347 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var (
+	ErrUnknownBrowser     = errors.New("Unknown browser. Should be firefox, chrome or chromium.")
+	ErrBrowserUnsupported = errors.New("Reading cookies from that browser isn't supported on this platform.")
+	ErrNoCookieStore      = errors.New("Found no cookie store for the browser. Is it installed?")
+	ErrNoSQLite           = errors.New("Reading browser cookies needs the sqlite3 command to be installed.")
+)
+
+var cookiesFromBrowser string
+
+func init() {
+	commonFlags.StringVar(&cookiesFromBrowser, "cookies-from-browser", "",
+		"Import cookies from a browser (firefox, chrome or chromium), letting plugins reuse its logged in sessions instead of logging in.")
+}
+
+// Reads the cookies plugins need from the browser passed with
+// --cookies-from-browser and hands them to the plugins.
+func setupBrowserCookies() {
+	if cookiesFromBrowser == "" {
+		return
+	}
+
+	var domains []string
+	for _, p := range Plugins {
+		if cu, ok := p.(plugins.CookieUser); ok {
+			domains = append(domains, cu.CookieDomains()...)
+		}
+	}
+	cookies, err := ReadBrowserCookies(cookiesFromBrowser, domains)
+	if err != nil {
+		fatal(err)
+	}
+	log.Debugf("Imported %d cookie(s) from %s.", len(cookies), cookiesFromBrowser)
+	plugins.SetBrowserCookies(cookies)
+}
+
+// Reads the browser's cookies for the domains and their subdomains.
+func ReadBrowserCookies(browser string, domains []string) ([]*http.Cookie, error) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		return nil, ErrNoSQLite
+	}
+
+	switch strings.ToLower(browser) {
+	case "firefox":
+		return readFirefoxCookies(domains)
+	case "chrome":
+		return readChromeCookies("Chrome", domains)
+	case "chromium":
+		return readChromeCookies("Chromium", domains)
+	default:
+		return nil, ErrUnknownBrowser
+	}
+}
+
+func readFirefoxCookies(domains []string) ([]*http.Cookie, error) {
+	var dir string
+	switch runtime.GOOS {
+	case "darwin":
+		dir = "~/Library/Application Support/Firefox/Profiles"
+	case "windows":
+		dir = "$APPDATA/Mozilla/Firefox/Profiles"
+	default:
+		dir = "~/.mozilla/firefox"
+	}
+	path := newestFile(filepath.Join(outputDirectory(dir), "*", "cookies.sqlite"))
+	if path == "" {
+		return nil, ErrNoCookieStore
+	}
+
+	rows, err := querySQLite(path, "SELECT host, name, value, path, expiry, isSecure, isHttpOnly FROM moz_cookies WHERE "+
+		domainCondition("host", domains))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*http.Cookie, 0, len(rows))
+	for _, row := range rows {
+		if len(row) != 7 {
+			continue
+		}
+		expiry, _ := strconv.ParseInt(row[4], 10, 64)
+		res = append(res, &http.Cookie{
+			Domain:   row[0],
+			Name:     row[1],
+			Value:    row[2],
+			Path:     row[3],
+			Expires:  time.Unix(expiry, 0),
+			Secure:   row[5] == "1",
+			HttpOnly: row[6] == "1",
+		})
+	}
+
+	return res, nil
+}
+
+func readChromeCookies(name string, domains []string) ([]*http.Cookie, error) {
+	var dir, password string
+	// Chrome uses a single iteration on Linux and 1003 on macOS.
+	iterations := 1
+	switch runtime.GOOS {
+	case "darwin":
+		vendor := "Google/Chrome"
+		if name == "Chromium" {
+			vendor = "Chromium"
+		}
+		dir = "~/Library/Application Support/" + vendor
+		out, err := exec.Command("security", "find-generic-password", "-w", "-s", name+" Safe Storage").Output()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get the cookie key from the keychain: %s", err)
+		}
+		password = strings.TrimSpace(string(out))
+		iterations = 1003
+	case "linux", "freebsd", "openbsd", "netbsd":
+		dir = "~/.config/google-chrome"
+		if name == "Chromium" {
+			dir = "~/.config/chromium"
+		}
+		// Without a keyring, Chrome uses a hardcoded password.
+		password = "peanuts"
+		out, err := exec.Command("secret-tool", "lookup", "application", strings.ToLower(name)).Output()
+		if err == nil && len(out) > 0 {
+			password = strings.TrimSpace(string(out))
+		}
+	default:
+		// Newer versions on Windows encrypt cookies with a key only
+		// the browser itself can get at.
+		return nil, ErrBrowserUnsupported
+	}
+
+	dir = outputDirectory(dir)
+	path := newestFile(filepath.Join(dir, "Default", "Network", "Cookies"), filepath.Join(dir, "Default", "Cookies"))
+	if path == "" {
+		return nil, ErrNoCookieStore
+	}
+
+	// Newer versions put a hash of the domain in front of the value.
+	version := 0
+	if rows, err := querySQLite(path, "SELECT value FROM meta WHERE key = 'version'"); err == nil && len(rows) > 0 {
+		version, _ = strconv.Atoi(rows[0][0])
+	}
+	rows, err := querySQLite(path, "SELECT host_key, name, value, hex(encrypted_value), path, expires_utc, is_secure, is_httponly FROM cookies WHERE "+
+		domainCondition("host_key", domains))
+	if err != nil {
+		return nil, err
+	}
+
+	key := pbkdf2SHA1([]byte(password), []byte("saltysalt"), iterations, 16)
+	peanuts := pbkdf2SHA1([]byte("peanuts"), []byte("saltysalt"), iterations, 16)
+	res := make([]*http.Cookie, 0, len(rows))
+	for _, row := range rows {
+		if len(row) != 8 {
+			continue
+		}
+		value := row[2]
+		if enc, _ := hex.DecodeString(row[3]); len(enc) > 0 {
+			k := key
+			if bytes.HasPrefix(enc, []byte("v10")) && runtime.GOOS != "darwin" {
+				k = peanuts
+			}
+			dec, err := decryptChromeValue(enc, k)
+			if err != nil {
+				log.WithField("cookie", row[1]).Debugf("Failed to decrypt cookie: %s", err)
+				continue
+			}
+			if version >= 24 && len(dec) >= 32 {
+				dec = dec[32:]
+			}
+			value = string(dec)
+		}
+		cookie := &http.Cookie{
+			Domain:   row[0],
+			Name:     row[1],
+			Value:    value,
+			Path:     row[4],
+			Secure:   row[6] == "1",
+			HttpOnly: row[7] == "1",
+		}
+		// Microseconds since 1601, or 0 for session cookies, which are left
+		// without an expiry rather than having expired in 1601.
+		if expires, _ := strconv.ParseInt(row[5], 10, 64); expires != 0 {
+			cookie.Expires = time.Unix(expires/1e6-11644473600, 0)
+		}
+		res = append(res, cookie)
+	}
+
+	return res, nil
+}
+
+func decryptChromeValue(enc, key []byte) ([]byte, error) {
+	if len(enc) < 3 || !(bytes.HasPrefix(enc, []byte("v10")) || bytes.HasPrefix(enc, []byte("v11"))) {
+		return nil, errors.New("Unknown encryption.")
+	}
+	enc = enc[3:]
+	if len(enc) == 0 || len(enc)%aes.BlockSize != 0 {
+		return nil, errors.New("Bad length.")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	dec := make([]byte, len(enc))
+	iv := bytes.Repeat([]byte(" "), aes.BlockSize)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(dec, enc)
+
+	// Remove the PKCS#7 padding.
+	pad := int(dec[len(dec)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errors.New("Bad padding. Wrong key?")
+	}
+
+	return dec[:len(dec)-pad], nil
+}
+
+// PBKDF2 with HMAC-SHA1, which is all Chrome needs.
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	var res []byte
+	for block := 1; len(res) < keyLen; block++ {
+		mac := hmac.New(sha1.New, password)
+		mac.Write(salt)
+		mac.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := mac.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		res = append(res, t...)
+	}
+
+	return res[:keyLen]
+}
+
+// Returns an SQL condition matching the domains and their subdomains.
+func domainCondition(column string, domains []string) string {
+	if len(domains) == 0 {
+		return "0"
+	}
+
+	conds := make([]string, 0, len(domains)*2)
+	for _, d := range domains {
+		d = strings.Replace(strings.TrimPrefix(d, "."), "'", "''", -1)
+		conds = append(conds, fmt.Sprintf("%s = '%s'", column, d), fmt.Sprintf("%s LIKE '%%.%s'", column, d))
+	}
+
+	return strings.Join(conds, " OR ")
+}
+
+// Runs a query with the sqlite3 command on a copy of the database, since
+// browsers keep theirs locked while running.
+func querySQLite(path, query string) ([][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "mindl-cookies-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Unit and record separators won't show up in cookies.
+	out, err := exec.Command("sqlite3", "-readonly", "-separator", "\x1f", "-newline", "\x1e",
+		tmp.Name(), query).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the cookie store: %s", err)
+	}
+
+	var rows [][]string
+	for _, line := range strings.Split(string(out), "\x1e") {
+		if line != "" {
+			rows = append(rows, strings.Split(line, "\x1f"))
+		}
+	}
+
+	return rows, nil
+}
+
+// Returns the most recently modified file matching any of the patterns.
+func newestFile(patterns ...string) string {
+	var newest string
+	var newestTime time.Time
+	for _, p := range patterns {
+		matches, _ := filepath.Glob(p)
+		for _, match := range matches {
+			// Files can disappear or be unreadable, e.g. a profile being
+			// deleted, so skip those.
+			info, err := os.Stat(match)
+			if err != nil {
+				continue
+			}
+			if newest == "" || info.ModTime().After(newestTime) {
+				newest, newestTime = match, info.ModTime()
+			}
+		}
+	}
+
+	return newest
+}
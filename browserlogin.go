@@ -0,0 +1,94 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var ErrNoLoginBrowser = errors.New("Found no Chrome, Chromium or Edge to log in with. Pass the path to one to --browser-login.")
+
+var (
+	browserLogin         string
+	browserLoginHeadless bool
+	browserLoginTimeout  time.Duration
+)
+
+func init() {
+	commonFlags.StringVar(&browserLogin, "browser-login", "",
+		"Log in through Chrome, Chromium or Edge when a plugin's own login fails. Takes the path to the browser, or finds one without it.")
+	commonFlags.Lookup("browser-login").NoOptDefVal = "auto"
+	commonFlags.BoolVar(&browserLoginHeadless, "browser-login-headless", false,
+		"Set to run the login browser without a window. Logins that need you, like ones with captchas, then time out.")
+	commonFlags.DurationVar(&browserLoginTimeout, "browser-login-timeout", 5*time.Minute,
+		"How long to wait for a login in the browser.")
+}
+
+// Makes plugins fall back on logging in with a browser if --browser-login
+// was passed.
+func setupBrowserLogin() {
+	if browserLogin == "" {
+		return
+	}
+
+	path := browserLogin
+	if path == "auto" {
+		if path = findLoginBrowser(); path == "" {
+			fatal(ErrNoLoginBrowser)
+		}
+	}
+	log.Debugf("Logging in with %s when plugins' logins fail.", path)
+	plugins.SetLoginBrowser(&plugins.ChromeLogin{Path: path, Headless: browserLoginHeadless,
+		Timeout: browserLoginTimeout})
+}
+
+// Looks for a browser that speaks the DevTools protocol where they're
+// usually installed.
+func findLoginBrowser() string {
+	var candidates []string
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = []string{
+			"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+			"/Applications/Chromium.app/Contents/MacOS/Chromium",
+			"/Applications/Microsoft Edge.app/Contents/MacOS/Microsoft Edge",
+		}
+	case "windows":
+		for _, dir := range []string{"$PROGRAMFILES", "${PROGRAMFILES(X86)}", "$LOCALAPPDATA"} {
+			candidates = append(candidates,
+				filepath.Join(outputDirectory(dir), "Google", "Chrome", "Application", "chrome.exe"),
+				filepath.Join(outputDirectory(dir), "Microsoft", "Edge", "Application", "msedge.exe"))
+		}
+	default:
+		candidates = []string{"google-chrome", "google-chrome-stable", "chromium", "chromium-browser",
+			"microsoft-edge"}
+	}
+
+	for _, c := range candidates {
+		if path, err := exec.LookPath(c); err == nil {
+			return path
+		}
+	}
+
+	return ""
+}
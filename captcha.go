@@ -0,0 +1,107 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var (
+	captchaService string
+	captchaKey     string
+	captchaTimeout time.Duration
+)
+
+func init() {
+	commonFlags.StringVar(&captchaService, "captcha-service", "",
+		"The URL of a captcha solving service with a 2Captcha-compatible API, e.g. https://2captcha.com. Without one, you're asked to solve captchas yourself.")
+	commonFlags.StringVar(&captchaKey, "captcha-key", "",
+		"The API key for the captcha solving service.")
+	commonFlags.DurationVar(&captchaTimeout, "captcha-timeout", 3*time.Minute,
+		"How long to wait for the captcha solving service.")
+}
+
+// Asks the user to solve captchas.
+type promptCaptchaSolver struct {
+	// Workers could get captchas at the same time.
+	m sync.Mutex
+}
+
+func (s *promptCaptchaSolver) SolveCaptcha(c *plugins.Captcha) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if c.Kind != plugins.CaptchaImage {
+		fmt.Println(i18n.Tf("Solve the captcha at %s in a browser, then paste the response token from the page's %s field.",
+			c.PageURL, captchaField(c.Kind)))
+		return prompt(i18n.T("Token")), nil
+	}
+
+	f, err := ioutil.TempFile("", "mindl-captcha-*.png")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(c.Image)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	fmt.Println(i18n.Tf("The captcha has been saved to %s.", f.Name()))
+
+	return prompt(i18n.T("Answer")), nil
+}
+
+// Asks the user for two-factor codes, from an app or sent by the site.
+type promptTwoFactor struct {
+	m sync.Mutex
+}
+
+func (p *promptTwoFactor) TwoFactorCode(plugin string) (string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	fmt.Println(i18n.Tf("%s wants a two-factor authentication code.", plugin))
+	return prompt(i18n.T("Code")), nil
+}
+
+func captchaField(kind string) string {
+	if kind == plugins.CaptchaHCaptcha {
+		return "h-captcha-response"
+	}
+	return "g-recaptcha-response"
+}
+
+func setupCaptcha() {
+	if captchaService != "" {
+		plugins.SetCaptchaSolver(&plugins.CaptchaService{
+			URL:     captchaService,
+			Key:     captchaKey,
+			Timeout: captchaTimeout,
+		})
+	} else if isTerminal(os.Stdin) && progressMode != ProgressTUI {
+		plugins.SetCaptchaSolver(&promptCaptchaSolver{})
+	}
+	if isTerminal(os.Stdin) && progressMode != ProgressTUI {
+		plugins.SetTwoFactorPrompter(&promptTwoFactor{})
+	}
+}
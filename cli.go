@@ -18,18 +18,15 @@ package main
 
 import (
 	"errors"
-	"path/filepath"
-	//"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
-	"time"
 
 	flag "github.com/spf13/pflag"
 
+	"github.com/MinoMino/mindl/i18n"
 	"github.com/MinoMino/mindl/logger"
-	"github.com/MinoMino/mindl/plugins"
-	"github.com/MinoMino/minterm"
 )
 
 // Main logger.
@@ -41,6 +38,7 @@ var version = "UNSET"
 // Errors.
 var (
 	ErrInvalidOptionFormat = errors.New("Invalid option format. Should be key=value.")
+	ErrInvalidSize         = errors.New("Invalid size. Should be a number of bytes, optionally followed by K, M, G or T.")
 )
 
 // Flag for options passed through the CLI that satisfies
@@ -82,119 +80,281 @@ func (opt *OptionsFlag) Type() string {
 	return "key=value"
 }
 
+// Flag for a number of bytes, like 500M or 2G. The units are powers of 1024,
+// and 0 usually means there's no limit.
+type SizeFlag int64
+
+func (size *SizeFlag) String() string {
+	if *size == 0 {
+		return "0"
+	}
+
+	return strings.Replace(formatBytes(int64(*size)), " ", "", 1)
+}
+
+func (size *SizeFlag) Set(v string) error {
+	v = strings.ToUpper(strings.Replace(strings.TrimSpace(v), " ", "", -1))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	mult := int64(1)
+	if i := strings.IndexAny(v, "KMGT"); i != -1 && i == len(v)-1 {
+		for j := strings.IndexByte("KMGT", v[i]); j >= 0; j-- {
+			mult *= 1024
+		}
+		v = v[:i]
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return ErrInvalidSize
+	}
+
+	*size = SizeFlag(n * float64(mult))
+	return nil
+}
+
+func (size *SizeFlag) Type() string {
+	return "size"
+}
+
+// A subcommand, e.g. the "download" in "mindl download <url>".
+type Command struct {
+	Name string
+	// What follows the command name in the usage line, e.g. "[flags] <url>...".
+	Usage string
+	// A one-line description for the command list.
+	Short string
+	Flags *flag.FlagSet
+	// Called with the positional arguments after the flags have been parsed.
+	Run func(args []string)
+	// What has to be set up before it's run.
+	Setup CommandSetup
+}
+
+// What a command needs set up before it runs. Commands that don't download
+// anything skip the rest, so that they don't touch the output directory and
+// a broken setting for downloads can't get in their way.
+type CommandSetup int
+
+const (
+	// Everything, for commands that download. The default.
+	SetupDownload CommandSetup = iota
+	// Only what HTTP requests need, like proxies.
+	SetupNetwork
+	// Nothing but logging.
+	SetupNone
+)
+
+// Creates a flag set for a command. The common flags are added
+// to it by setupCommands().
+func NewCommandFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+// The command used when the first argument isn't the name of a command.
+// This keeps "mindl <url>" working like it always has.
+var defaultCommand *Command
+
+// All commands in the order they're listed in the usage.
+var commands []*Command
+
 var (
-	options                                                    OptionsFlag
-	workers                                                    int
-	verbose, defaults, noprompt, zipit, printVersion, override bool
-	dldir                                                      string
-	urls                                                       []string
+	verbose        int
+	quiet          bool
+	logFile        string
+	logRotation    logger.Rotation
+	logMaxSize     SizeFlag
+	jsonOutput     bool
+	commonFlags    = flag.NewFlagSet("common", flag.ExitOnError)
+	versionCommand = &Command{
+		Name:  "version",
+		Short: "Print the program version.",
+		Flags: NewCommandFlags("version"),
+		Setup: SetupNone,
+		Run: func(args []string) {
+			fmt.Println(version)
+		},
+	}
 )
 
 func init() {
-	flag.VarP(&options, "option", "o",
-		"Options in a key=value format passed to plugins.")
-	flag.IntVarP(&workers, "workers", "w", 10,
-		"The number of workers to use.")
-	flag.BoolVarP(&verbose, "verbose", "v", false,
-		"Set to display debug messages.")
-	flag.BoolVarP(&defaults, "defaults", "d", false,
-		"Set to use default values for options whenever possible. No effect if --no-prompt is on.")
-	flag.BoolVarP(&noprompt, "no-prompt", "n", false,
-		"Set to turn off prompts for options and instead throw an error if a required option is left unset.")
-	flag.BoolVarP(&zipit, "zip", "z", false,
-		"Set to ZIP the files after the download finishes.")
-	flag.StringVarP(&dldir, "directory", "D", "downloads/",
-		"The directory in which to save the downloaded files.")
-	flag.BoolVar(&printVersion, "version", false,
-		"Print the program version.")
-	flag.BoolVar(&override, "override", false,
-		"Override special options, such as forcing the number of workers.")
-
-	flag.CommandLine.MarkHidden("override")
+	commonFlags.CountVarP(&verbose, "verbose", "v",
+		"Set to display debug messages. Use -vv to also display every HTTP request.")
+	commonFlags.BoolVarP(&quiet, "quiet", "q", false,
+		"Set to only display warnings and errors.")
+	commonFlags.StringVar(&logFile, "log-file", "",
+		"Write logs, including debug messages, as JSON to the given file.")
+	commonFlags.Var(&logMaxSize, "log-max-size", "Start a new --log-file once it would grow past this, like 100M. 0 for no limit.")
+	commonFlags.DurationVar(&logRotation.Every, "log-rotate", 0,
+		"Start a new --log-file after writing to it for this long, like 24h. 0 for never.")
+	commonFlags.IntVar(&logRotation.Keep, "log-keep", 7,
+		"How many old log files to keep once --log-file is rotated. 0 keeps all of them.")
+	commonFlags.DurationVar(&logRotation.MaxAge, "log-max-age", 0,
+		"Delete old log files once they're older than this, like 720h. 0 for no limit.")
+
+	// Has to be done after the other commands' variables are initialized.
+	defaultCommand = downloadCommand
+	commands = []*Command{
+		downloadCommand,
+		pluginsCommand,
+		searchCommand,
+		infoCommand,
+		loginCommand,
+		watchCommand,
+		clipboardCommand,
+		resumeCommand,
+		serveCommand,
+		historyCommand,
+		statsCommand,
+		gcCommand,
+		filesCommand,
+		keyringCommand,
+		authCommand,
+		completionCommand,
+		updateCommand,
+		versionCommand,
+	}
 }
 
-func main() {
-	flag.Parse()
-	if printVersion {
-		fmt.Println(version)
-		os.Exit(0)
+// Adds the common flags to every command. Done in main() rather than init()
+// so that every file has had the chance to add common flags first.
+func setupCommands() {
+	for _, cmd := range commands {
+		cmd.Flags.AddFlagSet(commonFlags)
+		cmd.setUsage()
+	}
+	// The common flags are shared, but translating twice is harmless.
+	for _, cmd := range commands {
+		cmd.Flags.VisitAll(func(f *flag.Flag) {
+			f.Usage = i18n.T(f.Usage)
+		})
 	}
+}
 
-	urls = flag.Args()
-	logger.Verbose(verbose)
-	// Ensure the path uses os.PathSeparator and ends with one.
-	dldir = strings.TrimSuffix(filepath.FromSlash(dldir), string(os.PathSeparator)) + string(os.PathSeparator)
+func findCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
 
-	if flag.NArg() == 0 {
-		flag.Usage()
-		os.Exit(0)
+	return nil
+}
+
+func (cmd *Command) setUsage() {
+	cmd.Flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s mindl %s %s\n\n%s\n\n%s\n",
+			i18n.T("Usage:"), cmd.Name, cmd.Usage, i18n.T(cmd.Short), i18n.T("Flags:"))
+		cmd.Flags.PrintDefaults()
 	}
+}
 
-	pm := PluginManager(Plugins[:])
-	handlers := pm.FindHandlers(urls)
-	for i, h := range handlers {
-		// Ensure we have at least one handler for each URL.
-		if len(h) == 0 {
-			log.Errorf("Found no handler for: %s", urls[i])
-		}
-		// Set options for the plugin.
-		if err := pm.SetOptions(h, map[string]string(options), defaults, noprompt); err != nil {
-			log.Fatal(err)
-		}
+func usage() {
+	fmt.Fprintln(os.Stderr, i18n.T("Usage: mindl [command] [flags] [arguments]"))
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, i18n.T("Commands:"))
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.Name, i18n.T(cmd.Short))
 	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, i18n.Tf("If no command is given, \"%s\" is used.", defaultCommand.Name))
+	fmt.Fprintln(os.Stderr, i18n.T("Run \"mindl <command> --help\" for the flags of a command."))
+}
 
-	// Start downloading.
-	for i, h := range handlers {
-		// Make the user pick a handler if multiple plugins
-		// can handle a URL.
-		// TODO: Make it possible to run mindl without user input.
-		if p, err := pm.SelectPlugin(h); err != nil {
-			log.Fatal(err)
-		} else {
-			// If we're dealing with multiple URLs, print which one we're processing.
-			if len(urls) > 1 {
-				log.Infof("Processing URL: %s", urls[i])
-			}
-			log.Infof("Starting download using \"%s\"...", pluginName(p))
-			startDownloading(urls[i], p)
+// Turns the parts into the name of an environment variable, e.g.
+// "BookLive", "Username" into "MINDL_BOOKLIVE_USERNAME".
+func envName(parts ...string) string {
+	name := strings.ToUpper(strings.Join(append([]string{"mindl"}, parts...), "_"))
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
 		}
-	}
+		return '_'
+	}, name)
 }
 
-func startDownloading(url string, plugin plugins.Plugin) {
-	dm := NewDownloadManager(plugin, dldir)
-	lr, _ := minterm.NewLineReserver()
-	defer func() {
-		if r := recover(); r != nil {
-			log.Fatalf("Panicked: %v", r)
+// Sets every flag that wasn't passed on the command line from
+// its environment variable if set, e.g. MINDL_WORKERS for --workers.
+func setFlagsFromEnv(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Changed {
+			return
 		}
-	}()
-	defer lr.Release()
-
-	// Get a new progress string and refresh the reserved line
-	// in regular intervals.
-	ticker := time.NewTicker(time.Millisecond * 500)
-	done := make(chan struct{})
-	defer func() {
-		ticker.Stop()
-		done <- struct{}{}
-	}()
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				lr.Set(dm.ProgressString())
-				lr.Refresh()
-			case <-done:
-				return
+		env := envName(f.Name)
+		if val, ok := os.LookupEnv(env); ok {
+			if err := fs.Set(f.Name, val); err != nil {
+				fatalUsage("Invalid value for %s: %s", env, err)
 			}
 		}
-	}()
+	})
+}
 
-	dls, err := dm.Download(url, workers, zipit, override)
-	if err != nil {
-		log.Error(err)
-		return
+func setupLogging() {
+	if quiet {
+		logger.SetVerbosity(logger.VerbosityQuiet)
+	} else {
+		logger.SetVerbosity(verbose)
+	}
+	if jsonOutput || progressMode == ProgressJSON {
+		logger.UseStderr()
+	}
+	if logFile != "" {
+		logRotation.MaxSize = int64(logMaxSize)
+		if err := logger.LogToFile(logFile, logRotation); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+func main() {
+	setupCommands()
+	args := os.Args[1:]
+	if len(args) == 0 {
+		usage()
+		os.Exit(0)
+	}
+
+	cmd := defaultCommand
+	switch args[0] {
+	case "help", "-h", "--help":
+		usage()
+		os.Exit(0)
+	case "--version":
+		// Kept from before we had subcommands.
+		cmd = versionCommand
+		args = args[1:]
+	default:
+		if c := findCommand(args[0]); c != nil {
+			cmd = c
+			args = args[1:]
+		}
+	}
+
+	cmd.Flags.Parse(args)
+	setFlagsFromEnv(cmd.Flags)
+	applyProfile(cmd.Flags)
+	setupProgress()
+	setupLogging()
+	defer logger.Close()
+	setupAccount()
+	if cmd.Setup != SetupNone {
+		setupTransport()
+		defer stopTransport()
+		setupProxies()
+		setupHeaders()
+	}
+	if cmd.Setup == SetupDownload {
+		setupEvents()
+		setupBrowserCookies()
+		setupCookieJar()
+		setupCaptcha()
+		setupBrowserLogin()
+		setupOAuth2()
+		setupAria2()
+		setupHistory()
+		setupFileIndex()
+		setupTempFiles()
+	}
+	cmd.Run(cmd.Flags.Args())
+	if exitCode != ExitOK {
+		exit(exitCode)
 	}
-	log.Infof("Done! Got a total of %d downloads.", len(dls))
 }
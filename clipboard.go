@@ -0,0 +1,211 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var ErrClipboardUnsupported = errors.New("Found no way to read the clipboard. On Linux, install wl-clipboard, xclip or xsel.")
+
+// Commands that print the clipboard, in order of preference.
+var clipboardCommands = map[string][][]string{
+	"linux":   {{"wl-paste", "--no-newline"}, {"xclip", "-selection", "clipboard", "-o"}, {"xsel", "--clipboard", "--output"}},
+	"freebsd": {{"xclip", "-selection", "clipboard", "-o"}, {"xsel", "--clipboard", "--output"}},
+	"openbsd": {{"xclip", "-selection", "clipboard", "-o"}, {"xsel", "--clipboard", "--output"}},
+	"netbsd":  {{"xclip", "-selection", "clipboard", "-o"}, {"xsel", "--clipboard", "--output"}},
+	"darwin":  {{"pbpaste"}},
+	"windows": {{"powershell", "-NoProfile", "-NonInteractive", "-Command", "Get-Clipboard -Raw"}},
+}
+
+// Returns the text in the system clipboard.
+func ReadClipboard() (string, error) {
+	found := false
+	for _, args := range clipboardCommands[runtime.GOOS] {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		found = true
+		out, err := exec.Command(args[0], args[1:]...).Output()
+		if err != nil {
+			// Try the next one, since e.g. wl-paste fails outside Wayland
+			// even when installed.
+			log.WithField("command", args[0]).Debugf("Failed to read the clipboard: %s", err)
+			continue
+		}
+		return string(out), nil
+	}
+	if found {
+		// An empty clipboard is an error for some of them.
+		return "", nil
+	}
+
+	return "", ErrClipboardUnsupported
+}
+
+var (
+	clipboardInterval time.Duration
+	clipboardConfirm  bool
+	clipboardCommand  = &Command{
+		Name:  "clipboard",
+		Usage: "[flags]",
+		Short: "Watch the clipboard and download copied URLs.",
+		Flags: NewCommandFlags("clipboard"),
+	}
+)
+
+func init() {
+	clipboardCommand.Run = runClipboard
+	fs := clipboardCommand.Flags
+	fs.VarP(&options, "option", "o",
+		"Options in a key=value format passed to plugins.")
+	fs.IntVarP(&workers, "workers", "w", 10,
+		"The number of workers to use.")
+	fs.BoolVarP(&defaults, "defaults", "d", false,
+		"Set to use default values for options whenever possible. No effect if --no-prompt is on.")
+	fs.BoolVarP(&noprompt, "no-prompt", "n", false,
+		"Set to turn off prompts for options and instead throw an error if a required option is left unset.")
+	fs.BoolVarP(&zipit, "zip", "z", false,
+		"Set to ZIP the files after each download finishes.")
+	addOutputFlag(fs)
+	fs.DurationVar(&clipboardInterval, "interval", time.Second,
+		"How often to check the clipboard.")
+	fs.BoolVar(&clipboardConfirm, "confirm", false,
+		"Set to ask before queuing each copied URL.")
+}
+
+func runClipboard(args []string) {
+	dldir = outputDirectory(dldir)
+	if _, err := ReadClipboard(); err != nil {
+		fatal(err)
+	}
+
+	pm := PluginManager(Plugins[:])
+	queued := make(chan string, 64)
+	go watchClipboard(pm, clipboardInterval, queued)
+	log.Info(i18n.T("Watching the clipboard for URLs. Copy one to download it."))
+
+	// Plugins only get their options set the first time they're needed.
+	configured := make(map[plugins.Plugin]bool)
+	for {
+		var url string
+		select {
+		case url = <-queued:
+		case <-interrupt:
+			log.Info("Interrupted!")
+			return
+		}
+
+		h := pm.FindHandlers([]string{url})[0]
+		ps := unconfigured(h, configured)
+		if err := pm.SetOptions(ps, map[string]string(options), defaults, noprompt); err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, p := range ps {
+			configured[p] = true
+		}
+		p, err := pm.SelectPlugin(h)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		log.Info(i18n.Tf("Starting download of %s using \"%s\"...", url, pluginName(p)))
+		if res := startDownloading(url, p); errors.Is(res.err, ErrInterrupted) {
+			return
+		}
+	}
+}
+
+// Returns the plugins that haven't been configured yet. They're only marked
+// as configured once their options have been set successfully, so that they
+// are asked for again otherwise.
+func unconfigured(ps []plugins.Plugin, configured map[plugins.Plugin]bool) []plugins.Plugin {
+	res := make([]plugins.Plugin, 0, len(ps))
+	for _, p := range ps {
+		if !configured[p] {
+			res = append(res, p)
+		}
+	}
+
+	return res
+}
+
+// Checks the clipboard for URLs that a plugin can handle and sends them
+// on the channel. Each URL is only sent once.
+func watchClipboard(pm PluginManager, interval time.Duration, queued chan<- string) {
+	seen := make(map[string]bool)
+	// Don't download whatever happened to be in the clipboard already.
+	last, _ := ReadClipboard()
+	for range time.Tick(interval) {
+		text, err := ReadClipboard()
+		if err != nil {
+			log.Error(err)
+			continue
+		} else if text == last {
+			continue
+		}
+		last = text
+
+		for _, url := range clipboardURLs(text) {
+			if seen[url] || len(pm.FindHandlers([]string{url})[0]) == 0 {
+				continue
+			}
+			seen[url] = true
+			if clipboardConfirm && !confirm(i18n.Tf("Download %s?", url)) {
+				continue
+			}
+
+			select {
+			case queued <- url:
+				log.Info(i18n.Tf("Queued: %s", url))
+			default:
+				log.Warnf("Too many queued URLs. Ignoring: %s", url)
+			}
+		}
+	}
+}
+
+// Returns the URLs in a piece of text.
+func clipboardURLs(text string) []string {
+	var res []string
+	for _, f := range strings.Fields(text) {
+		if strings.HasPrefix(f, "http://") || strings.HasPrefix(f, "https://") {
+			res = append(res, f)
+		}
+	}
+
+	return res
+}
+
+// Asks a yes/no question, defaulting to no.
+func confirm(msg string) bool {
+	switch strings.ToLower(prompt(msg + " [y/N]")) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/logger"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var ErrPathCollision = errors.New("Two files in the download have the same path. Use --on-collision to allow it.")
+
+var onCollision string
+
+func init() {
+	commonFlags.StringVar(&onCollision, "on-collision", "suffix",
+		"What to do when two files in a download have the same path: suffix to add a number to the name, error to stop, or overwrite.")
+}
+
+// Keeps track of the paths used in a download, so that two downloaders
+// can't save to the same one.
+type pathClaims struct {
+	plugin plugins.Plugin
+	// The downloader that has each path.
+	paths map[string]int
+	m     sync.Mutex
+}
+
+func newPathClaims(p plugins.Plugin) *pathClaims {
+	return &pathClaims{plugin: p, paths: make(map[string]int)}
+}
+
+// Paths that only differ in case are the same file on Windows and macOS.
+func pathKey(p string) string {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		return strings.ToLower(p)
+	}
+
+	return p
+}
+
+// Returns the path downloader n should save to instead of p, which is a
+// relative path with forward slashes. A downloader can save to its own path
+// again, like when it retries.
+func (c *pathClaims) Claim(p string, n int) (string, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if owner, ok := c.paths[pathKey(p)]; !ok || owner == n || onCollision == "overwrite" {
+		c.paths[pathKey(p)] = n
+		return p, nil
+	} else if onCollision == "error" {
+		return "", fmt.Errorf("%s: %s", ErrPathCollision, p)
+	}
+
+	res := ""
+	if d, ok := c.plugin.(plugins.Disambiguator); ok {
+		res = path.Clean(d.Disambiguate(p, n))
+		if _, taken := c.paths[pathKey(res)]; taken || res == "." || path.IsAbs(res) || path.Dir(res) == "." {
+			res = ""
+		}
+	}
+	if res == "" {
+		// Numbering by downloader keeps the names the same from run to run,
+		// whichever downloader happens to be first.
+		ext := path.Ext(p)
+		for i := n + 1; res == ""; i++ {
+			candidate := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(p, ext), i, ext)
+			if _, taken := c.paths[pathKey(candidate)]; !taken {
+				res = candidate
+			}
+		}
+	}
+
+	log.WithField(logger.WorkerField, n).Warn(i18n.Tf("Saving %s as %s, since another file in the download has the same path.", p, res))
+	c.paths[pathKey(res)] = n
+	return res, nil
+}
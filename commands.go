@@ -0,0 +1,267 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var (
+	ErrNoSearchers = errors.New("None of the plugins support searching.")
+	ErrNoInformer  = errors.New("The plugin can't get info about items.")
+	ErrNoLogin     = errors.New("The plugin doesn't log in.")
+)
+
+var (
+	searchPlugin   string
+	pluginsCommand = &Command{
+		Name:  "plugins",
+		Usage: "[flags]",
+		Short: "List the available plugins and their options.",
+		Flags: NewCommandFlags("plugins"),
+		Setup: SetupNone,
+	}
+	searchCommand = &Command{
+		Name:  "search",
+		Usage: "[flags] <query>",
+		Short: "Search for content using the plugins that support it.",
+		Flags: NewCommandFlags("search"),
+	}
+	infoCommand = &Command{
+		Name:  "info",
+		Usage: "[flags] <url>...",
+		Short: "Print metadata about items without downloading them.",
+		Flags: NewCommandFlags("info"),
+	}
+	loginCommand = &Command{
+		Name:  "login",
+		Usage: "[flags] <plugin>",
+		Short: "Log in with a plugin to check the credentials, keeping the session for downloads.",
+		Flags: NewCommandFlags("login"),
+	}
+	completionCommand = &Command{
+		Name:  "completion",
+		Usage: "<bash|zsh|fish>",
+		Short: "Print a shell completion script.",
+		Flags: NewCommandFlags("completion"),
+		Setup: SetupNone,
+	}
+)
+
+func init() {
+	pluginsCommand.Run = runPlugins
+	searchCommand.Run = runSearch
+	infoCommand.Run = runInfo
+	loginCommand.Run = runLogin
+	completionCommand.Run = runCompletion
+
+	infoCommand.Flags.VarP(&options, "option", "o",
+		"Options in a key=value format passed to plugins.")
+	infoCommand.Flags.BoolVarP(&noprompt, "no-prompt", "n", false,
+		"Set to turn off prompts for options and instead throw an error if a required option is left unset.")
+	infoCommand.Flags.BoolVar(&jsonOutput, "json", false,
+		"Print the info as JSON, one item per line. Logs go to stderr.")
+
+	loginCommand.Flags.VarP(&options, "option", "o",
+		"Options in a key=value format passed to plugins.")
+	loginCommand.Flags.BoolVarP(&noprompt, "no-prompt", "n", false,
+		"Set to turn off prompts for options and instead throw an error if a required option is left unset.")
+
+	searchCommand.Flags.VarP(&options, "option", "o",
+		"Options in a key=value format passed to plugins.")
+	searchCommand.Flags.StringVarP(&searchPlugin, "plugin", "p", "",
+		"Only search using the plugin with this name.")
+}
+
+func runPlugins(args []string) {
+	for _, p := range Plugins {
+		fmt.Println(pluginName(p))
+		for _, opt := range p.Options() {
+			// Special and hidden options aren't meant to be set by the user.
+			if opt.IsHidden() || strings.HasPrefix(opt.Key(), "!") {
+				continue
+			}
+
+			var required string
+			if opt.IsRequired() {
+				required = " (required)"
+			}
+			fmt.Printf("    %s [%v]%s\n", opt.Key(), opt.Value(), required)
+			if comment := opt.Comment(); comment != "" {
+				fmt.Printf("        %s\n", comment)
+			}
+		}
+	}
+}
+
+func runLogin(args []string) {
+	if len(args) != 1 {
+		loginCommand.Flags.Usage()
+		os.Exit(ExitUsage)
+	}
+	p, err := findPlugin(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	auth, ok := p.(plugins.Authenticator)
+	if !ok {
+		fatal(ErrNoLogin)
+	}
+
+	pm := PluginManager{p}
+	if err := pm.SetOptions([]plugins.Plugin{p}, map[string]string(options), true, noprompt); err != nil {
+		fatal(err)
+	}
+	log.Info(i18n.Tf("Logging in with \"%s\"...", pluginName(p)))
+	if err := auth.Login(); err != nil {
+		log.Error(err)
+		exitCode = errorExitCode(err)
+		return
+	}
+	if plugins.PersistingCookies() {
+		log.Info(i18n.T("Logged in! The session is kept for the next downloads."))
+	} else {
+		log.Info(i18n.T("Logged in!"))
+	}
+}
+
+func runSearch(args []string) {
+	if len(args) == 0 {
+		searchCommand.Flags.Usage()
+		os.Exit(0)
+	}
+	query := strings.Join(args, " ")
+
+	searchers := make([]plugins.Plugin, 0, len(Plugins))
+	for _, p := range Plugins {
+		if _, ok := p.(plugins.Searcher); !ok {
+			continue
+		} else if searchPlugin != "" && !strings.EqualFold(searchPlugin, p.Name()) {
+			continue
+		}
+		searchers = append(searchers, p)
+	}
+	if len(searchers) == 0 {
+		fatal(ErrNoSearchers)
+	}
+
+	pm := PluginManager(searchers)
+	if err := pm.SetOptions(searchers, map[string]string(options), true, false); err != nil {
+		fatal(err)
+	}
+	for _, p := range searchers {
+		results, err := p.(plugins.Searcher).Search(query)
+		if err != nil {
+			log.WithField("plugin", pluginName(p)).Error(err)
+			continue
+		}
+
+		for _, res := range results {
+			fmt.Printf("[%s] %s\n    %s\n", p.Name(), res.Title, res.URL)
+		}
+	}
+}
+
+func runInfo(args []string) {
+	if len(args) == 0 {
+		infoCommand.Flags.Usage()
+		os.Exit(0)
+	}
+
+	pm := PluginManager(Plugins[:])
+	enc := json.NewEncoder(os.Stdout)
+	for i, h := range pm.FindHandlers(args) {
+		p, err := pm.SelectPlugin(h)
+		if err != nil {
+			log.WithField("url", args[i]).Error(err)
+			exitCode = errorExitCode(err)
+			continue
+		}
+		if err := pm.SetOptions([]plugins.Plugin{p}, map[string]string(options), true, noprompt); err != nil {
+			fatal(err)
+		}
+
+		info, err := getInfo(p, args[i])
+		if err != nil {
+			log.WithField("url", args[i]).Error(err)
+			exitCode = errorExitCode(err)
+			continue
+		}
+
+		if jsonOutput {
+			enc.Encode(struct {
+				URL    string `json:"url"`
+				Plugin string `json:"plugin"`
+				*plugins.ItemInfo
+			}{args[i], p.Name(), info})
+			continue
+		}
+		fmt.Println(args[i])
+		fmt.Printf("    %s: %s\n", i18n.T("Title"), info.Title)
+		if info.Volume != 0 {
+			fmt.Printf("    %s: %d\n", i18n.T("Volume"), info.Volume)
+		}
+		if len(info.Authors) != 0 {
+			fmt.Printf("    %s: %s\n", i18n.T("Authors"), strings.Join(info.Authors, ", "))
+		}
+		if info.Pages != 0 {
+			fmt.Printf("    %s: %d\n", i18n.T("Pages"), info.Pages)
+		}
+		for j, chapter := range info.Chapters {
+			fmt.Printf("    %s: %s\n", i18n.Tf("Chapter %d", j+1), chapter)
+		}
+		for k, v := range info.Extra {
+			fmt.Printf("    %s: %s\n", k, v)
+		}
+		if info.Description != "" {
+			fmt.Printf("    %s: %s\n", i18n.T("Description"), info.Description)
+		}
+	}
+}
+
+func getInfo(p plugins.Plugin, url string) (info *plugins.ItemInfo, err error) {
+	informer, ok := p.(plugins.Informer)
+	if !ok {
+		return nil, ErrNoInformer
+	}
+
+	// Plugins tend to panic on errors.
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{r}
+		}
+	}()
+	return informer.Info(url)
+}
+
+func runCompletion(args []string) {
+	if len(args) != 1 {
+		completionCommand.Flags.Usage()
+		os.Exit(ExitUsage)
+	}
+
+	if err := WriteCompletion(os.Stdout, args[0], commands, Plugins[:]); err != nil {
+		fatal(err)
+	}
+}
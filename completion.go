@@ -0,0 +1,254 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var ErrUnknownShell = errors.New("Unknown shell. Supported shells are bash, zsh and fish.")
+
+// Writes a completion script for the given shell to w. The flags are taken
+// from the commands' flag sets and the option keys from the plugins.
+func WriteCompletion(w io.Writer, shell string, cmds []*Command, ps []plugins.Plugin) error {
+	names := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		names[i] = cmd.Name
+	}
+	flags := completionFlags(cmds)
+	keys := completionOptionKeys(ps)
+
+	switch shell {
+	case "bash":
+		writeBashCompletion(w, names, flags, keys)
+	case "zsh":
+		writeZshCompletion(w, names, flags, keys)
+	case "fish":
+		writeFishCompletion(w, names, flags, keys)
+	default:
+		return ErrUnknownShell
+	}
+
+	return nil
+}
+
+// Returns the flags of all the commands, without duplicates.
+func completionFlags(cmds []*Command) []*flag.Flag {
+	res := make([]*flag.Flag, 0, 20)
+	seen := make(map[string]bool)
+	for _, cmd := range cmds {
+		cmd.Flags.VisitAll(func(f *flag.Flag) {
+			if !f.Hidden && !seen[f.Name] {
+				seen[f.Name] = true
+				res = append(res, f)
+			}
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
+
+// Returns every option key in the "Plugin.Key=" format, along with
+// a bare "Plugin." for each plugin.
+func completionOptionKeys(ps []plugins.Plugin) []string {
+	res := make([]string, 0, 20)
+	for _, p := range ps {
+		res = append(res, p.Name()+".")
+		for _, opt := range p.Options() {
+			// Special and hidden options aren't meant to be set by the user,
+			// and keys with spaces can't be completed as a single word.
+			if opt.IsHidden() || strings.HasPrefix(opt.Key(), "!") ||
+				strings.Contains(opt.Key(), " ") {
+				continue
+			}
+			res = append(res, p.Name()+"."+opt.Key()+"=")
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// Flags that take paths, which file names are completed for.
+var pathFlags = map[string]bool{
+	"ca-file":          true,
+	"credentials-file": true,
+	"dedup-store":      true,
+	"directory":        true,
+	"events":           true,
+	"har":              true,
+	"history-file":     true,
+	"http-cache":       true,
+	"index-file":       true,
+	"log-file":         true,
+	"output":           true,
+	"profiles-file":    true,
+	"queue-file":       true,
+	"rclone":           true,
+	"schedule-file":    true,
+	"sftp-key":         true,
+	"sftp-known-hosts": true,
+	"speed-history":    true,
+	"state":            true,
+	"temp-dir":         true,
+	"watch-dir":        true,
+}
+
+// Whether or not a flag takes an argument, as opposed to being a switch.
+func takesArgument(f *flag.Flag) bool {
+	return f.NoOptDefVal == ""
+}
+
+// Whether or not a flag can be given more than once, like -vv or -o.
+func repeatable(f *flag.Flag) bool {
+	switch f.Value.Type() {
+	case "count", "stringArray", "stringSlice", "key=value":
+		return true
+	}
+
+	return false
+}
+
+func writeBashCompletion(w io.Writer, cmds []string, flags []*flag.Flag, keys []string) {
+	words := make([]string, 0, len(flags)*2)
+	args := make([]string, 0, len(flags)*2)
+	for _, f := range flags {
+		words = append(words, "--"+f.Name)
+		if f.Shorthand != "" {
+			words = append(words, "-"+f.Shorthand)
+		}
+		// Complete file names for anything that takes a path.
+		if pathFlags[f.Name] && takesArgument(f) {
+			args = append(args, "--"+f.Name)
+			if f.Shorthand != "" {
+				args = append(args, "-"+f.Shorthand)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, `# bash completion for mindl
+_mindl() {
+    local cur prev
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+    case "$prev" in
+        -o|--option)
+            compopt -o nospace
+            COMPREPLY=( $(compgen -W %q -- "$cur") )
+            return
+            ;;
+        %s)
+            COMPREPLY=( $(compgen -f -- "$cur") )
+            return
+            ;;
+    esac
+    if [[ "$cur" == -* ]]; then
+        COMPREPLY=( $(compgen -W %q -- "$cur") )
+    elif [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=( $(compgen -W %q -- "$cur") )
+    fi
+}
+complete -o default -F _mindl mindl
+`, strings.Join(keys, " "), strings.Join(args, "|"), strings.Join(words, " "), strings.Join(cmds, " "))
+}
+
+func writeZshCompletion(w io.Writer, cmds []string, flags []*flag.Flag, keys []string) {
+	fmt.Fprintln(w, "#compdef mindl")
+	fmt.Fprintln(w, "# zsh completion for mindl")
+	fmt.Fprintln(w, "_mindl() {")
+	fmt.Fprintln(w, "    local -a option_keys")
+	fmt.Fprintf(w, "    option_keys=(%s)\n", strings.Join(quoteAll(keys), " "))
+	fmt.Fprintln(w, "    _arguments -s \\")
+	for _, f := range flags {
+		desc := zshEscape(f.Usage)
+		var action string
+		switch {
+		case f.Name == "option":
+			action = ":key=value:compadd -S '' -a option_keys"
+		case pathFlags[f.Name] && takesArgument(f):
+			action = ":path:_files"
+		case takesArgument(f):
+			action = fmt.Sprintf(":%s:", f.Value.Type())
+		}
+
+		// Flags that can be repeated are offered again, so they can't
+		// exclude themselves, while the others exclude both their names.
+		switch {
+		case f.Shorthand != "" && repeatable(f):
+			fmt.Fprintf(w, "        '*'{-%s,--%s}'[%s]%s' \\\n", f.Shorthand, f.Name, desc, action)
+		case f.Shorthand != "":
+			fmt.Fprintf(w, "        '(-%s --%s)'{-%s,--%s}'[%s]%s' \\\n",
+				f.Shorthand, f.Name, f.Shorthand, f.Name, desc, action)
+		case repeatable(f):
+			fmt.Fprintf(w, "        '*--%s[%s]%s' \\\n", f.Name, desc, action)
+		default:
+			fmt.Fprintf(w, "        '--%s[%s]%s' \\\n", f.Name, desc, action)
+		}
+	}
+	fmt.Fprintf(w, "        '1:command or url:(%s)' \\\n", strings.Join(cmds, " "))
+	fmt.Fprintln(w, "        '*:url:'")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, `_mindl "$@"`)
+}
+
+func writeFishCompletion(w io.Writer, cmds []string, flags []*flag.Flag, keys []string) {
+	fmt.Fprintln(w, "# fish completion for mindl")
+	fmt.Fprintf(w, "complete -c mindl -n __fish_use_subcommand -f -a %s\n", fishQuote(strings.Join(cmds, " ")))
+	for _, f := range flags {
+		line := "complete -c mindl"
+		if f.Shorthand != "" {
+			line += " -s " + f.Shorthand
+		}
+		line += " -l " + f.Name
+		if f.Name == "option" {
+			line += " -x -a " + fishQuote(strings.Join(keys, " "))
+		} else if takesArgument(f) && pathFlags[f.Name] {
+			line += " -r -F"
+		} else if takesArgument(f) {
+			line += " -x"
+		}
+		line += " -d " + fishQuote(f.Usage)
+		fmt.Fprintln(w, line)
+	}
+}
+
+func quoteAll(ss []string) []string {
+	res := make([]string, len(ss))
+	for i, s := range ss {
+		res[i] = "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+	}
+
+	return res
+}
+
+func zshEscape(s string) string {
+	r := strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`)
+	return r.Replace(s)
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,232 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var ErrCookieJarCorrupt = errors.New("The stored cookies could not be decrypted.")
+
+// The keyring account the cookie jar's key is kept under.
+const cookieJarKeyAccount = "cookie-jar"
+
+var noCookieJar bool
+
+func init() {
+	commonFlags.BoolVar(&noCookieJar, "no-cookie-jar", false,
+		"Set to not keep plugins' cookies, like login sessions, between runs.")
+}
+
+// A cookie as it's stored on disk.
+type storedCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"`
+	Path     string    `json:"path"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"http_only,omitempty"`
+}
+
+// Keeps the cookies of each plugin in a file of its own, encrypted with
+// AES-GCM using a key from the OS keyring if possible.
+type FileCookieStore struct {
+	dir string
+	// Set up when first needed so the keyring is left alone unless
+	// a plugin actually uses the jar.
+	gcm cipher.AEAD
+	m   sync.Mutex
+}
+
+// The default directory of the cookie jar, in the user's config directory.
+func DefaultCookieJarDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "mindl-cookies"
+	}
+
+	return filepath.Join(dir, "mindl", "cookies")
+}
+
+func NewFileCookieStore(dir string) *FileCookieStore {
+	return &FileCookieStore{dir: dir}
+}
+
+// Returns the cipher, creating the directory and key if needed.
+// Must be called with the lock held.
+func (s *FileCookieStore) cipher() (cipher.AEAD, error) {
+	if s.gcm != nil {
+		return s.gcm, nil
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := cookieJarKey(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	s.gcm, err = cipher.NewGCM(block)
+
+	return s.gcm, err
+}
+
+// Gets the key from the keyring, creating one if there is none. If the
+// keyring can't be used, the key is kept in a file only the user can read.
+func cookieJarKey(dir string) ([]byte, error) {
+	if !noKeyring {
+		secret, err := KeyringGet(cookieJarKeyAccount)
+		if err == nil {
+			if key, err := hex.DecodeString(secret); err == nil && len(key) == 32 {
+				return key, nil
+			}
+		} else if err == ErrKeyringNotFound {
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return nil, err
+			}
+			if err := KeyringSet(cookieJarKeyAccount, hex.EncodeToString(key)); err == nil {
+				return key, nil
+			}
+			log.Debug("Failed to store the cookie jar key in the keyring.")
+		} else {
+			log.Debugf("Failed to get the cookie jar key from the keyring: %s", err)
+		}
+	}
+
+	path := filepath.Join(dir, "key")
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) == 32 {
+			return key, nil
+		}
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, ioutil.WriteFile(path, []byte(hex.EncodeToString(key)), 0600)
+}
+
+func (s *FileCookieStore) path(plugin string) string {
+	return filepath.Join(s.dir, strings.ToLower(plugin)+".bin")
+}
+
+func (s *FileCookieStore) Load(plugin string) ([]*http.Cookie, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	data, err := ioutil.ReadFile(s.path(plugin))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	gcm, err := s.cipher()
+	if err != nil {
+		return nil, err
+	}
+	ns := gcm.NonceSize()
+	if len(data) < ns {
+		return nil, ErrCookieJarCorrupt
+	}
+	data, err = gcm.Open(nil, data[:ns], data[ns:], []byte(plugin))
+	if err != nil {
+		return nil, ErrCookieJarCorrupt
+	}
+
+	var stored []storedCookie
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	res := make([]*http.Cookie, len(stored))
+	for i, c := range stored {
+		res[i] = &http.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			Expires:  c.Expires,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+	}
+
+	return res, nil
+}
+
+func (s *FileCookieStore) Save(plugin string, cookies []*http.Cookie) error {
+	stored := make([]storedCookie, len(cookies))
+	for i, c := range cookies {
+		stored[i] = storedCookie{c.Name, c.Value, c.Domain, c.Path, c.Expires, c.Secure, c.HttpOnly}
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	gcm, err := s.cipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// The plugin name is authenticated so files can't be swapped around.
+	data = gcm.Seal(nonce, nonce, data, []byte(plugin))
+
+	path := s.path(plugin)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func setupCookieJar() {
+	if noCookieJar {
+		return
+	}
+
+	var store plugins.CookieStore = NewFileCookieStore(DefaultCookieJarDir())
+	if accountName != "" {
+		store = accountCookieStore{store}
+	}
+	plugins.SetCookieStore(store)
+}
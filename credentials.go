@@ -0,0 +1,200 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/logrus"
+	"golang.org/x/term"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// How long a job in the daemon waits for a credential to be entered.
+const credentialTimeout = 10 * time.Minute
+
+// Where the daemon asks for missing credentials. Only set when the API is on.
+var credentialRequests *CredentialRequests
+
+// Whether or not the plugin says an option holds a credential.
+func isSecretOption(opt plugins.Option) bool {
+	s, ok := opt.(interface{ IsSecret() bool })
+	return ok && s.IsSecret()
+}
+
+// Reads a line from the terminal without echoing it. Terminals that wrap
+// pastes in escape sequences have them removed.
+func readSecret(msg string) string {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return prompt(msg)
+	}
+
+	fmt.Print(msg + ": ")
+	data, _ := term.ReadPassword(fd)
+	fmt.Println()
+	s := strings.NewReplacer("\x1b[200~", "", "\x1b[201~", "").Replace(string(data))
+	return strings.TrimSpace(s)
+}
+
+// Prompts for a secret, asking for it twice if confirm is set until both
+// match.
+func promptSecret(msg string, confirm bool) string {
+	for {
+		s := readSecret(msg)
+		if !confirm || s == "" || readSecret(i18n.T("Confirm")) == s {
+			return s
+		}
+		fmt.Println(i18n.T("The entries didn't match. Try again."))
+	}
+}
+
+// A credential a job in the daemon is waiting for.
+type CredentialRequest struct {
+	ID      string    `json:"id"`
+	Plugin  string    `json:"plugin"`
+	Option  string    `json:"option"`
+	Account string    `json:"account"`
+	Comment string    `json:"comment,omitempty"`
+	Time    time.Time `json:"time"`
+	answer  chan string
+}
+
+// Credentials jobs in the daemon are waiting for, which are entered through
+// the API.
+type CredentialRequests struct {
+	pending map[string]*CredentialRequest
+	next    int
+	m       sync.Mutex
+}
+
+func NewCredentialRequests() *CredentialRequests {
+	return &CredentialRequests{pending: make(map[string]*CredentialRequest)}
+}
+
+// Waits for the option to be entered, returning false if it isn't in time.
+func (c *CredentialRequests) Ask(p plugins.Plugin, opt plugins.Option) (string, bool) {
+	c.m.Lock()
+	c.next++
+	req := &CredentialRequest{
+		ID:      strconv.Itoa(c.next),
+		Plugin:  p.Name(),
+		Option:  opt.Key(),
+		Account: credentialAccount(p, opt),
+		Comment: opt.Comment(),
+		Time:    time.Now(),
+		answer:  make(chan string, 1),
+	}
+	c.pending[req.ID] = req
+	c.m.Unlock()
+	defer func() {
+		c.m.Lock()
+		delete(c.pending, req.ID)
+		c.m.Unlock()
+	}()
+
+	log.WithField("plugin", pluginName(p)).Warnf("Waiting for the \"%s\" option to be entered at /credentials.", opt.Key())
+	select {
+	case v := <-req.answer:
+		return v, true
+	case <-time.After(credentialTimeout):
+		return "", false
+	}
+}
+
+// Returns the credentials being waited for, oldest first.
+func (c *CredentialRequests) Pending() []CredentialRequest {
+	c.m.Lock()
+	defer c.m.Unlock()
+	res := make([]CredentialRequest, 0, len(c.pending))
+	for _, req := range c.pending {
+		res = append(res, *req)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+
+	return res
+}
+
+// Gives the waiting job the value, optionally storing it in the keyring
+// too. Returns false if nothing is waiting for it.
+func (c *CredentialRequests) Answer(id, value string, save bool) bool {
+	c.m.Lock()
+	req, ok := c.pending[id]
+	if ok {
+		delete(c.pending, id)
+	}
+	c.m.Unlock()
+	if !ok {
+		return false
+	}
+
+	if save {
+		if err := KeyringSet(req.Account, value); err != nil {
+			log.Warnf("Failed to store %s in the keyring: %s", req.Account, err)
+		}
+	}
+	req.answer <- value
+	return true
+}
+
+// The keyring and credentials file account of a plugin's option, e.g.
+// BookLive.Password or BookLive@work.Password. Credentials are only ever
+// looked up by it, so that plugins only get their own.
+func credentialAccount(p plugins.Plugin, opt plugins.Option) string {
+	return accountScope(p) + "." + opt.Key()
+}
+
+// Reads an option from the environment, the OS keyring or the credentials
+// file, in that order, returning where it came from. Reads of credentials
+// are audited.
+func readCredential(p plugins.Plugin, opt plugins.Option) (string, string, bool) {
+	env := optionEnvName(p, opt)
+	val, ok := os.LookupEnv(env)
+	source := env
+	if !ok {
+		if val, ok = keyringOption(p, opt); ok {
+			source = "the keyring"
+		} else if val, ok = storedCredential(p, opt); ok {
+			source = "the credentials file"
+		} else {
+			return "", "", false
+		}
+	}
+	if isSecretOption(opt) {
+		auditCredential(credentialAccount(p, opt), source)
+	}
+
+	return val, source, true
+}
+
+// Logs that a credential was read and where from, but never the value.
+// They're debug messages, so they only end up in --log-file.
+func auditCredential(account, source string) {
+	log.WithFields(logrus.Fields{
+		"audit":   "credential",
+		"account": account,
+		"source":  source,
+	}).Debug("Read a credential.")
+}
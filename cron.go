@@ -0,0 +1,152 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCron = errors.New("Invalid schedule. Should be five cron fields like \"0 3 * * *\" or one of @hourly, @daily, @weekly or @monthly.")
+
+// Shorthands for common schedules.
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// A cron-style schedule with the standard five fields: minute, hour,
+// day of month, month and day of week. Each field supports *, lists,
+// ranges and steps, e.g. "*/15 8-18 * * 1-5".
+type CronSchedule struct {
+	minute, hour, dom, month, dow []bool
+	// Whether or not the day fields started with *, like * or */2. Like
+	// cron, if both are restricted a day matches if either of them does.
+	anyDom, anyDow bool
+}
+
+func ParseCron(spec string) (*CronSchedule, error) {
+	if s, ok := cronShorthands[strings.TrimSpace(spec)]; ok {
+		spec = s
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, ErrInvalidCron
+	}
+
+	var err error
+	cs := &CronSchedule{
+		anyDom: strings.HasPrefix(fields[2], "*"),
+		anyDow: strings.HasPrefix(fields[4], "*"),
+	}
+	if cs.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	} else if cs.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	} else if cs.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	} else if cs.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	} else if cs.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 are Sunday.
+	cs.dow[0] = cs.dow[0] || cs.dow[7]
+
+	return cs, nil
+}
+
+// Returns a slice where the indices of the matching values are true.
+func parseCronField(field string, min, max int) ([]bool, error) {
+	res := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step, stepped := 1, false
+		if split := strings.SplitN(part, "/", 2); len(split) == 2 {
+			var err error
+			if step, err = strconv.Atoi(split[1]); err != nil || step < 1 {
+				return nil, fmt.Errorf("Invalid step in schedule: %s", part)
+			}
+			part, stepped = split[0], true
+		}
+
+		start, end := min, max
+		if part != "*" {
+			split := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(split[0]); err != nil {
+				return nil, fmt.Errorf("Invalid value in schedule: %s", part)
+			}
+			end = start
+			if len(split) == 1 && stepped {
+				// Like cron, 5/10 is short for 5-59/10.
+				end = max
+			} else if len(split) == 2 {
+				if end, err = strconv.Atoi(split[1]); err != nil {
+					return nil, fmt.Errorf("Invalid value in schedule: %s", part)
+				}
+			}
+		}
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("Value out of range in schedule: %s", part)
+		}
+
+		for i := start; i <= end; i += step {
+			res[i] = true
+		}
+	}
+
+	return res, nil
+}
+
+func (cs *CronSchedule) matchesDay(t time.Time) bool {
+	dom, dow := cs.dom[t.Day()], cs.dow[int(t.Weekday())]
+	if cs.anyDom || cs.anyDow {
+		// Like cron, both have to match then, since one like */2 still
+		// restricts the days.
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+// Returns the first time after t that matches the schedule, or the zero
+// time if there is none within five years (e.g. "0 0 31 2 *").
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !cs.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !cs.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !cs.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !cs.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,309 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/MinoMino/mindl/i18n"
+)
+
+var ErrDedupOutputMissing = errors.New("An output directory using the dedup store is missing, so there's no telling which files it still uses.")
+
+// The file in the store listing every output directory that links to it.
+const dedupOutputsName = "outputs"
+
+var (
+	dedupMode  string
+	dedupStore string
+	gcCommand  = &Command{
+		Name:  "gc",
+		Usage: "[flags]",
+		Short: "Remove files from the dedup store that are no longer in any output directory using it.",
+		Flags: NewCommandFlags("gc"),
+		Setup: SetupNone,
+	}
+)
+
+func init() {
+	commonFlags.StringVar(&dedupMode, "dedup", "",
+		"Set to keep a single copy of identical files, even across downloads, by linking them to a store. Can be hardlink or symlink.")
+	commonFlags.Lookup("dedup").NoOptDefVal = "hardlink"
+	commonFlags.StringVar(&dedupStore, "dedup-store", "",
+		"The directory in which --dedup keeps files. Defaults to .store in the output directory.")
+
+	gcCommand.Run = runGC
+	addOutputFlag(gcCommand.Flags)
+	gcCommand.Flags.BoolVar(&dryRun, "dry-run", false,
+		"Set to only print what would be removed.")
+}
+
+// Files stored by their SHA-256 hashes, with downloaded files being links
+// to them, so that files downloaded more than once only take up space once.
+type DedupStore struct {
+	Directory string
+	// The output directory the files being added are in. Recorded in the
+	// store so that GC knows every directory that can link to it, since one
+	// store can be shared with --dedup-store.
+	Output string
+	// Whether to use symlinks instead of hardlinks, e.g. when the store is on
+	// another disk.
+	Symlink    bool
+	registered bool
+	m          sync.Mutex
+}
+
+// Returns the dedup store to use for an output directory, or nil if
+// deduplication is off or the output isn't local.
+func OpenDedupStore(output string) *DedupStore {
+	if dedupMode == "" || isOutputURL(output) {
+		return nil
+	}
+	if dedupMode != "hardlink" && dedupMode != "symlink" {
+		log.Warnf("Unknown --dedup mode: %s", dedupMode)
+		return nil
+	}
+
+	return &DedupStore{Directory: dedupDirectory(output), Output: output, Symlink: dedupMode == "symlink"}
+}
+
+func dedupDirectory(output string) string {
+	if dedupStore != "" {
+		return outputDirectory(dedupStore)
+	}
+
+	return filepath.Join(output, ".store")
+}
+
+func (s *DedupStore) blob(sum string) string {
+	return filepath.Join(s.Directory, sum[:2], sum)
+}
+
+// Adds a file to the store, replacing it with a link to the stored copy if
+// there already is one.
+func (s *DedupStore) Add(path, sum string) error {
+	blob := s.blob(sum)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.registered && s.Output != "" {
+		if err := s.register(s.Output); err != nil {
+			return err
+		}
+		s.registered = true
+	}
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blob), os.FileMode(permission)); err != nil {
+			return err
+		}
+		if !s.Symlink {
+			return os.Link(path, blob)
+		} else if err := os.Rename(path, blob); err != nil {
+			return err
+		}
+		return s.link(blob, path)
+	} else if err != nil {
+		return err
+	}
+
+	// Link to it next to the file first, so that the file is only replaced
+	// if that works.
+	tmp := path + ".dedup"
+	if err := s.link(blob, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	log.WithField("path", path).Debug("Replaced a duplicate with a link.")
+	return nil
+}
+
+func (s *DedupStore) link(blob, path string) error {
+	if !s.Symlink {
+		return os.Link(blob, path)
+	}
+	// Relative links keep working if the output directory is moved along
+	// with the store.
+	target, err := filepath.Rel(filepath.Dir(path), blob)
+	if err != nil {
+		target = blob
+	}
+
+	return os.Symlink(target, path)
+}
+
+// Adds an output directory to the ones recorded in the store.
+func (s *DedupStore) register(output string) error {
+	abs, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	outputs, err := s.Outputs()
+	if err != nil {
+		return err
+	}
+	for _, dir := range outputs {
+		if dir == abs {
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(s.Directory, os.FileMode(permission)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.Directory, dedupOutputsName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, abs); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Returns every output directory that has added files to the store.
+func (s *DedupStore) Outputs() ([]string, error) {
+	f, err := os.Open(filepath.Join(s.Directory, dedupOutputsName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			res = append(res, line)
+		}
+	}
+
+	return res, scanner.Err()
+}
+
+// Removes the stored files that no file in the directories links to anymore.
+// Every output directory recorded in the store is checked on top of the given
+// ones, and nothing is removed if one of them is missing.
+// Returns how many were removed and their total size.
+func (s *DedupStore) GC(dirs []string, dryRun bool) (n int, size int64, err error) {
+	// Stored files by size, so that only files of the same size have to be
+	// compared.
+	if _, err := os.Stat(s.Directory); os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	blobs := make(map[int64][]os.FileInfo)
+	paths := make(map[os.FileInfo]string)
+	err = filepath.Walk(s.Directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		} else if path == filepath.Join(s.Directory, dedupOutputsName) {
+			return nil
+		}
+		blobs[info.Size()] = append(blobs[info.Size()], info)
+		paths[info] = path
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	outputs, err := s.Outputs()
+	if err != nil {
+		return
+	}
+	for _, dir := range outputs {
+		if _, err = os.Stat(dir); err != nil {
+			log.WithField("directory", dir).Error(err)
+			return 0, 0, ErrDedupOutputMissing
+		}
+	}
+
+	store, _ := filepath.Abs(s.Directory)
+	for _, dir := range append(dirs, outputs...) {
+		if err = s.unmark(dir, store, blobs); err != nil {
+			return
+		}
+	}
+
+	for _, unused := range blobs {
+		for _, blob := range unused {
+			if dryRun {
+				fmt.Println(paths[blob])
+			} else if err = os.Remove(paths[blob]); err != nil {
+				return
+			}
+			n++
+			size += blob.Size()
+		}
+	}
+
+	return
+}
+
+// Removes the stored files that the files in a directory link to from blobs.
+func (s *DedupStore) unmark(dir, store string, blobs map[int64][]os.FileInfo) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if abs, _ := filepath.Abs(path); abs == store {
+			return filepath.SkipDir
+		} else if info.IsDir() {
+			return nil
+		}
+		// Stat() follows symlinks, so both kinds of links end up at the
+		// stored file.
+		if info, err = os.Stat(path); err != nil {
+			return nil
+		}
+		for i, blob := range blobs[info.Size()] {
+			if os.SameFile(info, blob) {
+				blobs[info.Size()] = append(blobs[info.Size()][:i], blobs[info.Size()][i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func runGC(args []string) {
+	dldir = outputDirectory(dldir)
+	if isOutputURL(dldir) {
+		fatalUsage("%s", i18n.T("Only local output directories can have a dedup store."))
+	}
+
+	store := &DedupStore{Directory: dedupDirectory(dldir)}
+	n, size, err := store.GC([]string{strings.TrimSuffix(dldir, string(os.PathSeparator))}, dryRun)
+	if err != nil {
+		fatal(err)
+	}
+	if dryRun {
+		log.Info(i18n.Tf("Would remove %d file(s), freeing %s.", n, formatBytes(size)))
+	} else {
+		log.Info(i18n.Tf("Removed %d file(s), freeing %s.", n, formatBytes(size)))
+	}
+}
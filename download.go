@@ -0,0 +1,303 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var (
+	options                   OptionsFlag
+	workers                   int
+	defaults, noprompt, zipit bool
+	override, noRedownload    bool
+	dryRun                    bool
+	maxSize                   SizeFlag
+	stallTimeout              time.Duration
+	restartStalled            bool
+	dldir                     string
+	urls                      []string
+	downloadCommand           = &Command{
+		Name:  "download",
+		Usage: "[flags] <url>...",
+		Short: "Download from one or more URLs.",
+		Flags: NewCommandFlags("download"),
+	}
+)
+
+func init() {
+	downloadCommand.Run = runDownload
+	fs := downloadCommand.Flags
+	fs.VarP(&options, "option", "o",
+		"Options in a key=value format passed to plugins.")
+	fs.IntVarP(&workers, "workers", "w", 10,
+		"The number of workers to use.")
+	fs.BoolVarP(&defaults, "defaults", "d", false,
+		"Set to use default values for options whenever possible. No effect if --no-prompt is on.")
+	fs.BoolVarP(&noprompt, "no-prompt", "n", false,
+		"Set to turn off prompts for options and instead throw an error if a required option is left unset.")
+	fs.BoolVarP(&zipit, "zip", "z", false,
+		"Set to ZIP the files after the download finishes.")
+	addOutputFlag(fs)
+	fs.BoolVar(&jsonOutput, "json", false,
+		"Print the results as a JSON document to stdout when done. Logs go to stderr.")
+	fs.BoolVar(&noRedownload, "no-redownload", false,
+		"Set to skip URLs that are already in the download history.")
+	fs.BoolVar(&dryRun, "dry-run", false,
+		"Set to only print how many files and roughly how much data each URL would download.")
+	fs.BoolVar(&override, "override", false,
+		"Override special options, such as forcing the number of workers.")
+
+	fs.MarkHidden("override")
+	commonFlags.Var(&maxSize, "max-size", "Stop a download once its files add up to more than this, like 10G. "+
+		"In a terminal, you're asked whether to keep going instead, unless --no-prompt is on.")
+	commonFlags.DurationVar(&stallTimeout, "stall-timeout", time.Minute,
+		"Warn about workers that haven't received any data for this long. 0 turns it off.")
+	commonFlags.BoolVar(&restartStalled, "restart-stalled", false,
+		"Set to abort and retry files that stalled workers are downloading. Only works for files plugins download straight from a URL.")
+}
+
+// Adds the flag for the output directory. --directory is kept for
+// compatibility with older scripts.
+func addOutputFlag(fs *flag.FlagSet) {
+	fs.StringVarP(&dldir, "output", "D", "downloads/",
+		"The directory in which to save the downloaded files. ~ and environment variables are expanded. "+
+			"Can also be a URL to save somewhere else, like s3://bucket/prefix.")
+	fs.StringVar(&dldir, "directory", "downloads/", "")
+	fs.MarkDeprecated("directory", "use --output instead")
+}
+
+// Expands ~ and environment variables in an output directory, and ensures
+// the path uses os.PathSeparator and ends with one. URLs only get a slash
+// at the end.
+func outputDirectory(dir string) string {
+	dir = os.ExpandEnv(dir)
+	if isOutputURL(dir) {
+		return strings.TrimSuffix(dir, "/") + "/"
+	}
+	if dir == "~" || strings.HasPrefix(dir, "~/") || strings.HasPrefix(dir, "~"+string(os.PathSeparator)) {
+		if home, err := os.UserHomeDir(); err == nil {
+			dir = home + dir[1:]
+		}
+	}
+
+	return strings.TrimSuffix(filepath.FromSlash(dir), string(os.PathSeparator)) + string(os.PathSeparator)
+}
+
+func runDownload(args []string) {
+	urls = args
+	dldir = outputDirectory(dldir)
+
+	if len(urls) == 0 {
+		downloadCommand.Flags.Usage()
+		os.Exit(0)
+	}
+
+	pm := PluginManager(Plugins[:])
+	handlers := pm.FindHandlers(urls)
+	for i, h := range handlers {
+		// Ensure we have at least one handler for each URL.
+		if len(h) == 0 {
+			log.Errorf("Found no handler for: %s", urls[i])
+		}
+		// Set options for the plugin.
+		if err := pm.SetOptions(h, map[string]string(options), defaults, noprompt); err != nil {
+			fatal(err)
+		}
+	}
+
+	// Make the user pick a handler if multiple plugins can handle a URL.
+	// Done before downloading anything so that nothing needs to be asked
+	// once the TUI is up.
+	// TODO: Make it possible to run mindl without user input.
+	selected := make([]plugins.Plugin, len(handlers))
+	selectErrs := make([]error, len(handlers))
+	for i, h := range handlers {
+		selected[i], selectErrs[i] = pm.SelectPlugin(h)
+	}
+
+	// Start downloading.
+	startTUI(urls)
+	results := make([]*JobResult, 0, len(urls))
+	estimates := make([]*Estimate, 0, len(urls))
+	for i, p := range selected {
+		if tui.Quitting() {
+			res := NewJobResult(urls[i])
+			res.Finish(ErrCanceled)
+			results = append(results, res)
+			tui.FinishJob(i, res)
+		} else if err := selectErrs[i]; err != nil {
+			log.Error(err)
+			res := NewJobResult(urls[i])
+			res.Finish(err)
+			results = append(results, res)
+			tui.FinishJob(i, res)
+		} else {
+			// If we're dealing with multiple URLs, print which one we're processing.
+			if len(urls) > 1 {
+				log.Info(i18n.Tf("Processing URL: %s", urls[i]))
+			}
+			if noRedownload && inHistory(p, urls[i]) {
+				log.Info(i18n.Tf("Skipping URL already in the history: %s", urls[i]))
+				res := NewJobResult(urls[i])
+				res.Plugin = pluginName(p)
+				res.Finish(nil)
+				res.Status = StatusSkipped
+				results = append(results, res)
+				tui.FinishJob(i, res)
+				continue
+			}
+			if dryRun {
+				log.Info(i18n.Tf("Estimating download using \"%s\"...", pluginName(p)))
+				estimates = append(estimates, estimateDownload(urls[i], p))
+				continue
+			}
+			log.Info(i18n.Tf("Starting download using \"%s\"...", pluginName(p)))
+			tui.StartJob(i)
+			res := startDownloading(urls[i], p)
+			results = append(results, res)
+			tui.FinishJob(i, res)
+		}
+	}
+	stopTUI()
+
+	if dryRun {
+		if err := writeEstimates(os.Stdout, estimates); err != nil {
+			fatal(err)
+		}
+		if exitCode = resultsExitCode(results); exitCode == ExitOK {
+			exitCode = estimatesExitCode(estimates)
+		}
+		return
+	}
+
+	logLatencies()
+	writeSpeedHistory()
+	if len(results) > 1 {
+		logSummary(results)
+	}
+	if jsonOutput {
+		if err := WriteResults(os.Stdout, results); err != nil {
+			fatal(err)
+		}
+	}
+	exitCode = resultsExitCode(results)
+}
+
+func startDownloading(url string, plugin plugins.Plugin) *JobResult {
+	return downloadSession(NewSession(url, plugin), plugin)
+}
+
+// Downloads with the plugin while keeping the session saved, making it
+// possible to resume if it's interrupted. The session is removed if it
+// finishes successfully.
+func downloadSession(sess *Session, plugin plugins.Plugin) (res *JobResult) {
+	url := sess.URL
+	res = NewJobResult(url)
+	res.Plugin = pluginName(plugin)
+	dm := NewDownloadManager(plugin, dldir)
+	dm.HashFiles = history != nil || fileIndex != nil
+	dm.Dedup = OpenDedupStore(dldir)
+	dm.MaxSize = int64(maxSize)
+	dm.StallTimeout = stallTimeout
+	dm.RestartStalled = restartStalled
+	dm.Span = plugins.StartSpan(nil, "job")
+	dm.Span.SetAttribute("mindl.job", sess.ID)
+	defer func() { dm.Span.End(res.err) }()
+	if !dm.Preview() {
+		defer recordStats(res)
+	}
+	if isTerminal(os.Stdin) && !noprompt && progressMode != ProgressTUI {
+		dm.SizeExceeded = func(size int64) bool {
+			return confirm(i18n.Tf("The download is already %s, which is more than --max-size. Keep going?", formatBytes(size)))
+		}
+	}
+	dm.Skip = sess.CompletedSet()
+	dm.Resumed = sess.Files
+	dm.ResumedBytes = sess.Bytes
+	dm.DownloaderDone = func(n int) {
+		if err := sess.Complete(n, dm.SavedFiles()); err != nil {
+			log.Warnf("Failed to save the session: %s", err)
+		}
+	}
+	if err := sess.Save(); err != nil {
+		log.Warnf("Failed to save the session: %s", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err := &PanicError{r}
+			log.Error(err)
+			res.Finish(err)
+		}
+	}()
+
+	defer showProgress(dm, url, dm.maxWorkers(workers, override))()
+
+	streamEvents(dm, url, res.Plugin, sess.ID)
+	stopSampling := sampleSpeed(dm, url, plugin)
+	dls, err := dm.Download(url, workers, zipit, override)
+	stopSampling()
+	if dls != nil {
+		res.Files = dls
+	}
+	res.Bytes = dm.Bytes()
+	res.Hosts = dm.HostStats()
+	res.Finish(err)
+	notifyResult(res)
+	indexFiles(plugin, url, sess.ID, dm)
+	if err != nil {
+		log.Error(err)
+		log.Info(res.Summary())
+		log.Info(i18n.Tf("The download can be resumed with: mindl resume %s", sess.ID))
+		return
+	}
+	if err := sess.Remove(); err != nil {
+		log.Warnf("Failed to remove the session: %s", err)
+	}
+	log.Info(i18n.Tf("Done! Got a total of %d downloads.", len(dls)))
+	log.Info(res.Summary())
+	logHostStats(log, res.Hosts)
+	if dm.Preview() {
+		out := os.Stdout
+		if jsonOutput {
+			out = os.Stderr
+		}
+		dm.storage.(*MemoryStorage).Print(out)
+	}
+	recordHistory(plugin, url, dm)
+	return
+}
+
+func inHistory(p plugins.Plugin, url string) bool {
+	if history == nil {
+		return false
+	}
+
+	found, err := history.Contains(CanonicalURL(p, url))
+	if err != nil {
+		log.Errorf("Failed to read the history: %s", err)
+	}
+	return found
+}
@@ -18,18 +18,26 @@ package main
 
 import (
 	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	. "github.com/MinoMino/mindl/plugins"
 
+	"github.com/MinoMino/logrus"
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/logger"
 	"github.com/MinoMino/minprogress"
 )
 
@@ -50,6 +58,8 @@ var (
 	ErrInvaidSpecialOptionType = errors.New("A special option was not of the expected type.")
 	ErrInterrupted             = errors.New("The download failed to finish because of an interrupt.")
 	ErrDisabled                = errors.New("This plugin is temporarily disabled.")
+	ErrCanceled                = errors.New("The download was canceled.")
+	ErrMaxSize                 = errors.New("The download got bigger than its maximum size.")
 )
 
 type IODataHandler func(data []byte) error
@@ -77,15 +87,18 @@ func (ioctrl *IOController) Write(p []byte) (int, error) {
 	}
 }
 
+// Closes the writer, and calls the close callbacks if that worked.
 func (ioctrl *IOController) Close() error {
-	for _, cb := range ioctrl.closeCallbacks {
-		if err := cb(); err != nil {
+	if closer, ok := ioctrl.Writer.(io.WriteCloser); ok {
+		if err := closer.Close(); err != nil {
 			return err
 		}
 	}
 
-	if closer, ok := ioctrl.Writer.(io.WriteCloser); ok {
-		return closer.Close()
+	for _, cb := range ioctrl.closeCallbacks {
+		if err := cb(); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -101,27 +114,67 @@ func (ioctrl *IOController) RegisterCloseCallback(cb IOCloseHandler) {
 
 // plugins.Reporter implementation.
 type DownloadReporter struct {
-	plugin         Plugin
-	saved          chan<- string
+	plugin Plugin
+	saved  chan<- SavedFile
+	// Closed when the manager stops listening to saved.
+	cancel         <-chan struct{}
 	reportCallback IODataHandler
+	// Called with the destination whenever a file is about to be written,
+	// along with its expected size, or 0 if unknown.
+	fileCallback func(dst string, size int64)
+	// The index of the worker and the file it's currently writing.
+	n    int
+	item string
 	// Other callbacks.
 	callbacks []IODataHandler
-	dstdir    string
-	dirm      sync.Mutex
+	storage   Storage
+	// Whether or not to hash files as they're saved.
+	hash   bool
+	dedup  *DedupStore
+	claims *pathClaims
+	// The downloader's span, which requests made through the reporter are
+	// children of.
+	span *Span
+	// Aborts the request SaveURL() is waiting on, and whether it was
+	// aborted because it stalled. See abortStalled().
+	abort   func()
+	stalled bool
+	dirm    sync.Mutex
+	// Counts bytes being written towards the manager's MaxSize, returning
+	// ErrMaxSize once it's exceeded. Expected sizes are checked with 0 bytes.
+	checkSize func(n, expected int64) error
 }
 
-func (dr *DownloadReporter) FileWriter(dst string, report bool) (w io.WriteCloser, err error) {
+// Makes sure the path is valid and that no other downloader saves to it,
+// returning the relative path to save to with forward slashes.
+func (dr *DownloadReporter) claim(dst string) (string, error) {
 	if err := dr.assertValidPath(dst); err != nil {
+		return "", err
+	} else if dr.claims == nil {
+		return filepath.ToSlash(dst), nil
+	}
+
+	return dr.claims.Claim(filepath.ToSlash(dst), dr.n)
+}
+
+// Creates the file in the storage after making sure the path is valid.
+func (dr *DownloadReporter) create(dst string, size int64) (*savedWriter, error) {
+	dst, err := dr.claim(dst)
+	if err != nil {
 		return nil, err
 	}
 
-	// Create the directories if we have to first.
-	dst = filepath.Join(dr.dstdir, dst)
-	if err := dr.makeDirectories(dst); err != nil {
+	dr.startFile(dr.storage.Location(dst), size)
+	w, err := dr.storage.Create(dst)
+	if err != nil {
 		return nil, err
 	}
 
-	f, err := os.Create(dst)
+	return newSavedWriter(w, dr.storage, dst, dr.hash), nil
+}
+
+func (dr *DownloadReporter) FileWriter(dst string, report bool) (w io.WriteCloser, err error) {
+	f, err := dr.create(dst, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -130,19 +183,40 @@ func (dr *DownloadReporter) FileWriter(dst string, report bool) (w io.WriteClose
 	for _, cb := range dr.callbacks {
 		ioctrl.RegisterDataCallback(cb)
 	}
+	release := dr.limitSize(ioctrl)
 	// Report when we close the file.
 	ioctrl.RegisterCloseCallback(func() error {
-		dr.saved <- dst
+		dr.report(f.Saved())
 		return nil
 	})
 
 	if report {
 		ioctrl.RegisterDataCallback(dr.reportCallback)
 	}
+	ioctrl.RegisterCloseCallback(func() error {
+		release()
+		return nil
+	})
 
 	return ioctrl, nil
 }
 
+// Makes writes through the controller count towards the manager's MaxSize
+// and fail once it's exceeded. Returns a function that stops counting the
+// bytes written, to call once they've been reported or thrown away.
+func (dr *DownloadReporter) limitSize(ioctrl *IOController) (release func()) {
+	if dr.checkSize == nil {
+		return func() {}
+	}
+
+	var written int64
+	ioctrl.RegisterDataCallback(func(data []byte) error {
+		written += int64(len(data))
+		return dr.checkSize(int64(len(data)), 0)
+	})
+	return func() { dr.checkSize(-written, 0) }
+}
+
 func (dr *DownloadReporter) Copy(dst io.Writer, src io.Reader) (written int64, err error) {
 	return dr.copy(dst, src, true)
 }
@@ -156,6 +230,7 @@ func (dr *DownloadReporter) copy(dst io.Writer, src io.Reader, report bool) (wri
 	if report {
 		ioctrl.RegisterDataCallback(dr.reportCallback)
 	}
+	defer dr.limitSize(ioctrl)()
 
 	buf := make([]byte, 4*1024)
 	for {
@@ -187,29 +262,176 @@ func (dr *DownloadReporter) copy(dst io.Writer, src io.Reader, report bool) (wri
 }
 
 func (dr *DownloadReporter) SaveData(dst string, src io.Reader, report bool) (int64, error) {
-	if err := dr.assertValidPath(dst); err != nil {
-		return 0, err
-	}
+	return dr.saveData(dst, src, report, "", 0)
+}
 
-	// Create the directories if we have to first.
-	dst = filepath.Join(dr.dstdir, dst)
-	if err := dr.makeDirectories(dst); err != nil {
-		return 0, err
+// Like SaveData(), but also keeps where the file was downloaded from
+// and how big it's expected to be, if known.
+func (dr *DownloadReporter) saveData(dst string, src io.Reader, report bool, url string, size int64) (int64, error) {
+	if dr.checkSize != nil && size > 0 {
+		if err := dr.checkSize(0, size); err != nil {
+			return 0, err
+		}
 	}
-
-	f, err := os.Create(dst)
+	f, err := dr.create(dst, size)
 	if err != nil {
 		return 0, err
 	}
-	defer f.Close()
 
 	if n, err := dr.copy(f, src, report); err != nil {
+		// Don't leave a broken file behind that looks complete.
+		f.Abort()
+		return n, err
+	} else if err = f.Close(); err != nil {
 		return n, err
 	} else {
 		// Tell the manager we got a file.
-		dr.saved <- dst
+		file := f.Saved()
+		file.URL = url
+		dr.report(file)
+		return n, err
+	}
+}
+
+func (dr *DownloadReporter) SaveURL(dst string, client *http.Client, req *http.Request, mirrors ...*http.Request) (int64, error) {
+	reqs := sortMirrors(append([]*http.Request{req}, mirrors...))
+	for i, req := range reqs {
+		n, err := dr.saveURLRetrying(dst, client, req)
+		if err == nil {
+			mirrorSucceeded(req.URL.Host)
+			return n, nil
+		} else if err == ErrCanceled || i == len(reqs)-1 {
+			return n, err
+		}
+
+		select {
+		case <-dr.cancel:
+			return n, ErrCanceled
+		default:
+		}
+		// A mirror without the file isn't failing, and plugins can pass the
+		// same file in different sizes, some of which are often missing.
+		var serr *mirrorStatusError
+		if errors.As(err, &serr) && serr.code == http.StatusNotFound {
+			dr.Log().WithField("host", req.URL.Host).Debug("Not found, trying the next mirror.")
+			continue
+		}
+		mirrorFailed(req.URL.Host)
+		dr.Log().WithField("host", req.URL.Host).Warnf("Download failed, trying the next mirror: %s", err)
+	}
+
+	// Never reached, since there's always at least one request.
+	return 0, nil
+}
+
+// Saves the URL, starting over if the response gets cut off. The transport
+// only retries failures before the body is read.
+func (dr *DownloadReporter) saveURLRetrying(dst string, client *http.Client, req *http.Request) (int64, error) {
+	for attempt := 0; ; attempt++ {
+		n, err := dr.saveURL(dst, client, req)
+		if err != nil && dr.takeStalled() {
+			err = ErrStalled
+		}
+		var truncErr *ErrTruncated
+		if (!errors.As(err, &truncErr) && err != ErrStalled) || attempt >= MaxRetries {
+			return n, err
+		}
+
+		wait := RetryDelay << uint(attempt)
+		if wait > MaxRetryDelay {
+			wait = MaxRetryDelay
+		}
+		RecordRetry(dr.plugin.Name(), req.URL.Host)
+		dr.Log().WithFields(logrus.Fields{
+			"attempt": attempt + 1,
+			"wait":    wait.String(),
+		}).Warn(err)
+		select {
+		case <-time.After(wait):
+		case <-dr.cancel:
+			return n, ErrCanceled
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return n, err
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return n, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+func (dr *DownloadReporter) saveURL(dst string, client *http.Client, req *http.Request) (int64, error) {
+	req = req.WithContext(ContextWithSpan(req.Context(), dr.span))
+	// aria2 can only do GET requests, and only to the local disk. It can't
+	// use SOCKS proxies or proxy chains either, which would leave Tor users
+	// exposed.
+	local, isLocal := dr.storage.(*LocalStorage)
+	proxy, err := ProxyFor(dr.plugin.Name(), req)
+	viaProxy := err == nil && (proxy == nil || proxy.Scheme == "http" || proxy.Scheme == "https") &&
+		!IsProxyChain(dr.plugin.Name(), proxy)
+	if aria2 != nil && !viaProxy {
+		dr.Log().Debug("Not using aria2, since it can't use the proxy.")
+	}
+	if aria2 == nil || req.Method != http.MethodGet || !isLocal || !viaProxy {
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		dr.setAbort(cancel)
+		defer dr.setAbort(nil)
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return 0, &mirrorStatusError{resp.StatusCode}
+		}
+		return dr.saveData(dst, CheckLength(req, resp), true, req.URL.String(), resp.ContentLength)
+	}
+
+	rel, err := dr.claim(dst)
+	if err != nil {
+		return 0, err
+	}
+	dst = local.Location(rel)
+	if err := local.makeDirectories(dst); err != nil {
+		return 0, err
+	}
+	dr.startFile(dst, 0)
+
+	header := RequestHeaders(dr.plugin.Name(), client, req)
+	span := StartSpan(dr.span, "aria2")
+	span.SetAttribute("server.address", req.URL.Host)
+	n, err := aria2.Download(req.URL.String(), dst, header, proxy, dr.reportBytes, dr.cancel)
+	span.SetAttribute("mindl.bytes", n)
+	span.End(err)
+	if err != nil {
 		return n, err
 	}
+	file := dr.localFile(dst, rel, n)
+	file.URL = req.URL.String()
+	dr.report(file)
+	return n, nil
+}
+
+// Reports progress for bytes that didn't go through a writer.
+func (dr *DownloadReporter) reportBytes(n int64) {
+	var zeros [32 * 1024]byte
+	for n > 0 {
+		chunk := int64(len(zeros))
+		if n < chunk {
+			chunk = n
+		}
+		dr.reportCallback(zeros[:chunk])
+		for _, cb := range dr.callbacks {
+			cb(zeros[:chunk])
+		}
+		n -= chunk
+	}
 }
 
 func (dr *DownloadReporter) SaveFile(dst, src string) (int64, error) {
@@ -223,42 +445,92 @@ func (dr *DownloadReporter) SaveFile(dst, src string) (int64, error) {
 		return 0, err
 	}
 
+	local, ok := dr.storage.(*LocalStorage)
+	if !ok {
+		// Upload it and remove the local copy.
+		f, err := os.Open(src)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		n, err := dr.SaveData(dst, f, false)
+		if err == nil {
+			f.Close()
+			os.Remove(src)
+		}
+		return n, err
+	}
+
 	// Create the directories if we have to first.
-	dst = filepath.Join(dr.dstdir, dst)
-	if err = dr.makeDirectories(dst); err != nil {
+	rel, err := dr.claim(dst)
+	if err != nil {
+		return 0, err
+	}
+	dst = local.Location(rel)
+	if err = local.makeDirectories(dst); err != nil {
 		return 0, err
 	} else if err = os.Rename(src, dst); err != nil {
 		return 0, err
 	}
 
-	dr.saved <- dst
+	dr.report(dr.localFile(dst, rel, info.Size()))
 	return info.Size(), nil
 }
 
+// Describes a file that was saved to the local disk without going through
+// a savedWriter.
+func (dr *DownloadReporter) localFile(path, rel string, size int64) SavedFile {
+	file := SavedFile{Path: path, Size: size, rel: rel}
+	if dr.hash {
+		var err error
+		if file.SHA256, err = hashFile(path); err != nil {
+			log.WithField("path", path).Warnf("Failed to hash file: %s", err)
+		}
+	}
+
+	return file
+}
+
 func (dr *DownloadReporter) TempFile() (f *os.File, err error) {
-	f, err = ioutil.TempFile(filepath.Join(dr.dstdir, ".tmp"), fmt.Sprintf("mindl-%s-", dr.plugin.Name()))
-	if err != nil {
+	// Temporary files are always local, but they're kept in the output
+	// directory when it's on the same disk so that SaveFile() can move them.
+	f, err = createTempFile(tempDirectory(dr.storage), dr.plugin.Name(), dr.n, dr.cancel)
+	if err == nil {
 		log.WithField("path", f.Name()).Debugf("Temporary file created.")
 	}
 	return
 }
 
-func (dr *DownloadReporter) makeDirectories(path string) error {
-	dir := filepath.Dir(path)
+func (dr *DownloadReporter) Log() logrus.FieldLogger {
 	dr.dirm.Lock()
-	defer dr.dirm.Unlock()
-	if _, err := os.Stat(dir); err != nil {
-		if os.IsNotExist(err) {
-			log.WithField("path", dir).Debug("Creating non-existing directories.")
-			if err = os.MkdirAll(dir, os.FileMode(permission)); err != nil {
-				return err
-			}
-		} else {
-			return err
+	item := dr.item
+	dr.dirm.Unlock()
+	return logger.GetWorkerLog(dr.plugin.Name(), dr.n, item)
+}
+
+func (dr *DownloadReporter) startFile(dst string, size int64) {
+	dr.dirm.Lock()
+	dr.item = filepath.Base(dst)
+	dr.dirm.Unlock()
+	if dr.fileCallback != nil {
+		if size < 0 {
+			size = 0
 		}
+		dr.fileCallback(dst, size)
 	}
+}
 
-	return nil
+// Tells the manager a file has been saved, unless it's been canceled.
+func (dr *DownloadReporter) report(file SavedFile) {
+	if _, ok := dr.storage.(*LocalStorage); ok && dr.dedup != nil && file.SHA256 != "" {
+		if err := dr.dedup.Add(file.Path, file.SHA256); err != nil {
+			log.WithField("path", file.Path).Warnf("Failed to deduplicate file: %s", err)
+		}
+	}
+	select {
+	case dr.saved <- file:
+	case <-dr.cancel:
+	}
 }
 
 // Asserts it's a relative path, that it's a file, and that it has at least one parent directory.
@@ -280,21 +552,166 @@ func (dr *DownloadReporter) assertValidPath(path string) error {
 // The manager itself.
 
 type DownloadManager struct {
-	progress  *minprogress.ProgressBar
-	paths     []string
+	// The channel the manager listens to for interrupts. Defaults to one that
+	// gets os.Interrupt, but can be set to nil to ignore interrupts, which is
+	// useful when something else handles them and uses Cancel() instead.
+	Interrupt <-chan os.Signal
+	// Whether or not to calculate the SHA-256 of the files as they're saved.
+	HashFiles bool
+	// If set, saved files are added to it, replacing duplicates with links.
+	// Files are always hashed then.
+	Dedup *DedupStore
+	// Indices of downloaders to skip, e.g. ones that finished before a resume.
+	// The plugin's generator is still called for them.
+	Skip map[int]bool
+	// The files and bytes the skipped downloaders saved. The progress starts
+	// from them so that it covers the whole download, and they're zipped
+	// along with the new files.
+	Resumed      []string
+	ResumedBytes int64
+	// Stops the download with ErrMaxSize once the saved files add up to more
+	// bytes than this, unless SizeExceeded says otherwise. 0 for no limit.
+	MaxSize int64
+	// If set, called when MaxSize is exceeded, and the download keeps going
+	// without a limit if it returns true. It's called by the worker that went
+	// over, and the others wait for it once they do too, so it can wait for
+	// the user.
+	SizeExceeded func(size int64) bool
+	// If set, called by the worker when a downloader finishes without errors.
+	DownloaderDone func(n int)
+	// Whether or not to write a manifest into every output directory.
+	// Defaults to true.
+	Manifest bool
+	// Workers that haven't written anything for this long are warned about.
+	// 0 turns it off.
+	StallTimeout time.Duration
+	// Whether to abort and retry what stalled workers are downloading. Only
+	// works for files saved with SaveURL(), since the plugin's own requests
+	// can't be interrupted.
+	RestartStalled bool
+	// If set, the download's span is a child of it. See StartSpan().
+	Span *Span
+	// The span of the current download, if tracing is on.
+	span *Span
+	// Called with events as the download goes. See OnEvent().
+	listeners  []func(e DownloadEvent)
+	listenersM sync.Mutex
+	// The plugin's host stats when the download started.
+	hostsBefore map[string]HostStat
+	progress    *minprogress.ProgressBar
+	active      map[int]*WorkerProgress
+	paths       []string
+	files       []SavedFile
+	saved       map[string]int
+	bytes       int64
+	// How fast the workers are getting data.
+	speed     speedMeter
+	total     int
 	plugin    Plugin
 	directory string
-	m         sync.Mutex
+	storage   Storage
+	// Set if the storage couldn't be opened, and returned by Download().
+	storageErr error
+	cancel     chan struct{}
+	once       sync.Once
+	m          sync.Mutex
+	// Closed and reset by Resume(). Nil unless paused.
+	resume chan struct{}
+	pauseM sync.Mutex
+	// How many times the session was renewed, and why the last renewal
+	// failed if it did. See runDownloader().
+	renewals int
+	renewErr error
+	renewM   sync.Mutex
+	// The bytes of the files being written, which aren't in bytes yet, and
+	// whether MaxSize was exceeded. See checkSize().
+	writing  int64
+	oversize bool
+	sizeM    sync.Mutex
 }
 
+// The directory can also be a URL to save the files somewhere other than
+// the local disk. See OpenStorage().
 func NewDownloadManager(plugin Plugin, directory string) *DownloadManager {
-	return &DownloadManager{
+	storage, err := OpenStorage(directory)
+	dm := NewStorageDownloadManager(plugin, storage)
+	dm.directory = directory
+	dm.storageErr = err
+	return dm
+}
+
+// Like NewDownloadManager(), but saves to the given storage, e.g. a
+// MemoryStorage when testing a plugin.
+func NewStorageDownloadManager(plugin Plugin, storage Storage) *DownloadManager {
+	dm := &DownloadManager{
+		Interrupt: interrupt,
+		Manifest:  true,
 		plugin:    plugin,
-		directory: directory,
+		storage:   storage,
+		cancel:    make(chan struct{}),
 	}
+	if local, ok := storage.(*LocalStorage); ok {
+		dm.directory = local.Directory
+	}
+
+	return dm
+}
+
+// Stops the download, making Download() clean up and return ErrCanceled.
+// Safe to call multiple times and from other goroutines.
+func (dm *DownloadManager) Cancel() {
+	dm.once.Do(func() {
+		close(dm.cancel)
+	})
 }
 
 func (dm *DownloadManager) Download(url string, maxWorkers int, zipit, override bool) ([]string, error) {
+	dm.span = StartSpan(dm.Span, "download")
+	dm.span.SetAttribute("mindl.url", url)
+	dm.span.SetAttribute("mindl.plugin", dm.plugin.Name())
+	// Plugins don't pass contexts to their requests, so the download is
+	// the parent of every request the plugin makes while it's running.
+	SetPluginSpan(dm.plugin.Name(), dm.span)
+	defer SetPluginSpan(dm.plugin.Name(), nil)
+	dm.emit(DownloadEvent{Kind: EventStart})
+	stopTicking := dm.tickProgress()
+	stopWatching := dm.watchStalls()
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("%v", r)
+			stopWatching()
+			stopTicking()
+			dm.emit(DownloadEvent{Kind: EventDone, Err: err})
+			dm.span.End(err)
+			panic(r)
+		}
+	}()
+	paths, err := dm.download(url, maxWorkers, zipit, override)
+	stopWatching()
+	stopTicking()
+	dm.emit(DownloadEvent{Kind: EventDone, Err: err})
+	dm.span.SetAttribute("mindl.files", len(paths))
+	dm.span.SetAttribute("mindl.bytes", dm.Bytes())
+	dm.span.End(err)
+
+	return paths, err
+}
+
+// Returns how many workers a download uses, which the plugin can force
+// unless overridden.
+func (dm *DownloadManager) maxWorkers(workers int, override bool) int {
+	if !override {
+		if w, ok := GetSpecialOptions(dm.plugin)["Workers"]; ok {
+			if n, ok := w.Value().(int); ok {
+				return n
+			}
+		}
+	}
+
+	return workers
+}
+
+func (dm *DownloadManager) download(url string, maxWorkers int, zipit, override bool) ([]string, error) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Info("Cleaning up early due to a panic...")
@@ -302,6 +719,14 @@ func (dm *DownloadManager) Download(url string, maxWorkers int, zipit, override
 			panic(r)
 		}
 	}()
+	if dm.storageErr != nil {
+		return nil, dm.storageErr
+	}
+	// Logging in tends to happen in the generator, so it counts too.
+	dm.hostsBefore = HostStats(dm.plugin.Name())
+	if UsingTor() {
+		NewTorCircuit(dm.plugin.Name())
+	}
 
 	if !override {
 		special := GetSpecialOptions(dm.plugin)
@@ -335,13 +760,36 @@ func (dm *DownloadManager) Download(url string, maxWorkers int, zipit, override
 			log.Warnf("This plugin forces the --workers flag to %d.", maxWorkers)
 		}
 	}
+	// Files going somewhere other than the local disk are zipped as they're
+	// uploaded, since they can't be zipped afterwards.
+	var archive *archiveStorage
+	if _, ok := dm.storage.(*LocalStorage); zipit && !ok {
+		archive = newArchiveStorage(dm.storage)
+		dm.storage = archive
+		defer func() {
+			archive.Abort()
+			dm.storage = archive.Storage
+		}()
+		if len(dm.Skip) > 0 {
+			log.Warn(i18n.T("Files can't be added to an archive that's already uploaded, so everything is downloaded again."))
+			dm.Skip = nil
+		}
+	}
 
 	var dlCount int
+	claims := newPathClaims(dm.plugin)
+	genSpan := StartSpan(dm.span, "generator")
+	SetPluginSpan(dm.plugin.Name(), genSpan)
 	dlgen, total := dm.plugin.DownloadGenerator(url)
+	SetPluginSpan(dm.plugin.Name(), dm.span)
+	genSpan.End(nil)
 	if dlgen == nil {
 		panic(ErrNilGenerator)
 	}
 
+	dm.m.Lock()
+	dm.total = total
+	dm.m.Unlock()
 	if total == UnknownTotal {
 		dm.progress = minprogress.NewProgressBar(minprogress.UnknownTotal)
 	} else {
@@ -352,10 +800,11 @@ func (dm *DownloadManager) Download(url string, maxWorkers int, zipit, override
 	dm.progress.Units = "files"
 	dm.progress.ReportsPerSample = 8 * maxWorkers
 	next := dlgen()
-	// nil or error to signal the goroutines are done.
-	done := make(chan error)
-	// Report the paths to the files as they're done and written to disk.
-	got := make(chan string, maxWorkers)
+	// nil or error to signal the goroutines are done. Buffered so that the
+	// spawner can exit even if we've stopped listening.
+	done := make(chan error, 1)
+	// Report the files as they're done and written to disk.
+	got := make(chan SavedFile, maxWorkers)
 	// Use a WaitGroup to make sure all goroutines finish before we exit on error.
 	var wg sync.WaitGroup
 
@@ -372,46 +821,96 @@ func (dm *DownloadManager) Download(url string, maxWorkers int, zipit, override
 		workerLimiter := make(chan struct{}, maxWorkers)
 		ec := make(chan error, maxWorkers)
 		for dlCount = 0; next != nil; dlCount++ {
+			// Downloaders that finished in an earlier session aren't ran again.
+			if dm.Skip[dlCount] {
+				log.Debugf("Skipping worker #%d...", dlCount)
+				dm.progress.Progress(1)
+				next = dlgen()
+				continue
+			}
+
 			// Blocks until we have worker slots or we get an error.
 			select {
 			case err := <-ec:
 				// Pass the error down the chain and return immediately.
 				done <- err
 				return
+			case <-dm.cancel:
+				return
 			case workerLimiter <- struct{}{}:
 			}
+			dm.waitResumed()
 
-			log.Debugf("Spawning worker #%d...", dlCount)
+			log.WithField(logger.WorkerField, dlCount).Debug("Spawning worker...")
 			// Spawn the worker and make sure we free a slot when done.
 			wg.Add(1)
 			go func(n int, dl Downloader) {
+				span := StartSpan(dm.span, "downloader")
+				span.SetAttribute("mindl.worker", n)
 				// Deal with potential panic by the worker.
 				defer func() {
 					if r := recover(); r != nil {
-						ec <- fmt.Errorf("Worker #%d panicked: %s", n, r)
+						err := fmt.Errorf("Worker #%d panicked: %s", n, r)
+						span.End(err)
+						ec <- err
 					}
 					wg.Done()
 					return
 				}()
 
 				// Prepare the reporter for this particular worker.
+				worker := dm.startWorker(n)
 				reporter := &DownloadReporter{
 					plugin: dm.plugin,
 					saved:  got,
+					cancel: dm.cancel,
 					//callbacks: []IODataHandler{},
 					reportCallback: func(data []byte) error {
+						dm.waitResumed()
 						dm.progress.Report(n, len(data))
+						dm.speed.Add(int64(len(data)))
+						worker.speed.Add(int64(len(data)))
+						dm.m.Lock()
+						worker.Bytes += int64(len(data))
+						worker.FileBytes += int64(len(data))
+						worker.active = time.Now()
+						worker.Stalled = false
+						dm.m.Unlock()
 						return nil
 					},
-					dstdir: dm.directory,
+					fileCallback: func(dst string, size int64) {
+						dm.m.Lock()
+						worker.File = dst
+						worker.FileBytes = 0
+						worker.FileSize = size
+						worker.active = time.Now()
+						worker.Stalled = false
+						dm.m.Unlock()
+					},
+					storage:   dm.storage,
+					hash:      dm.HashFiles || dm.Dedup != nil,
+					dedup:     dm.Dedup,
+					claims:    claims,
+					n:         n,
+					span:      span,
+					checkSize: dm.checkSize,
 				}
+				dm.m.Lock()
+				worker.reporter = reporter
+				dm.m.Unlock()
 				// Make sure we report we're done with the download regardless of what happens.
 				defer dm.progress.Done(n)
+				defer dm.stopWorker(n)
 				// Run the task.
-				if err := dl(n, reporter); err != nil {
+				err := dm.runDownloader(n, dl, reporter)
+				span.End(err)
+				if err != nil {
 					ec <- err
 					return
 				}
+				if dm.DownloaderDone != nil {
+					dm.DownloaderDone(n)
+				}
 				// Free the slot.
 				<-workerLimiter
 			}(dlCount, next)
@@ -435,49 +934,202 @@ func (dm *DownloadManager) Download(url string, maxWorkers int, zipit, override
 		}
 	}()
 
+	started := time.Now()
 	dm.m.Lock()
 	// All the paths to the files that have been written to disk.
 	dm.paths = make([]string, 0, 100)
+	dm.files = make([]SavedFile, 0, 100)
+	dm.saved = make(map[string]int)
+	dm.bytes = 0
 	dm.m.Unlock()
 loop:
 	for {
 		select {
-		case <-interrupt:
-			log.Info("Interrupted! Cleaning up...")
+		case <-dm.Interrupt:
+			log.Info(i18n.T("Interrupted! Cleaning up..."))
+			dm.Cancel()
+			dm.finish(url, started, ErrInterrupted)
 			dm.plugin.Cleanup(ErrInterrupted)
 			return nil, ErrInterrupted
+		case <-dm.cancel:
+			log.Info(i18n.T("Canceled! Cleaning up..."))
+			dm.finish(url, started, ErrCanceled)
+			dm.plugin.Cleanup(ErrCanceled)
+			return nil, ErrCanceled
 		case err := <-done:
+			if err != nil && dm.exceededSize() {
+				// Plugins can wrap the error or panic with it.
+				log.Warn(i18n.Tf("Stopping since the download is bigger than %s.", formatBytes(dm.MaxSize)))
+				err = ErrMaxSize
+			}
+			dm.finish(url, started, err)
 			if err != nil {
-				log.Info("Cleaning up early due to an error...")
+				log.Info(i18n.T("Cleaning up early due to an error..."))
 				dm.plugin.Cleanup(err)
 				return nil, err
-			} else {
-				break loop
 			}
-		case path := <-got:
-			path = filepath.FromSlash(path)
-			dm.m.Lock()
-			dm.paths = append(dm.paths, path)
-			dm.m.Unlock()
-			// Report progress.
-			dm.progress.Progress(1)
-			log.Debug("Got file: " + path)
+			// The last files can still be buffered after the workers are done.
+			for len(got) > 0 {
+				dm.addFile(<-got)
+			}
+			break loop
+		case file := <-got:
+			dm.addFile(file)
+			if dm.checkSize(0, 0) != nil {
+				log.Warn(i18n.Tf("Stopping since the download is bigger than %s.", formatBytes(dm.MaxSize)))
+				dm.Cancel()
+				dm.finish(url, started, ErrMaxSize)
+				dm.plugin.Cleanup(ErrMaxSize)
+				return nil, ErrMaxSize
+			}
 		}
 	}
 
-	if zipit {
-		if _, err := dm.ZipDownloads(true); err != nil {
+	var zipSpan *Span
+	if archive != nil || zipit {
+		zipSpan = StartSpan(dm.span, "zip")
+	}
+	if archive != nil {
+		err := archive.Close()
+		zipSpan.End(err)
+		if err != nil {
+			log.Info("Cleaning up early due to error while zipping...")
+			dm.plugin.Cleanup(err)
+			return dm.paths, err
+		}
+	} else if zipit {
+		_, err := dm.ZipDownloads(true)
+		zipSpan.End(err)
+		if err != nil {
 			log.Info("Cleaning up early due to error while zipping...")
 			dm.plugin.Cleanup(err)
 			return dm.paths, err
 		}
 	}
 
-	log.Info("Cleaning up...")
+	log.Info(i18n.T("Cleaning up..."))
 	dm.plugin.Cleanup(nil)
 	return dm.paths, nil
 }
 
+// Adds a file a worker saved and reports the progress.
+func (dm *DownloadManager) addFile(file SavedFile) {
+	dm.m.Lock()
+	// Downloaders run again after renewing the session can save the same
+	// files again.
+	i, again := dm.saved[file.Path]
+	if again {
+		dm.bytes += file.Size - dm.files[i].Size
+		dm.files[i] = file
+	} else {
+		dm.saved[file.Path] = len(dm.files)
+		dm.paths = append(dm.paths, file.Path)
+		dm.files = append(dm.files, file)
+		dm.bytes += file.Size
+	}
+	dm.m.Unlock()
+	if !again {
+		dm.progress.Progress(1)
+	}
+	log.Debug("Got file: " + file.Path)
+	dm.emit(DownloadEvent{Kind: EventFile, File: &file})
+}
+
+// Runs the downloader, renewing the session and running it again if it
+// fails with an authentication error and the plugin is a SessionRenewer.
+func (dm *DownloadManager) runDownloader(n int, dl Downloader, reporter *DownloadReporter) error {
+	renewer, ok := dm.plugin.(SessionRenewer)
+	if !ok {
+		return dl(n, reporter)
+	}
+
+	dm.m.Lock()
+	renewals := dm.renewals
+	dm.m.Unlock()
+	err := runCatchingAuth(n, dl, reporter)
+	if _, auth := err.(*ErrAuthentication); !auth {
+		return err
+	}
+
+	// Only the first worker to fail renews the session, and the others wait
+	// for it and use the renewed one.
+	dm.renewM.Lock()
+	if dm.renewals == renewals && dm.renewErr == nil {
+		entry := log.WithField(logger.WorkerField, n).WithError(err)
+		entry.Warn(i18n.T("The session seems to have expired. Renewing it..."))
+		if dm.renewErr = renewer.RenewSession(); dm.renewErr != nil {
+			entry.Errorf("Failed to renew the session: %s", dm.renewErr)
+		}
+		dm.m.Lock()
+		dm.renewals++
+		dm.m.Unlock()
+	}
+	renewErr := dm.renewErr
+	dm.renewM.Unlock()
+	if renewErr != nil {
+		return err
+	}
+
+	return runCatchingAuth(n, dl, reporter)
+}
+
+// Runs the downloader, returning authentication errors it panics with,
+// since most plugins panic on errors.
+func runCatchingAuth(n int, dl Downloader, reporter *DownloadReporter) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(*ErrAuthentication); ok {
+				err = e
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	return dl(n, reporter)
+}
+
+// Adds n to the bytes being written and returns ErrMaxSize if they, the
+// saved files and the expected bytes add up to more than MaxSize. Asks
+// SizeExceeded whether to keep going first, lifting the limit if so.
+func (dm *DownloadManager) checkSize(n, expected int64) error {
+	dm.sizeM.Lock()
+	defer dm.sizeM.Unlock()
+	dm.writing += n
+	if n < 0 {
+		return nil
+	} else if dm.oversize {
+		return ErrMaxSize
+	} else if dm.MaxSize <= 0 {
+		return nil
+	}
+	size := dm.Bytes() + dm.writing + expected
+	if size <= dm.MaxSize {
+		return nil
+	} else if dm.SizeExceeded != nil && dm.SizeExceeded(size) {
+		dm.MaxSize = 0
+		return nil
+	}
+
+	dm.oversize = true
+	return ErrMaxSize
+}
+
+func (dm *DownloadManager) exceededSize() bool {
+	dm.sizeM.Lock()
+	defer dm.sizeM.Unlock()
+	return dm.oversize
+}
+
+// Called when the downloading is over, whether it succeeded or not.
+func (dm *DownloadManager) finish(url string, started time.Time, err error) {
+	if dm.Manifest {
+		span := StartSpan(dm.span, "manifest")
+		dm.writeManifests(url, started, err)
+		span.End(nil)
+	}
+}
+
 func (dm *DownloadManager) ProgressString() string {
 	var res string
 	if dm.progress != nil {
@@ -494,22 +1146,288 @@ func (dm *DownloadManager) ProgressString() string {
 	return res
 }
 
+// A file saved by a download, along with its size and hash at the time.
+type SavedFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Only set if hashing is enabled.
+	SHA256 string `json:"sha256,omitempty"`
+	// The URL it was downloaded from, if it was saved with SaveURL().
+	URL string `json:"url,omitempty"`
+	// The path relative to the output directory, with forward slashes.
+	rel string
+}
+
+// Returns the files saved so far. Unlike the returned paths of Download(),
+// the files are the ones originally saved even if they were zipped afterwards.
+func (dm *DownloadManager) SavedFiles() []SavedFile {
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	res := make([]SavedFile, len(dm.files))
+	copy(res, dm.files)
+	return res
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// A snapshot of the progress of a download. The files and bytes include
+// the ones saved before it was resumed.
+type Progress struct {
+	Files int `json:"files"`
+	// The number of files the plugin expects to download. 0 if unknown.
+	Total int   `json:"total"`
+	Bytes int64 `json:"bytes"`
+	// Bytes per second, smoothed over the last few seconds.
+	Speed float64 `json:"speed"`
+	// Roughly how many seconds are left, based on the speed and the average
+	// size of the files so far. 0 if the total is unknown or nothing's done yet.
+	ETA float64 `json:"eta,omitempty"`
+	// The same as ProgressString().
+	Text string `json:"text"`
+}
+
+func (dm *DownloadManager) Progress() Progress {
+	text := dm.ProgressString()
+	dm.m.Lock()
+	p := Progress{
+		Files: len(dm.Resumed) + len(dm.paths),
+		Total: dm.total,
+		Bytes: dm.ResumedBytes + dm.bytes,
+		Speed: dm.speed.Speed(),
+		Text:  text,
+	}
+	var inFlight int64
+	for _, w := range dm.active {
+		inFlight += w.FileBytes
+	}
+	dm.m.Unlock()
+	p.ETA = estimateETA(p, inFlight)
+
+	return p
+}
+
+// What a single worker is currently doing.
+type WorkerProgress struct {
+	N int `json:"n"`
+	// The file currently being written. Empty until the worker starts saving.
+	File string `json:"file"`
+	// Bytes written of the current file, and how big it's expected to be.
+	// The size is 0 if unknown.
+	FileBytes int64 `json:"file_bytes"`
+	FileSize  int64 `json:"file_size,omitempty"`
+	// Bytes written in total, and per second smoothed over the last few seconds.
+	Bytes   int64     `json:"bytes"`
+	Speed   float64   `json:"speed"`
+	Started time.Time `json:"started"`
+	// Whether it hasn't written anything for longer than the StallTimeout.
+	Stalled bool `json:"stalled,omitempty"`
+	speed   *speedMeter
+	// When it last wrote anything or started on a file.
+	active   time.Time
+	reporter *DownloadReporter
+}
+
+func (dm *DownloadManager) startWorker(n int) *WorkerProgress {
+	now := time.Now()
+	w := &WorkerProgress{N: n, Started: now, speed: &speedMeter{}, active: now}
+	dm.m.Lock()
+	if dm.active == nil {
+		dm.active = make(map[int]*WorkerProgress)
+	}
+	dm.active[n] = w
+	dm.m.Unlock()
+	return w
+}
+
+func (dm *DownloadManager) stopWorker(n int) {
+	dm.m.Lock()
+	delete(dm.active, n)
+	dm.m.Unlock()
+}
+
+// Returns the workers that are currently running, ordered by their index.
+func (dm *DownloadManager) Workers() []WorkerProgress {
+	dm.m.Lock()
+	res := make([]WorkerProgress, 0, len(dm.active))
+	for _, w := range dm.active {
+		res = append(res, *w)
+	}
+	dm.m.Unlock()
+	for i := range res {
+		res[i].Speed = res[i].speed.Speed()
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].N < res[j].N })
+	return res
+}
+
+// Kinds of DownloadEvent.
+const (
+	// Sent when Download() is called, before the plugin is asked for anything.
+	EventStart = "start"
+	// Sent every ProgressInterval while downloading, with the workers.
+	EventProgress = "progress"
+	// Sent when a file has been saved.
+	EventFile = "file"
+	// Sent when Download() is about to return, with the error if it failed.
+	EventDone = "done"
+)
+
+// How often progress events are sent.
+const ProgressInterval = time.Second
+
+// Something that happened during a download, letting programs follow along
+// without polling the manager.
+type DownloadEvent struct {
+	Kind     string
+	Time     time.Time
+	Progress Progress
+	// Only set for progress events.
+	Workers []WorkerProgress
+	// Only set for file events.
+	File *SavedFile
+	// Only set for done events of failed downloads.
+	Err error
+}
+
+// Calls f with every event of the downloads from now on. It's called from
+// different goroutines, but never more than once at a time, and it blocks
+// the download while it runs, so it shouldn't take long.
+func (dm *DownloadManager) OnEvent(f func(e DownloadEvent)) {
+	dm.listenersM.Lock()
+	dm.listeners = append(dm.listeners, f)
+	dm.listenersM.Unlock()
+}
+
+func (dm *DownloadManager) emit(e DownloadEvent) {
+	dm.listenersM.Lock()
+	defer dm.listenersM.Unlock()
+	if len(dm.listeners) == 0 {
+		return
+	}
+
+	e.Time = time.Now()
+	e.Progress = dm.Progress()
+	if e.Kind == EventProgress {
+		e.Workers = dm.Workers()
+	}
+	for _, f := range dm.listeners {
+		f(e)
+	}
+}
+
+// Sends progress events until the returned function is called.
+func (dm *DownloadManager) tickProgress() (stop func()) {
+	ticker := time.NewTicker(ProgressInterval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				dm.emit(DownloadEvent{Kind: EventProgress})
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// Returns the total size in bytes of the files saved so far.
+func (dm *DownloadManager) Bytes() int64 {
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	return dm.bytes
+}
+
+// Returns the requests sent to each host since the download started.
+func (dm *DownloadManager) HostStats() map[string]HostStat {
+	return DiffHostStats(dm.hostsBefore, HostStats(dm.plugin.Name()))
+}
+
+// Logs the stats of each host, slowest first, to help spot a slow server.
+func logHostStats(entry logrus.FieldLogger, hosts map[string]HostStat) {
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Slice(names, func(i, j int) bool { return hosts[names[i]].Seconds > hosts[names[j]].Seconds })
+	for _, host := range names {
+		stat := hosts[host]
+		elapsed := time.Duration(stat.Seconds * float64(time.Second)).Round(time.Millisecond)
+		entry.WithField("host", host).Info(i18n.Tf("%d request(s), %s in %s.",
+			stat.Requests, formatBytes(stat.Bytes), elapsed))
+	}
+}
+
+// Logs how long requests to each endpoint took to get a response, to help
+// tell a slow API apart from a slow CDN or slow processing on our end.
+func logLatencies() {
+	for _, h := range Latencies() {
+		p95 := h.Quantile(0.95).String()
+		if h.Quantile(0.95) == 0 {
+			p95 = "> " + LatencyBuckets[len(LatencyBuckets)-1].String()
+		}
+		avg := (h.Total / time.Duration(h.Count)).Round(time.Millisecond)
+		log.WithField("endpoint", h.Endpoint).Debug(i18n.Tf("%d request(s), %s on average, 95%% within %s.",
+			h.Count, avg, p95))
+	}
+}
+
 // Zip top-level directories separately, then delete the directories after doing so if desired.
 func (dm *DownloadManager) ZipDownloads(deleteAfter bool) ([]string, error) {
 	// We zip every top-level directory separately.
 	files := make(map[string][]string) // files[topdir] = file
 	dm.m.Lock()
+	zipped := make(map[string]bool, len(dm.paths))
 	for _, file := range dm.paths {
+		zipped[file] = true
+	}
+	// The files from earlier runs need to go in too, or they'd be lost along
+	// with the directories.
+	paths := append([]string(nil), dm.paths...)
+	for _, file := range dm.Resumed {
+		if zipped[file] {
+			continue
+		} else if _, err := os.Stat(file); err != nil {
+			log.WithField("file", file).Warnf("A file from an earlier run is missing: %s", err)
+			continue
+		}
+		paths = append(paths, file)
+	}
+	for _, file := range paths {
 		split := strings.Split(strings.TrimPrefix(file, dm.directory), string(os.PathSeparator))
 		// len(split) >= 2 is guaranteed by DownloadReporter.
 		files[split[0]] = append(files[split[0]], strings.Join(split[1:], string(os.PathSeparator)))
 	}
 	dm.m.Unlock()
+	// Include the manifests so that they aren't lost with the directories.
+	for dir := range files {
+		if _, err := os.Stat(filepath.Join(dm.directory, dir, manifestName)); err == nil {
+			files[dir] = append(files[dir], manifestName)
+		}
+	}
 
 	res := make([]string, 0, len(files))
 	for dir, filelist := range files {
-		path := filepath.Join(dm.directory, dir+".zip")
-		log.Infof("Zipping files to: %s", filepath.Base(path))
+		path := filepath.Join(dm.directory, dir+"."+zipExtension)
+		log.Info(i18n.Tf("Zipping files to: %s", filepath.Base(path)))
 		res = append(res, dir)
 		outf, err := os.Create(path)
 		if err != nil {
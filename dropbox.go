@@ -0,0 +1,278 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var ErrDropboxNoApp = errors.New("Set --dropbox-app-key to save to Dropbox.")
+
+var dropboxAppKey string
+
+const (
+	dropboxAPI          = "https://api.dropboxapi.com"
+	dropboxContentAPI   = "https://content.dropboxapi.com"
+	dropboxAuthorizeURL = "https://www.dropbox.com/oauth2/authorize"
+	// Dropbox recommends multiples of 4 MiB.
+	dropboxChunkSize = 8 << 20
+)
+
+func init() {
+	commonFlags.StringVar(&dropboxAppKey, "dropbox-app-key", "",
+		"The app key of a Dropbox app, for saving to Dropbox.")
+	storageSchemes["dropbox"] = newDropboxStorage
+}
+
+// Files in a Dropbox folder, e.g. dropbox:///Books. The first time, the user
+// is asked to allow access in a browser and paste the code they get, and
+// the token is kept in the OS keyring or config directory.
+type DropboxStorage struct {
+	Directory string
+	client    *http.Client
+	auth      *plugins.OAuth2
+}
+
+func newDropboxStorage(u *url.URL) (Storage, error) {
+	if dropboxAppKey == "" {
+		return nil, ErrDropboxNoApp
+	}
+
+	client := &http.Client{}
+	return &DropboxStorage{
+		Directory: path.Join("/", u.Host, u.Path),
+		client:    client,
+		// PKCE needs no redirect or app secret.
+		auth: plugins.NewOAuth2("Dropbox", &plugins.OAuth2Config{
+			ClientID:   dropboxAppKey,
+			AuthURL:    dropboxAuthorizeURL,
+			TokenURL:   dropboxAPI + "/oauth2/token",
+			AuthParams: url.Values{"token_access_type": {"offline"}},
+			Flow:       plugins.OAuth2PasteFlow,
+		}, client),
+	}, nil
+}
+
+// Encodes the arguments for the Dropbox-API-Arg header, which has to be
+// ASCII.
+func dropboxArg(v interface{}) string {
+	data, _ := json.Marshal(v)
+	var b strings.Builder
+	for _, r := range string(data) {
+		if r < 0x80 {
+			b.WriteRune(r)
+		} else if r < 0x10000 {
+			fmt.Fprintf(&b, `\u%04x`, r)
+		} else {
+			r -= 0x10000
+			fmt.Fprintf(&b, `\u%04x\u%04x`, 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+		}
+	}
+
+	return b.String()
+}
+
+// Calls an endpoint, retrying network errors and when Dropbox is busy. The
+// arguments go in the header for content endpoints, and in the body
+// otherwise.
+func (s *DropboxStorage) call(endpoint string, arg interface{}, body []byte, res interface{}) error {
+	content := strings.HasPrefix(endpoint, dropboxContentAPI)
+	if !content {
+		body, _ = json.Marshal(arg)
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		if err := s.auth.Authorize(req); err != nil {
+			return err
+		}
+		if content {
+			req.Header.Set("Dropbox-API-Arg", dropboxArg(arg))
+			req.Header.Set("Content-Type", "application/octet-stream")
+		} else {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		wait := plugins.RetryDelay << uint(attempt)
+		resp, err := s.client.Do(req)
+		if err == nil {
+			data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusOK:
+				if res != nil {
+					return json.Unmarshal(data, res)
+				}
+				return nil
+			case resp.StatusCode == http.StatusUnauthorized:
+				s.auth.Invalidate()
+				err = errors.New("Dropbox: unauthorized")
+			case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+				if secs, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil {
+					wait = time.Duration(secs) * time.Second
+				}
+				err = fmt.Errorf("Dropbox returned error code: %d", resp.StatusCode)
+			default:
+				return &dropboxError{resp.StatusCode, data}
+			}
+		}
+		if attempt >= plugins.MaxRetries {
+			return err
+		}
+		log.Debugf("Dropbox request failed, retrying: %s", err)
+		time.Sleep(wait)
+	}
+}
+
+type dropboxError struct {
+	status int
+	body   []byte
+}
+
+func (e *dropboxError) Error() string {
+	var res struct {
+		Summary string `json:"error_summary"`
+	}
+	if json.Unmarshal(e.body, &res) == nil && res.Summary != "" {
+		return "Dropbox: " + res.Summary
+	}
+
+	return fmt.Sprintf("Dropbox returned error code: %d", e.status)
+}
+
+// Returns the offset Dropbox expected if that's why an append failed.
+func (e *dropboxError) correctOffset() (int64, bool) {
+	var res struct {
+		Error struct {
+			Tag           string `json:".tag"`
+			CorrectOffset int64  `json:"correct_offset"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(e.body, &res) != nil || res.Error.Tag != "incorrect_offset" {
+		return 0, false
+	}
+
+	return res.Error.CorrectOffset, true
+}
+
+func (s *DropboxStorage) Create(p string) (StorageWriter, error) {
+	return &dropboxWriter{s: s, path: path.Join(s.Directory, p)}, nil
+}
+
+func (s *DropboxStorage) Remove(p string) error {
+	return s.call(dropboxAPI+"/2/files/delete_v2", map[string]string{"path": path.Join(s.Directory, p)}, nil, nil)
+}
+
+func (s *DropboxStorage) Location(p string) string {
+	return "dropbox://" + path.Join(s.Directory, p)
+}
+
+// Uploads the file in chunks with an upload session as it's written. It
+// only shows up in Dropbox once it's complete.
+type dropboxWriter struct {
+	s       *DropboxStorage
+	path    string
+	session string
+	offset  int64
+	buf     bytes.Buffer
+}
+
+type dropboxCursor struct {
+	SessionID string `json:"session_id"`
+	Offset    int64  `json:"offset"`
+}
+
+func (w *dropboxWriter) commit() map[string]interface{} {
+	return map[string]interface{}{"path": w.path, "mode": "overwrite", "mute": true}
+}
+
+func (w *dropboxWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for w.buf.Len() >= dropboxChunkSize {
+		if err := w.append(w.buf.Next(dropboxChunkSize)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *dropboxWriter) append(chunk []byte) error {
+	if w.session == "" {
+		var res struct {
+			SessionID string `json:"session_id"`
+		}
+		err := w.s.call(dropboxContentAPI+"/2/files/upload_session/start", map[string]bool{"close": false}, chunk, &res)
+		if err != nil {
+			return err
+		}
+		w.session = res.SessionID
+		w.offset = int64(len(chunk))
+		return nil
+	}
+
+	start := w.offset
+	for {
+		arg := map[string]interface{}{"cursor": dropboxCursor{w.session, w.offset}, "close": false}
+		err := w.s.call(dropboxContentAPI+"/2/files/upload_session/append_v2", arg, chunk[w.offset-start:], nil)
+		if dbErr, ok := err.(*dropboxError); ok {
+			// A retry after Dropbox got some or all of it.
+			if offset, ok := dbErr.correctOffset(); ok && offset > w.offset && offset < start+int64(len(chunk)) {
+				w.offset = offset
+				continue
+			} else if ok && offset == start+int64(len(chunk)) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		w.offset = start + int64(len(chunk))
+		return nil
+	}
+}
+
+func (w *dropboxWriter) Close() error {
+	if w.session == "" {
+		return w.s.call(dropboxContentAPI+"/2/files/upload", w.commit(), w.buf.Bytes(), nil)
+	}
+
+	arg := map[string]interface{}{"cursor": dropboxCursor{w.session, w.offset}, "commit": w.commit()}
+	return w.s.call(dropboxContentAPI+"/2/files/upload_session/finish", arg, w.buf.Bytes(), nil)
+}
+
+// Unfinished upload sessions expire on their own.
+func (w *dropboxWriter) Abort() error {
+	w.buf.Reset()
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// How much a URL would download, as found by --dry-run.
+type Estimate struct {
+	URL    string `json:"url"`
+	Plugin string `json:"plugin,omitempty"`
+	Files  int    `json:"files"`
+	// -1 if unknown.
+	Bytes int64  `json:"bytes"`
+	Error string `json:"error,omitempty"`
+	err   error
+}
+
+// Estimates the size of a download using the plugin's Estimator if it has
+// one. Otherwise only the number of files is known, which requires running
+// the initialization of the plugin's DownloadGenerator().
+func estimateDownload(url string, p plugins.Plugin) (est *Estimate) {
+	est = &Estimate{URL: url, Plugin: pluginName(p), Bytes: -1}
+	defer func() {
+		if r := recover(); r != nil {
+			est.err = &PanicError{r}
+			est.Error = est.err.Error()
+			log.Error(est.err)
+		}
+	}()
+
+	if e, ok := p.(plugins.Estimator); ok {
+		files, size, err := e.Estimate(url)
+		if err != nil {
+			log.Error(err)
+			est.err, est.Error = err, err.Error()
+			return
+		}
+		est.Files, est.Bytes = files, size
+		return
+	}
+
+	_, est.Files = p.DownloadGenerator(url)
+	p.Cleanup(nil)
+	return
+}
+
+func writeEstimates(w io.Writer, estimates []*Estimate) error {
+	var files int
+	var size int64
+	var unknown bool
+	for _, est := range estimates {
+		files += est.Files
+		if est.Bytes >= 0 {
+			size += est.Bytes
+		} else if est.Error == "" {
+			unknown = true
+		}
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Jobs  []*Estimate `json:"jobs"`
+			Files int         `json:"files"`
+			Bytes int64       `json:"bytes"`
+		}{estimates, files, size})
+	}
+
+	for _, est := range estimates {
+		switch {
+		case est.Error != "":
+			fmt.Fprint(w, i18n.Tf("%s\n    Failed: %s\n", est.URL, est.Error))
+		case est.Bytes < 0:
+			fmt.Fprint(w, i18n.Tf("%s\n    %d file(s), unknown size\n", est.URL, est.Files))
+		default:
+			fmt.Fprint(w, i18n.Tf("%s\n    %d file(s), ~%s\n", est.URL, est.Files, formatBytes(est.Bytes)))
+		}
+	}
+	var err error
+	switch {
+	case unknown && size == 0:
+		_, err = fmt.Fprint(w, i18n.Tf("Total: %d file(s), unknown size\n", files))
+	case unknown:
+		_, err = fmt.Fprint(w, i18n.Tf("Total: %d file(s), more than ~%s\n", files, formatBytes(size)))
+	default:
+		_, err = fmt.Fprint(w, i18n.Tf("Total: %d file(s), ~%s\n", files, formatBytes(size)))
+	}
+	return err
+}
+
+// Returns the exit code for the first estimate that failed.
+func estimatesExitCode(estimates []*Estimate) int {
+	for _, est := range estimates {
+		if est.err != nil {
+			return errorExitCode(est.err)
+		}
+	}
+
+	return ExitOK
+}
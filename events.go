@@ -0,0 +1,153 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidEvents = errors.New("Invalid --events destination. Should be a file, fd:<n>, unix:<path> or tcp:<host:port>.")
+
+var eventsDest string
+
+// Where events are written. Nil if --events wasn't passed.
+var events *EventWriter
+
+func init() {
+	commonFlags.StringVar(&eventsDest, "events", "",
+		"Write progress events as JSON lines to a file, a file descriptor (fd:3) or a socket (unix:/path or tcp:host:port), for wrappers and GUIs.")
+}
+
+// Something that happened during a download, written as a line of JSON.
+type Event struct {
+	// start, progress, file or done, or job from the daemon's feed.
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	URL    string    `json:"url"`
+	Plugin string    `json:"plugin,omitempty"`
+	// The ID of the session or daemon job, if any.
+	Job      string           `json:"job,omitempty"`
+	Workers  []WorkerProgress `json:"workers,omitempty"`
+	File     *SavedFile       `json:"file,omitempty"`
+	Progress *Progress        `json:"progress,omitempty"`
+	// Only set for done events of failed downloads.
+	Error string `json:"error,omitempty"`
+	// Only set for job events, to the status the job is now in.
+	Status string `json:"status,omitempty"`
+}
+
+// Writes events as JSON lines. Safe to use from multiple goroutines.
+type EventWriter struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+	m   sync.Mutex
+}
+
+// Opens the destination, which is either fd:<n> for an inherited file
+// descriptor, unix:<path> or tcp:<host:port> for a socket to connect to, or
+// a file to append to.
+func OpenEventWriter(dest string) (*EventWriter, error) {
+	var w io.WriteCloser
+	switch {
+	case strings.HasPrefix(dest, "fd:"):
+		fd, err := strconv.Atoi(dest[3:])
+		if err != nil || fd < 0 {
+			return nil, ErrInvalidEvents
+		}
+		w = os.NewFile(uintptr(fd), dest)
+	case strings.HasPrefix(dest, "unix:"), strings.HasPrefix(dest, "tcp:"):
+		split := strings.SplitN(dest, ":", 2)
+		conn, err := net.DialTimeout(split[0], split[1], 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		w = conn
+	case dest == "":
+		return nil, ErrInvalidEvents
+	default:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	return &EventWriter{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (ew *EventWriter) Emit(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	ew.m.Lock()
+	defer ew.m.Unlock()
+	if err := ew.enc.Encode(e); err != nil {
+		log.Debugf("Failed to write an event: %s", err)
+	}
+}
+
+func (ew *EventWriter) Close() error {
+	return ew.w.Close()
+}
+
+func setupEvents() {
+	if eventsDest == "" {
+		return
+	}
+
+	var err error
+	if events, err = OpenEventWriter(eventsDest); err != nil {
+		fatal(err)
+	}
+}
+
+// Writes the events of the manager's downloads. Does nothing without --events.
+func streamEvents(dm *DownloadManager, url, plugin, job string) {
+	if events == nil {
+		return
+	}
+
+	dm.OnEvent(func(de DownloadEvent) {
+		events.Emit(newEvent(de, url, plugin, job))
+	})
+}
+
+func newEvent(de DownloadEvent, url, plugin, job string) *Event {
+	e := &Event{
+		Event:    de.Kind,
+		Time:     de.Time,
+		URL:      url,
+		Plugin:   plugin,
+		Job:      job,
+		Workers:  de.Workers,
+		File:     de.File,
+		Progress: &de.Progress,
+	}
+	if de.Err != nil {
+		e.Error = de.Err.Error()
+	}
+
+	return e
+}
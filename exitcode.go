@@ -0,0 +1,170 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+
+	"github.com/MinoMino/mindl/logger"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// Exit codes, letting scripts tell what kind of failure happened.
+const (
+	ExitOK = 0
+	// Anything not covered by the others.
+	ExitFailure = 1
+	// Invalid flags or arguments.
+	ExitUsage = 2
+	// A URL no plugin can handle, or no plugin was picked.
+	ExitNoPlugin = 3
+	// Logging in or otherwise authenticating failed.
+	ExitAuth = 4
+	// A network error or an unexpected HTTP status code.
+	ExitNetwork = 5
+	// Some URLs or files were downloaded, but not all of them.
+	ExitPartial = 6
+	// A bug in mindl or a plugin.
+	ExitInternal = 7
+	// Interrupted or canceled, following the shell convention for SIGINT.
+	ExitCanceled = 130
+)
+
+// The code main() exits with once the command returns.
+var exitCode = ExitOK
+
+// Wraps the value of a recovered panic. Plugins tend to panic
+// with errors, so the original error is kept when there is one.
+type PanicError struct {
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Panicked: %v", e.Value)
+}
+
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// Returns the exit code for a single error.
+func errorExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var authErr *plugins.ErrAuthentication
+	var truncErr *plugins.ErrTruncated
+	var netErr net.Error
+	var rtErr runtime.Error
+	var panicErr *PanicError
+	switch {
+	case errors.Is(err, ErrCanceled), errors.Is(err, ErrInterrupted):
+		return ExitCanceled
+	case isUsageError(err):
+		return ExitUsage
+	case errors.Is(err, ErrNoPlugins), errors.Is(err, ErrNoSuchPlugin),
+		errors.Is(err, ErrUnintelligibleNumber), errors.Is(err, ErrOutOfRange):
+		return ExitNoPlugin
+	case errors.As(err, &authErr):
+		return ExitAuth
+	case errors.As(err, &netErr), errors.As(err, &truncErr):
+		return ExitNetwork
+	case errors.As(err, &rtErr):
+		return ExitInternal
+	case errors.As(err, &panicErr):
+		// PanicForStatus() panics with something that isn't an error.
+		if status, ok := panicErr.Value.(*plugins.ErrHTTPStatusCode); ok {
+			if status.StatusCode == http.StatusUnauthorized || status.StatusCode == http.StatusForbidden {
+				return ExitAuth
+			}
+			return ExitNetwork
+		} else if panicErr.Unwrap() == nil {
+			return ExitInternal
+		}
+	}
+
+	return ExitFailure
+}
+
+// Errors from invalid flags or arguments.
+var usageErrors = []error{
+	ErrInvalidProgressMode, ErrProgressJSONOutput, ErrTUINotTerminal, ErrInvalidProxyRotation, ErrTorAndProxy,
+	ErrIPv4AndIPv6, plugins.ErrInvalidPin, ErrInvalidKeyringKey, ErrInvalidAccount, ErrUnknownProfile, ErrApiNoToken,
+}
+
+func isUsageError(err error) bool {
+	for _, usageErr := range usageErrors {
+		if errors.Is(err, usageErr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Logs the error and exits with its exit code. Used instead of log.Fatal,
+// which always exits with 1.
+func fatal(err error) {
+	log.Error(err)
+	exit(errorExitCode(err))
+}
+
+// Logs a problem with the flags or arguments and exits with ExitUsage.
+func fatalUsage(format string, args ...interface{}) {
+	log.Errorf(format, args...)
+	exit(ExitUsage)
+}
+
+// Cleans up like main() does after a command and exits with the code.
+func exit(code int) {
+	stopTUI()
+	stopTransport()
+	logger.Close()
+	os.Exit(code)
+}
+
+// Returns the exit code for a batch of jobs. If some succeeded and others
+// didn't, or a failed job got some of the files, it's a partial completion.
+func resultsExitCode(results []*JobResult) int {
+	var succeeded, partial bool
+	code := ExitOK
+	for _, res := range results {
+		switch res.Status {
+		case StatusDone, StatusSkipped:
+			succeeded = true
+		default:
+			if len(res.Files) > 0 {
+				partial = true
+			}
+			if code == ExitOK {
+				code = errorExitCode(res.err)
+			}
+		}
+	}
+
+	if code != ExitOK && code != ExitCanceled && (succeeded || partial) {
+		return ExitPartial
+	}
+	return code
+}
@@ -0,0 +1,155 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sent by the daemon's feed whenever a job's status changes.
+const EventJob = "job"
+
+// How many events a feed listener can fall behind by before they're dropped.
+const feedBuffer = 256
+
+// How often a comment is sent to keep idle feeds from being closed by proxies.
+const feedKeepAlive = 15 * time.Second
+
+// Passes events on to whoever's listening. Listeners that can't keep up miss
+// events rather than holding up the downloads.
+type EventHub struct {
+	subs map[chan *Event]bool
+	m    sync.Mutex
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subs: make(map[chan *Event]bool)}
+}
+
+func (h *EventHub) Publish(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+	for sub := range h.subs {
+		select {
+		case sub <- e:
+		default:
+		}
+	}
+}
+
+// Returns a channel with the events published from now on, until
+// unsubscribe is called.
+func (h *EventHub) Subscribe() (events <-chan *Event, unsubscribe func()) {
+	sub := make(chan *Event, feedBuffer)
+	h.m.Lock()
+	h.subs[sub] = true
+	h.m.Unlock()
+
+	return sub, func() {
+		h.m.Lock()
+		delete(h.subs, sub)
+		h.m.Unlock()
+	}
+}
+
+// An event for the job's current status.
+func jobEvent(job *Job) *Event {
+	return &Event{
+		Event:  EventJob,
+		Time:   time.Now(),
+		URL:    job.URL,
+		Plugin: job.Plugin,
+		Job:    job.ID,
+		Status: job.Status,
+	}
+}
+
+// Streams events as server-sent events, starting with the status of every
+// job. With ?job=<id>, only that job's events are sent.
+func (api *ApiServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"Method not allowed."})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, apiError{"Streaming isn't supported."})
+		return
+	}
+
+	id := r.URL.Query().Get("job")
+	if id != "" {
+		if _, err := api.queue.Get(id); err != nil {
+			writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+			return
+		}
+	}
+	// Subscribe before listing the jobs so nothing falls in between.
+	events, unsubscribe := api.queue.Events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, job := range api.queue.Jobs() {
+		if id == "" || job.ID == id {
+			writeEvent(w, jobEvent(&job))
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(feedKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-events:
+			if id != "" && e.Job != id {
+				continue
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Event, data)
+	return err
+}
@@ -0,0 +1,297 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// The files that have been saved, where they came from, and their hashes.
+// Like the history, they're stored as JSON, one per line, and a file saved
+// again to the same path replaces the old one.
+type FileIndex struct {
+	path string
+	// The files by path and the paths by hash, read from the file when
+	// first needed, and how much of the file they were read from.
+	files  map[string]*IndexedFile
+	hashes map[string]map[string]bool
+	size   int64
+	m      sync.Mutex
+}
+
+func OpenFileIndex(path string) *FileIndex {
+	return &FileIndex{path: path}
+}
+
+// The default location of the index, next to the history.
+func DefaultFileIndexPath() string {
+	return filepath.Join(filepath.Dir(DefaultHistoryPath()), "files.jsonl")
+}
+
+// Reads the index unless it's already been read and nothing else has added
+// to it since. Must be called with the lock held.
+func (idx *FileIndex) load() error {
+	if idx.files != nil && fileSize(idx.path) == idx.size {
+		return nil
+	}
+
+	idx.files, idx.hashes = make(map[string]*IndexedFile), make(map[string]map[string]bool)
+	size, err := readJSONLines(idx.path, func(line []byte) {
+		var f IndexedFile
+		if err := json.Unmarshal(line, &f); err != nil {
+			log.WithField("path", idx.path).Warnf("Skipping malformed file index entry: %s", err)
+			return
+		}
+		idx.put(&f)
+	})
+	if err != nil {
+		idx.files = nil
+		return err
+	}
+	idx.size = size
+
+	return nil
+}
+
+// Puts the file in the maps, replacing the one with the same path.
+func (idx *FileIndex) put(f *IndexedFile) {
+	if old, ok := idx.files[f.Path]; ok && old.SHA256 != "" {
+		delete(idx.hashes[old.SHA256], old.Path)
+		if len(idx.hashes[old.SHA256]) == 0 {
+			delete(idx.hashes, old.SHA256)
+		}
+	}
+	idx.files[f.Path] = f
+	if f.SHA256 != "" {
+		if idx.hashes[f.SHA256] == nil {
+			idx.hashes[f.SHA256] = make(map[string]bool)
+		}
+		idx.hashes[f.SHA256][f.Path] = true
+	}
+}
+
+// Adds the files of a download, all at once.
+func (idx *FileIndex) Add(item, plugin, job string, files []SavedFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	indexed := make([]*IndexedFile, len(files))
+	values := make([]interface{}, len(files))
+	for i, f := range files {
+		indexed[i] = &IndexedFile{SavedFile: f, Item: item, Plugin: plugin, Job: job, Time: now}
+		values[i] = indexed[i]
+	}
+
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	before, after, err := appendJSONLines(idx.path, values...)
+	if err != nil {
+		return err
+	}
+	// Unless something else wrote to the file too, in which case it's read
+	// again when needed.
+	if idx.files != nil && before == idx.size {
+		for _, f := range indexed {
+			idx.put(f)
+		}
+		idx.size = after
+	}
+
+	return nil
+}
+
+// A file in the index.
+type IndexedFile struct {
+	SavedFile
+	// The URL that was downloaded, like a book or a gallery.
+	Item   string    `json:"item"`
+	Plugin string    `json:"plugin"`
+	Job    string    `json:"job,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Returns the files with paths, URLs or items containing the search, or all
+// of them if it's empty.
+func (idx *FileIndex) Search(search string) ([]IndexedFile, error) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	if err := idx.load(); err != nil {
+		return nil, err
+	}
+
+	search = strings.ToLower(search)
+	var res []IndexedFile
+	for _, f := range idx.files {
+		if search == "" || strings.Contains(strings.ToLower(f.Path), search) ||
+			strings.Contains(strings.ToLower(f.URL), search) || strings.Contains(strings.ToLower(f.Item), search) {
+			res = append(res, *f)
+		}
+	}
+	sortIndexedFiles(res, false)
+
+	return res, nil
+}
+
+// Returns the files with the SHA-256 hash.
+func (idx *FileIndex) Hash(sum string) ([]IndexedFile, error) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	if err := idx.load(); err != nil {
+		return nil, err
+	}
+
+	var res []IndexedFile
+	for path := range idx.hashes[strings.ToLower(sum)] {
+		res = append(res, *idx.files[path])
+	}
+	sortIndexedFiles(res, false)
+
+	return res, nil
+}
+
+// Returns the files that have the same hash as another file, grouped
+// together.
+func (idx *FileIndex) Duplicates() ([]IndexedFile, error) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	if err := idx.load(); err != nil {
+		return nil, err
+	}
+
+	var res []IndexedFile
+	for _, paths := range idx.hashes {
+		if len(paths) < 2 {
+			continue
+		}
+		for path := range paths {
+			res = append(res, *idx.files[path])
+		}
+	}
+	sortIndexedFiles(res, true)
+
+	return res, nil
+}
+
+// Sorts files by when they were saved and then by path, grouping them by
+// hash first if byHash is set.
+func sortIndexedFiles(files []IndexedFile, byHash bool) {
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if byHash && a.SHA256 != b.SHA256 {
+			return a.SHA256 < b.SHA256
+		} else if !a.Time.Equal(b.Time) {
+			return a.Time.Before(b.Time)
+		}
+		return a.Path < b.Path
+	})
+}
+
+// Adds the files saved by a download to the index if it's enabled. Done
+// whether the download finished or not, since the files are there either way.
+func indexFiles(p plugins.Plugin, url, job string, dm *DownloadManager) {
+	if fileIndex == nil || dm.Preview() {
+		return
+	}
+
+	span := plugins.StartSpan(dm.Span, "index")
+	err := fileIndex.Add(CanonicalURL(p, url), pluginName(p), job, dm.SavedFiles())
+	span.End(err)
+	if err != nil {
+		log.WithField("url", url).Errorf("Failed to add to the file index: %s", err)
+	}
+}
+
+var (
+	// nil if the index is disabled.
+	fileIndex       *FileIndex
+	fileIndexPath   string
+	noFileIndex     bool
+	filesHash       string
+	filesDuplicates bool
+	filesCommand    = &Command{
+		Name:  "files",
+		Usage: "[flags] [search]",
+		Short: "List saved files, optionally only those with paths or URLs matching a search.",
+		Flags: NewCommandFlags("files"),
+		Setup: SetupNone,
+	}
+)
+
+func init() {
+	filesCommand.Run = runFiles
+	commonFlags.StringVar(&fileIndexPath, "index-file", DefaultFileIndexPath(),
+		"The file in which every saved file is indexed.")
+	commonFlags.BoolVar(&noFileIndex, "no-index", false,
+		"Set to not add saved files to the file index.")
+	filesCommand.Flags.StringVar(&filesHash, "hash", "",
+		"Only list files with this SHA-256 hash.")
+	filesCommand.Flags.BoolVar(&filesDuplicates, "duplicates", false,
+		"Set to only list files that have the same contents as another file.")
+	filesCommand.Flags.BoolVar(&jsonOutput, "json", false,
+		"Print the files as JSON, one per line.")
+}
+
+func setupFileIndex() {
+	if !noFileIndex {
+		fileIndex = OpenFileIndex(fileIndexPath)
+	}
+}
+
+func runFiles(args []string) {
+	idx := OpenFileIndex(fileIndexPath)
+	var files []IndexedFile
+	var err error
+	switch {
+	case filesHash != "":
+		files, err = idx.Hash(filesHash)
+	case filesDuplicates:
+		files, err = idx.Duplicates()
+	default:
+		files, err = idx.Search(strings.Join(args, " "))
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for i, f := range files {
+		if jsonOutput {
+			enc.Encode(f)
+			continue
+		}
+		// Groups of duplicates are separated by an empty line.
+		if filesDuplicates && i > 0 && files[i-1].SHA256 != f.SHA256 {
+			fmt.Println()
+		}
+		fmt.Printf("%s  %-12s %10s  %s\n", f.Time.Local().Format("2006-01-02 15:04"), f.Plugin,
+			formatBytes(f.Size), f.Path)
+		if f.URL != "" {
+			fmt.Printf("%43s%s\n", "", "from "+f.URL)
+		}
+	}
+}
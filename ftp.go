@@ -0,0 +1,293 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+	"github.com/jlaffaye/ftp"
+)
+
+var (
+	ftpPassword string
+	ftpEPSV     bool
+)
+
+func init() {
+	commonFlags.StringVar(&ftpPassword, "ftp-password", "",
+		"The password for an FTP output, if it's not in the URL. Preferably set with MINDL_FTP_PASSWORD.")
+	commonFlags.BoolVar(&ftpEPSV, "ftp-epsv", true,
+		"Set to false for FTP servers or firewalls that don't handle extended passive mode.")
+	storageSchemes["ftp"] = newFTPStorage
+	storageSchemes["ftps"] = newFTPStorage
+}
+
+// Files on an FTP server. ftps:// uses explicit TLS, or implicit TLS if the
+// port is 990. Without a user, it logs in anonymously.
+type FTPStorage struct {
+	Host      string
+	User      string
+	Password  string
+	Directory string
+	TLS       bool
+	// Connections that aren't in use. Each upload needs its own.
+	idle []*ftp.ServerConn
+	// Directories that are known to exist.
+	dirs map[string]bool
+	m    sync.Mutex
+}
+
+func newFTPStorage(u *url.URL) (Storage, error) {
+	s := &FTPStorage{
+		Host:      u.Host,
+		User:      "anonymous",
+		Password:  ftpPassword,
+		Directory: strings.TrimSuffix(u.Path, "/"),
+		TLS:       u.Scheme == "ftps",
+		dirs:      make(map[string]bool),
+	}
+	if u.Port() == "" {
+		s.Host = net.JoinHostPort(u.Hostname(), "21")
+	}
+	if u.User != nil {
+		s.User = u.User.Username()
+		if pass, ok := u.User.Password(); ok {
+			s.Password = pass
+		}
+	}
+	if s.Directory == "" {
+		s.Directory = "/"
+	}
+
+	return s, nil
+}
+
+// Returns an idle connection or opens a new one. Give it back with put().
+func (s *FTPStorage) get() (*ftp.ServerConn, error) {
+	s.m.Lock()
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.m.Unlock()
+		// It might have timed out while idle.
+		if err := c.NoOp(); err == nil {
+			return c, nil
+		}
+		c.Quit()
+	} else {
+		s.m.Unlock()
+	}
+
+	opts := []ftp.DialOption{
+		ftp.DialWithTimeout(30 * time.Second),
+		ftp.DialWithDisabledEPSV(!ftpEPSV),
+	}
+	if s.TLS {
+		config := &tls.Config{ServerName: strings.Split(s.Host, ":")[0]}
+		if strings.HasSuffix(s.Host, ":990") {
+			opts = append(opts, ftp.DialWithTLS(config))
+		} else {
+			opts = append(opts, ftp.DialWithExplicitTLS(config))
+		}
+	}
+	c, err := ftp.Dial(s.Host, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Login(s.User, s.Password); err != nil {
+		c.Quit()
+		return nil, err
+	}
+	log.WithField("host", s.Host).Debug("Connected to the FTP server.")
+
+	return c, nil
+}
+
+func (s *FTPStorage) put(c *ftp.ServerConn) {
+	s.m.Lock()
+	s.idle = append(s.idle, c)
+	s.m.Unlock()
+}
+
+func (s *FTPStorage) path(p string) string {
+	return path.Join(s.Directory, p)
+}
+
+// Creates the directory and its parents one at a time, since not every
+// server can create parents.
+func (s *FTPStorage) makeDirectories(c *ftp.ServerConn, dir string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var p string
+	for _, part := range strings.Split(dir, "/") {
+		p = path.Join("/", p, part)
+		if s.dirs[p] {
+			continue
+		}
+		// Fails if it already exists, and if it really failed, so will the upload.
+		c.MakeDir(p)
+		s.dirs[p] = true
+	}
+}
+
+func (s *FTPStorage) Create(p string) (StorageWriter, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	p = s.path(p)
+	s.makeDirectories(c, path.Dir(p))
+
+	w := &ftpWriter{s: s, conn: c, path: p, done: make(chan error, 1)}
+	var r *io.PipeReader
+	r, w.pipe = io.Pipe()
+	// Uploaded under another name first so that nothing on the other end
+	// picks up a file that's only partly there.
+	go func() {
+		err := c.Stor(w.part(), r)
+		r.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+func (s *FTPStorage) Remove(p string) error {
+	c, err := s.get()
+	if err != nil {
+		return err
+	}
+	defer s.put(c)
+
+	return c.Delete(s.path(p))
+}
+
+func (s *FTPStorage) Location(p string) string {
+	u := url.URL{Scheme: "ftp", Host: s.Host, Path: s.path(p)}
+	if s.TLS {
+		u.Scheme = "ftps"
+	}
+	if s.User != "anonymous" {
+		u.User = url.User(s.User)
+	}
+
+	return u.String()
+}
+
+// Streams the file to the server as it's written, while also keeping a copy
+// so that the upload can be resumed if the connection is lost.
+type ftpWriter struct {
+	s     *FTPStorage
+	conn  *ftp.ServerConn
+	path  string
+	pipe  *io.PipeWriter
+	done  chan error
+	spool spool
+}
+
+func (w *ftpWriter) part() string {
+	return w.path + ".part"
+}
+
+func (w *ftpWriter) Write(p []byte) (int, error) {
+	if _, err := w.spool.Write(p); err != nil {
+		return 0, err
+	}
+	// Errors are left for Close(), which can still resume from the spool.
+	w.pipe.Write(p)
+
+	return len(p), nil
+}
+
+func (w *ftpWriter) Close() error {
+	defer w.spool.Close()
+	w.pipe.Close()
+	err := <-w.done
+	for attempt := 0; err != nil; attempt++ {
+		if attempt >= plugins.MaxRetries {
+			w.conn.Quit()
+			return err
+		}
+		log.WithField("path", w.path).Debugf("FTP upload failed, resuming: %s", err)
+		time.Sleep(plugins.RetryDelay << uint(attempt))
+		err = w.resume()
+	}
+
+	// Not every server replaces files when renaming.
+	if err := w.conn.Rename(w.part(), w.path); err != nil {
+		w.conn.Delete(w.path)
+		if err := w.conn.Rename(w.part(), w.path); err != nil {
+			w.conn.Quit()
+			return err
+		}
+	}
+	w.s.put(w.conn)
+
+	return nil
+}
+
+// Reconnects and uploads the rest of the file, starting over if the server
+// can't tell how much it got.
+func (w *ftpWriter) resume() error {
+	w.conn.Quit()
+	c, err := w.s.get()
+	if err != nil {
+		return err
+	}
+	w.conn = c
+
+	offset, err := c.FileSize(w.part())
+	if err != nil || offset > w.spool.size {
+		offset = 0
+	}
+	r, err := w.spool.Reader(offset)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		err = c.StorFrom(w.part(), r, uint64(offset))
+	}
+	if offset == 0 || err != nil {
+		if r, err = w.spool.Reader(0); err != nil {
+			return err
+		}
+		err = c.Stor(w.part(), r)
+	}
+	if err != nil {
+		return fmt.Errorf("FTP: %s", err)
+	}
+
+	return nil
+}
+
+func (w *ftpWriter) Abort() error {
+	defer w.spool.Close()
+	w.pipe.CloseWithError(ErrCanceled)
+	<-w.done
+	// The connection is in an unknown state after a cut off transfer.
+	w.conn.Quit()
+	return w.s.Remove(strings.TrimPrefix(w.part(), w.s.Directory))
+}
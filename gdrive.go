@@ -0,0 +1,407 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var (
+	ErrGDriveNoClient = errors.New("Set --gdrive-client-id and --gdrive-client-secret to save to Google Drive.")
+)
+
+var (
+	gdriveClientID     string
+	gdriveClientSecret string
+)
+
+const (
+	gdriveAPI        = "https://www.googleapis.com/drive/v3"
+	gdriveUploadAPI  = "https://www.googleapis.com/upload/drive/v3"
+	gdriveDeviceURL  = "https://oauth2.googleapis.com/device/code"
+	gdriveTokenURL   = "https://oauth2.googleapis.com/token"
+	gdriveFolderType = "application/vnd.google-apps.folder"
+	// Only files and folders mindl creates are visible to it with this scope,
+	// which is the only one that works with the device flow.
+	gdriveScope = "https://www.googleapis.com/auth/drive.file"
+	// Has to be a multiple of 256 KiB.
+	gdriveChunkSize = 8 << 20
+)
+
+func init() {
+	commonFlags.StringVar(&gdriveClientID, "gdrive-client-id", "",
+		"The client ID of a Google OAuth client of the \"TVs and Limited Input devices\" type, for saving to Google Drive.")
+	commonFlags.StringVar(&gdriveClientSecret, "gdrive-client-secret", "",
+		"The client secret of the Google OAuth client.")
+	storageSchemes["gdrive"] = newGDriveStorage
+}
+
+// Files in a folder on Google Drive, e.g. gdrive:///Books/Manga. Folders are
+// created as needed. The first time, the user is asked to allow access on
+// another device, and the token is kept in the OS keyring or config directory.
+type GDriveStorage struct {
+	Directory string
+	client    *http.Client
+	auth      *plugins.OAuth2
+	// The IDs of folders by their path.
+	folders map[string]string
+	m       sync.Mutex
+}
+
+func newGDriveStorage(u *url.URL) (Storage, error) {
+	if gdriveClientID == "" || gdriveClientSecret == "" {
+		return nil, ErrGDriveNoClient
+	}
+
+	client := &http.Client{}
+	return &GDriveStorage{
+		Directory: strings.Trim(path.Join(u.Host, u.Path), "/"),
+		client:    client,
+		auth: plugins.NewOAuth2("GoogleDrive", &plugins.OAuth2Config{
+			ClientID:     gdriveClientID,
+			ClientSecret: gdriveClientSecret,
+			TokenURL:     gdriveTokenURL,
+			DeviceURL:    gdriveDeviceURL,
+			Scopes:       []string{gdriveScope},
+			Flow:         plugins.OAuth2DeviceFlow,
+		}, client),
+		folders: map[string]string{"": "root"},
+	}, nil
+}
+
+// Sends an authorized request, retrying network and server errors.
+func (s *GDriveStorage) do(method, endpoint string, header http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if err := s.auth.Authorize(req); err != nil {
+			return nil, err
+		}
+
+		resp, err := s.client.Do(req)
+		if err == nil && resp.StatusCode == http.StatusUnauthorized {
+			resp.Body.Close()
+			s.auth.Invalidate()
+			err = errors.New("Google Drive: unauthorized")
+		} else if err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		} else if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("Google Drive returned error code: %d", resp.StatusCode)
+		}
+		if attempt >= plugins.MaxRetries {
+			return nil, err
+		}
+		log.Debugf("Google Drive request failed, retrying: %s", err)
+		time.Sleep(plugins.RetryDelay << uint(attempt))
+	}
+}
+
+func gdriveError(resp *http.Response) error {
+	defer resp.Body.Close()
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error.Message != "" {
+		return fmt.Errorf("Google Drive: %s", e.Error.Message)
+	}
+
+	return fmt.Errorf("Google Drive returned error code: %d", resp.StatusCode)
+}
+
+// Returns the ID of the file or folder with the name in the parent, or ""
+// if there isn't one.
+func (s *GDriveStorage) find(parent, name string, folder bool) (string, error) {
+	q := fmt.Sprintf("'%s' in parents and name = '%s' and trashed = false", parent,
+		strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(name))
+	if folder {
+		q += " and mimeType = '" + gdriveFolderType + "'"
+	}
+	resp, err := s.do(http.MethodGet, gdriveAPI+"/files?"+url.Values{
+		"q":      {q},
+		"fields": {"files(id)"},
+		"spaces": {"drive"},
+	}.Encode(), nil, nil)
+	if err != nil {
+		return "", err
+	} else if resp.StatusCode != http.StatusOK {
+		return "", gdriveError(resp)
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Files []struct {
+			ID string `json:"id"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	} else if len(res.Files) == 0 {
+		return "", nil
+	}
+
+	return res.Files[0].ID, nil
+}
+
+// Returns the ID of the folder, creating it and its parents if needed.
+func (s *GDriveStorage) folder(dir string) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var p string
+	for _, name := range strings.Split(dir, "/") {
+		parent := s.folders[p]
+		p = strings.TrimPrefix(p+"/"+name, "/")
+		if _, ok := s.folders[p]; ok || name == "" {
+			continue
+		}
+
+		id, err := s.find(parent, name, true)
+		if err != nil {
+			return "", err
+		} else if id == "" {
+			data, _ := json.Marshal(map[string]interface{}{
+				"name":     name,
+				"mimeType": gdriveFolderType,
+				"parents":  []string{parent},
+			})
+			header := http.Header{"Content-Type": {"application/json"}}
+			resp, err := s.do(http.MethodPost, gdriveAPI+"/files?fields=id", header, data)
+			if err != nil {
+				return "", err
+			} else if resp.StatusCode != http.StatusOK {
+				return "", gdriveError(resp)
+			}
+			var res struct {
+				ID string `json:"id"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&res)
+			resp.Body.Close()
+			if err != nil {
+				return "", err
+			}
+			id = res.ID
+			log.WithField("path", s.Location(p)).Debug("Created Google Drive folder.")
+		}
+		s.folders[p] = id
+	}
+
+	return s.folders[dir], nil
+}
+
+func (s *GDriveStorage) Create(p string) (StorageWriter, error) {
+	full := strings.TrimPrefix(path.Join(s.Directory, p), "/")
+	parent, err := s.folder(path.Dir(full))
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(full)
+	existing, err := s.find(parent, name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gdriveWriter{s: s, parent: parent, name: name, existing: existing}, nil
+}
+
+func (s *GDriveStorage) Remove(p string) error {
+	full := strings.TrimPrefix(path.Join(s.Directory, p), "/")
+	parent, err := s.folder(path.Dir(full))
+	if err != nil {
+		return err
+	}
+	id, err := s.find(parent, path.Base(full), false)
+	if err != nil || id == "" {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, gdriveAPI+"/files/"+id, nil, nil)
+	if err != nil {
+		return err
+	} else if resp.StatusCode >= 300 {
+		return gdriveError(resp)
+	}
+
+	return resp.Body.Close()
+}
+
+func (s *GDriveStorage) Location(p string) string {
+	return "gdrive:///" + strings.TrimPrefix(path.Join(s.Directory, p), "/")
+}
+
+// Uploads the file in chunks with a resumable upload, which only shows up in
+// Drive once it's complete. Files that already exist get a new version.
+type gdriveWriter struct {
+	s        *GDriveStorage
+	parent   string
+	name     string
+	existing string
+	session  string
+	buf      bytes.Buffer
+	// How much the server has received.
+	offset int64
+}
+
+func (w *gdriveWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for w.buf.Len() >= gdriveChunkSize {
+		if err := w.upload(w.buf.Next(gdriveChunkSize), false); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *gdriveWriter) start() error {
+	method, endpoint := http.MethodPost, gdriveUploadAPI+"/files?uploadType=resumable"
+	meta := map[string]interface{}{"name": w.name, "parents": []string{w.parent}}
+	if w.existing != "" {
+		method, endpoint = http.MethodPatch, gdriveUploadAPI+"/files/"+w.existing+"?uploadType=resumable"
+		meta = map[string]interface{}{}
+	}
+	data, _ := json.Marshal(meta)
+	header := http.Header{"Content-Type": {"application/json; charset=UTF-8"}}
+	resp, err := w.s.do(method, endpoint, header, data)
+	if err != nil {
+		return err
+	} else if resp.StatusCode != http.StatusOK {
+		return gdriveError(resp)
+	}
+	resp.Body.Close()
+	w.session = resp.Header.Get("Location")
+
+	return nil
+}
+
+// Sends a chunk, resending whatever the server didn't get if it fails.
+func (w *gdriveWriter) upload(chunk []byte, last bool) error {
+	if w.session == "" {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+
+	start := w.offset
+	end := start + int64(len(chunk))
+	total := "*"
+	if last {
+		total = strconv.FormatInt(end, 10)
+	}
+	// Set after a failure to first ask the server how much it got.
+	query := false
+	for attempt := 0; attempt <= plugins.MaxRetries+1; attempt++ {
+		var sent []byte
+		if !query {
+			sent = chunk[w.offset-start:]
+		}
+		req, err := http.NewRequest(http.MethodPut, w.session, bytes.NewReader(sent))
+		if err != nil {
+			return err
+		}
+		if len(sent) == 0 {
+			req.Header.Set("Content-Range", "bytes */"+total)
+		} else {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", w.offset, end-1, total))
+		}
+
+		resp, err := w.s.client.Do(req)
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+				w.offset = end
+				return nil
+			case resp.StatusCode == http.StatusPermanentRedirect:
+				// "Resume Incomplete", with the range it has so far.
+				w.offset = 0
+				if r := resp.Header.Get("Range"); r != "" {
+					if n, err := strconv.ParseInt(r[strings.LastIndex(r, "-")+1:], 10, 64); err == nil {
+						w.offset = n + 1
+					}
+				}
+				if w.offset < start || w.offset > end {
+					return errors.New("The Google Drive upload lost data that was already sent.")
+				} else if w.offset == end && !last {
+					return nil
+				}
+				// Send the rest right away.
+				query = false
+				continue
+			case resp.StatusCode == http.StatusNotFound:
+				return errors.New("The Google Drive upload expired.")
+			default:
+				err = fmt.Errorf("Google Drive returned error code: %d", resp.StatusCode)
+				if resp.StatusCode < 500 {
+					return err
+				}
+			}
+		}
+
+		log.WithField("name", w.name).Debugf("Google Drive upload failed, resuming: %s", err)
+		time.Sleep(plugins.RetryDelay << uint(attempt))
+		query = true
+	}
+
+	return errors.New("The Google Drive upload kept failing.")
+}
+
+func (w *gdriveWriter) Close() error {
+	if err := w.upload(w.buf.Bytes(), true); err != nil {
+		w.Abort()
+		return err
+	}
+
+	return nil
+}
+
+func (w *gdriveWriter) Abort() error {
+	w.buf.Reset()
+	if w.session == "" {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, w.session, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,61 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"strings"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var headerFlags, userAgentFlags []string
+
+func init() {
+	commonFlags.StringArrayVar(&headerFlags, "header", nil,
+		"A header to add to every request, e.g. \"Accept-Language: ja\". Prefix it with \"Plugin=\" to only add it for that plugin. Can be repeated.")
+	commonFlags.StringArrayVar(&userAgentFlags, "user-agent", nil,
+		"The user agent to use, either firefox, chrome, edge, safari, iphone or a custom one. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.")
+}
+
+// Adds the headers passed with --header and --user-agent. Headers are
+// either "Name: Value" for every plugin or "Plugin=Name: Value" for a
+// single one, and user agents work the same way.
+func setupHeaders() {
+	for _, h := range headerFlags {
+		var plugin string
+		// Header values can have = in them, so only treat it as a plugin
+		// name if it comes before the colon.
+		if i := strings.Index(h, "="); i != -1 && !strings.Contains(h[:i], ":") {
+			plugin, h = h[:i], h[i+1:]
+		}
+		split := strings.SplitN(h, ":", 2)
+		if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+			fatalUsage("Invalid header. Should be \"Name: Value\": %s", h)
+		}
+		plugins.AddHeader(plugin, strings.TrimSpace(split[0]), strings.TrimSpace(split[1]))
+	}
+
+	for _, ua := range userAgentFlags {
+		var plugin string
+		// Plugin names have no spaces or slashes, while user agents
+		// generally have both before any =.
+		if i := strings.Index(ua, "="); i != -1 && !strings.ContainsAny(ua[:i], " /") {
+			plugin, ua = ua[:i], ua[i+1:]
+		}
+		plugins.SetUserAgent(plugin, strings.TrimSpace(ua))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"net/http"
+	"time"
+)
+
+// How long the queue gets to respond to a health check before the daemon is
+// considered stuck.
+const healthTimeout = 5 * time.Second
+
+// The file written to check that the output is writable. It's never kept.
+const healthProbeFile = ".mindl-readyz"
+
+type healthResponse struct {
+	Status string `json:"status"`
+	// The result of each check, "ok" or what went wrong.
+	Checks map[string]string `json:"checks"`
+}
+
+// Whether the daemon is alive, meaning its queue isn't stuck. Orchestrators
+// should restart it if this fails.
+func (api *ApiServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	api.writeHealth(w, r, map[string]func() string{
+		"queue": api.checkQueue,
+	})
+}
+
+// Whether the daemon can take jobs, meaning that on top of the queue being
+// responsive, the output is writable and there are plugins to download with.
+func (api *ApiServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	api.writeHealth(w, r, map[string]func() string{
+		"queue":   api.checkQueue,
+		"storage": api.checkStorage,
+		"plugins": api.checkPlugins,
+	})
+}
+
+func (api *ApiServer) writeHealth(w http.ResponseWriter, r *http.Request, checks map[string]func() string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"Method not allowed."})
+		return
+	}
+
+	res := healthResponse{Status: "ok", Checks: make(map[string]string)}
+	status := http.StatusOK
+	for name, check := range checks {
+		res.Checks[name] = check()
+		if res.Checks[name] != "ok" {
+			res.Status = "failing"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, res)
+}
+
+func (api *ApiServer) checkQueue() string {
+	if !api.queue.Responsive(healthTimeout) {
+		return "The queue isn't responding."
+	} else if api.queue.Stopping() {
+		return "The queue is stopping."
+	}
+
+	return "ok"
+}
+
+// Writes a file to the output and throws it away.
+func (api *ApiServer) checkStorage() string {
+	storage, err := OpenStorage(api.queue.Directory)
+	if err != nil {
+		return err.Error()
+	}
+	w, err := storage.Create(healthProbeFile)
+	if err != nil {
+		return err.Error()
+	}
+	if _, err := w.Write([]byte("ok")); err != nil {
+		w.Abort()
+		return err.Error()
+	}
+	if err := w.Abort(); err != nil {
+		return err.Error()
+	}
+
+	return "ok"
+}
+
+func (api *ApiServer) checkPlugins() string {
+	if len(api.queue.plugins) == 0 {
+		return ErrNoPlugins.Error()
+	}
+
+	return "ok"
+}
+
+// Returns whether the queue's lock could be taken within the timeout, which
+// it can't if something's deadlocked while holding it.
+func (q *JobQueue) Responsive(timeout time.Duration) bool {
+	locked := make(chan struct{})
+	go func() {
+		q.m.Lock()
+		q.m.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Whether the queue has been told to stop and is waiting for its jobs to.
+func (q *JobQueue) Stopping() bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.stopping
+}
@@ -0,0 +1,223 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// A completed download in the history.
+type HistoryEntry struct {
+	// The canonical URL of the item if the plugin provides one.
+	URL    string      `json:"url"`
+	Plugin string      `json:"plugin"`
+	Files  []SavedFile `json:"files"`
+	Time   time.Time   `json:"time"`
+}
+
+// A log of every completed download. Entries are stored as JSON, one per
+// line, so adding one is just appending to the file.
+type History struct {
+	path string
+	// The URLs in the file, read when first needed, and how much of the
+	// file they were read from.
+	urls map[string]bool
+	size int64
+	m    sync.Mutex
+}
+
+func OpenHistory(path string) *History {
+	return &History{path: path}
+}
+
+// The default location of the history file, in the user's config directory.
+func DefaultHistoryPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "mindl-history.jsonl"
+	}
+
+	return filepath.Join(dir, "mindl", "history.jsonl")
+}
+
+// Returns the URL used to identify an item in the history.
+func CanonicalURL(p plugins.Plugin, url string) string {
+	if c, ok := p.(plugins.Canonicalizer); ok {
+		return c.CanonicalURL(url)
+	}
+
+	return strings.TrimSpace(url)
+}
+
+func (h *History) Add(entry *HistoryEntry) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	before, after, err := appendJSONLines(h.path, entry)
+	if err != nil {
+		return err
+	}
+	// Unless something else wrote to the file too, in which case the URLs
+	// are read again when needed.
+	if h.urls != nil && before == h.size {
+		h.urls[entry.URL] = true
+		h.size = after
+	}
+
+	return nil
+}
+
+// Returns every entry, oldest first.
+func (h *History) Entries() ([]*HistoryEntry, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	res := make([]*HistoryEntry, 0, 100)
+	_, err := readJSONLines(h.path, func(line []byte) {
+		var entry HistoryEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.WithField("path", h.path).Warnf("Skipping malformed history entry: %s", err)
+			return
+		}
+		res = append(res, &entry)
+	})
+
+	return res, err
+}
+
+// Whether or not the URL has been downloaded before. The URLs are only read
+// from the file the first time, and again if something else adds to it.
+func (h *History) Contains(url string) (bool, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.urls == nil || fileSize(h.path) != h.size {
+		urls := make(map[string]bool)
+		size, err := readJSONLines(h.path, func(line []byte) {
+			var entry struct {
+				URL string `json:"url"`
+			}
+			if json.Unmarshal(line, &entry) == nil {
+				urls[entry.URL] = true
+			}
+		})
+		if err != nil {
+			return false, err
+		}
+		h.urls, h.size = urls, size
+	}
+
+	return h.urls[url], nil
+}
+
+// Adds a successful download to the history if it's enabled.
+func recordHistory(p plugins.Plugin, url string, dm *DownloadManager) {
+	if history == nil || dm.Preview() {
+		return
+	}
+
+	entry := &HistoryEntry{
+		URL:    CanonicalURL(p, url),
+		Plugin: pluginName(p),
+		Files:  dm.SavedFiles(),
+		Time:   time.Now(),
+	}
+	span := plugins.StartSpan(dm.Span, "history")
+	err := history.Add(entry)
+	span.End(err)
+	if err != nil {
+		log.WithField("url", url).Errorf("Failed to add to the history: %s", err)
+	}
+}
+
+var (
+	// nil if the history is disabled.
+	history        *History
+	historyPath    string
+	noHistory      bool
+	historyJSON    bool
+	historyCommand = &Command{
+		Name:  "history",
+		Usage: "[flags] [search]",
+		Short: "List previous downloads, optionally only those with URLs or plugins matching a search.",
+		Flags: NewCommandFlags("history"),
+		Setup: SetupNone,
+	}
+)
+
+func init() {
+	historyCommand.Run = runHistory
+	commonFlags.StringVar(&historyPath, "history-file", DefaultHistoryPath(),
+		"The file in which the download history is kept.")
+	commonFlags.BoolVar(&noHistory, "no-history", false,
+		"Set to not record downloads in the history.")
+	historyCommand.Flags.BoolVar(&historyJSON, "json", false,
+		"Print the entries as JSON, one per line.")
+}
+
+func setupHistory() {
+	if !noHistory {
+		history = OpenHistory(historyPath)
+		stats = OpenStatsLog(StatsPath(historyPath))
+	}
+}
+
+func runHistory(args []string) {
+	entries, err := OpenHistory(historyPath).Entries()
+	if err != nil {
+		fatal(err)
+	}
+
+	search := strings.ToLower(strings.Join(args, " "))
+	enc := json.NewEncoder(os.Stdout)
+	for _, entry := range entries {
+		if search != "" && !strings.Contains(strings.ToLower(entry.URL), search) &&
+			!strings.Contains(strings.ToLower(entry.Plugin), search) {
+			continue
+		}
+
+		if historyJSON {
+			enc.Encode(entry)
+			continue
+		}
+		var size int64
+		for _, f := range entry.Files {
+			size += f.Size
+		}
+		fmt.Printf("%s  %-12s %4d file(s) %10s  %s\n", entry.Time.Local().Format("2006-01-02 15:04"),
+			entry.Plugin, len(entry.Files), formatBytes(size), entry.URL)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,81 @@
+package i18n
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// A tiny message catalog for user-facing CLI strings. Messages are looked up
+// by their English text, so anything missing from a catalog is just shown in
+// English and wrapping a string with T() never breaks anything.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Catalogs by language code. English is the source language and has none.
+var catalogs = map[string]map[string]string{
+	"ja": ja,
+}
+
+var lang = detectLanguage()
+
+// Gets the language from the environment: MINDL_LANG first, then the
+// usual POSIX locale variables. Values like "ja_JP.UTF-8" become "ja".
+func detectLanguage() string {
+	for _, env := range []string{"MINDL_LANG", "LC_ALL", "LC_MESSAGES", "LANG"} {
+		if val := os.Getenv(env); val != "" {
+			return normalize(val)
+		}
+	}
+
+	return "en"
+}
+
+func normalize(locale string) string {
+	if i := strings.IndexAny(locale, "_.@-"); i != -1 {
+		locale = locale[:i]
+	}
+	if locale == "C" || locale == "POSIX" {
+		return "en"
+	}
+
+	return strings.ToLower(locale)
+}
+
+// Sets the language by a code or locale like "ja" or "ja_JP.UTF-8".
+func SetLanguage(locale string) {
+	lang = normalize(locale)
+}
+
+func Language() string {
+	return lang
+}
+
+// Returns the translation of the message in the current language,
+// or the message itself if there is none.
+func T(msg string) string {
+	if translated, ok := catalogs[lang][msg]; ok {
+		return translated
+	}
+
+	return msg
+}
+
+// Translates the format string and then formats it like fmt.Sprintf().
+func Tf(format string, args ...interface{}) string {
+	return fmt.Sprintf(T(format), args...)
+}
@@ -0,0 +1,273 @@
+package i18n
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Japanese.
+var ja = map[string]string{
+	// Usage.
+	"Usage: mindl [command] [flags] [arguments]": "使い方: mindl [コマンド] [フラグ] [引数]",
+	"Commands:": "コマンド:",
+	"Flags:":    "フラグ:",
+	"Usage:":    "使い方:",
+	"If no command is given, \"%s\" is used.":                    "コマンドが指定されていない場合は「%s」が使われます。",
+	"Run \"mindl <command> --help\" for the flags of a command.": "各コマンドのフラグは「mindl <コマンド> --help」で確認できます。",
+
+	// Commands.
+	"Download from one or more URLs.":                                                        "一つ以上のURLからダウンロードします。",
+	"List the available plugins and their options.":                                          "利用可能なプラグインとそのオプションを一覧表示します。",
+	"Search for content using the plugins that support it.":                                  "対応しているプラグインでコンテンツを検索します。",
+	"Print metadata about items without downloading them.":                                   "ダウンロードせずに作品の情報を表示します。",
+	"Log in with a plugin to check the credentials, keeping the session for downloads.":      "プラグインでログインして認証情報を確認します。セッションはダウンロード用に保存されます。",
+	"Periodically check sources like series and download new items.":                         "シリーズなどを定期的にチェックし、新しい作品をダウンロードします。",
+	"Resume an interrupted download, or list them if no session is given.":                   "中断したダウンロードを再開します。セッションが指定されていない場合は一覧を表示します。",
+	"Run as a daemon that downloads queued jobs.":                                            "キューに入ったジョブをダウンロードするデーモンとして動作します。",
+	"List previous downloads, optionally only those with URLs or plugins matching a search.": "過去のダウンロードを一覧表示します。検索語でURLやプラグインを絞り込めます。",
+	"Store plugin options like passwords in the OS keyring.":                                 "パスワードなどのプラグインオプションをOSのキーリングに保存します。",
+	"Store plugin options like usernames and passwords in an encrypted file.":                "ユーザー名やパスワードなどのプラグインオプションを暗号化されたファイルに保存します。",
+	"Print a shell completion script.":                                                       "シェル補完スクリプトを出力します。",
+	"Update mindl to the latest release.":                                                    "mindlを最新のリリースに更新します。",
+	"Print the program version.":                                                             "バージョンを表示します。",
+
+	// Flags.
+	"A directory to watch for files with URLs, one per line, to queue.":       "URLを一行ずつ書いたファイルを監視してキューに追加するディレクトリ。",
+	"Check once and exit instead of checking periodically. Useful with cron.": "定期的にチェックせず、一度だけチェックして終了します。cronで使う場合に便利です。",
+	"How long to wait between checks.":                                        "チェックの間隔。",
+	"Watch the clipboard and download copied URLs.":                           "クリップボードを監視し、コピーされたURLをダウンロードします。",
+	"How often to check the clipboard.":                                       "クリップボードを確認する間隔。",
+	"Set to ask before queuing each copied URL.":                              "コピーされたURLをキューに入れる前に確認します。",
+	"Watching the clipboard for URLs. Copy one to download it.":               "クリップボードのURLを監視しています。コピーするとダウンロードされます。",
+	"Download %s?": "%sをダウンロードしますか？",
+	"Queued: %s":   "キューに追加しました: %s",
+	"Starting download of %s using \"%s\"...":                                                                                                          "「%[2]s」を使って%[1]sのダウンロードを開始しています...",
+	"How often to check the watched directory for new files.":                                                                                          "監視ディレクトリに新しいファイルがないか確認する間隔。",
+	"How to display progress: auto, bar, rich, tui, none or json.":                                                                                     "進捗の表示方法: auto、bar、rich、tui、none、json。",
+	"If set, API requests need an \"Authorization: Bearer <token>\" header.":                                                                           "設定すると、APIリクエストに「Authorization: Bearer <token>」ヘッダーが必要になります。",
+	"Write progress events as JSON lines to a file, a file descriptor (fd:3) or a socket (unix:/path or tcp:host:port), for wrappers and GUIs.":        "ラッパーやGUI向けに、進捗イベントをJSON Lines形式でファイル、ファイルディスクリプタ（fd:3）またはソケット（unix:/path、tcp:host:port）に書き出します。",
+	"Send traces of jobs, downloaders, HTTP requests and post-processing to an OpenTelemetry collector over OTLP/HTTP, e.g. http://localhost:4318.":    "ジョブ、ダウンローダー、HTTPリクエスト、後処理のトレースをOTLP/HTTPでOpenTelemetryコレクターに送信します（例: http://localhost:4318）。",
+	"A header to send to the OpenTelemetry collector as \"Name: Value\", e.g. for an API key. Can be repeated.":                                        "OpenTelemetryコレクターに送信するヘッダー（「Name: Value」形式、APIキーなど）。複数指定できます。",
+	"Save how fast downloads went every second to a file when done, as CSV if it ends in .csv and JSON otherwise.":                                     "終了時にダウンロード速度の毎秒の記録をファイルに保存します。.csvで終わる場合はCSV、それ以外はJSON形式。",
+	"Warn about workers that haven't received any data for this long. 0 turns it off.":                                                                 "この時間データを受信していないワーカーについて警告します。0で無効になります。",
+	"Set to abort and retry files that stalled workers are downloading. Only works for files plugins download straight from a URL.":                    "停止したワーカーがダウンロード中のファイルを中止して再試行します。プラグインがURLから直接ダウンロードするファイルにのみ有効です。",
+	"Only search using the plugin with this name.":                                                                                                     "この名前のプラグインだけで検索します。",
+	"Options in a key=value format passed to plugins for every job.":                                                                                   "全ジョブのプラグインに渡す key=value 形式のオプション。",
+	"Options in a key=value format passed to plugins.":                                                                                                 "プラグインに渡す key=value 形式のオプション。",
+	"Print the entries as JSON, one per line.":                                                                                                         "エントリーを一行ずつJSONで出力します。",
+	"Print the info as JSON, one item per line. Logs go to stderr.":                                                                                    "情報を一作品一行のJSONで出力します。ログは標準エラー出力に出ます。",
+	"Print the result as a JSON document to stdout when done. Logs go to stderr.":                                                                      "完了時に結果をJSONで標準出力に出力します。ログは標準エラー出力に出ます。",
+	"Print the results as a JSON document to stdout when done. Logs go to stderr.":                                                                     "完了時に結果をJSONで標準出力に出力します。ログは標準エラー出力に出ます。",
+	"Set to ZIP the files after each download finishes.":                                                                                               "ダウンロードが終わるたびにファイルをZIPにまとめます。",
+	"Set to ZIP the files after each job finishes.":                                                                                                    "ジョブが終わるたびにファイルをZIPにまとめます。",
+	"Set to ZIP the files after the download finishes.":                                                                                                "ダウンロード完了後にファイルをZIPにまとめます。",
+	"The file extension of ZIP files made with --zip, e.g. cbz for comic book readers.":                                                                "--zipで作るZIPファイルの拡張子。コミックビューア向けにはcbzなど。",
+	"Files can't be added to an archive that's already uploaded, so everything is downloaded again.":                                                   "アップロード済みのアーカイブにはファイルを追加できないため、すべて再ダウンロードします。",
+	"Don't look up unset credentials in the OS keyring.":                                                                                               "未設定の認証情報をOSのキーリングから探しません。",
+	"The name of the account to use with plugins, for keeping the options and cookies of several accounts apart.":                                      "プラグインで使うアカウントの名前。複数のアカウントのオプションやクッキーを分けて保存するためのもの。",
+	"The encrypted file plugin options are stored in with the auth command.":                                                                           "authコマンドでプラグインオプションが保存される暗号化されたファイル。",
+	"The passphrase of the credentials file. Preferably set with MINDL_CREDENTIALS_PASSPHRASE. Without one, the file's key is kept in the OS keyring.": "認証情報ファイルのパスフレーズ。MINDL_CREDENTIALS_PASSPHRASEで設定することを推奨します。指定しない場合、ファイルの鍵はOSのキーリングに保存されます。",
+	"Set to not keep plugins' cookies, like login sessions, between runs.":                                                                             "ログインセッションなどのプラグインのクッキーを実行間で保持しません。",
+	"Set to not record downloads in the history.":                                                                                                      "ダウンロードを履歴に記録しません。",
+	"Set to only display warnings and errors.":                                                                                                         "警告とエラーのみを表示します。",
+	"Set to only connect to sites over IPv4.":                                                                                                          "サイトへの接続にIPv4のみを使います。",
+	"Set to only connect to sites over IPv6.":                                                                                                          "サイトへの接続にIPv6のみを使います。",
+	"Set to only print how many files and roughly how much data each URL would download.":                                                              "各URLでダウンロードされるファイル数とおおよそのデータ量だけを表示します。",
+	"Show a desktop notification when a download finishes or fails.":                                                                                   "ダウンロードの完了時や失敗時にデスクトップ通知を表示します。",
+	"Import cookies from a browser (firefox, chrome or chromium), letting plugins reuse its logged in sessions instead of logging in.":                 "ブラウザ（firefox、chrome、chromium）からクッキーを読み込み、プラグインがログインする代わりにブラウザのセッションを使えるようにします。",
+	"A proxy URL for plugins to use, or \"direct\" for none. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated, in which case plugins rotate between the proxies.": "プラグインが使うプロキシのURL。使わない場合は「direct」。「プラグイン名=」を前に付けるとそのプラグインのみに使います。複数指定でき、その場合はプロキシを順番に使います。",
+	"How to rotate between several proxies: round-robin for a different one every request, or sticky to keep using the same one for a site until it stops working.":                         "複数のプロキシの使い方。round-robinはリクエストごとに別のプロキシを、stickyは動かなくなるまでサイトごとに同じプロキシを使います。",
+	"Route plugin traffic through Tor's SOCKS port at the given address, with a separate circuit for every job.":                                                                            "プラグインの通信を指定したアドレスのTorのSOCKSポート経由にします。ジョブごとに別の回線を使います。",
+	"The URL of a FlareSolverr instance to solve anti-bot challenges like Cloudflare's with, e.g. http://localhost:8191.":                                                                   "Cloudflareなどのボット対策チャレンジを解くFlareSolverrのURL。例: http://localhost:8191",
+	"How long to let FlareSolverr try to solve a challenge.":                                                                                                                                "FlareSolverrがチャレンジを解くのを待つ時間。",
+	"Cache API responses and pages in the given directory, and only ask the server whether they changed when they're needed again.":                                                         "APIのレスポンスやページを指定したディレクトリにキャッシュし、再び必要になったときは変更があったかだけをサーバーに確認します。",
+	"Hand the transfer of plain files to a running aria2c through its JSON-RPC at the given URL.":                                                                                           "通常のファイルの転送を、指定したURLのJSON-RPCを通じて実行中のaria2cに任せます。",
+	"The secret token set with aria2c's --rpc-secret.":                                                                                                                                      "aria2cの--rpc-secretで設定したシークレットトークン。",
+	"The client ID of a Google OAuth client of the \"TVs and Limited Input devices\" type, for saving to Google Drive.":                                                                     "Google Driveに保存するための、「テレビと入力が限られたデバイス」タイプのGoogle OAuthクライアントのクライアントID。",
+	"The client secret of the Google OAuth client.":                                                                                                                                         "Google OAuthクライアントのクライアントシークレット。",
+	"To let mindl use %s, go to %s and enter the code: %s":                                                                                                                                  "mindlが%sを使えるようにするには、%sにアクセスしてコードを入力してください: %s",
+	"To let mindl use %s, open %s in a browser on this computer.":                                                                                                                           "mindlが%sを使えるようにするには、このコンピューターのブラウザで%sを開いてください。",
+	"The app key of a Dropbox app, for saving to Dropbox.":                                                                                                                                  "Dropboxに保存するための、DropboxアプリのApp key。",
+	"The rclone executable to use for outputs like remote:path.":                                                                                                                            "remote:pathのような出力先に使うrcloneの実行ファイル。",
+	"The directory for temporary files. By default, they're kept in the output directory if it's local, so that they can be moved instead of copied.":                                       "一時ファイルを置くディレクトリ。デフォルトでは、コピーではなく移動できるように、ローカルの出力先ディレクトリに置かれます。",
+	"How much space temporary files may take up, like 2G. Workers wait for others to finish when there's no more room.":                                                                     "一時ファイルが使える容量（2Gなど）。空きがなくなると、ワーカーは他のワーカーが終わるのを待ちます。",
+	"Set to keep a single copy of identical files, even across downloads, by linking them to a store. Can be hardlink or symlink.":                                                          "同一のファイルをストアへのリンクにして、ダウンロードをまたいでも1つだけ保持します。hardlinkかsymlinkを指定できます。",
+	"The directory in which --dedup keeps files. Defaults to .store in the output directory.":                                                                                               "--dedupがファイルを保持するディレクトリ。デフォルトは出力先ディレクトリの.store。",
+	"Remove files from the dedup store that are no longer in any output directory using it.":                                                                                                "重複排除ストアを使うどの出力先ディレクトリにもないファイルをストアから削除します。",
+	"Set to only print what would be removed.":                                                                                                                                              "削除されるものを表示するだけにします。",
+	"Stop a download once its files add up to more than this, like 10G. In a terminal, you're asked whether to keep going instead, unless --no-prompt is on.":                               "ファイルの合計がこのサイズ（10Gなど）を超えたらダウンロードを止めます。端末では、--no-promptでない限り、続けるかどうか尋ねます。",
+	"The download is already %s, which is more than --max-size. Keep going?":                                                                                                                "ダウンロードはすでに%sで、--max-sizeを超えています。続けますか？",
+	"Stopping since the download is bigger than %s.":                                                                                                                                        "ダウンロードが%sを超えたため停止します。",
+	"List saved files, optionally only those with paths or URLs matching a search.":                                                                                                         "保存したファイルを一覧表示します。検索語を指定すると、パスかURLが一致するものだけを表示します。",
+	"The file in which every saved file is indexed.":                                                                                                                                        "保存したすべてのファイルを記録するファイル。",
+	"Set to not add saved files to the file index.":                                                                                                                                         "保存したファイルをファイルインデックスに追加しません。",
+	"Only list files with this SHA-256 hash.":                                                                                                                                               "このSHA-256ハッシュを持つファイルだけを表示します。",
+	"Set to only list files that have the same contents as another file.":                                                                                                                   "他のファイルと同じ内容のファイルだけを表示します。",
+	"Print the files as JSON, one per line.":                                                                                                                                                "ファイルを1行に1つずつJSONで出力します。",
+	"What to do when two files in a download have the same path: suffix to add a number to the name, error to stop, or overwrite.":                                                          "ダウンロード内の2つのファイルが同じパスになった場合の処理: suffixは名前に番号を付け、errorは停止し、overwriteは上書きします。",
+	"Saving %s as %s, since another file in the download has the same path.":                                                                                                                "ダウンロード内の別のファイルと同じパスのため、%sを%sとして保存します。",
+	"Total: %d file(s), %s\n":                                   "合計: %d個のファイル、%s\n",
+	"%s wants a two-factor authentication code.":                "%sが二段階認証のコードを求めています。",
+	"Only local output directories can have a dedup store.":     "重複排除ストアはローカルの出力先ディレクトリでのみ使えます。",
+	"Would remove %d file(s), freeing %s.":                      "%d個のファイルを削除し、%sを解放します。",
+	"Removed %d file(s), freeing %s.":                           "%d個のファイルを削除し、%sを解放しました。",
+	"To let mindl use %s, go to %s and paste the code you get.": "mindlが%sを使えるようにするには、%sにアクセスして表示されたコードを貼り付けてください。",
+	"Code":                                 "コード",
+	"Confirm":                              "確認",
+	"The entries didn't match. Try again.": "入力が一致しませんでした。もう一度入力してください。",
+	"Passphrase for the credentials file":  "認証情報ファイルのパスフレーズ",
+	"Nothing was changed.":                 "何も変更されませんでした。",
+	"Saved the credentials to: %s":         "認証情報を保存しました: %s",
+	"(stored)":                             "（保存済み）",
+	"The URL of an S3-compatible server, like MinIO, to use instead of AWS.":                                                                                "AWSの代わりに使う、MinIOなどのS3互換サーバーのURL。",
+	"The region of the S3 bucket. Defaults to $AWS_REGION or us-east-1.":                                                                                    "S3バケットのリージョン。デフォルトは$AWS_REGIONまたはus-east-1。",
+	"The password for a WebDAV output, if it's not in the URL. Preferably set with MINDL_WEBDAV_PASSWORD.":                                                  "URLに含まれていない場合のWebDAV出力先のパスワード。MINDL_WEBDAV_PASSWORDで設定することを推奨します。",
+	"The private key to log in to an SFTP output with. Defaults to ssh-agent or the usual keys in ~/.ssh.":                                                  "SFTP出力先へのログインに使う秘密鍵。デフォルトはssh-agentまたは~/.sshの通常の鍵。",
+	"The passphrase of the SFTP key, if it has one. Preferably set with MINDL_SFTP_KEY_PASSPHRASE.":                                                         "SFTPの鍵のパスフレーズ（ある場合）。MINDL_SFTP_KEY_PASSPHRASEで設定することを推奨します。",
+	"The known_hosts file to verify SFTP servers with. Defaults to ~/.ssh/known_hosts.":                                                                     "SFTPサーバーの検証に使うknown_hostsファイル。デフォルトは~/.ssh/known_hosts。",
+	"The password for an FTP output, if it's not in the URL. Preferably set with MINDL_FTP_PASSWORD.":                                                       "URLに含まれていない場合のFTP出力先のパスワード。MINDL_FTP_PASSWORDで設定することを推奨します。",
+	"Set to false for FTP servers or firewalls that don't handle extended passive mode.":                                                                    "拡張パッシブモードに対応していないFTPサーバーやファイアウォールではfalseに設定します。",
+	"The URL of a captcha solving service with a 2Captcha-compatible API, e.g. https://2captcha.com. Without one, you're asked to solve captchas yourself.": "2Captcha互換のAPIを持つキャプチャ解決サービスのURL。例: https://2captcha.com 。指定しない場合は自分でキャプチャを解くよう求められます。",
+	"The API key for the captcha solving service.":                                                                                                          "キャプチャ解決サービスのAPIキー。",
+	"How long to wait for the captcha solving service.":                                                                                                     "キャプチャ解決サービスを待つ時間。",
+	"Log in through Chrome, Chromium or Edge when a plugin's own login fails. Takes the path to the browser, or finds one without it.":                      "プラグイン自体のログインに失敗した場合、Chrome、Chromium、Edgeでログインします。ブラウザのパスを指定するか、省略すると自動で探します。",
+	"Set to run the login browser without a window. Logins that need you, like ones with captchas, then time out.":                                          "ログイン用のブラウザをウィンドウなしで実行します。キャプチャなど操作が必要なログインはタイムアウトします。",
+	"How long to wait for a login in the browser.":                                                                                                          "ブラウザでのログインを待つ時間。",
+	"Solve the captcha at %s in a browser, then paste the response token from the page's %s field.":                                                         "ブラウザで%sのキャプチャを解き、ページの%sフィールドのレスポンストークンを貼り付けてください。",
+	"The captcha has been saved to %s.":                                                                                                                     "キャプチャを%sに保存しました。",
+	"Token":                                                                                                                                                 "トークン",
+	"Answer":                                                                                                                                                "答え",
+	"How many times to retry requests that fail because of network or server errors.":                                                                       "ネットワークやサーバーのエラーで失敗したリクエストを再試行する回数。",
+	"How long to wait before the first retry. The wait doubles with every retry.":                                                                           "最初の再試行までの待ち時間。再試行のたびに倍になります。",
+	"How many idle connections to keep open per host for reuse.":                                                                                            "再利用のためにホストごとに開いておくアイドル接続の数。",
+	"How long idle connections are kept open for reuse, 90s by default. 0 turns reusing connections off. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.":                           "アイドル接続を再利用のために開いておく時間。デフォルトは90秒。0で接続の再利用を無効にします。「Plugin=」を前に付けるとそのプラグインだけに使います。複数指定できます。",
+	"The most requests per second a plugin can send, e.g. 2 or 0.5. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.":                                                                "プラグインが1秒間に送れるリクエストの最大数。例: 2、0.5。「Plugin=」を前に付けるとそのプラグインだけに使います。複数指定できます。",
+	"How long to wait for connections to be made, 30s by default. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.":                                                                  "接続が確立されるまで待つ時間。デフォルトは30秒。「Plugin=」を前に付けるとそのプラグインだけに使います。複数指定できます。",
+	"How long to wait for TLS handshakes, 10s by default. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.":                                                                          "TLSハンドシェイクを待つ時間。デフォルトは10秒。「Plugin=」を前に付けるとそのプラグインだけに使います。複数指定できます。",
+	"How long to wait for the response after sending a request, with no limit by default. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.":                                          "リクエストを送ってからレスポンスを待つ時間。デフォルトでは無制限です。「Plugin=」を前に付けるとそのプラグインだけに使います。複数指定できます。",
+	"How long every attempt at a request can take, including reading the response. Plugins pick their own by default, usually 20s. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.": "レスポンスの読み込みを含め、リクエストの各試行にかけられる時間。デフォルトはプラグインごとに決まっており、通常は20秒です。「Plugin=」を前に付けるとそのプラグインだけに使います。複数指定できます。",
+	"Record the HTTP traffic of plugins to a HAR file for debugging. Passwords and cookies are redacted.":                                                                                                       "デバッグのためにプラグインのHTTP通信をHARファイルに記録します。パスワードとクッキーは伏せられます。",
+	"How many bytes of each request and response body to record in the HAR file. 0 leaves bodies out.":                                                                                                          "HARファイルに記録する各リクエストとレスポンスの本文のバイト数。0で本文を記録しません。",
+	"A PEM file with CA certificates to trust on top of the system's. Can be repeated.":                                                                                                                         "システムのものに加えて信頼するCA証明書のPEMファイル。複数指定できます。",
+	"Only accept certificates with a specific public key for a host, given as host=sha256/<base64 hash>. Can be repeated.":                                                                                      "ホストに対して特定の公開鍵を持つ証明書のみを受け付けます。host=sha256/<base64ハッシュ>の形式で指定します。複数指定できます。",
+	"Set to not verify TLS certificates at all. Only for debugging, since anyone in between can read and change the traffic.":                                                                                   "TLS証明書を一切検証しません。通信を途中で読み取られたり改ざんされたりする恐れがあるため、デバッグ専用です。",
+	"A DNS server to look up hosts with instead of the system's, e.g. 1.1.1.1.":                                                                                                                                 "システムの代わりにホスト名の解決に使うDNSサーバー。例: 1.1.1.1",
+	"The URL of a DNS-over-HTTPS resolver to look up hosts with, e.g. https://1.1.1.1/dns-query.":                                                                                                               "ホスト名の解決に使うDNS over HTTPSリゾルバーのURL。例: https://1.1.1.1/dns-query",
+	"The most connections to have open at the same time across all plugins and jobs. 0 means no limit.":                                                                                                         "すべてのプラグインとジョブで同時に開く接続の最大数。0は無制限。",
+	"Use HTTP/2 with servers that support it. Use --http2=false to turn it off.":                                                                                                                                "対応しているサーバーとHTTP/2を使います。無効にするには--http2=falseを使います。",
+	"A header to add to every request, e.g. \"Accept-Language: ja\". Prefix it with \"Plugin=\" to only add it for that plugin. Can be repeated.":                                                               "すべてのリクエストに追加するヘッダー。例:「Accept-Language: ja」。「プラグイン名=」を前に付けるとそのプラグインのみに追加します。複数指定できます。",
+	"The user agent to use, either firefox, chrome, edge, safari, iphone or a custom one. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.":                                          "使用するユーザーエージェント。firefox、chrome、edge、safari、iphoneまたは任意の文字列。「プラグイン名=」を前に付けるとそのプラグインのみに使います。複数指定できます。",
+	"Set to only check if there's a newer release.":                                                      "新しいリリースがあるかどうかだけを確認します。",
+	"Set to update even if already up to date.":                                                          "最新の場合でも更新します。",
+	"Set to skip URLs that are already in the download history.":                                         "ダウンロード履歴にあるURLをスキップします。",
+	"Set to turn off prompts for options and instead throw an error if a required option is left unset.": "オプションの入力を求めず、必須オプションが未設定の場合はエラーにします。",
+	"Set to use default values for options whenever possible. No effect if --no-prompt is on.":           "可能な限りオプションのデフォルト値を使います。--no-prompt が有効な場合は効果がありません。",
+	"Set to display debug messages. Use -vv to also display every HTTP request.":                         "デバッグメッセージを表示します。-vv ですべてのHTTPリクエストも表示します。",
+	"The address to serve the HTTP API on, e.g. 127.0.0.1:8420. Disabled if empty.":                      "HTTP APIを提供するアドレス（例: 127.0.0.1:8420）。空の場合は無効です。",
+	"The directory in which to save the downloaded files. ~ and environment variables are expanded. Can also be a URL to save somewhere else, like s3://bucket/prefix.": "ダウンロードしたファイルの保存先ディレクトリ。~ と環境変数は展開されます。s3://bucket/prefix のようなURLを指定して他の場所に保存することもできます。",
+	"The file in which the download history is kept.":                                        "ダウンロード履歴を保存するファイル。",
+	"The file the job queue is saved to, letting the daemon resume after a restart.":         "ジョブキューを保存するファイル。再起動後にデーモンが再開できるようになります。",
+	"The file to keep track of what has already been downloaded in.":                         "ダウンロード済みの作品を記録するファイル。",
+	"The file with the user's profiles.":                                                     "ユーザーのプロファイルを記述したファイル。",
+	"The name of a profile to use, which sets flags and options not set otherwise.":          "使用するプロファイル名。他で指定されていないフラグとオプションを設定します。",
+	"The number of jobs to run at the same time.":                                            "同時に実行するジョブの数。",
+	"The number of workers to use per job.":                                                  "ジョブごとのワーカー数。",
+	"The number of workers to use.":                                                          "ワーカー数。",
+	"When a source is checked for the first time, only download items published after that.": "初めてチェックするソースでは、それ以降に公開された作品だけをダウンロードします。",
+	"Write logs, including debug messages, as JSON to the given file.":                       "デバッグメッセージを含むログをJSONで指定したファイルに書き込みます。",
+
+	// Scheduled sources.
+	"The file scheduled sources and what has been queued from them are saved to.":                                           "スケジュールされたソースと、そこからキューに入れたものを保存するファイル。",
+	"A source to check on a cron-style schedule, e.g. \"0 3 * * * <url>\" to check it every day at 03:00. Can be repeated.": "cron形式のスケジュールで確認するソース。例えば「0 3 * * * <url>」で毎日03:00に確認します。複数指定できます。",
+	"When a scheduled source is checked for the first time, only queue items published after that.":                         "スケジュールされたソースを初めて確認するとき、それ以降に公開されたアイテムのみをキューに入れます。",
+
+	// Prompts.
+	"Found multiple handlers. Please select one:": "対応するプラグインが複数見つかりました。一つ選んでください:",
+	"Desired plugin: ":                          "使用するプラグイン: ",
+	"The plugin \"%s\" has required option(s):": "プラグイン「%s」には必須オプションがあります:",
+	"The plugin \"%s\" has option(s):":          "プラグイン「%s」にはオプションがあります:",
+
+	// Downloading.
+	"Processing URL: %s":                                     "処理中のURL: %s",
+	"Skipping URL already in the history: %s":                "履歴にあるURLをスキップします: %s",
+	"Estimating download using \"%s\"...":                    "「%s」でダウンロードを見積もっています...",
+	"Starting download using \"%s\"...":                      "「%s」でダウンロードを開始します...",
+	"The download can be resumed with: mindl resume %s":      "次のコマンドでダウンロードを再開できます: mindl resume %s",
+	"Done! Got a total of %d downloads.":                     "完了！合計%d件をダウンロードしました。",
+	"%d request(s), %s in %s.":                               "%d件のリクエスト、%s（%s）。",
+	"%d request(s), %s on average, 95%% within %s.":          "%d件のリクエスト、平均%s、95%%が%s以内。",
+	"Resuming %s with %d downloader(s) already done...":      "%sを再開します（%d件は完了済み）...",
+	"There are no interrupted sessions.":                     "中断したセッションはありません。",
+	"Interrupted! Cleaning up...":                            "中断されました！後片付けをしています...",
+	"Canceled! Cleaning up...":                               "キャンセルされました！後片付けをしています...",
+	"Cleaning up early due to an error...":                   "エラーのため後片付けをしています...",
+	"Cleaning up...":                                         "後片付けをしています...",
+	"Logging in with \"%s\"...":                              "「%s」でログインしています...",
+	"Logged in! The session is kept for the next downloads.": "ログインしました！セッションは次のダウンロードのために保存されます。",
+	"Logged in!": "ログインしました！",
+	"The session seems to have expired. Renewing it...": "セッションの有効期限が切れたようです。更新しています...",
+	"Zipping files to: %s":                              "ZIPにまとめています: %s",
+
+	// Resuming without saved credentials.
+	"The session needs the plugin \"%s\"'s credentials again:": "セッションを再開するにはプラグイン「%s」の認証情報をもう一度入力してください：",
+
+	// Summaries.
+	"%d file(s), %s in %s at %s with %d retries.":                         "%d件のファイル、%s（%s、%s、リトライ%d回）。",
+	"Summary: %d job(s), %d done, %d failed, %d canceled and %d skipped.": "概要: ジョブ%d件（完了%d件、失敗%d件、キャンセル%d件、スキップ%d件）。",
+
+	// Stalls.
+	"No data for %s. Retrying...":                       "%sの間データがありません。再試行しています...",
+	"No data for %s. The worker seems to have stalled.": "%sの間データがありません。ワーカーが停止したようです。",
+
+	// Stats.
+	"Show how often downloads with each plugin succeeded, how fast they were and how many retries they needed.": "プラグインごとのダウンロードの成功率、速度、リトライ回数を表示します。",
+	"Only count jobs that finished within this long, like 168h for the last week. 0 for all of them.":           "この期間内に終わったジョブだけを数えます。例えば168hで直近1週間。0ですべて。",
+	"Print the stats as a JSON array.": "統計をJSONの配列で出力します。",
+	"No jobs have been recorded yet.":  "まだジョブが記録されていません。",
+
+	// Log rotation.
+	"Start a new --log-file once it would grow past this, like 100M. 0 for no limit.":  "--log-fileがこれより大きくなる前に新しいファイルにします。例: 100M。0で無制限。",
+	"Start a new --log-file after writing to it for this long, like 24h. 0 for never.": "--log-fileにこの期間書き込んだら新しいファイルにします。例: 24h。0で無効。",
+	"How many old log files to keep once --log-file is rotated. 0 keeps all of them.":  "--log-fileをローテーションしたときに残す古いログファイルの数。0ですべて残します。",
+	"Delete old log files once they're older than this, like 720h. 0 for no limit.":    "これより古いログファイルを削除します。例: 720h。0で無制限。",
+
+	// TUI.
+	"Pausing the download...":              "ダウンロードを一時停止しています...",
+	"Resuming the download...":             "ダウンロードを再開しています...",
+	"Canceling the download...":            "ダウンロードをキャンセルしています...",
+	"Canceling the remaining downloads...": "残りのダウンロードをキャンセルしています...",
+	"%d/%d jobs":                           "ジョブ %d/%d",
+	"PAUSED":                               "一時停止中",
+	"Quitting...":                          "終了しています...",
+	"waiting":                              "待機中",
+	"running":                              "実行中",
+	"done (%d files)":                      "完了（%d件）",
+	"p: pause/resume | c: cancel the current job | q: quit": "p: 一時停止/再開 | c: 現在のジョブをキャンセル | q: 終了",
+
+	// Dry runs.
+	"%s\n    Failed: %s\n":               "%s\n    失敗: %s\n",
+	"%s\n    %d file(s), unknown size\n": "%s\n    %d個のファイル、サイズ不明\n",
+	"%s\n    %d file(s), ~%s\n":          "%s\n    %d個のファイル、約%s\n",
+	"Total: %d file(s), unknown size\n":  "合計: %d個のファイル、サイズ不明\n",
+	"Total: %d file(s), more than ~%s\n": "合計: %d個のファイル、約%s以上\n",
+	"Total: %d file(s), ~%s\n":           "合計: %d個のファイル、約%s\n",
+
+	// Info.
+	"Title":       "タイトル",
+	"Volume":      "巻",
+	"Authors":     "著者",
+	"Pages":       "ページ数",
+	"Chapter %d":  "第%d章",
+	"Description": "あらすじ",
+}
@@ -0,0 +1,523 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/MinoMino/mindl/plugins"
+)
+
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = StatusDone
+	JobFailed   = StatusFailed
+	JobCanceled = StatusCanceled
+)
+
+var (
+	ErrJobNotFound  = errors.New("No job with that ID.")
+	ErrJobFinished  = errors.New("The job has already finished.")
+	ErrNoSuchPlugin = errors.New("No plugin by that name can handle the URL.")
+	ErrJobDirectory = errors.New("A job's directory must be a relative path inside the output directory.")
+)
+
+// A download queued in the daemon.
+type Job struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// The name of the plugin to use if several can handle the URL.
+	// If empty, the first one is used.
+	Plugin string `json:"plugin,omitempty"`
+	// Plugin options for this job on top of the daemon's.
+	Options map[string]string `json:"options,omitempty"`
+	// Overrides the daemon's output directory if set.
+	Directory string     `json:"directory,omitempty"`
+	Status    string     `json:"status"`
+	Added     time.Time  `json:"added"`
+	Result    *JobResult `json:"result,omitempty"`
+}
+
+// A queue of jobs that is saved to disk whenever it changes, letting the
+// daemon pick up where it left off after a restart.
+type JobQueue struct {
+	// Options used for every job. Job options take precedence.
+	Options   map[string]string
+	Directory string
+	Workers   int
+	Zip       bool
+	MaxSize   int64
+	jobs      []*Job
+	path      string
+	nextID    int
+	running   map[string]*DownloadManager
+	// See the fields of the same name in DownloadManager.
+	StallTimeout   time.Duration
+	RestartStalled bool
+	// Status changes of jobs and the progress of running ones.
+	Events *EventHub
+	// Plugins keep their options in themselves, so only one job
+	// can use a particular plugin at a time.
+	pluginLocks map[Plugin]*sync.Mutex
+	plugins     PluginManager
+	wake        chan struct{}
+	stopping    bool
+	m           sync.Mutex
+}
+
+// Creates a queue that persists itself to the file at path, loading any
+// jobs already in it. Jobs that were running when the daemon stopped are
+// queued again.
+func NewJobQueue(path string, ps []Plugin) (*JobQueue, error) {
+	q := &JobQueue{
+		path:        path,
+		nextID:      1,
+		running:     make(map[string]*DownloadManager),
+		pluginLocks: make(map[Plugin]*sync.Mutex),
+		plugins:     PluginManager(ps),
+		wake:        make(chan struct{}, 1),
+		Events:      NewEventHub(),
+	}
+	for _, p := range ps {
+		q.pluginLocks[p] = &sync.Mutex{}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &q.jobs); err != nil {
+		return nil, fmt.Errorf("Failed to load the job queue: %s", err)
+	}
+	for _, job := range q.jobs {
+		if job.Status == JobRunning {
+			job.Status = JobQueued
+		}
+		if id, err := strconv.Atoi(job.ID); err == nil && id >= q.nextID {
+			q.nextID = id + 1
+		}
+	}
+
+	return q, nil
+}
+
+// Adds a job to the end of the queue.
+func (q *JobQueue) Add(url, plugin string, options map[string]string, directory string) (*Job, error) {
+	if _, err := jobDirectory(q.Directory, directory); err != nil {
+		return nil, err
+	}
+	url = strings.TrimSpace(url)
+	if handlers := q.plugins.FindHandlers([]string{url}); len(handlers[0]) == 0 {
+		return nil, ErrNoPlugins
+	}
+
+	q.m.Lock()
+	job := &Job{
+		ID:        strconv.Itoa(q.nextID),
+		URL:       url,
+		Plugin:    plugin,
+		Options:   options,
+		Directory: directory,
+		Status:    JobQueued,
+		Added:     time.Now(),
+	}
+	q.nextID++
+	q.jobs = append(q.jobs, job)
+	q.Events.Publish(jobEvent(job))
+	err := q.save()
+	q.m.Unlock()
+
+	log.WithField("job", job.ID).Infof("Queued: %s", url)
+	q.notify()
+	return job, err
+}
+
+// Returns a copy of the job with the given ID.
+func (q *JobQueue) Get(id string) (Job, error) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for _, job := range q.jobs {
+		if job.ID == id {
+			return *job, nil
+		}
+	}
+
+	return Job{}, ErrJobNotFound
+}
+
+// Returns copies of all jobs in the order they were added.
+func (q *JobQueue) Jobs() []Job {
+	q.m.Lock()
+	defer q.m.Unlock()
+	res := make([]Job, len(q.jobs))
+	for i, job := range q.jobs {
+		res[i] = *job
+	}
+
+	return res
+}
+
+// Returns the progress of a job if it's currently downloading.
+func (q *JobQueue) Progress(id string) (Progress, bool) {
+	q.m.Lock()
+	dm, ok := q.running[id]
+	q.m.Unlock()
+	if !ok {
+		return Progress{}, false
+	}
+
+	return dm.Progress(), true
+}
+
+// Cancels a job. Queued jobs are never started, and running ones are stopped.
+func (q *JobQueue) Cancel(id string) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for _, job := range q.jobs {
+		if job.ID != id {
+			continue
+		}
+
+		switch job.Status {
+		case JobQueued:
+			job.Status = JobCanceled
+			q.Events.Publish(jobEvent(job))
+			return q.save()
+		case JobRunning:
+			// The runner sets the status when the manager returns. If it hasn't
+			// started downloading yet, it checks the status before it does.
+			if dm, ok := q.running[id]; ok {
+				dm.Cancel()
+			} else {
+				job.Status = JobCanceled
+				q.Events.Publish(jobEvent(job))
+			}
+			return nil
+		default:
+			return ErrJobFinished
+		}
+	}
+
+	return ErrJobNotFound
+}
+
+// Runs queued jobs, at most concurrency at a time, until stop is closed.
+// Running jobs are canceled and put back in the queue when stopping.
+func (q *JobQueue) Run(concurrency int, stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-stop:
+			q.stopAll()
+			wg.Wait()
+			return
+		}
+
+		job := q.next()
+		for job == nil {
+			select {
+			case <-q.wake:
+				job = q.next()
+			case <-stop:
+				q.stopAll()
+				wg.Wait()
+				return
+			}
+		}
+
+		wg.Add(1)
+		go func(job *Job) {
+			defer func() {
+				<-slots
+				wg.Done()
+				// A slot opened up, so check the queue again.
+				q.notify()
+			}()
+			q.run(job)
+		}(job)
+	}
+}
+
+// Takes the next queued job and marks it as running.
+func (q *JobQueue) next() *Job {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for _, job := range q.jobs {
+		if job.Status == JobQueued {
+			job.Status = JobRunning
+			q.Events.Publish(jobEvent(job))
+			if err := q.save(); err != nil {
+				log.Error(err)
+			}
+			return job
+		}
+	}
+
+	return nil
+}
+
+func (q *JobQueue) run(job *Job) {
+	jlog := log.WithField("job", job.ID)
+	res := NewJobResult(job.URL)
+	status, err := q.download(job, res)
+	res.Finish(err)
+	if status == JobCanceled {
+		jlog.Info("Canceled.")
+	} else if err != nil {
+		jlog.Errorf("Failed: %s", err)
+		jlog.Info(res.Summary())
+	} else {
+		jlog.Infof("Done! Got a total of %d downloads.", len(res.Files))
+		jlog.Info(res.Summary())
+		logHostStats(jlog, res.Hosts)
+	}
+
+	q.m.Lock()
+	requeue := q.stopping && status == JobCanceled
+	if requeue {
+		// Stopped by a shutdown, so run it again next time.
+		job.Status = JobQueued
+		job.Result = nil
+	} else {
+		job.Status = status
+		job.Result = res
+	}
+	q.Events.Publish(jobEvent(job))
+	if err := q.save(); err != nil {
+		jlog.Error(err)
+	}
+	q.m.Unlock()
+
+	if !requeue {
+		notifyResult(res)
+		recordStats(res)
+	}
+}
+
+func (q *JobQueue) download(job *Job, res *JobResult) (status string, err error) {
+	p, err := q.selectPlugin(job)
+	if err != nil {
+		return JobFailed, err
+	}
+	res.Plugin = pluginName(p)
+	defer q.lockPlugin(p)()
+	// Waiting for the plugin can take a while, and the queue might have
+	// started shutting down in the meantime.
+	q.m.Lock()
+	stopping := q.stopping
+	q.m.Unlock()
+	if stopping {
+		return JobCanceled, ErrCanceled
+	}
+	span := StartSpan(nil, "job")
+	span.SetAttribute("mindl.job", job.ID)
+	defer func() { span.End(err) }()
+
+	// Plugins tend to panic on errors, and one job shouldn't take the daemon down.
+	defer func() {
+		if r := recover(); r != nil {
+			status, err = JobFailed, &PanicError{r}
+		}
+	}()
+
+	defer saveOptions(p)()
+	if err := q.setOptions(p, job.Options); err != nil {
+		return JobFailed, err
+	}
+
+	dir, err := jobDirectory(q.Directory, job.Directory)
+	if err != nil {
+		return JobFailed, err
+	}
+	dm := NewDownloadManager(p, dir)
+	dm.Interrupt = nil
+	dm.HashFiles = history != nil || fileIndex != nil
+	dm.Dedup = OpenDedupStore(dir)
+	dm.MaxSize = q.MaxSize
+	dm.StallTimeout = q.StallTimeout
+	dm.RestartStalled = q.RestartStalled
+	dm.Span = span
+	q.m.Lock()
+	if job.Status == JobCanceled || q.stopping {
+		q.m.Unlock()
+		return JobCanceled, ErrCanceled
+	}
+	q.running[job.ID] = dm
+	q.m.Unlock()
+	defer func() {
+		q.m.Lock()
+		delete(q.running, job.ID)
+		q.m.Unlock()
+	}()
+
+	log.WithField("job", job.ID).Infof("Starting download using \"%s\"...", res.Plugin)
+	streamEvents(dm, job.URL, res.Plugin, job.ID)
+	dm.OnEvent(func(de DownloadEvent) {
+		q.Events.Publish(newEvent(de, job.URL, res.Plugin, job.ID))
+	})
+	dls, err := dm.Download(job.URL, q.Workers, q.Zip, false)
+	if dls != nil {
+		res.Files = dls
+	}
+	res.Bytes = dm.Bytes()
+	res.Hosts = dm.HostStats()
+	indexFiles(p, job.URL, job.ID, dm)
+	if err == ErrCanceled {
+		return JobCanceled, err
+	} else if err != nil {
+		return JobFailed, err
+	}
+	recordHistory(p, job.URL, dm)
+
+	return JobDone, nil
+}
+
+func (q *JobQueue) selectPlugin(job *Job) (Plugin, error) {
+	handlers := q.plugins.FindHandlers([]string{job.URL})[0]
+	if len(handlers) == 0 {
+		return nil, ErrNoPlugins
+	} else if job.Plugin == "" {
+		return handlers[0], nil
+	}
+
+	for _, p := range handlers {
+		if strings.EqualFold(p.Name(), job.Plugin) {
+			return p, nil
+		}
+	}
+
+	return nil, ErrNoSuchPlugin
+}
+
+// Locks the plugin and returns a function that unlocks it. Plugins keep their
+// options in themselves, so only one thing can use a plugin at a time.
+func (q *JobQueue) lockPlugin(p Plugin) func() {
+	lock := q.pluginLocks[p]
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Sets the plugin's options to the daemon's with the given ones on top.
+// The plugin must be locked.
+func (q *JobQueue) setOptions(p Plugin, options map[string]string) error {
+	opts := make(map[string]string, len(q.Options)+len(options))
+	for k, v := range q.Options {
+		opts[k] = v
+	}
+	for k, v := range options {
+		opts[k] = v
+	}
+
+	// No one is around to answer prompts.
+	return q.plugins.SetOptions([]Plugin{p}, opts, true, true)
+}
+
+// Returns a function that sets the plugin's options back to what they are
+// now, so that what one job sets doesn't carry over to the next one using
+// the plugin. The plugin must be locked.
+func saveOptions(p Plugin) func() {
+	opts := p.Options()
+	values := make([]string, len(opts))
+	for i, opt := range opts {
+		values[i] = fmt.Sprint(opt.Value())
+	}
+
+	return func() {
+		for i, opt := range opts {
+			if err := opt.Set(values[i]); err != nil {
+				log.WithField("plugin", pluginName(p)).Warnf("Failed to reset the \"%s\" option: %s", opt.Key(), err)
+			}
+		}
+	}
+}
+
+// Cancels every running job and puts them back in the queue.
+func (q *JobQueue) stopAll() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.stopping = true
+	for _, dm := range q.running {
+		dm.Cancel()
+	}
+}
+
+func (q *JobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Writes the jobs to disk. Must be called with the lock held.
+func (q *JobQueue) save() error {
+	data, err := json.MarshalIndent(q.jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave a half-written queue.
+	tmp := q.path + ".tmp"
+	// The options can contain credentials.
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, q.path)
+}
+
+// Returns the directory a job saves to. Jobs come from API clients, so the
+// directory they ask for has to be inside the daemon's output directory.
+// Nothing is expanded, and absolute paths and ".." are rejected.
+func jobDirectory(root, dir string) (string, error) {
+	if dir == "" {
+		return root, nil
+	}
+	slashed := filepath.ToSlash(dir)
+	if filepath.IsAbs(dir) || filepath.VolumeName(dir) != "" || strings.HasPrefix(slashed, "/") ||
+		strings.HasPrefix(slashed, "~") {
+		return "", ErrJobDirectory
+	}
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return "", ErrJobDirectory
+		}
+	}
+
+	clean := path.Clean(slashed)
+	if clean == "." {
+		return root, nil
+	} else if isOutputURL(root) {
+		return strings.TrimSuffix(root, "/") + "/" + clean + "/", nil
+	}
+	return filepath.Join(root, filepath.FromSlash(clean)) + string(os.PathSeparator), nil
+}
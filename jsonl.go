@@ -0,0 +1,88 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Appends the values to a file as JSON, one per line, creating the file and
+// its directory if needed. Returns the size of the file before and after,
+// so that callers keeping what they've read in memory can tell whether
+// something else wrote to it in the meantime.
+func appendJSONLines(path string, values ...interface{}) (before, after int64, err error) {
+	var data []byte
+	for _, v := range values {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return 0, 0, err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(permission)); err != nil {
+		return 0, 0, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	if info, err := f.Stat(); err == nil {
+		before = info.Size()
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return 0, 0, err
+	}
+
+	return before, before + int64(len(data)), f.Close()
+}
+
+// Calls fn with every line of a file written by appendJSONLines(), returning
+// the size of what was read. A file that doesn't exist is empty.
+func readJSONLines(path string, fn func(line []byte)) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var size int64
+	scanner := bufio.NewScanner(f)
+	// Entries with a lot of files can get long.
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		size += int64(len(scanner.Bytes())) + 1
+		fn(scanner.Bytes())
+	}
+
+	return size, scanner.Err()
+}
+
+// Returns the size of a file, or 0 if it doesn't exist.
+func fileSize(path string) int64 {
+	if info, err := os.Stat(path); err == nil {
+		return info.Size()
+	}
+
+	return 0
+}
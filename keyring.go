@@ -0,0 +1,188 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var (
+	ErrKeyringNotFound    = errors.New("No such entry in the keyring.")
+	ErrKeyringUnsupported = errors.New("The OS keyring isn't supported on this platform.")
+	ErrKeyringNewline     = errors.New("Secrets with line breaks can't be stored in the keyring.")
+	ErrInvalidKeyringKey  = errors.New("Invalid keyring key. Should be Plugin.Key.")
+)
+
+// The service the entries are stored under in the keyring.
+const keyringService = "mindl"
+
+var noKeyring bool
+
+var keyringCommand = &Command{
+	Name:  "keyring",
+	Usage: "[flags] <set|delete> <Plugin.Key>",
+	Short: "Store plugin options like passwords in the OS keyring.",
+	Flags: NewCommandFlags("keyring"),
+	Setup: SetupNone,
+}
+
+func init() {
+	keyringCommand.Run = runKeyring
+	commonFlags.BoolVar(&noKeyring, "no-keyring", false,
+		"Don't look up unset credentials in the OS keyring.")
+}
+
+// Gets a secret from the OS keyring. The account is in the form Plugin.Key.
+func KeyringGet(account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", account, "-w")
+	case "windows":
+		return credRead(keyringService + ":" + account)
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.Command("secret-tool", "lookup", "service", keyringService, "account", account)
+	default:
+		return "", ErrKeyringUnsupported
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", ErrKeyringNotFound
+		}
+		return "", err
+	}
+
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// Stores a secret in the OS keyring, replacing it if it already exists.
+func KeyringSet(account, secret string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// Passes the command through stdin with -i, since -w would put the
+		// secret in the process list.
+		if strings.ContainsAny(account+secret, "\r\n") {
+			return ErrKeyringNewline
+		}
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+			securityQuote(keyringService), securityQuote(account), securityQuote(secret)))
+	case "windows":
+		return credWrite(keyringService+":"+account, secret)
+	case "linux", "freebsd", "openbsd", "netbsd":
+		// Reads the secret from stdin so that it doesn't show up in the process list.
+		cmd = exec.Command("secret-tool", "store", "--label", "mindl: "+account,
+			"service", keyringService, "account", account)
+		cmd.Stdin = strings.NewReader(secret)
+	default:
+		return ErrKeyringUnsupported
+	}
+
+	return runKeyringTool(cmd)
+}
+
+// Quotes an argument for a command read by security -i.
+func securityQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func KeyringDelete(account string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "delete-generic-password", "-s", keyringService, "-a", account)
+	case "windows":
+		return credDelete(keyringService + ":" + account)
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.Command("secret-tool", "clear", "service", keyringService, "account", account)
+	default:
+		return ErrKeyringUnsupported
+	}
+
+	return runKeyringTool(cmd)
+}
+
+func runKeyringTool(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %s", err, msg)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Looks up an option in the keyring. Only done for options that look like
+// credentials, since every lookup can mean running an external program.
+func keyringOption(p plugins.Plugin, opt plugins.Option) (string, bool) {
+	if noKeyring || !isSecretOption(opt) {
+		return "", false
+	}
+
+	account := credentialAccount(p, opt)
+	secret, err := KeyringGet(account)
+	if err != nil {
+		if err != ErrKeyringNotFound {
+			log.WithField("account", account).Debugf("Keyring lookup failed: %s", err)
+		}
+		return "", false
+	}
+
+	return secret, true
+}
+
+func runKeyring(args []string) {
+	if len(args) != 2 {
+		keyringCommand.Flags.Usage()
+		os.Exit(ExitUsage)
+	}
+	account := args[1]
+	if split := strings.SplitN(account, ".", 2); len(split) != 2 || split[0] == "" || split[1] == "" {
+		fatal(ErrInvalidKeyringKey)
+	}
+
+	switch args[0] {
+	case "set":
+		secret := promptSecret(account, true)
+		if err := KeyringSet(account, secret); err != nil {
+			fatal(err)
+		}
+		log.Infof("Stored %s in the keyring.", account)
+	case "delete":
+		if err := KeyringDelete(account); err != nil {
+			fatal(err)
+		}
+		log.Infof("Deleted %s from the keyring.", account)
+	default:
+		keyringCommand.Flags.Usage()
+		os.Exit(ExitUsage)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Credential Manager is Windows only. The other platforms use external tools.
+
+func credRead(target string) (string, error) {
+	return "", ErrKeyringUnsupported
+}
+
+func credWrite(target, secret string) error {
+	return ErrKeyringUnsupported
+}
+
+func credDelete(target string) error {
+	return ErrKeyringUnsupported
+}
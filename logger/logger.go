@@ -2,7 +2,10 @@ package logger
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"sync"
 
 	log "github.com/MinoMino/logrus"
 	lcf "github.com/MinoMino/logrus-custom-formatter"
@@ -23,8 +26,100 @@ func (std *stdoutReferer) Write(p []byte) (int, error) {
 	return w.Write(p)
 }
 
+// Writes to the console, or to whatever it's captured by. See Capture().
+type consoleWriter struct{}
+
+func (consoleWriter) Write(p []byte) (int, error) {
+	captureM.Lock()
+	w := captured
+	captureM.Unlock()
+	if w != nil {
+		return w.Write(p)
+	}
+
+	return console.Write(p)
+}
+
+// Releases the capture when something fatal is logged, so that it
+// makes it to the console before the program exits.
+type fatalHook struct{}
+
+func (fatalHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel}
+}
+
+func (fatalHook) Fire(e *log.Entry) error {
+	captureM.Lock()
+	f := onFatal
+	onFatal = nil
+	captureM.Unlock()
+	if f != nil {
+		f()
+	}
+
+	return nil
+}
+
 type Fields map[string]interface{}
 
+// The field holding the index of the worker an entry is from. Shown
+// right after the name on the console, aligned and colored per worker.
+const WorkerField = "worker"
+
+// ANSI colors the workers cycle through.
+var workerColors = []int{36, 33, 35, 32, 34, 31}
+
+// Verbosity levels, as set by -q, -v and -vv.
+const (
+	VerbosityQuiet = iota - 1
+	VerbosityNormal
+	VerbosityDebug
+	VerbosityTrace
+)
+
+// A hook that writes entries of certain levels to a writer with its own
+// formatter. Used to send the same entries to both the console and a log
+// file at different levels.
+type writerHook struct {
+	out       io.Writer
+	formatter log.Formatter
+	levels    []log.Level
+	m         sync.Mutex
+}
+
+func (h *writerHook) Levels() []log.Level {
+	return h.levels
+}
+
+func (h *writerHook) Fire(e *log.Entry) error {
+	b, err := h.formatter.Format(e)
+	if err != nil {
+		return err
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+	_, err = h.out.Write(b)
+	return err
+}
+
+var (
+	console          io.Writer = &stdoutReferer{&os.Stdout}
+	consoleFormatter log.Formatter
+	verbosity        = VerbosityNormal
+	logFile          *rotatingFile
+	colors           = isTerminal(os.Stdout)
+	// Set while the console output is captured. See Capture().
+	captured io.Writer
+	onFatal  func()
+	captureM sync.Mutex
+)
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 func init() {
 	NameHandler := func(e *log.Entry, f *lcf.CustomFormatter) (interface{}, error) {
 		if n, ok := e.Data["name"]; ok {
@@ -33,21 +128,123 @@ func init() {
 
 		return "", nil
 	}
+	WorkerHandler := func(e *log.Entry, f *lcf.CustomFormatter) (interface{}, error) {
+		n, ok := e.Data[WorkerField].(int)
+		if !ok {
+			return "", nil
+		}
 
-	std := &stdoutReferer{&os.Stdout}
-	log.SetOutput(std)
-	templ := "(%[ascTime]s %[shortLevelName]s) %[name]s%-45[message]s%[fields]s\n"
-	formatter := lcf.NewFormatter(templ, lcf.CustomHandlers{"name": NameHandler})
+		prefix := fmt.Sprintf("#%-3d ", n)
+		if colors {
+			color := workerColors[n%len(workerColors)]
+			prefix = fmt.Sprintf("\x1b[%dm%s\x1b[0m", color, prefix)
+		}
+		return prefix, nil
+	}
+
+	log.AddHook(redactHook{})
+	log.AddHook(fatalHook{})
+	log.SetOutput(consoleWriter{})
+	templ := "(%[ascTime]s %[shortLevelName]s) %[name]s%[worker]s%-45[message]s%[fields]s\n"
+	formatter := lcf.NewFormatter(templ, lcf.CustomHandlers{"name": NameHandler, "worker": WorkerHandler})
 	formatter.TimestampFormat = "15:04:05"
+	consoleFormatter = formatter
 	log.SetFormatter(formatter)
 }
 
-func Verbose(enable bool) {
-	if enable {
-		log.SetLevel(log.DebugLevel)
+func consoleLevel() log.Level {
+	switch {
+	case verbosity <= VerbosityQuiet:
+		return log.WarnLevel
+	case verbosity == VerbosityNormal:
+		return log.InfoLevel
+	default:
+		return log.DebugLevel
+	}
+}
+
+// Sets how much is logged to the console. Anything below 0 only logs
+// warnings and errors, 0 is the default, 1 enables debug messages, and
+// 2 or higher also enables tracing of things like HTTP requests.
+func SetVerbosity(v int) {
+	verbosity = v
+	if logFile == nil {
+		log.SetLevel(consoleLevel())
 	}
 }
 
+// Whether or not tracing messages should be logged. Meant to be checked before
+// doing expensive logging like dumping every HTTP request.
+func Tracing() bool {
+	return verbosity >= VerbosityTrace
+}
+
+// Makes the logger write to stderr instead of stdout, keeping
+// stdout clean for machine-readable output.
+func UseStderr() {
+	console = os.Stderr
+	colors = isTerminal(os.Stderr)
+}
+
+// Sends what would've been written to the console to w instead until the
+// returned function is called, e.g. to show it in a pane of a TUI. Colors
+// are turned off in the meantime. If something fatal is logged, release is
+// called before it's written so that it ends up on the console.
+func Capture(w io.Writer, release func()) (stop func()) {
+	captureM.Lock()
+	captured = w
+	onFatal = release
+	wasColored := colors
+	colors = false
+	captureM.Unlock()
+
+	return func() {
+		captureM.Lock()
+		defer captureM.Unlock()
+		if captured == w {
+			captured = nil
+			onFatal = nil
+			colors = wasColored
+		}
+	}
+}
+
+// Starts writing every entry, including debug messages, as JSON to the file
+// at the given path regardless of the console verbosity. The file is appended
+// to if it already exists, and rotated as set by rot. The console output is
+// unaffected.
+func LogToFile(path string, rot Rotation) error {
+	f, err := openRotatingFile(path, rot)
+	if err != nil {
+		return err
+	}
+	logFile = f
+
+	// The logger needs to let everything through for the file to get it,
+	// so the console filters by level with a hook of its own instead.
+	levels := make([]log.Level, 0, len(log.AllLevels))
+	for _, lvl := range log.AllLevels {
+		if lvl <= consoleLevel() {
+			levels = append(levels, lvl)
+		}
+	}
+	log.SetOutput(ioutil.Discard)
+	log.AddHook(&writerHook{out: consoleWriter{}, formatter: consoleFormatter, levels: levels})
+	log.AddHook(&writerHook{out: f, formatter: &log.JSONFormatter{}, levels: log.AllLevels})
+	log.SetLevel(log.DebugLevel)
+
+	return nil
+}
+
+// Closes the log file if there is one.
+func Close() error {
+	if logFile == nil {
+		return nil
+	}
+
+	return logFile.Close()
+}
+
 func GetLog(name string) log.FieldLogger {
 	if name == "" {
 		return log.StandardLogger()
@@ -55,3 +252,13 @@ func GetLog(name string) log.FieldLogger {
 
 	return log.WithField("name", name)
 }
+
+// Returns a logger for a worker, with its index and the item it's on as fields.
+func GetWorkerLog(name string, n int, item string) log.FieldLogger {
+	l := GetLog(name).WithField(WorkerField, n)
+	if item != "" {
+		l = l.WithField("item", item)
+	}
+
+	return l
+}
@@ -0,0 +1,131 @@
+package logger
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/MinoMino/logrus"
+)
+
+// What secrets are replaced with in entries.
+const redacted = "********"
+
+// Values shorter than this aren't redacted, since replacing them would
+// mangle unrelated text.
+const minSecretLength = 4
+
+// How many values of a secret are kept, like a session cookie that keeps
+// changing. Older ones are no longer redacted.
+const maxSecretValues = 4
+
+var (
+	// The values to redact, keyed by what they're for, oldest first.
+	secrets = make(map[string][]string)
+	// Rebuilt from the secrets when something is redacted after they changed.
+	replacer *strings.Replacer
+	secretsM sync.RWMutex
+)
+
+// Makes every entry from now on have the value replaced with asterisks,
+// e.g. passwords. It's also replaced when URL-encoded.
+func AddSecret(s string) {
+	SetSecret(s, s)
+}
+
+// Like AddSecret, but for secrets whose value changes, like cookies or
+// access tokens. Only the last few values under the name are redacted.
+func SetSecret(name, s string) {
+	if len(s) < minSecretLength {
+		return
+	}
+
+	secretsM.Lock()
+	defer secretsM.Unlock()
+	values := secrets[name]
+	for _, v := range values {
+		if v == s {
+			return
+		}
+	}
+	if len(values) >= maxSecretValues {
+		values = append(values[:0:0], values[len(values)-maxSecretValues+1:]...)
+	}
+	secrets[name] = append(values, s)
+	replacer = nil
+}
+
+// Replaces every secret in the string with asterisks.
+func Redact(s string) string {
+	secretsM.RLock()
+	r := replacer
+	empty := len(secrets) == 0
+	secretsM.RUnlock()
+	if empty {
+		return s
+	} else if r == nil {
+		r = buildReplacer()
+	}
+
+	return r.Replace(s)
+}
+
+func buildReplacer() *strings.Replacer {
+	secretsM.Lock()
+	defer secretsM.Unlock()
+	if replacer != nil {
+		return replacer
+	}
+
+	var all []string
+	for _, values := range secrets {
+		for _, v := range values {
+			all = append(all, v)
+			if escaped := url.QueryEscape(v); escaped != v {
+				all = append(all, escaped)
+			}
+		}
+	}
+	// The replacer goes with the first secret that matches, so longer ones
+	// come first in case one starts with another.
+	sort.Slice(all, func(i, j int) bool { return len(all[i]) > len(all[j]) })
+	pairs := make([]string, 0, 2*len(all))
+	for _, v := range all {
+		pairs = append(pairs, v, redacted)
+	}
+	replacer = strings.NewReplacer(pairs...)
+
+	return replacer
+}
+
+// Redacts secrets from the message and fields of every entry. Added before
+// any other hook so that the log file doesn't get them either.
+type redactHook struct{}
+
+func (redactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (redactHook) Fire(e *log.Entry) error {
+	e.Message = Redact(e.Message)
+	// The fields can be shared with other entries, so they're copied.
+	data := make(log.Fields, len(e.Data))
+	for k, v := range e.Data {
+		switch v := v.(type) {
+		case string:
+			data[k] = Redact(v)
+		case error:
+			if s := v.Error(); Redact(s) != s {
+				data[k] = Redact(s)
+			} else {
+				data[k] = v
+			}
+		default:
+			data[k] = v
+		}
+	}
+	e.Data = data
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package logger
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"strings"
+	"testing"
+)
+
+func resetSecrets() {
+	secretsM.Lock()
+	secrets = make(map[string][]string)
+	replacer = nil
+	secretsM.Unlock()
+}
+
+func TestRedact(t *testing.T) {
+	resetSecrets()
+	AddSecret("hunter22")
+	AddSecret("a b&c")
+	AddSecret("abc")
+
+	for in, want := range map[string]string{
+		"password=hunter22": "password=" + redacted,
+		"q=a+b%26c":         "q=" + redacted,
+		"abc is too short":  "abc is too short",
+	} {
+		if got := Redact(in); got != want {
+			t.Errorf("Redact(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSetSecretKeepsLastValues(t *testing.T) {
+	resetSecrets()
+	for i := 0; i < 100; i++ {
+		SetSecret("cookie session", "session"+strings.Repeat("x", i))
+	}
+
+	secretsM.RLock()
+	n := len(secrets["cookie session"])
+	secretsM.RUnlock()
+	if n != maxSecretValues {
+		t.Fatalf("Kept %d values, want %d.", n, maxSecretValues)
+	}
+	latest := "session" + strings.Repeat("x", 99)
+	if got := Redact(latest); got != redacted {
+		t.Errorf("Latest value not redacted: %q", got)
+	}
+	oldest := "session" + strings.Repeat("x", 10)
+	if got := Redact("[" + oldest + "]"); got != "["+oldest+"]" {
+		t.Errorf("Evicted value still redacted: %q", got)
+	}
+}
+
+func TestRedactRebuildsAfterChange(t *testing.T) {
+	resetSecrets()
+	SetSecret("token", "first-token")
+	if got := Redact("first-token"); got != redacted {
+		t.Fatalf("got %q", got)
+	}
+	SetSecret("token", "second-token")
+	if got := Redact("second-token"); got != redacted {
+		t.Errorf("New value not redacted: %q", got)
+	}
+	if got := Redact("first-token"); got != redacted {
+		t.Errorf("Previous value no longer redacted: %q", got)
+	}
+}
@@ -0,0 +1,143 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What's appended to the name of rotated log files.
+const rotatedLayout = "20060102-150405.000"
+
+// When to move on to a new log file, and how many of the old ones to keep.
+// The zero value never rotates.
+type Rotation struct {
+	// Rotates once the file would grow past this many bytes. 0 for no limit.
+	MaxSize int64
+	// Rotates once the file has been written to for this long. 0 for never.
+	Every time.Duration
+	// How many rotated files to keep. 0 keeps all of them.
+	Keep int
+	// Rotated files older than this are deleted. 0 keeps them regardless.
+	MaxAge time.Duration
+}
+
+// A log file that renames itself to <path>.<time> and starts over when
+// it's due to be rotated, deleting old ones as it goes.
+type rotatingFile struct {
+	path   string
+	rot    Rotation
+	f      *os.File
+	size   int64
+	opened time.Time
+	m      sync.Mutex
+}
+
+func openRotatingFile(path string, rot Rotation) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, rot: rot}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	rf.prune()
+
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.f = f
+	rf.size = info.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.m.Lock()
+	defer rf.m.Unlock()
+	if rf.due(len(p)) {
+		// Keep writing to the old file rather than losing the entry.
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate the log file: %s\n", err)
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) due(n int) bool {
+	if rf.size == 0 {
+		return false
+	}
+
+	return rf.rot.MaxSize > 0 && rf.size+int64(n) > rf.rot.MaxSize ||
+		rf.rot.Every > 0 && time.Since(rf.opened) >= rf.rot.Every
+}
+
+func (rf *rotatingFile) rotate() error {
+	rotated := rf.path + "." + time.Now().Format(rotatedLayout)
+	if err := os.Rename(rf.path, rotated); err != nil {
+		return err
+	}
+	old := rf.f
+	if err := rf.open(); err != nil {
+		// Put it back so the next rotation can try again.
+		os.Rename(rotated, rf.path)
+		return err
+	}
+	old.Close()
+	rf.prune()
+
+	return nil
+}
+
+// Deletes the rotated files that are past the retention.
+func (rf *rotatingFile) prune() {
+	if rf.rot.Keep <= 0 && rf.rot.MaxAge <= 0 {
+		return
+	}
+
+	matches, _ := filepath.Glob(rf.path + ".*")
+	type rotated struct {
+		path string
+		at   time.Time
+	}
+	var files []rotated
+	for _, path := range matches {
+		// Leave anything that isn't ours alone, e.g. mindl.log.bak.
+		at, err := time.ParseInLocation(rotatedLayout, strings.TrimPrefix(path, rf.path+"."), time.Local)
+		if err == nil {
+			files = append(files, rotated{path, at})
+		}
+	}
+	// Newest first.
+	sort.Slice(files, func(i, j int) bool { return files[i].at.After(files[j].at) })
+
+	for i, file := range files {
+		if rf.rot.Keep > 0 && i >= rf.rot.Keep || rf.rot.MaxAge > 0 && time.Since(file.at) > rf.rot.MaxAge {
+			if err := os.Remove(file.path); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to delete an old log file: %s\n", err)
+			}
+		}
+	}
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.m.Lock()
+	defer rf.m.Unlock()
+	return rf.f.Close()
+}
@@ -0,0 +1,103 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// The name of the manifest written into every output directory.
+const manifestName = "mindl-job.json"
+
+// Describes how the contents of an output directory were downloaded,
+// so that it's still possible to tell long after the fact.
+type JobManifest struct {
+	URL     string            `json:"url"`
+	Plugin  string            `json:"plugin"`
+	Version string            `json:"version"`
+	Options map[string]string `json:"options"`
+	Status  string            `json:"status"`
+	Error   string            `json:"error,omitempty"`
+	// Paths are relative to the directory the manifest is in.
+	Files    []SavedFile `json:"files"`
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+	// Requests sent to each host for the whole job.
+	Hosts map[string]plugins.HostStat `json:"hosts,omitempty"`
+}
+
+// Returns the values of the plugin's options with secrets redacted.
+func redactedOptions(p plugins.Plugin) map[string]string {
+	res := make(map[string]string)
+	for _, opt := range p.Options() {
+		if strings.HasPrefix(opt.Key(), "!") {
+			continue
+		}
+		if opt.IsHidden() || isSecretOption(opt) {
+			res[opt.Key()] = "REDACTED"
+		} else {
+			res[opt.Key()] = fmt.Sprint(opt.Value())
+		}
+	}
+
+	return res
+}
+
+// Writes a manifest into every top-level directory files have been saved to,
+// listing only the files in that directory.
+func (dm *DownloadManager) writeManifests(url string, started time.Time, err error) {
+	dirs := make(map[string][]SavedFile)
+	for _, file := range dm.SavedFiles() {
+		split := strings.SplitN(file.rel, "/", 2)
+		if len(split) < 2 {
+			continue
+		}
+		file.Path = split[1]
+		dirs[split[0]] = append(dirs[split[0]], file)
+	}
+
+	manifest := JobManifest{
+		URL:      url,
+		Plugin:   dm.plugin.Name(),
+		Version:  version,
+		Options:  redactedOptions(dm.plugin),
+		Status:   resultStatus(err),
+		Started:  started,
+		Finished: time.Now(),
+		Hosts:    dm.HostStats(),
+	}
+	if err != nil {
+		manifest.Error = err.Error()
+	}
+	for dir, files := range dirs {
+		manifest.Files = files
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			log.Warnf("Failed to create the manifest: %s", err)
+			return
+		}
+		path := dir + "/" + manifestName
+		if err := writeStorageFile(dm.storage, path, data); err != nil {
+			log.WithField("path", dm.storage.Location(path)).Warnf("Failed to write the manifest: %s", err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long a failure counts against a mirror.
+const mirrorPenalty = 10 * time.Minute
+
+// How mirrors have been doing, keyed by host.
+var (
+	mirrorFailures = make(map[string][]time.Time)
+	mirrorsM       sync.Mutex
+)
+
+// What saving a URL fails with when the server answers with anything but 200.
+type mirrorStatusError struct {
+	code int
+}
+
+func (e *mirrorStatusError) Error() string {
+	return fmt.Sprintf("HTTP request returned error code: %d", e.code)
+}
+
+func mirrorFailed(host string) {
+	mirrorsM.Lock()
+	defer mirrorsM.Unlock()
+	mirrorFailures[host] = append(recentFailures(host), time.Now())
+}
+
+func mirrorSucceeded(host string) {
+	mirrorsM.Lock()
+	defer mirrorsM.Unlock()
+	delete(mirrorFailures, host)
+}
+
+// Returns the failures of the host within the penalty. Must be called with
+// the lock held.
+func recentFailures(host string) []time.Time {
+	var res []time.Time
+	for _, t := range mirrorFailures[host] {
+		if time.Since(t) < mirrorPenalty {
+			res = append(res, t)
+		}
+	}
+
+	return res
+}
+
+// Sorts the requests by how many recent failures their hosts have, keeping
+// the order the plugin gave them in otherwise.
+func sortMirrors(reqs []*http.Request) []*http.Request {
+	mirrorsM.Lock()
+	defer mirrorsM.Unlock()
+	failures := make(map[string]int)
+	for _, req := range reqs {
+		failures[req.URL.Host] = len(recentFailures(req.URL.Host))
+	}
+	sort.SliceStable(reqs, func(i, j int) bool {
+		return failures[reqs[i].URL.Host] < failures[reqs[j].URL.Host]
+	})
+
+	return reqs
+}
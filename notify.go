@@ -0,0 +1,96 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+var ErrNotifyUnsupported = errors.New("Desktop notifications aren't supported on this platform.")
+
+var notify bool
+
+func init() {
+	commonFlags.BoolVar(&notify, "notify", false,
+		"Show a desktop notification when a download finishes or fails.")
+}
+
+// Shows a desktop notification using whatever the platform provides.
+func Notify(title, message string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.Command("notify-send", "--app-name=mindl", title, message)
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s",
+			appleScriptString(message), appleScriptString(title))
+		cmd = exec.Command("osascript", "-e", script)
+	case "windows":
+		script := fmt.Sprintf(windowsToast, powerShellString(title), powerShellString(message))
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	default:
+		return ErrNotifyUnsupported
+	}
+
+	return cmd.Run()
+}
+
+// Shows a notification about a finished job if notifications are enabled.
+func notifyResult(res *JobResult) {
+	if !notify {
+		return
+	}
+
+	var title, message string
+	switch res.Status {
+	case StatusDone:
+		title = "Download finished"
+		message = fmt.Sprintf("%s\n%d file(s), %s", res.URL, len(res.Files), formatBytes(res.Bytes))
+	case StatusCanceled:
+		title = "Download canceled"
+		message = res.URL
+	default:
+		title = "Download failed"
+		message = fmt.Sprintf("%s\n%s", res.URL, res.Error)
+	}
+
+	if err := Notify(title, message); err != nil {
+		log.Warnf("Failed to show a notification: %s", err)
+	}
+}
+
+func appleScriptString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+func powerShellString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// Uses the WinRT toast API, which is available from Windows 10 on.
+const windowsToast = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode(%s)) | Out-Null
+$text.Item(1).AppendChild($template.CreateTextNode(%s)) | Out-Null
+$toast = [Windows.UI.Notifications.ToastNotification]::new($template)
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('mindl').Show($toast)`
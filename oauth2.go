@@ -0,0 +1,65 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// Keeps OAuth2 refresh tokens the same way as the tokens of storage backends.
+type storageTokenStore struct{}
+
+func (storageTokenStore) LoadToken(name string) string {
+	return loadStorageToken(name+".RefreshToken", strings.ToLower(name)+"-token")
+}
+
+func (storageTokenStore) SaveToken(name, token string) error {
+	return saveStorageToken(name+".RefreshToken", strings.ToLower(name)+"-token", token)
+}
+
+type promptOAuth2 struct {
+	m sync.Mutex
+}
+
+func (p *promptOAuth2) OAuth2Visit(name, url, code string) {
+	if code != "" {
+		log.Warn(i18n.Tf("To let mindl use %s, go to %s and enter the code: %s", name, url, code))
+	} else {
+		log.Warn(i18n.Tf("To let mindl use %s, open %s in a browser on this computer.", name, url))
+	}
+}
+
+func (p *promptOAuth2) OAuth2Code(name, url string) (string, error) {
+	if !isTerminal(os.Stdin) {
+		return "", plugins.ErrOAuth2NoUser
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	fmt.Println(i18n.Tf("To let mindl use %s, go to %s and paste the code you get.", name, url))
+	return prompt(i18n.T("Code")), nil
+}
+
+func setupOAuth2() {
+	plugins.SetTokenStore(storageTokenStore{})
+	plugins.SetOAuth2Prompter(&promptOAuth2{})
+}
@@ -0,0 +1,69 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import "time"
+
+// Stops the workers from getting any more data and new ones from being
+// spawned until Resume() is called. Requests that are in the middle of
+// being downloaded are left open, so servers with short timeouts might
+// drop them if it's paused for long.
+func (dm *DownloadManager) Pause() {
+	dm.pauseM.Lock()
+	defer dm.pauseM.Unlock()
+	if dm.resume == nil {
+		dm.resume = make(chan struct{})
+	}
+}
+
+func (dm *DownloadManager) Resume() {
+	dm.pauseM.Lock()
+	defer dm.pauseM.Unlock()
+	if dm.resume == nil {
+		return
+	}
+	close(dm.resume)
+	dm.resume = nil
+
+	// Don't count the time it was paused as the workers stalling.
+	dm.m.Lock()
+	for _, w := range dm.active {
+		w.active = time.Now()
+	}
+	dm.m.Unlock()
+}
+
+func (dm *DownloadManager) Paused() bool {
+	dm.pauseM.Lock()
+	defer dm.pauseM.Unlock()
+	return dm.resume != nil
+}
+
+// Blocks while the download is paused, unless it's canceled.
+func (dm *DownloadManager) waitResumed() {
+	dm.pauseM.Lock()
+	resume := dm.resume
+	dm.pauseM.Unlock()
+	if resume == nil {
+		return
+	}
+
+	select {
+	case <-resume:
+	case <-dm.cancel:
+	}
+}
@@ -24,6 +24,8 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/logger"
 	. "github.com/MinoMino/mindl/plugins"
 )
 
@@ -61,12 +63,12 @@ func (pm *PluginManager) SelectPlugin(ps []Plugin) (Plugin, error) {
 		return ps[0], nil
 	}
 
-	fmt.Println("Found multiple handlers. Please select one:")
+	fmt.Println(i18n.T("Found multiple handlers. Please select one:"))
 	for i, p := range ps {
 		fmt.Printf("  %2d) %s\n", i+1, p.Name())
 	}
 
-	if n, err := strconv.Atoi(prompt("Desired plugin: ")); err != nil {
+	if n, err := strconv.Atoi(prompt(i18n.T("Desired plugin: "))); err != nil {
 		return nil, ErrUnintelligibleNumber
 	} else if n < 1 || n > len(ps) {
 		return nil, ErrOutOfRange
@@ -79,6 +81,9 @@ func (pm *PluginManager) SelectPlugin(ps []Plugin) (Plugin, error) {
 // If prompting isn't desired, return an error instead if required fields
 // are unset.
 func (pm *PluginManager) SetOptions(ps []Plugin, usropts map[string]string, defaults, noprompt bool) error {
+	// However the credentials end up set, keep them out of the logs.
+	defer redactSecretOptions(ps)
+	defer setCookiesOptions(ps)
 	// A map of all unset options.
 	unset := make(map[Plugin][]Option)
 	// A map of all unset required options.
@@ -87,14 +92,33 @@ func (pm *PluginManager) SetOptions(ps []Plugin, usropts map[string]string, defa
 		plgopts := p.Options()
 		for _, plgopt := range plgopts {
 			set := false
+			// The most specific key wins, e.g. BookLive.Lossless over Lossless.
+			rank, val := 0, ""
 			for usrkey, usrval := range usropts {
-				if strings.EqualFold(plgopt.Key(), usrkey) {
-					if err := plgopt.Set(usrval); err != nil {
+				if r := optionKeyRank(p, plgopt, usrkey); r > rank {
+					rank, val = r, usrval
+				}
+			}
+			if rank > 0 {
+				if err := plgopt.Set(val); err != nil {
+					return err
+				}
+				set = true
+				log.WithField("plugin", pluginName(p)).Debugf("Set Option: %s = %v",
+					plgopt.Key(), optionLogValue(plgopt))
+			}
+
+			// Fall back on the environment, e.g. MINDL_BOOKLIVE_USERNAME,
+			// then the OS keyring and the credentials file.
+			if !set {
+				if val, source, ok := readCredential(p, plgopt); ok {
+					if err := plgopt.Set(val); err != nil {
 						return err
 					}
 					set = true
-					log.WithField("plugin", pluginName(p)).Debugf("Set Option: %s = %s",
-						plgopt.Key(), usrval)
+					// Not logging the value since it's likely a credential.
+					log.WithField("plugin", pluginName(p)).Debugf("Set Option: %s from %s",
+						plgopt.Key(), source)
 				}
 			}
 
@@ -114,6 +138,26 @@ func (pm *PluginManager) SetOptions(ps []Plugin, usropts map[string]string, defa
 	}
 
 	if noprompt {
+		// The daemon can still have credentials entered through the API.
+		if credentialRequests != nil {
+			for p, opts := range unsetReq {
+				missing := opts[:0]
+				for _, opt := range opts {
+					if isSecretOption(opt) {
+						if v, ok := credentialRequests.Ask(p, opt); ok && opt.Set(v) == nil {
+							auditCredential(credentialAccount(p, opt), "the HTTP API")
+							continue
+						}
+					}
+					missing = append(missing, opt)
+				}
+				if len(missing) == 0 {
+					delete(unsetReq, p)
+				} else {
+					unsetReq[p] = missing
+				}
+			}
+		}
 		if len(unsetReq) == 0 { // No prompt, but all required options set?
 			return nil
 		} else {
@@ -131,7 +175,7 @@ func (pm *PluginManager) SetOptions(ps []Plugin, usropts map[string]string, defa
 			// If we're prompting, but defaults is on, only prompt required options.
 			for p, opts := range unsetReq {
 				name := pluginName(p)
-				fmt.Printf("The plugin \"%s\" has required option(s):\n", name)
+				fmt.Println(i18n.Tf("The plugin \"%s\" has required option(s):", name))
 				for _, opt := range opts {
 					// Hidden options are never prompted.
 					if opt.IsHidden() {
@@ -139,14 +183,14 @@ func (pm *PluginManager) SetOptions(ps []Plugin, usropts map[string]string, defa
 					}
 
 					optionPrompt(opt)
-					log.WithField("plugin", name).Debugf("Set Option: %s = %s", opt.Key(), opt.Value())
+					log.WithField("plugin", name).Debugf("Set Option: %s = %v", opt.Key(), optionLogValue(opt))
 				}
 			}
 		} else {
 			// We're prompting and defaults is off. Prompt everything missing.
 			for p, opts := range unset {
 				name := pluginName(p)
-				fmt.Printf("The plugin \"%s\" has option(s):\n", name)
+				fmt.Println(i18n.Tf("The plugin \"%s\" has option(s):", name))
 				for _, opt := range opts {
 					// Hidden options are never prompted.
 					if opt.IsHidden() {
@@ -154,7 +198,7 @@ func (pm *PluginManager) SetOptions(ps []Plugin, usropts map[string]string, defa
 					}
 
 					optionPrompt(opt)
-					log.WithField("plugin", name).Debugf("Set Option: %s = %s", opt.Key(), opt.Value())
+					log.WithField("plugin", name).Debugf("Set Option: %s = %v", opt.Key(), optionLogValue(opt))
 				}
 			}
 		}
@@ -163,6 +207,11 @@ func (pm *PluginManager) SetOptions(ps []Plugin, usropts map[string]string, defa
 	return nil
 }
 
+// Returns the name of the environment variable for a plugin option.
+func optionEnvName(p Plugin, opt Option) string {
+	return envName(accountScope(p), opt.Key())
+}
+
 func prompt(msg string) string {
 	r := bufio.NewReader(os.Stdin)
 	fmt.Print(msg + ": ")
@@ -184,14 +233,18 @@ func optionPrompt(opt Option) {
 
 	def := fmt.Sprintf("%v", opt.Value()) != "" && !opt.IsRequired()
 	if def {
-		s = fmt.Sprintf("    %s [%v]%s", opt.Key(), opt.Value(), asterisk)
+		s = fmt.Sprintf("    %s [%v]%s", opt.Key(), optionLogValue(opt), asterisk)
 	} else {
 		s = fmt.Sprintf("    %s%s", opt.Key(), asterisk)
 	}
 
 	var in string
 	for {
-		in = prompt(s)
+		if isSecretOption(opt) {
+			in = promptSecret(s, false)
+		} else {
+			in = prompt(s)
+		}
 		if in == "" {
 			if opt.IsRequired() { // Don't allow empty on required.
 				continue
@@ -206,6 +259,61 @@ func optionPrompt(opt Option) {
 	}
 }
 
+// Returns the value of an option for logs and prompts, masked if it's a
+// credential.
+func optionLogValue(opt Option) interface{} {
+	if isSecretOption(opt) && fmt.Sprintf("%v", opt.Value()) != "" {
+		return "********"
+	}
+	return opt.Value()
+}
+
+// Makes the logger redact the values of the plugins' secret options.
+func redactSecretOptions(ps []Plugin) {
+	for _, p := range ps {
+		for _, opt := range p.Options() {
+			if s, ok := opt.Value().(string); ok && isSecretOption(opt) {
+				logger.AddSecret(s)
+			}
+		}
+	}
+}
+
+// Hands the cookies of the plugins' Cookies options to their HTTP clients.
+func setCookiesOptions(ps []Plugin) {
+	for _, p := range ps {
+		var domains []string
+		if cu, ok := p.(CookieUser); ok {
+			domains = cu.CookieDomains()
+		}
+		for _, opt := range p.Options() {
+			if co, ok := opt.(*CookiesOption); ok {
+				SetPluginCookies(p.Name(), co.Cookies(domains))
+			}
+		}
+	}
+}
+
+// How specifically a key passed by the user refers to a plugin's option, or
+// 0 if it doesn't. Keys can either be the bare option key, be scoped to a
+// specific plugin with the "Plugin.Key" format, or to one of its accounts
+// with "Plugin@account.Key", which only applies when that account is used.
+func optionKeyRank(p Plugin, opt Option, key string) int {
+	if strings.EqualFold(opt.Key(), key) {
+		return 1
+	}
+
+	split := strings.SplitN(key, ".", 2)
+	if len(split) != 2 || !strings.EqualFold(opt.Key(), split[1]) {
+		return 0
+	} else if strings.EqualFold(p.Name(), split[0]) {
+		return 2
+	} else if accountName != "" && strings.EqualFold(accountScope(p), split[0]) {
+		return 3
+	}
+	return 0
+}
+
 func pluginName(p Plugin) string {
 	return strings.TrimSpace(p.Name() + " " + p.Version())
 }
@@ -43,6 +43,19 @@ const (
 	SafariUserAgent  = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_9_3) AppleWebKit/537.75.14 (KHTML, like Gecko) Version/7.0.3 Safari/7046A194A"
 )
 
+// User agents of current browsers the user can pick by name.
+var UserAgentPresets = map[string]string{
+	"firefox": "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:144.0) Gecko/20100101 Firefox/144.0",
+	"chrome":  "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36",
+	"edge":    "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36 Edg/141.0.0.0",
+	"safari":  "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/26.0 Safari/605.1.15",
+	"iphone":  "Mozilla/5.0 (iPhone; CPU iPhone OS 18_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/26.0 Mobile/15E148 Safari/604.1",
+}
+
+// Used for requests that don't set a user agent, instead of Go's, which
+// some sites reject.
+var DefaultUserAgent = UserAgentPresets["chrome"]
+
 // Implements the error interface.
 type ErrHTTPStatusCode struct {
 	StatusCode int
@@ -52,6 +65,20 @@ func (e *ErrHTTPStatusCode) String() string {
 	return "The HTTP request did not respond with status code 200."
 }
 
+// Used for failures to log in or otherwise authenticate, letting mindl tell
+// them apart from other errors. Create them with NewAuthError().
+type ErrAuthentication struct {
+	Msg string
+}
+
+func (e *ErrAuthentication) Error() string {
+	return e.Msg
+}
+
+func NewAuthError(msg string) error {
+	return &ErrAuthentication{msg}
+}
+
 // Panic with an ErrHTTPStatusCode if the status code isn't 200.
 func PanicForStatus(resp *http.Response, msg string) {
 	if resp.StatusCode != http.StatusOK {
@@ -73,23 +100,50 @@ func OptionsToMap(opts []Option) map[string]interface{} {
 	return res
 }
 
-// Create an HTTP client with a proper timeout timer.
+// Create an HTTP client that times out requests after the given number of
+// seconds, unless the user set a timeout of their own.
 func NewHTTPClient(timeout int) *http.Client {
-	jar, _ := cookiejar.New(nil)
-	return &http.Client{
-		Timeout: time.Second * 20,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			last := via[len(via)-1]
-			log.WithField("url", last.URL.String()).Debug("Following HTTP redirect...")
-			req.Header = last.Header
-			if req.URL.Host != last.URL.Host {
-				delete(req.Header, "Authorization")
-			}
-
-			return nil
-		},
-		Jar: jar,
+	return NewPluginHTTPClient("", timeout)
+}
+
+// Like NewHTTPClient, but uses the proxy and headers set for the plugin if
+// any, and starts out with the plugin's stored cookies, the ones imported
+// from the user's browser and the ones of its Cookies option.
+func NewPluginHTTPClient(plugin string, timeout int) *http.Client {
+	base, _ := cookiejar.New(nil)
+	var jar http.CookieJar = base
+	if plugin != "" {
+		if cookieStore != nil {
+			jar = newPersistentJar(plugin, base)
+		}
+		// Not stored, since they're in the browser already.
+		addCookies(base, browserCookies)
+		// Set last, since they were given for the plugin specifically.
+		addCookies(base, pluginCookies(plugin))
 	}
+	jar = redactingJar{jar}
+	client := &http.Client{
+		CheckRedirect: checkRedirect,
+		Jar:           jar,
+		// The transport times out each attempt, since a rate limited
+		// request can take a lot longer than the timeout as a whole.
+		Transport: newTransport(plugin, jar, time.Duration(timeout)*time.Second),
+	}
+
+	return client
+}
+
+// Keeps the headers when following redirects, except for credentials
+// when going to another host.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	last := via[len(via)-1]
+	log.WithField("url", last.URL.String()).Debug("Following HTTP redirect...")
+	req.Header = last.Header
+	if req.URL.Host != last.URL.Host {
+		delete(req.Header, "Authorization")
+	}
+
+	return nil
 }
 
 // Create a new GET request with a Firefox user agent.
@@ -157,6 +211,12 @@ type Reporter interface {
 	// The report bool determines whether or not it should report download speeds.
 	// In other words, whether or not src is getting its data straight from the network.
 	SaveData(dst string, src io.Reader, report bool) (written int64, err error)
+	// Sends the request with the client and saves the response body like SaveData.
+	// Use it for files that can be saved as they are, since it lets the user hand
+	// the transfer to an external downloader like aria2. If the file is on several
+	// mirrors, pass requests for the others too, and they're tried in turn when
+	// one fails, starting with the ones that have worked best so far.
+	SaveURL(dst string, client *http.Client, req *http.Request, mirrors ...*http.Request) (written int64, err error)
 	// Saves the file as a successful download. The destination path must be relative,
 	// as the downloader will take care of where to save files. The file is renamed (moved)
 	// to the final destination rather than copied. This only works if the file resides on
@@ -169,6 +229,11 @@ type Reporter interface {
 	// Returns a writer to the destination file. The caller must close it.
 	// Download completion is reported on close.
 	FileWriter(dst string, report bool) (io.WriteCloser, error)
+	// Returns a logger whose messages are prefixed with the index of the worker
+	// and include the file it's currently saving. Makes it a lot easier to tell
+	// what's going on with many workers, so use it instead of the plugin's logger
+	// inside downloaders.
+	Log() log.FieldLogger
 }
 
 /*
@@ -223,6 +288,16 @@ func (opt *StringOption) Comment() string {
 	return opt.C
 }
 
+// A StringOption for passwords and the like, which are read without being
+// shown when prompted for and never logged.
+type SecretOption struct {
+	StringOption
+}
+
+func (opt *SecretOption) IsSecret() bool {
+	return true
+}
+
 // An implementation of Option that tries to convert
 // the user input into an integer.
 type IntOption struct {
@@ -414,6 +489,53 @@ func (opt *ForceDisableOption) IsHidden() bool {
 	return true
 }
 
+// An option for cookies to start out with, like a session copied from a
+// browser, for when a plugin's login is broken. Takes either a Cookie header
+// or the path to a cookies.txt file, and should be given to every plugin that
+// logs in. Its cookies are put in the plugin's HTTP clients.
+type CookiesOption struct {
+	SecretOption
+	cookies []*http.Cookie
+}
+
+func NewCookiesOption() *CookiesOption {
+	return &CookiesOption{
+		SecretOption: SecretOption{StringOption{
+			K: "Cookies",
+			C: "Cookies to log in with instead, either like a Cookie header (name=value; name2=value2) or the path to a cookies.txt file.",
+		}},
+	}
+}
+
+func (opt *CookiesOption) Set(v string) error {
+	cookies, err := ParseCookies(v)
+	if err != nil {
+		return err
+	}
+	opt.V, opt.cookies = v, cookies
+
+	return nil
+}
+
+// Returns the cookies, with the ones from a header set for the domains
+// and their subdomains.
+func (opt *CookiesOption) Cookies(domains []string) []*http.Cookie {
+	var res []*http.Cookie
+	for _, c := range opt.cookies {
+		if c.Domain != "" {
+			res = append(res, c)
+			continue
+		}
+		for _, d := range domains {
+			cookie := *c
+			cookie.Domain = "." + strings.TrimPrefix(d, ".")
+			res = append(res, &cookie)
+		}
+	}
+
+	return res
+}
+
 /*
    ==================================================
                          PLUGIN
@@ -465,3 +587,92 @@ type Plugin interface {
 	// to abort, it is passed. Otherwise nil is passed.
 	Cleanup(error)
 }
+
+// Plugins whose content can be reached through several different URLs can
+// optionally implement this interface to let things like the download history
+// know when two URLs are the same item.
+type Canonicalizer interface {
+	// Returns the one URL that represents the same item as the given URL,
+	// which is one the plugin can handle.
+	CanonicalURL(url string) string
+}
+
+// Plugins for sources that get new content over time, like a series getting
+// new volumes, can optionally implement this interface to be usable with the
+// watch command. Options are set before List() is called.
+type Lister interface {
+	// Whether or not the URL is a source List() can be called with.
+	CanList(url string) bool
+	// Returns the URLs of every item currently available from the source, in
+	// the order they were published. They must be URLs the plugin can handle.
+	List(url string) ([]string, error)
+}
+
+type SearchResult struct {
+	Title string
+	// A URL the plugin can handle.
+	URL string
+}
+
+// Plugins that can search their service for content can optionally implement
+// this interface to be usable with the search command. Options are set before
+// Search() is called, just like with DownloadGenerator().
+type Searcher interface {
+	Search(query string) ([]SearchResult, error)
+}
+
+// Plugins that can tell how big a download is without downloading it, either
+// from metadata or with HEAD requests, can optionally implement this interface
+// to give better estimates with --dry-run. Options are set before it's called.
+type Estimator interface {
+	// Returns the number of files and their estimated total size in bytes,
+	// or -1 for the size if it's unknown.
+	Estimate(url string) (files int, size int64, err error)
+}
+
+// Metadata about an item. Fields the plugin doesn't know are left empty.
+type ItemInfo struct {
+	Title       string   `json:"title"`
+	Volume      int      `json:"volume,omitempty"`
+	Authors     []string `json:"authors,omitempty"`
+	Pages       int      `json:"pages,omitempty"`
+	Chapters    []string `json:"chapters,omitempty"`
+	Description string   `json:"description,omitempty"`
+	// Anything else worth knowing that doesn't fit the above.
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+// Plugins that fetch metadata before downloading can optionally implement this
+// interface to be usable with the info command. Options are set before Info()
+// is called, and nothing should be downloaded.
+type Informer interface {
+	Info(url string) (*ItemInfo, error)
+}
+
+// Plugins whose downloaders can end up saving different files to the same
+// path, e.g. when file names are made from titles, can optionally implement
+// this interface to pick another path for one of them. Otherwise, a number is
+// added to the file name.
+type Disambiguator interface {
+	// Returns another path for a file that downloader n wants to save to an
+	// already used path, or an empty string to have a number added instead.
+	Disambiguate(path string, n int) string
+}
+
+// Plugins whose sessions or API tokens can expire during long downloads in
+// ways their clients can't recover from on their own (see OnSessionExpired),
+// like tokens in URLs. When a downloader fails with an ErrAuthentication, the
+// manager calls RenewSession once for every worker that failed around the
+// same time, and then runs the failed downloaders again. Downloaders need to
+// get the client or token from the plugin when they run for that to help.
+type SessionRenewer interface {
+	RenewSession() error
+}
+
+// Plugins that log in, letting users check their credentials with the login
+// command before queueing downloads. Login must log in with the plugin's
+// options even if there's a session already, and keep the session for
+// downloads like they do.
+type Authenticator interface {
+	Login() error
+}
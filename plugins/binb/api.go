@@ -29,8 +29,10 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/MinoMino/mindl/logger"
@@ -85,6 +87,7 @@ var StaticImageSizes = []string{"M_H", "S_H", "M_L", "S_L"}
 
 const staticImageUrlFmt = "%s/%s/%s.jpg"
 const staticContentUrlFmt = "%s/content.js"
+const ptimgContentUrlFmt = "%s/content?%s"
 
 // The API doesn't always serve images over the API, but often redirects to a CDN.
 type ContentServerType int
@@ -93,6 +96,7 @@ const (
 	ServerTypeUnset  ContentServerType = iota - 1
 	ServerTypeSbc                      // means the images should be downloaded through the provided sbc API
 	ServerTypeStatic                   // means the images should be downloaded directly from the provided CDN
+	ServerTypePtimg                    // means each image comes with ptimg metadata on how to descramble it, see Ptimg
 )
 
 type ParamsGetter func(binb *Api, method string) map[string][]string
@@ -107,6 +111,13 @@ type Api struct {
 	ServerType              ContentServerType
 	Session                 *http.Client
 	Params                  ParamsGetter
+	// Detected from the content info. See ApiRevision.
+	Revision ApiRevision
+	// How each page is served. See DeliveryMode.
+	deliveries []DeliveryMode
+	// The metadata of the pages served as ptimg tile sets, by page.
+	ptimgs map[int]*Ptimg
+	ptimgM sync.Mutex
 }
 
 type Response struct {
@@ -124,6 +135,8 @@ type ContentInfoResponse struct {
 	ServerType                             ContentServerType
 	Title, TitleRuby                       string
 	P, Ctbl, Ptbl, Atbl, Ttbl              string
+	// Only sent by the current revision.
+	ViewMode *int
 }
 
 type ContentResponse struct {
@@ -147,6 +160,7 @@ func NewApi(bib, cid string, session *http.Client, params ParamsGetter) *Api {
 		Session:    session,
 		Params:     params,
 		K:          generateK(),
+		ptimgs:     make(map[int]*Ptimg),
 	}
 	res.Bib = strings.TrimSuffix(bib, "/")
 	res.Cid = cid
@@ -163,6 +177,8 @@ func (binb *Api) GetContentInfo() error {
 	params := url.Values{}
 	params.Set("cid", binb.Cid)
 	params.Set("k", binb.K)
+	// Ignored by servers running the 2016 revision.
+	params.Set("dmytime", dmytime())
 	extraParams := binb.Params(binb, method)
 	for k, v := range extraParams {
 		params[k] = v
@@ -197,6 +213,19 @@ func (binb *Api) GetContentInfo() error {
 		return err
 	}
 	binb.ContentInfo = &info
+	binb.Revision = detectRevision(&info)
+	log.WithField("revision", binb.Revision).Debug("Detected the API revision.")
+
+	// Get the content server.
+	binb.ContentServer = strings.TrimSuffix(binb.ContentInfo.ContentsServer, "/")
+	binb.ServerType = binb.ContentInfo.ServerType
+
+	// Contents on ptimg servers have their scramble data in the metadata
+	// of each page instead, and some contents aren't scrambled at all.
+	if info.Ctbl == "" && info.Ptbl == "" {
+		log.Debug("The content has no scramble data.")
+		return nil
+	}
 
 	// Get encrypted scramble data if present and process it.
 	// Get the decrypted bytes.
@@ -218,16 +247,13 @@ func (binb *Api) GetContentInfo() error {
 		return err
 	}
 
-	// Create a descrambler with the decrypted data.
-	binb.Descrambler, err = NewDescrambler(c, p)
+	// Create a descrambler with the decrypted data, or reuse the one from
+	// the last time we got this content.
+	binb.Descrambler, err = cachedDescrambler(binb.Cid, c, p)
 	if err != nil {
 		return err
 	}
 
-	// Get the content server.
-	binb.ContentServer = strings.TrimSuffix(binb.ContentInfo.ContentsServer, "/")
-	binb.ServerType = binb.ContentInfo.ServerType
-
 	return nil
 }
 
@@ -250,6 +276,7 @@ func (binb *Api) GetContent() error {
 		params := url.Values{}
 		params.Set("cid", binb.Cid)
 		params.Set("p", binb.ContentInfo.P)
+		binb.revisionParams(params)
 		extraParams := binb.Params(binb, method)
 		for k, v := range extraParams {
 			params[k] = v
@@ -271,28 +298,13 @@ func (binb *Api) GetContent() error {
 		if err != nil {
 			return err
 		}
-		var content ContentResponse
-		if err := json.Unmarshal(s, &content); err != nil {
-			return err
-		}
-		binb.Content = &content
-		paths := reTtxImagePath.FindAllStringSubmatch(content.Ttx, -1)
-		if paths == nil {
-			return errors.New("No image listing found.")
-		}
-		// Populate the Pages and FullPages members.
-		binb.Pages = make([]string, content.SmlImageCnt)
-		binb.FullPages = make([]string, content.SmlImageCnt)
-		for i := 0; i < content.SmlImageCnt; i++ {
-			full := paths[i][1]
-			binb.FullPages[i] = full
-			// For Pages, only keep the base filename.
-			binb.Pages[i] = full[strings.LastIndex(full, "/")+1:]
-		}
 
-		return nil
+		return binb.setContent(s)
 	case ServerTypeStatic:
 		url := fmt.Sprintf(staticContentUrlFmt, binb.ContentServer)
+		if binb.Revision == RevisionCurrent {
+			url += "?dmytime=" + dmytime()
+		}
 		log.WithField("url", url).Debug("Getting content from CDN...")
 
 		r, err := binb.Session.Get(url)
@@ -312,83 +324,132 @@ func (binb *Api) GetContent() error {
 			return fmt.Errorf("content.js length shorter than expected: %d", len(s))
 		}
 		// Strip the JS and only leave the JSON.
-		s = s[16 : len(s)-1]
-		// Go ahead and unmarshal it.
-		var content ContentResponse
-		if err := json.Unmarshal(s, &content); err != nil {
+		return binb.setContent(s[16 : len(s)-1])
+	case ServerTypePtimg:
+		params := url.Values{}
+		binb.revisionParams(params)
+		url := fmt.Sprintf(ptimgContentUrlFmt, binb.ContentServer, params.Encode())
+		log.WithField("url", url).Debug("Getting content from the ptimg server...")
+
+		r, err := binb.Session.Get(url)
+		if err != nil {
 			return err
 		}
-		binb.Content = &content
-		paths := reTtxImagePath.FindAllStringSubmatch(content.Ttx, -1)
-		if paths == nil {
-			return errors.New("No image listing found.")
+		defer r.Body.Close()
+		if r.StatusCode != http.StatusOK {
+			return fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
 		}
-		// Populate the Pages and FullPages members.
-		binb.Pages = make([]string, content.SmlImageCnt)
-		binb.FullPages = make([]string, content.SmlImageCnt)
-		for i := 0; i < content.SmlImageCnt; i++ {
-			full := paths[i][1]
-			binb.FullPages[i] = full
-			// For Pages, only keep the base filename.
-			binb.Pages[i] = full[strings.LastIndex(full, "/")+1:]
+
+		s, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		// Some servers still wrap it like content.js does.
+		s = bytes.TrimSpace(s)
+		if bytes.HasPrefix(s, []byte("DataGet_Content(")) && bytes.HasSuffix(s, []byte(")")) {
+			s = s[16 : len(s)-1]
 		}
 
-		return nil
+		return binb.setContent(s)
 	}
 
 	return fmt.Errorf("Unknown content server type: %d", binb.ServerType)
 }
 
+// Unmarshals the content and populates the Pages and FullPages members
+// from the image listing in it.
+func (binb *Api) setContent(s []byte) error {
+	var content ContentResponse
+	if err := json.Unmarshal(s, &content); err != nil {
+		return err
+	}
+	binb.Content = &content
+	paths := reTtxImagePath.FindAllStringSubmatch(content.Ttx, -1)
+	if paths == nil {
+		return errors.New("No image listing found.")
+	} else if len(paths) < content.SmlImageCnt {
+		return fmt.Errorf("Expected %d images, but only found %d.", content.SmlImageCnt, len(paths))
+	}
+	binb.Pages = make([]string, content.SmlImageCnt)
+	binb.FullPages = make([]string, content.SmlImageCnt)
+	binb.deliveries = make([]DeliveryMode, content.SmlImageCnt)
+	for i := 0; i < content.SmlImageCnt; i++ {
+		full := paths[i][1]
+		binb.FullPages[i] = full
+		// For Pages, only keep the base filename.
+		binb.Pages[i] = full[strings.LastIndex(full, "/")+1:]
+		binb.deliveries[i] = binb.deliveryMode(full)
+	}
+
+	return nil
+}
+
 func (binb *Api) GetImage(page int) (io.ReadCloser, error) {
-	method := "get_image"
-	if err := binb.ensureContent(method); err != nil {
+	r, err := binb.imageRequest(page, http.MethodGet)
+	if err != nil {
 		return nil, err
 	}
 
+	return r.Body, nil
+}
+
+// Returns the size of an image as reported by the server without getting it.
+// The size is -1 if the server doesn't say.
+func (binb *Api) GetImageSize(page int) (int64, error) {
+	r, err := binb.imageRequest(page, http.MethodHead)
+	if err != nil {
+		return 0, err
+	}
+	r.Body.Close()
+
+	return r.ContentLength, nil
+}
+
+func (binb *Api) imageRequest(page int, httpMethod string) (*http.Response, error) {
+	if err := binb.ensureContent("get_image"); err != nil {
+		return nil, err
+	}
+
+	if binb.Delivery(page) == DeliveryPtimg {
+		return binb.ptimgImageRequest(page, httpMethod)
+	}
+
+	urls, err := binb.imageURLs(page)
+	if err != nil {
+		return nil, err
+	}
 	switch binb.ServerType {
 	case ServerTypeSbc:
-		// Start constructing the URL.
-		params := url.Values{}
-		params.Set("cid", binb.Cid)
-		params.Set("p", binb.ContentInfo.P)
-		params.Set("src", binb.FullPages[page])
-		// Some parameters to make the API return the largest image.
-		params.Set("h", "9999")
-		params.Set("q", "0")
-		extraParams := binb.Params(binb, method)
-		for k, v := range extraParams {
-			params[k] = v
-		}
-		url := fmt.Sprintf(sbcApi[method], binb.ContentServer, params.Encode())
-		log.WithField("url", url).Debugf("Calling %s...", method)
-
-		r, err := binb.Session.Get(url)
+		log.WithField("url", urls[0]).Debug("Calling get_image...")
+		r, err := binb.do(httpMethod, urls[0])
 		if err != nil {
 			return nil, err
 		} else if r.StatusCode != http.StatusOK {
+			r.Body.Close()
 			return nil, fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
 		}
 
-		return r.Body, nil
+		return r, nil
 	case ServerTypeStatic:
-		for _, size := range StaticImageSizes {
-			url := fmt.Sprintf(staticImageUrlFmt, binb.ContentServer, binb.FullPages[page], size)
+		for i, url := range urls {
 			log.WithField("url", url).Debug("Getting image from CDN...")
 
-			r, err := binb.Session.Get(url)
+			r, err := binb.do(httpMethod, url)
 			if err != nil {
 				return nil, err
 			} else if r.StatusCode == http.StatusNotFound {
-				log.WithField("size", size).Debug("Image not found.")
+				r.Body.Close()
+				log.WithField("size", StaticImageSizes[i]).Debug("Image not found.")
 				continue
 			} else if r.StatusCode != http.StatusOK {
+				r.Body.Close()
 				// Some servers might return something other than 404 even if
 				// the directory exists but perhaps not that particular image
 				// size, so we do not return an error right away.
 				log.Debugf("HTTP request returned error code: %d", r.StatusCode)
 				continue
 			}
-			return r.Body, nil
+			return r, nil
 		}
 
 		// Tried all image sizes but never got an image.
@@ -398,10 +459,130 @@ func (binb *Api) GetImage(page int) (io.ReadCloser, error) {
 	return nil, fmt.Errorf("Unknown content server type: %d", binb.ServerType)
 }
 
+// Returns requests for the image of a page that isn't a ptimg tile set,
+// for when it can be saved as it is. If there's more than one, they're the
+// image in different sizes, best first, to fall back on in turn.
+func (binb *Api) ImageRequests(page int) ([]*http.Request, error) {
+	if err := binb.ensureContent("get_image"); err != nil {
+		return nil, err
+	} else if binb.Delivery(page) == DeliveryPtimg {
+		return nil, errors.New("ptimg pages can't be saved as they are.")
+	}
+
+	urls, err := binb.imageURLs(page)
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]*http.Request, len(urls))
+	for i, url := range urls {
+		if reqs[i], err = http.NewRequest(http.MethodGet, url, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return reqs, nil
+}
+
+// The URLs the image of a page can be gotten from, in the order to try them.
+func (binb *Api) imageURLs(page int) ([]string, error) {
+	switch binb.ServerType {
+	case ServerTypeSbc:
+		method := "get_image"
+		// Start constructing the URL.
+		params := url.Values{}
+		params.Set("cid", binb.Cid)
+		params.Set("p", binb.ContentInfo.P)
+		params.Set("src", binb.FullPages[page])
+		// Some parameters to make the API return the largest image.
+		params.Set("h", "9999")
+		params.Set("q", "0")
+		binb.revisionParams(params)
+		extraParams := binb.Params(binb, method)
+		for k, v := range extraParams {
+			params[k] = v
+		}
+
+		return []string{fmt.Sprintf(sbcApi[method], binb.ContentServer, params.Encode())}, nil
+	case ServerTypeStatic:
+		urls := make([]string, len(StaticImageSizes))
+		for i, size := range StaticImageSizes {
+			urls[i] = fmt.Sprintf(staticImageUrlFmt, binb.ContentServer, binb.FullPages[page], size)
+		}
+
+		return urls, nil
+	}
+
+	return nil, fmt.Errorf("Unknown content server type: %d", binb.ServerType)
+}
+
 // ====================================================================
 //                               HELPERS
 // ====================================================================
 
+// The image of a page served as a ptimg tile set, which is next to its
+// metadata.
+func (binb *Api) ptimgImageRequest(page int, httpMethod string) (*http.Response, error) {
+	pt, err := binb.ptimg(page)
+	if err != nil {
+		return nil, err
+	}
+	url := binb.ContentServer + "/" + path.Join(path.Dir(binb.FullPages[page]), pt.ImageSrc())
+	log.WithField("url", url).Debug("Getting image from the ptimg server...")
+
+	r, err := binb.do(httpMethod, url)
+	if err != nil {
+		return nil, err
+	} else if r.StatusCode != http.StatusOK {
+		r.Body.Close()
+		return nil, fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
+	}
+
+	return r, nil
+}
+
+// Returns the metadata of a page of a ptimg content, getting it the first
+// time it's needed.
+func (binb *Api) ptimg(page int) (*Ptimg, error) {
+	binb.ptimgM.Lock()
+	pt, ok := binb.ptimgs[page]
+	binb.ptimgM.Unlock()
+	if ok {
+		return pt, nil
+	}
+
+	url := binb.ContentServer + "/" + binb.FullPages[page]
+	log.WithField("url", url).Debug("Getting ptimg metadata...")
+	r, err := binb.do(http.MethodGet, url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if pt, err = ParsePtimg(data); err != nil {
+		return nil, err
+	}
+
+	binb.ptimgM.Lock()
+	binb.ptimgs[page] = pt
+	binb.ptimgM.Unlock()
+	return pt, nil
+}
+
+func (binb *Api) do(method, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return binb.Session.Do(req)
+}
+
 func generateK() string {
 	var res bytes.Buffer
 	now := time.Now()
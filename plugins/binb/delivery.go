@@ -0,0 +1,92 @@
+package binb
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"image"
+	"io"
+	"strings"
+)
+
+// How the image of a page is served. A content can mix them, e.g. a volume
+// on a regular server with some of its pages sliced into ptimg tile sets.
+type DeliveryMode int
+
+const (
+	// A single image scrambled with the content's ctbl and ptbl.
+	DeliveryScrambled DeliveryMode = iota
+	// An image scrambled into tiles, with ptimg metadata on where each goes.
+	DeliveryPtimg
+	// The image as it is, for contents without any scramble data.
+	DeliveryOriginal
+)
+
+const ptimgExt = ".ptimg.json"
+
+var ErrNoScrambleData = errors.New("The page is scrambled, but the content has no scramble data.")
+
+func (mode DeliveryMode) String() string {
+	switch mode {
+	case DeliveryScrambled:
+		return "scrambled"
+	case DeliveryPtimg:
+		return "ptimg"
+	case DeliveryOriginal:
+		return "original"
+	}
+
+	return "unknown"
+}
+
+// Tells how a page is served from its path in the content and what the
+// content info said.
+func (binb *Api) deliveryMode(full string) DeliveryMode {
+	if binb.ServerType == ServerTypePtimg || strings.HasSuffix(full, ptimgExt) {
+		return DeliveryPtimg
+	} else if binb.Descrambler == nil {
+		return DeliveryOriginal
+	}
+
+	return DeliveryScrambled
+}
+
+// How the image of a page is served. Only valid after GetContent().
+func (binb *Api) Delivery(page int) DeliveryMode {
+	return binb.deliveries[page]
+}
+
+// Descrambles an image gotten with GetImage() in whatever way the page
+// needs.
+func (binb *Api) Descramble(page int, reader io.Reader) (image.Image, error) {
+	switch binb.Delivery(page) {
+	case DeliveryPtimg:
+		pt, err := binb.ptimg(page)
+		if err != nil {
+			return nil, err
+		}
+		return pt.Descramble(reader)
+	case DeliveryOriginal:
+		img, _, err := image.Decode(reader)
+		return img, err
+	}
+
+	if binb.Descrambler == nil {
+		return nil, ErrNoScrambleData
+	}
+	return binb.Descrambler.Descramble(binb.Pages[page], reader)
+}
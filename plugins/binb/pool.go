@@ -0,0 +1,51 @@
+package binb
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import "runtime"
+
+// Limits how many pages are descrambled and encoded at once, separately from
+// how many are being downloaded. Decoding, descrambling and especially PNG
+// encoding are CPU-bound, so running one per network worker just has them
+// fight over the CPUs while holding a full image each, whereas a worker that's
+// only waiting on the network shouldn't have to wait for a CPU too.
+type CPUPool struct {
+	sem chan struct{}
+}
+
+// Makes a pool running at most workers functions at once, or GOMAXPROCS
+// if workers isn't positive.
+func NewCPUPool(workers int) *CPUPool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	return &CPUPool{sem: make(chan struct{}, workers)}
+}
+
+// Runs f once there's a free CPU worker and returns its error.
+func (p *CPUPool) Do(f func() error) error {
+	p.sem <- struct{}{}
+	defer func() { <-p.sem }()
+
+	return f()
+}
+
+// How many functions can run at once.
+func (p *CPUPool) Workers() int {
+	return cap(p.sem)
+}
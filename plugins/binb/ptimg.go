@@ -0,0 +1,92 @@
+package binb
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"regexp"
+	"strconv"
+
+	"github.com/MinoMino/mindl/logger"
+)
+
+// A piece of the image: "i:<x>,<y>+<width>,<height>><dst x>,<dst y>".
+var rePtimgCoord = regexp.MustCompile(`^(\w+):(\d+),(\d+)\+(\d+),(\d+)>(\d+),(\d+)$`)
+
+// The metadata of a page on a ptimg server, which comes as a JSON file next
+// to the image. Instead of ctbl and ptbl, it says where each piece of the
+// image goes.
+type Ptimg struct {
+	Resources map[string]struct {
+		Src           string
+		Width, Height int
+	}
+	Views []struct {
+		Width, Height int
+		Coords        []string
+	}
+}
+
+func ParsePtimg(data []byte) (*Ptimg, error) {
+	var pt Ptimg
+	if err := json.Unmarshal(data, &pt); err != nil {
+		return nil, err
+	} else if len(pt.Views) == 0 {
+		return nil, errors.New("The ptimg has no views.")
+	} else if pt.Resources["i"].Src == "" {
+		return nil, errors.New("The ptimg has no image.")
+	}
+
+	return &pt, nil
+}
+
+// The path of the scrambled image, relative to the metadata.
+func (pt *Ptimg) ImageSrc() string {
+	return pt.Resources["i"].Src
+}
+
+// Puts the pieces of the scrambled image back in place.
+func (pt *Ptimg) Descramble(reader io.Reader) (image.Image, error) {
+	img, _, err := image.Decode(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	view := pt.Views[0]
+	res := image.NewRGBA(image.Rect(0, 0, view.Width, view.Height))
+	for _, coord := range view.Coords {
+		m := rePtimgCoord.FindStringSubmatch(coord)
+		if m == nil {
+			log.WithFields(logger.Fields{"coord": coord}).Debug("Invalid ptimg coordinate.")
+			return nil, errors.New("Invalid ptimg coordinate.")
+		}
+		n := make([]int, 6)
+		for i := range n {
+			n[i], _ = strconv.Atoi(m[i+2])
+		}
+
+		src := image.Pt(n[0], n[1])
+		dst := image.Rect(n[4], n[5], n[4]+n[2], n[5]+n[3])
+		draw.Draw(res, dst, img, src, draw.Src)
+	}
+
+	return res, nil
+}
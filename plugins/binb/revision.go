@@ -0,0 +1,73 @@
+package binb
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Revisions of the API. The package was written against the 2016 one.
+// Readers since then add a timestamp to every call to get around caches,
+// pass the content's view mode along with the p value, and can serve
+// contents from ptimg servers.
+type ApiRevision int
+
+const (
+	RevisionUnknown ApiRevision = iota
+	Revision2016
+	RevisionCurrent
+)
+
+func (rev ApiRevision) String() string {
+	switch rev {
+	case Revision2016:
+		return "2016"
+	case RevisionCurrent:
+		return "current"
+	}
+
+	return "unknown"
+}
+
+// Tells the revision of a content from its info. Only the current revision
+// sends a view mode, and ptimg servers didn't exist before it.
+func detectRevision(info *ContentInfoResponse) ApiRevision {
+	if info.ViewMode != nil || info.ServerType == ServerTypePtimg {
+		return RevisionCurrent
+	}
+
+	return Revision2016
+}
+
+// Adds what the revision needs on top of the parameters of a content call.
+func (binb *Api) revisionParams(params url.Values) {
+	if binb.Revision != RevisionCurrent {
+		return
+	}
+
+	params.Set("dmytime", dmytime())
+	if binb.ContentInfo != nil && binb.ContentInfo.ViewMode != nil {
+		params.Set("vm", strconv.Itoa(*binb.ContentInfo.ViewMode))
+	}
+}
+
+// The cache buster the current reader adds to its calls, in milliseconds.
+func dmytime() string {
+	return strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+}
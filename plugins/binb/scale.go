@@ -0,0 +1,82 @@
+package binb
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Scales the image down to the given height, keeping its aspect ratio, by
+// averaging the pixels each new one covers. Images that are no taller are
+// returned as they are. Otherwise, the result can be handed to Recycle
+// separately from the original.
+func Downscale(img image.Image, height int) image.Image {
+	bounds := img.Bounds()
+	if height <= 0 || bounds.Dy() <= height {
+		return img
+	}
+
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = newRGBA(bounds.Dx(), bounds.Dy())
+		draw.Draw(src, src.Rect, img, bounds.Min, draw.Src)
+		defer Recycle(src)
+		bounds = src.Rect
+	}
+	width := bounds.Dx() * height / bounds.Dy()
+	if width < 1 {
+		width = 1
+	}
+
+	res := newRGBA(width, height)
+	for y := 0; y < height; y++ {
+		y0, y1 := span(y, height, bounds.Min.Y, bounds.Dy())
+		for x := 0; x < width; x++ {
+			x0, x1 := span(x, width, bounds.Min.X, bounds.Dx())
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					a += int(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			o := res.PixOffset(x, y)
+			res.Pix[o] = uint8(r / n)
+			res.Pix[o+1] = uint8(g / n)
+			res.Pix[o+2] = uint8(b / n)
+			res.Pix[o+3] = uint8(a / n)
+		}
+	}
+
+	return res
+}
+
+// Returns the range of source pixels that the ith of n new ones covers.
+func span(i, n, min, size int) (int, int) {
+	start, end := min+i*size/n, min+(i+1)*size/n
+	if end == start {
+		end++
+	}
+
+	return start, end
+}
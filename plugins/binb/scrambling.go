@@ -19,10 +19,12 @@ package binb
 import (
 	"errors"
 	"image"
+	"image/draw"
 	"io"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	_ "image/jpeg"
 	_ "image/png"
@@ -90,6 +92,8 @@ type Descrambler struct {
 	keyType              scrambleKeyType
 	data                 []interface{}
 	rectangleCollections [][]*scrambleRectanglesCollection
+	// Pages are usually descrambled by several workers at once.
+	rectangleM sync.Mutex
 }
 
 func NewDescrambler(ctbl, ptbl []string) (*Descrambler, error) {
@@ -428,6 +432,43 @@ func (ds *Descrambler) rectanglesType2(cIndex, pIndex, srcWidth, srcHeight int)
 	}, nil
 }
 
+/*
+If we've previously calculated the rectangles for these indices and the
+source image resolution hasn't changed, we'll reuse it. Otherwise calculate
+the rectangles and save them for potential future use.
+
+All this makes the code quite a bit more convoluted, but we'll often find
+ourselves descrambling ~200 images of the same resolution with usually a max
+of 64 different combinations of rectangles, so it's probably worth the trouble.
+*/
+func (ds *Descrambler) rectangles(c, p, srcWidth, srcHeight int) (*scrambleRectanglesCollection, error) {
+	ds.rectangleM.Lock()
+	defer ds.rectangleM.Unlock()
+	col := ds.rectangleCollections[c][p]
+	if col != nil && srcWidth == col.srcWidth && srcHeight == col.srcHeight {
+		return col, nil
+	}
+
+	var err error
+	switch ds.keyType {
+	case type1:
+		col, err = ds.rectanglesType1(c, p, srcWidth, srcHeight)
+	case type2:
+		col, err = ds.rectanglesType2(c, p, srcWidth, srcHeight)
+	default:
+		log.WithField("type", ds.keyType).Debug("Found unknown key type while descrambling.")
+		return nil, errors.New("Tried to descramble with unknown key type.")
+	}
+	if err != nil {
+		return nil, err
+	}
+	ds.rectangleCollections[c][p] = col
+
+	return col, nil
+}
+
+// Descrambles an image. The result can be handed to Recycle once it's been
+// encoded so that its pixels can be reused for the next page.
 func (ds *Descrambler) Descramble(filename string, reader io.Reader) (image.Image, error) {
 	img, _, err := image.Decode(reader)
 	if err != nil {
@@ -435,49 +476,50 @@ func (ds *Descrambler) Descramble(filename string, reader io.Reader) (image.Imag
 	}
 
 	bounds := img.Bounds()
-	srcWidth := bounds.Dx()
-	srcHeight := bounds.Dy()
-
 	c, p := cpIndex(filename)
-
-	/*
-		If we've previously calculated the rectangles for these indices and the
-		source image resolution hasn't changed, we'll reuse it. Otherwise calculate
-		the rectangles and save them for potential future use.
-
-		All this makes the code quite a bit more convoluted, but we'll often find
-		ourselves descrambling ~200 images of the same resolution with usually a max
-		of 64 different combinations of rectangles, so it's probably worth the trouble.
-	*/
-	col := &ds.rectangleCollections[c][p]
-	if *col == nil || (*col != nil && (srcWidth != (*col).srcWidth || srcHeight != (*col).srcHeight)) {
-		switch ds.keyType {
-		case type1:
-			*col, err = ds.rectanglesType1(c, p, srcWidth, srcHeight)
-		case type2:
-			*col, err = ds.rectanglesType2(c, p, srcWidth, srcHeight)
-		default:
-			log.WithField("type", ds.keyType).Debug("Found unknown key type while descrambling.")
-			return nil, errors.New("Tried to descramble with unknown key type.")
-		}
-	}
-
+	col, err := ds.rectangles(c, p, bounds.Dx(), bounds.Dy())
 	if err != nil {
 		return nil, err
 	}
 
-	res := image.NewRGBA(image.Rect(0, 0, (*col).dstWidth, (*col).dstHeight))
-	for _, rect := range (*col).rectangles {
-		for x := 0; x < rect.width; x++ {
-			for y := 0; y < rect.height; y++ {
-				res.Set(x+rect.dst.X, y+rect.dst.Y, img.At(x+rect.src.X, y+rect.src.Y))
-			}
-		}
+	// Copy the tiles straight out of the decoded image, which for JPEGs is
+	// still in YCbCr, instead of converting the whole thing first. draw has
+	// fast paths for both that and RGBA, unlike going pixel by pixel.
+	res := newRGBA(col.dstWidth, col.dstHeight)
+	for _, rect := range col.rectangles {
+		dst := image.Rect(rect.dst.X, rect.dst.Y, rect.dst.X+rect.width, rect.dst.Y+rect.height)
+		draw.Draw(res, dst, img, bounds.Min.Add(rect.src), draw.Src)
 	}
 
 	return res, nil
 }
 
+// The pixels of descrambled images that have been encoded already.
+var pixPool sync.Pool
+
+// Gets an RGBA image, reusing the pixels of a recycled one if big enough.
+// Everything gets overwritten when descrambling, so they aren't cleared.
+func newRGBA(width, height int) *image.RGBA {
+	n := 4 * width * height
+	if pix, ok := pixPool.Get().([]uint8); ok && cap(pix) >= n {
+		return &image.RGBA{
+			Pix:    pix[:n],
+			Stride: 4 * width,
+			Rect:   image.Rect(0, 0, width, height),
+		}
+	}
+
+	return image.NewRGBA(image.Rect(0, 0, width, height))
+}
+
+// Lets the pixels of a descrambled image be reused. The image must not be
+// used afterwards.
+func Recycle(img image.Image) {
+	if rgba, ok := img.(*image.RGBA); ok {
+		pixPool.Put(rgba.Pix[:0])
+	}
+}
+
 // Helpers.
 
 func tnp(data string, h, v int) ([]int, []int, []int) {
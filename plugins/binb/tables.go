@@ -0,0 +1,101 @@
+package binb
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"image"
+	"sync"
+)
+
+// How many contents' descramblers are kept around.
+const maxCachedDescramblers = 16
+
+// The descramblers of the contents seen last, by cid. Estimating a content
+// and then downloading it, or downloading it again, gets the same tables
+// every time, so there's no need to parse them and work out the rectangles
+// all over again.
+var descramblers = struct {
+	m map[string]*Descrambler
+	sync.Mutex
+}{m: make(map[string]*Descrambler)}
+
+// Returns the cached descrambler of a content if it was made from the same
+// tables, or makes and caches a new one.
+func cachedDescrambler(cid string, ctbl, ptbl []string) (*Descrambler, error) {
+	descramblers.Lock()
+	defer descramblers.Unlock()
+	if ds, ok := descramblers.m[cid]; ok && equalStrings(ds.Ctbl, ctbl) && equalStrings(ds.Ptbl, ptbl) {
+		log.WithField("cid", cid).Debug("Using the cached scramble tables.")
+		return ds, nil
+	}
+
+	ds, err := NewDescrambler(ctbl, ptbl)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := descramblers.m[cid]; !ok && len(descramblers.m) >= maxCachedDescramblers {
+		// Which one goes doesn't matter much.
+		for k := range descramblers.m {
+			delete(descramblers.m, k)
+			break
+		}
+	}
+	descramblers.m[cid] = ds
+
+	return ds, nil
+}
+
+// A rectangle of a scrambled image and where it goes in the descrambled one.
+type Tile struct {
+	Src, Dst image.Rectangle
+}
+
+// Returns where each tile of a scrambled image of the given size goes, and
+// the size of the descrambled image. This is all the descrambling there is
+// to it, so golden fixtures of the tiles for known tables catch regressions
+// without needing any images.
+func (ds *Descrambler) Tiles(filename string, srcWidth, srcHeight int) ([]Tile, image.Rectangle, error) {
+	c, p := cpIndex(filename)
+	col, err := ds.rectangles(c, p, srcWidth, srcHeight)
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+
+	tiles := make([]Tile, len(col.rectangles))
+	for i, rect := range col.rectangles {
+		size := image.Pt(rect.width, rect.height)
+		tiles[i] = Tile{
+			Src: image.Rectangle{rect.src, rect.src.Add(size)},
+			Dst: image.Rectangle{rect.dst, rect.dst.Add(size)},
+		}
+	}
+
+	return tiles, image.Rect(0, 0, col.dstWidth, col.dstHeight), nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
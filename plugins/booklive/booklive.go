@@ -22,11 +22,13 @@ import (
 	"fmt"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -43,18 +45,29 @@ var log = logger.GetLog(name)
 var (
 	ErrBookLiveUnknownCid  = errors.New("CID format not <title_id>_<volume>.")
 	ErrBookLiveUnknownUrl  = errors.New("URL could not be parsed.")
-	ErrBookLiveFailedLogin = errors.New("Failed to login. Wrong credentials?")
+	ErrBookLiveFailedLogin = plugins.NewAuthError("Failed to login. Wrong credentials?")
 	ErrBookLiveLoginScreen = errors.New("Error while getting login token.")
+	ErrBookLiveCaptcha     = plugins.NewAuthError("Failed to solve the captcha on the login page.")
+	ErrBookLiveNoLogin     = plugins.NewAuthError("Set Username and Password, SocialLogin for accounts made with other sites' logins, or Cookies.")
 )
 
 var Plugin = BookLive{
-	[]plugins.Option{
-		&plugins.StringOption{K: "Username", Required: true},
-		&plugins.StringOption{K: "Password", Required: true},
+	options: []plugins.Option{
+		// Not required, since accounts made with social logins have neither,
+		// and the Cookies option can be used instead.
+		&plugins.StringOption{K: "Username"},
+		&plugins.SecretOption{StringOption: plugins.StringOption{K: "Password"}},
+		&plugins.BoolOption{K: "SocialLogin", V: false,
+			C: "Set to true for accounts made with a Yahoo! JAPAN, Google or Twitter login, and log in with it in a browser opened with --browser-login."},
+		plugins.NewCookiesOption(),
 		&plugins.BoolOption{K: "Lossless", V: false,
 			C: "If set to true, save as PNG. Original images are in JPEG, so you can't escape some artifacts even with this on."},
 		&plugins.IntOption{K: "JPEGQuality", V: 95,
 			C: "Does nothing if Lossless is on. >95 not adviced, as it increases file size a ton with little improvement."},
+		&plugins.IntOption{K: "MaxHeight", V: 0,
+			C: "Scale pages down to at most this many pixels tall, e.g. to fit a phone's screen. 0 to keep them as they are."},
+		&plugins.IntOption{K: "CPUWorkers", V: 0,
+			C: "How many pages can be descrambled and saved at once, regardless of the number of workers downloading them. 0 to use one per CPU."},
 		&plugins.BoolOption{K: "Metadata", V: true},
 	},
 }
@@ -63,19 +76,24 @@ const (
 	urlApi         = "https://booklive.jp/bib-api/"
 	urlLoginScreen = "https://booklive.jp/login"
 	urlLogin       = "https://booklive.jp/login/index"
+	urlMyPage      = "https://booklive.jp/mypage"
 )
 
 var urlBookLive, _ = url.ParseRequestURI("https://booklive.jp/")
 
 var (
-	reBook        = regexp.MustCompile(`^https?://booklive.jp/product/index/title_id/(?P<title_id>[0-9]+?)/vol_no/(?P<volume>[0-9]+?)$`)
-	reReader      = regexp.MustCompile(`^https?://booklive.jp/bviewer/\?cid=(?P<cid>[_0-9]+)`)
-	reTokenSearch = regexp.MustCompile(`input type="hidden" name="token" value="(.+?)">`)
-	reTitleClean  = regexp.MustCompile(`.+?( ?\([0-9]+\)| ?[0-9]+巻)$`)
+	reBook       = regexp.MustCompile(`^https?://booklive.jp/product/index/title_id/(?P<title_id>[0-9]+?)/vol_no/(?P<volume>[0-9]+?)$`)
+	reSeries     = regexp.MustCompile(`^https?://booklive.jp/product/index/title_id/(?P<title_id>[0-9]+?)/?$`)
+	reSeriesBook = regexp.MustCompile(`/product/index/title_id/([0-9]+)/vol_no/([0-9]+)`)
+	reReader     = regexp.MustCompile(`^https?://booklive.jp/bviewer/\?cid=(?P<cid>[_0-9]+)`)
+	reSiteKey    = regexp.MustCompile(`class="(g-recaptcha|h-captcha)"[^>]*?data-sitekey="(.+?)"`)
+	reTitleClean = regexp.MustCompile(`.+?( ?\([0-9]+\)| ?[0-9]+巻)$`)
 )
 
 type BookLive struct {
 	options []plugins.Option
+	// Whether the session has been checked to still be valid this run.
+	validated bool
 }
 
 func (bl *BookLive) Name() string {
@@ -97,28 +115,20 @@ func (bl *BookLive) Options() []plugins.Option {
 func (bl *BookLive) DownloadGenerator(url string) (dlgen func() plugins.Downloader, length int) {
 	// Initialization.
 	var ext string
-	cid, volume := bl.getCidAndVolume(url)
 	opts := plugins.OptionsToMap(bl.options)
 	if opts["Lossless"].(bool) {
 		ext = "png"
 	} else {
 		ext = "jpg"
 	}
-	client := plugins.NewHTTPClient(20)
-	bl.login(client, opts["Username"].(string), opts["Password"].(string))
-	api := binb.NewApi(urlApi, cid, client, nil)
+	api, volume := bl.getContent(url)
 	if err := api.GetContent(); err != nil {
 		panic(err)
 	}
 	length = len(api.Pages)
-
-	// Clean up the title from the volume inserted by them, then apply it ourselves.
-	title := norm.NFKC.String(api.ContentInfo.Title)
-	re := reTitleClean.FindStringSubmatch(title)
-	if re != nil {
-		title = title[:len(title)-len(re[1])]
-	}
-	dir := fmt.Sprintf("%s 第%02d巻", title, volume)
+	dir := fmt.Sprintf("%s 第%02d巻", cleanTitle(api.ContentInfo.Title), volume)
+	pool := binb.NewCPUPool(opts["CPUWorkers"].(int))
+	log.Debugf("Descrambling with %d CPU workers.", pool.Workers())
 
 	i := 0
 	// Generator.
@@ -130,6 +140,18 @@ func (bl *BookLive) DownloadGenerator(url string) (dlgen func() plugins.Download
 		i++
 		// Downloader
 		return func(n int, rep plugins.Reporter) error {
+			path := filepath.Join(dir, fmt.Sprintf("%04d.%s", n+1, ext))
+			if api.Delivery(n) == binb.DeliveryOriginal && !opts["Lossless"].(bool) && opts["MaxHeight"].(int) <= 0 {
+				// Nothing to descramble, so save the original JPEG as it is
+				// instead of encoding it again.
+				reqs, err := api.ImageRequests(n)
+				if err != nil {
+					return err
+				}
+				_, err = rep.SaveURL(path, api.Session, reqs[0], reqs[1:]...)
+				return err
+			}
+
 			r, err := api.GetImage(n)
 			if err != nil {
 				return err
@@ -142,37 +164,267 @@ func (bl *BookLive) DownloadGenerator(url string) (dlgen func() plugins.Download
 				return err
 			}
 
-			img, err := api.Descrambler.Descramble(api.Pages[n], buf)
-			path := filepath.Join(dir, fmt.Sprintf("%04d.%s", n+1, ext))
-			if opts["Lossless"].(bool) {
-				// Save as PNG.
-				w, err := rep.FileWriter(path, false)
+			// The download is done, so let the CPU workers take it from here.
+			return pool.Do(func() error {
+				img, err := api.Descramble(n, buf)
 				if err != nil {
-					panic(err)
+					return err
+				}
+				defer binb.Recycle(img)
+				if scaled := binb.Downscale(img, opts["MaxHeight"].(int)); scaled != img {
+					defer binb.Recycle(scaled)
+					img = scaled
 				}
-				defer w.Close()
 
-				enc := png.Encoder{}
-				return enc.Encode(w, img)
-			} else {
-				// Save as JPEG.
 				w, err := rep.FileWriter(path, false)
 				if err != nil {
-					panic(err)
+					return err
 				}
 				defer w.Close()
-				return jpeg.Encode(w, img, &jpeg.Options{Quality: opts["JPEGQuality"].(int)})
-			}
+				if opts["Lossless"].(bool) {
+					// Save as PNG.
+					enc := png.Encoder{}
+					return enc.Encode(w, img)
+				} else {
+					// Save as JPEG.
+					return jpeg.Encode(w, img, &jpeg.Options{Quality: opts["JPEGQuality"].(int)})
+				}
+			})
 		}
 	}
 	return
 }
 
+// Sums up the sizes of the scrambled images on the server. They're re-encoded
+// after descrambling, so it's only accurate-ish for JPEG and too low for PNG.
+func (bl *BookLive) Estimate(url string) (files int, size int64, err error) {
+	api, _ := bl.getContent(url)
+	if err := api.GetContent(); err != nil {
+		return 0, 0, err
+	}
+
+	for i := range api.Pages {
+		n, err := api.GetImageSize(i)
+		if err != nil {
+			return 0, 0, err
+		} else if n < 0 {
+			return len(api.Pages), -1, nil
+		}
+		size += n
+	}
+
+	return len(api.Pages), size, nil
+}
+
+func (bl *BookLive) Info(url string) (*plugins.ItemInfo, error) {
+	api, volume := bl.getContent(url)
+	if err := api.GetContent(); err != nil {
+		return nil, err
+	}
+
+	info := &plugins.ItemInfo{
+		Title:       cleanTitle(api.ContentInfo.Title),
+		Volume:      volume,
+		Pages:       len(api.Pages),
+		Description: api.ContentInfo.Abstract,
+	}
+	for _, author := range api.ContentInfo.Authors {
+		info.Authors = append(info.Authors, author.Name)
+	}
+
+	return info, nil
+}
+
+// Logs in and returns an API for the volume the URL points to.
+func (bl *BookLive) getContent(url string) (*binb.Api, int) {
+	cid, volume := bl.getCidAndVolume(url)
+	opts := plugins.OptionsToMap(bl.options)
+	client := plugins.NewPluginHTTPClient(bl.Name(), 20)
+	username, password := opts["Username"].(string), opts["Password"].(string)
+	if hasSession(client) && bl.validSession(client) {
+		log.Debug("Using the existing session.")
+	} else {
+		bl.login(client, username, password)
+		bl.validated = true
+	}
+	plugins.OnSessionExpired(client, checkSession, func(c *http.Client) error {
+		return plugins.RecoverLogin(func() { bl.login(c, username, password) })
+	})
+	return binb.NewApi(urlApi, cid, client, nil), volume
+}
+
+// Logs in with the options, replacing any existing session.
+func (bl *BookLive) Login() error {
+	opts := plugins.OptionsToMap(bl.options)
+	client := plugins.NewPluginHTTPClient(bl.Name(), 20)
+	err := plugins.RecoverLogin(func() { bl.login(client, opts["Username"].(string), opts["Password"].(string)) })
+	if err == nil {
+		bl.validated = true
+	}
+
+	return err
+}
+
+func (bl *BookLive) CookieDomains() []string {
+	return []string{"booklive.jp"}
+}
+
+// Whether or not the client has a session cookie, such as one from the
+// browser or a previous run.
+func hasSession(client *http.Client) bool {
+	return hasSessionCookie(client.Jar.Cookies(urlBookLive))
+}
+
+func hasSessionCookie(cookies []*http.Cookie) bool {
+	for _, cookie := range cookies {
+		if cookie.Name == "BL_LI" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks that a session from a previous run hasn't expired, since logging in
+// again for every volume of a series is slow and makes them add captchas.
+// Logged out users are redirected to the login page from their page.
+func (bl *BookLive) validSession(client *http.Client) bool {
+	if bl.validated {
+		return true
+	} else if !checkSession(client) {
+		return false
+	}
+
+	bl.validated = true
+	return true
+}
+
+// Checks whether the client is logged in.
+func checkSession(client *http.Client) bool {
+	c := *client
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	r, err := c.Do(plugins.NewGetRequest(urlMyPage))
+	if err != nil {
+		// Let it fail later if it's not just a hiccup.
+		log.Debugf("Failed to check the session: %s", err)
+		return true
+	}
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		log.Debug("The existing session has expired.")
+		return false
+	}
+
+	return true
+}
+
+// Cleans up the title from the volume inserted by them, so we can apply it ourselves.
+func cleanTitle(title string) string {
+	title = norm.NFKC.String(title)
+	if re := reTitleClean.FindStringSubmatch(title); re != nil {
+		title = title[:len(title)-len(re[1])]
+	}
+
+	return title
+}
+
+// Both the product page and the reader URLs point to the same volume.
+func (bl *BookLive) CanonicalURL(url string) string {
+	var titleID, volume string
+	if re := reBook.FindStringSubmatch(url); re != nil {
+		titleID, volume = re[1], re[2]
+	} else if re := reReader.FindStringSubmatch(url); re != nil {
+		if split := strings.SplitN(re[1], "_", 2); len(split) == 2 && split[0] != "" && split[1] != "" {
+			titleID, volume = split[0], split[1]
+		}
+	}
+	if titleID == "" {
+		// Can't tell which volume it is, so it can only be the same as itself.
+		return url
+	}
+
+	return fmt.Sprintf("https://booklive.jp/product/index/title_id/%s/vol_no/%s", titleID, volume)
+}
+
+func (bl *BookLive) CanList(url string) bool {
+	return reSeries.MatchString(url)
+}
+
+// Lists the volumes of a series by finding the links to them on its title page.
+func (bl *BookLive) List(url string) ([]string, error) {
+	titleID := reSeries.FindStringSubmatch(url)[1]
+	client := plugins.NewPluginHTTPClient(bl.Name(), 20)
+	r, err := client.Do(plugins.NewGetRequest(url))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// The same volume is usually linked more than once. Keep the volume
+	// number as it was in the link, since they tend to be zero-padded.
+	volumes := make(map[int]string)
+	for _, m := range reSeriesBook.FindAllStringSubmatch(string(body), -1) {
+		if m[1] != titleID {
+			continue
+		}
+		if vol, err := strconv.Atoi(m[2]); err == nil {
+			volumes[vol] = m[2]
+		}
+	}
+
+	vols := make([]int, 0, len(volumes))
+	for vol := range volumes {
+		vols = append(vols, vol)
+	}
+	sort.Ints(vols)
+	res := make([]string, len(vols))
+	for i, vol := range vols {
+		res[i] = fmt.Sprintf("https://booklive.jp/product/index/title_id/%s/vol_no/%s", titleID, volumes[vol])
+	}
+	log.WithField("title_id", titleID).Debugf("Found %d volume(s).", len(res))
+
+	return res, nil
+}
+
 func (bl *BookLive) Cleanup(err error) {
 
 }
 
+// Logs in, falling back on a browser if the form stops working and one was
+// set with --browser-login. Social logins can only be done in the browser.
 func (bl *BookLive) login(client *http.Client, username, password string) {
+	var err error
+	if plugins.OptionsToMap(bl.options)["SocialLogin"].(bool) {
+		err = plugins.LoginWithBrowser(client, &plugins.BrowserLogin{URL: urlLoginScreen, Done: hasSessionCookie})
+	} else if username == "" || password == "" {
+		err = ErrBookLiveNoLogin
+	} else {
+		err = plugins.RecoverLogin(func() { bl.loginWithForm(client, username, password) })
+		err = plugins.BrowserLoginFallback(client, err, &plugins.BrowserLogin{
+			URL:    urlLoginScreen,
+			Fields: map[string]string{`input[name="mail_addr"]`: username, `input[name="pswd"]`: password},
+			Submit: true,
+			Done:   hasSessionCookie,
+		})
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Logs in by posting the login form like the site's JavaScript does.
+func (bl *BookLive) loginWithForm(client *http.Client, username, password string) {
 	// First we get a login token.
 	var token string
 
@@ -188,21 +440,34 @@ func (bl *BookLive) login(client *http.Client, username, password string) {
 		log.Error(err)
 		panic(ErrBookLiveLoginScreen)
 	}
-	if re := reTokenSearch.FindStringSubmatch(string(body)); re == nil {
-		log.Error("Found no login token.")
+	if token, err = plugins.FormToken(body, "token"); err != nil {
+		log.Error(err)
 		panic(ErrBookLiveLoginScreen)
-	} else {
-		token = re[1]
 	}
 
-	// Then we login.
-	log.WithFields(logger.Fields{"token": token,
-		"username": username}).Debug("Logging in...")
-	r, err = client.Do(plugins.NewPostFormRequest(urlLogin, url.Values{
+	form := url.Values{
 		"mail_addr": {username},
 		"pswd":      {password},
 		"token":     {token},
-	}))
+	}
+	// They sometimes add a captcha when there have been too many logins.
+	if re := reSiteKey.FindStringSubmatch(string(body)); re != nil {
+		kind, field := plugins.CaptchaReCaptcha, "g-recaptcha-response"
+		if re[1] == "h-captcha" {
+			kind, field = plugins.CaptchaHCaptcha, "h-captcha-response"
+		}
+		answer, err := plugins.SolveCaptcha(&plugins.Captcha{Kind: kind, SiteKey: re[2], PageURL: urlLoginScreen})
+		if err != nil {
+			log.Error(err)
+			panic(ErrBookLiveCaptcha)
+		}
+		form.Set(field, answer)
+	}
+
+	// Then we login.
+	log.WithFields(logger.Fields{"token": token,
+		"username": username}).Debug("Logging in...")
+	r, err = client.Do(plugins.NewPostFormRequest(urlLogin, form))
 	if err != nil {
 		log.Error(err)
 		panic(ErrBookLiveFailedLogin)
@@ -213,17 +478,10 @@ func (bl *BookLive) login(client *http.Client, username, password string) {
 	}
 
 	// Confirm we logged in by checking cookies.
-	var logged bool
-	for _, cookie := range client.Jar.Cookies(urlBookLive) {
-		if cookie.Name == "BL_LI" {
-			log.WithField("session", cookie.Value).Debug("Logged in!")
-			logged = true
-			break
-		}
-	}
-	if !logged {
+	if !hasSession(client) {
 		panic(ErrBookLiveFailedLogin)
 	}
+	log.Debug("Logged in!")
 }
 
 func (bl *BookLive) getCidAndVolume(url string) (cid string, volume int) {
@@ -0,0 +1,71 @@
+package booklive
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+const urlSearch = "https://booklive.jp/search/keyword"
+
+// Searches the store for volumes by keyword, returning the ones on the
+// first page of results.
+func (bl *BookLive) Search(query string) ([]plugins.SearchResult, error) {
+	u, _ := url.Parse(urlSearch)
+	u.RawQuery = url.Values{"keyword": {query}}.Encode()
+	client := plugins.NewPluginHTTPClient(bl.Name(), 20)
+	r, err := client.Do(plugins.NewGetRequest(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every volume is usually linked from both its cover and its title, so
+	// they're merged, keeping the first title found.
+	var res []plugins.SearchResult
+	seen := make(map[string]int)
+	for _, link := range plugins.ParseLinks(body, r.Request.URL) {
+		m := reSeriesBook.FindStringSubmatch(link.URL)
+		if m == nil {
+			continue
+		}
+		vol := fmt.Sprintf("https://booklive.jp/product/index/title_id/%s/vol_no/%s", m[1], m[2])
+		if i, ok := seen[vol]; ok {
+			if res[i].Title == "" {
+				res[i].Title = link.Text
+			}
+			continue
+		}
+		seen[vol] = len(res)
+		res = append(res, plugins.SearchResult{Title: link.Text, URL: vol})
+	}
+
+	return res, nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"net/http"
 	"net/url"
 	"strconv"
 	"time"
@@ -14,8 +15,9 @@ import (
 )
 
 var (
-	ErrBookWalkerFailedAuth    = errors.New("Failed to authenticate for a book session.")
-	ErrBookWalkerFailedLogin   = errors.New("Failed to login. Wrong credentials?")
+	ErrBookWalkerFailedAuth    = plugins.NewAuthError("Failed to authenticate for a book session.")
+	ErrBookWalkerFailedLogin   = plugins.NewAuthError("Failed to login. Wrong credentials?")
+	ErrBookWalkerNoLogin       = plugins.NewAuthError("Set Username and Password, or Cookies.")
 	ErrBookWalkerFailedLogout  = errors.New("Failed to logout. Did the API change?")
 	ErrBookWalkerNoSession     = errors.New("Failed to get a book session.")
 	ErrBookWalkerNoContent     = errors.New("Failed to get book content info.")
@@ -23,8 +25,11 @@ var (
 	ErrBookWalkerNoConfig      = errors.New("Content info had no configuration key.")
 )
 
-func (bw *BookWalker) login(username, password string) {
-	r, err := bw.client.Do(plugins.NewPostFormRequestUA(urlLogin, plugins.IE11UserAgent,
+func (bw *BookWalker) login(client *http.Client, username, password string) {
+	if username == "" || password == "" {
+		panic(ErrBookWalkerNoLogin)
+	}
+	r, err := client.Do(plugins.NewPostFormRequestUA(urlLogin, plugins.IE11UserAgent,
 		url.Values{
 			"j_username":      {username},
 			"j_password":      {password},
@@ -43,6 +48,19 @@ func (bw *BookWalker) login(username, password string) {
 	}
 }
 
+// Whether or not the client is already logged in, which we can tell by
+// not getting redirected away from the profile page.
+func (bw *BookWalker) hasSession(client *http.Client) bool {
+	r, err := client.Do(plugins.NewGetRequestUA(urlProfile, plugins.IE11UserAgent))
+	if err != nil {
+		log.Debug(err)
+		return false
+	}
+	r.Body.Close()
+
+	return r.StatusCode == http.StatusOK && reProfile.MatchString(r.Request.URL.String())
+}
+
 func (bw *BookWalker) logout() {
 	r, err := bw.client.Do(plugins.NewGetRequestUA(urlLogout, plugins.IE11UserAgent))
 	if err != nil {
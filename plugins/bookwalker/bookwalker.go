@@ -40,8 +40,10 @@ var log = logger.GetLog(name)
 
 var Plugin = BookWalker{
 	options: []plugins.Option{
-		&plugins.StringOption{K: "Username", Required: true},
-		&plugins.StringOption{K: "Password", Required: true},
+		// Not required, since the Cookies option can be used instead.
+		&plugins.StringOption{K: "Username"},
+		&plugins.SecretOption{StringOption: plugins.StringOption{K: "Password"}},
+		plugins.NewCookiesOption(),
 		&plugins.BoolOption{K: "Lossless", V: false,
 			C: "If set to true, save as PNG. Original images are in JPEG, so you can't escape some artifacts even with this on."},
 		&plugins.IntOption{K: "JPEGQuality", V: 95,
@@ -62,6 +64,7 @@ const (
 	urlLoginScreen = "https://member.bookwalker.jp/app/03/login"
 	urlLogin       = "https://member.bookwalker.jp/app/j_spring_security_check"
 	urlLogout      = "https://member.bookwalker.jp/app/03/logout"
+	urlProfile     = "https://member.bookwalker.jp/app/03/my/profile"
 
 	browserIdSuffix = "NFBR"
 )
@@ -70,7 +73,6 @@ var urlBookLive, _ = url.ParseRequestURI("https://member.bookwalker.jp/")
 
 var reBook = regexp.MustCompile(`^https?://bookwalker.jp/de(?P<cid>[a-zA-Z0-9]+?-[a-zA-Z0-9]+?-[a-zA-Z0-9]+?-[a-zA-Z0-9]+?-[a-zA-Z0-9]+?)(?:/.*)?$`)
 var reReader = regexp.MustCompile(`^https?://booklive.jp/bviewer/\?cid=(?P<cid>[_0-9]+)`)
-var reTokenSearch = regexp.MustCompile(`input type="hidden" name="token" value="(.+?)">`)
 var reProfile = regexp.MustCompile(`^https?://member.bookwalker.jp/app/03/my/profile`)
 
 func init() {
@@ -84,6 +86,9 @@ type BookWalker struct {
 	session *BookSession
 	config  *BookConfig
 	content []*BookContent
+	// Set if we're using a session from the browser or a previous run,
+	// which we shouldn't log out of.
+	reusedSession bool
 }
 
 func (bw *BookWalker) Name() string {
@@ -114,9 +119,18 @@ func (bw *BookWalker) DownloadGenerator(url string) (dlgen func() plugins.Downlo
 
 	// Make a client and log in.
 	cid := reBook.FindStringSubmatch(url)[1]
-	bw.client = plugins.NewHTTPClient(20)
-	log.Info("Logging in...")
-	bw.login(opts["Username"].(string), opts["Password"].(string))
+	bw.client = plugins.NewPluginHTTPClient(bw.Name(), 20)
+	username, password := opts["Username"].(string), opts["Password"].(string)
+	bw.reusedSession = len(bw.client.Jar.Cookies(urlBookLive)) > 0 && bw.hasSession(bw.client)
+	if bw.reusedSession {
+		log.Info("Using the existing session.")
+	} else {
+		log.Info("Logging in...")
+		bw.login(bw.client, username, password)
+	}
+	plugins.OnSessionExpired(bw.client, bw.hasSession, func(c *http.Client) error {
+		return plugins.RecoverLogin(func() { bw.login(c, username, password) })
+	})
 
 	// Try to get a book session.
 	var err error
@@ -152,7 +166,7 @@ func (bw *BookWalker) DownloadGenerator(url string) (dlgen func() plugins.Downlo
 			// Check if we need to delay before starting.
 			delta := interval - time.Since(last)
 			if interval > 0 && n != 0 && delta > 0 {
-				log.Debugf("Delaying %.2f seconds before starting the next download...", delta.Seconds())
+				rep.Log().Debugf("Delaying %.2f seconds before starting the next download...", delta.Seconds())
 				time.Sleep(delta)
 			}
 			last = time.Now()
@@ -214,7 +228,22 @@ func (bw *BookWalker) DownloadGenerator(url string) (dlgen func() plugins.Downlo
 	return
 }
 
+// Logs in with the options, replacing any existing session.
+func (bw *BookWalker) Login() error {
+	opts := plugins.OptionsToMap(bw.options)
+	bw.client = plugins.NewPluginHTTPClient(bw.Name(), 20)
+	return plugins.RecoverLogin(func() { bw.login(bw.client, opts["Username"].(string), opts["Password"].(string)) })
+}
+
+func (bw *BookWalker) CookieDomains() []string {
+	return []string{"bookwalker.jp"}
+}
+
 func (bw *BookWalker) Cleanup(err error) {
+	// Logging out would end the session we're keeping for next time.
+	if bw.reusedSession || plugins.PersistingCookies() {
+		return
+	}
 	log.Info("Logging out...")
 	bw.logout()
 }
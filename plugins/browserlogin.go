@@ -0,0 +1,320 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+)
+
+var (
+	ErrBrowserLoginTimeout = errors.New("Timed out waiting for the login in the browser.")
+	ErrBrowserLoginClosed  = errors.New("The browser was closed before logging in.")
+	ErrBrowserNoPage       = errors.New("Found no page to log in with in the browser.")
+	ErrBrowserLoginUnset   = NewAuthError("Logging in needs a browser, which is set with --browser-login.")
+)
+
+// A login page for logging in through a real browser, for when a plugin's
+// own login breaks, like when the site starts relying on JavaScript.
+type BrowserLogin struct {
+	// The login page.
+	URL string
+	// Values to fill in, keyed by the CSS selector of the field, e.g. the
+	// username and password.
+	Fields map[string]string
+	// Whether or not to submit the form the fields are in once they're filled
+	// in. It's left to the user if there's a captcha.
+	Submit bool
+	// The domains whose cookies are put in the plugin's jar. Defaults to the
+	// host of the URL.
+	Domains []string
+	// Returns whether or not the cookies show a successful login.
+	Done func(cookies []*http.Cookie) bool
+}
+
+// Something that can go through a login page and return the cookies it
+// ends up with.
+type LoginBrowser interface {
+	Login(l *BrowserLogin) ([]*http.Cookie, error)
+}
+
+var (
+	loginBrowser LoginBrowser
+	// Held while logging in, since there's only one user to do it.
+	loginBrowserM sync.Mutex
+)
+
+// Makes plugins use the browser when their own login fails.
+func SetLoginBrowser(b LoginBrowser) {
+	loginBrowser = b
+}
+
+// Logs in through the browser and puts the cookies in the client's jar, for
+// logins only the user can do, like ones through other sites.
+func LoginWithBrowser(client *http.Client, l *BrowserLogin) error {
+	if loginBrowser == nil || client.Jar == nil {
+		return ErrBrowserLoginUnset
+	}
+
+	loginBrowserM.Lock()
+	cookies, err := loginBrowser.Login(l)
+	loginBrowserM.Unlock()
+	if err != nil {
+		return err
+	}
+	addCookies(client.Jar, cookies)
+	log.Debugf("Got %d cookie(s) from the browser.", len(cookies))
+
+	return nil
+}
+
+// Logs in through the browser like LoginWithBrowser, returning the error the
+// plugin's own login failed with if there's no browser to use, so that it
+// can be called with the result of it.
+func BrowserLoginFallback(client *http.Client, err error, l *BrowserLogin) error {
+	if err == nil || loginBrowser == nil || client.Jar == nil {
+		return err
+	}
+
+	log.WithError(err).Warn("Failed to log in. Trying again in a browser...")
+	if berr := LoginWithBrowser(client, l); berr != nil {
+		log.WithError(berr).Error("Failed to log in with the browser.")
+		return err
+	}
+
+	return nil
+}
+
+// Logs in with Chrome, Chromium, Edge or anything else that speaks the
+// DevTools protocol, with a new profile that's thrown away afterwards.
+type ChromeLogin struct {
+	// The browser's executable.
+	Path string
+	// Runs the browser without a window, which can only work if the login
+	// doesn't need the user, like for captchas.
+	Headless bool
+	// How long to wait for the login.
+	Timeout time.Duration
+}
+
+type devToolsCookie struct {
+	Name     string  `json:"name"`
+	Value    string  `json:"value"`
+	Domain   string  `json:"domain"`
+	Path     string  `json:"path"`
+	Expires  float64 `json:"expires"`
+	HTTPOnly bool    `json:"httpOnly"`
+	Secure   bool    `json:"secure"`
+}
+
+func (cl *ChromeLogin) Login(l *BrowserLogin) ([]*http.Cookie, error) {
+	dir, err := ioutil.TempDir("", "mindl-browser-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"--user-data-dir=" + dir, "--remote-debugging-port=0", "--no-first-run",
+		"--no-default-browser-check", "--password-store=basic", "--use-mock-keychain"}
+	if cl.Headless {
+		args = append(args, "--headless=new")
+	}
+	cmd := exec.Command(cl.Path, append(args, l.URL)...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	defer func() {
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+	}()
+
+	dt, err := cl.connect(dir, exited)
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+	defer dt.Close()
+	defer dt.Call("", "Browser.close", nil, nil)
+
+	var targets struct {
+		TargetInfos []struct {
+			TargetID string `json:"targetId"`
+			Type     string `json:"type"`
+		} `json:"targetInfos"`
+	}
+	if err := dt.Call("", "Target.getTargets", nil, &targets); err != nil {
+		return nil, err
+	}
+	var target string
+	for _, t := range targets.TargetInfos {
+		if t.Type == "page" {
+			target = t.TargetID
+			break
+		}
+	}
+	if target == "" {
+		return nil, ErrBrowserNoPage
+	}
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := dt.Call("", "Target.attachToTarget",
+		map[string]interface{}{"targetId": target, "flatten": true}, &attached); err != nil {
+		return nil, err
+	}
+
+	domains := l.Domains
+	if len(domains) == 0 {
+		if u, err := url.Parse(l.URL); err == nil {
+			domains = []string{u.Hostname()}
+		}
+	}
+	if !cl.Headless {
+		log.Info("Log in with the browser window that opened. It closes by itself once you're logged in.")
+	}
+	filled := len(l.Fields) == 0
+	deadline := time.Now().Add(cl.Timeout)
+	for time.Now().Before(deadline) {
+		var res struct {
+			Cookies []devToolsCookie `json:"cookies"`
+		}
+		if err := dt.Call("", "Storage.getCookies", nil, &res); err != nil {
+			return nil, ErrBrowserLoginClosed
+		}
+		cookies := devToolsCookies(res.Cookies, domains)
+		if l.Done(cookies) {
+			return cookies, nil
+		}
+
+		if !filled {
+			filled = fillLoginForm(dt, attached.SessionID, l)
+		}
+		time.Sleep(time.Second)
+	}
+
+	return nil, ErrBrowserLoginTimeout
+}
+
+// Waits for the browser to say which port DevTools is on, then connects.
+func (cl *ChromeLogin) connect(dir string, exited <-chan struct{}) (*devTools, error) {
+	for i := 0; i < 300; i++ {
+		select {
+		case <-exited:
+			return nil, ErrBrowserLoginClosed
+		case <-time.After(100 * time.Millisecond):
+		}
+		// The port, then the path of the browser's WebSocket.
+		data, err := ioutil.ReadFile(filepath.Join(dir, "DevToolsActivePort"))
+		if lines := strings.Fields(string(data)); err == nil && len(lines) == 2 {
+			return dialDevTools(fmt.Sprintf("ws://127.0.0.1:%s%s", lines[0], lines[1]))
+		}
+	}
+
+	return nil, errors.New("The browser didn't start DevTools.")
+}
+
+// Fills in the fields once the page has them, and submits the form if
+// asked to and there's no captcha. Returns whether or not it was done.
+func fillLoginForm(dt *devTools, session string, l *BrowserLogin) bool {
+	fields, _ := json.Marshal(l.Fields)
+	script := fmt.Sprintf(`(function(fields, submit) {
+	var last;
+	for (var sel in fields) {
+		last = document.querySelector(sel);
+		if (!last) return false;
+	}
+	for (var sel in fields) {
+		var el = document.querySelector(sel);
+		el.focus();
+		el.value = fields[sel];
+		el.dispatchEvent(new Event("input", {bubbles: true}));
+		el.dispatchEvent(new Event("change", {bubbles: true}));
+	}
+	if (submit && last && last.form && !document.querySelector('iframe[src*="captcha"]')) {
+		last.form.requestSubmit ? last.form.requestSubmit() : last.form.submit();
+	}
+	return true;
+})(%s, %t)`, fields, l.Submit)
+
+	var res struct {
+		Result struct {
+			Value bool `json:"value"`
+		} `json:"result"`
+	}
+	if err := dt.Call(session, "Runtime.evaluate",
+		map[string]interface{}{"expression": script, "returnByValue": true}, &res); err != nil {
+		log.WithError(err).Debug("Failed to fill in the login form.")
+		return false
+	}
+
+	return res.Result.Value
+}
+
+// Converts the cookies for the domains and their subdomains.
+func devToolsCookies(cookies []devToolsCookie, domains []string) []*http.Cookie {
+	var res []*http.Cookie
+	for _, c := range cookies {
+		host := strings.TrimPrefix(c.Domain, ".")
+		match := false
+		for _, d := range domains {
+			d = strings.TrimPrefix(d, ".")
+			if host == d || strings.HasSuffix(host, "."+d) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+
+		cookie := &http.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			HttpOnly: c.HTTPOnly,
+			Secure:   c.Secure,
+		}
+		if c.Expires > 0 {
+			cookie.Expires = time.Unix(int64(c.Expires), 0)
+		}
+		res = append(res, cookie)
+	}
+
+	return res
+}
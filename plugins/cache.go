@@ -0,0 +1,200 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/MinoMino/logrus"
+)
+
+// The largest response bodies to cache. Anything bigger is most likely
+// a file being downloaded rather than metadata.
+const maxCachedBody = 4 << 20
+
+// Where responses are cached. Empty if caching is off.
+var cacheDir string
+
+// Caches responses with an ETag or Last-Modified in the directory, so that
+// requests for them only have to ask the server whether they changed.
+func SetHTTPCache(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	cacheDir = dir
+
+	return nil
+}
+
+// A cached response.
+type cachedResponse struct {
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// A RoundTripper that sends conditional requests for cached responses,
+// using the cached one if the server says it hasn't changed.
+type cacheTransport struct {
+	http.RoundTripper
+	plugin string
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Leave requests that are already conditional or partial alone.
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" ||
+		req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	path := t.path(req)
+	cached := loadCachedResponse(path, req.URL.String())
+	if cached != nil {
+		req = req.Clone(req.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lm := cached.Header.Get("Last-Modified"); lm != "" {
+			req.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	} else if cached != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		log.WithField("url", req.URL.String()).Debug("Using the cached response.")
+		return cached.response(req), nil
+	} else if resp.StatusCode != http.StatusOK || resp.ContentLength > maxCachedBody ||
+		(resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "") ||
+		strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		return resp, nil
+	}
+
+	resp.Body = &cachingBody{ReadCloser: resp.Body, path: path, resp: &cachedResponse{
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+	}}
+
+	return resp, nil
+}
+
+// Responses are kept apart per plugin, since they can depend on who's
+// logged in.
+func (t *cacheTransport) path(req *http.Request) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(t.plugin) + " " + req.URL.String()))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:]))
+}
+
+func loadCachedResponse(path, url string) *cachedResponse {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var res cachedResponse
+	if err := json.Unmarshal(data, &res); err != nil || res.URL != url {
+		return nil
+	}
+
+	return &res
+}
+
+func (cr *cachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        http.StatusText(cr.StatusCode),
+		StatusCode:    cr.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cr.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(cr.Body)),
+		ContentLength: int64(len(cr.Body)),
+		Request:       req,
+	}
+}
+
+// Saves the body along with the response once all of it has been read.
+type cachingBody struct {
+	io.ReadCloser
+	path string
+	resp *cachedResponse
+	buf  bytes.Buffer
+	// Set if the body is too big or failed to be read.
+	skip bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.skip {
+		b.buf.Write(p[:n])
+		if b.buf.Len() > maxCachedBody {
+			b.skip = true
+			b.buf = bytes.Buffer{}
+		}
+	}
+	if err == io.EOF && !b.skip {
+		b.skip = true
+		b.save()
+	} else if err != nil {
+		b.skip = true
+	}
+
+	return n, err
+}
+
+func (b *cachingBody) save() {
+	b.resp.Body = b.buf.Bytes()
+	b.resp.Header = b.resp.Header.Clone()
+	b.resp.Header.Del("Content-Length")
+	// Cookies are the cookie jar's business, and shouldn't be set again
+	// whenever the cached response is used, let alone be kept on disk.
+	b.resp.Header.Del("Set-Cookie")
+	data, err := json.Marshal(b.resp)
+	if err != nil {
+		return
+	}
+
+	// A unique temporary file, since several workers can get the same URL.
+	tmp, err := ioutil.TempFile(filepath.Dir(b.path), filepath.Base(b.path)+".*.tmp")
+	if err != nil {
+		log.WithError(err).Debug("Failed to cache the response.")
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), b.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.WithError(err).Debug("Failed to cache the response.")
+	}
+}
@@ -0,0 +1,154 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+)
+
+var (
+	ErrNoCaptchaSolver = errors.New("Got a captcha, but there's no way to solve it. See --captcha-service.")
+	ErrCaptchaTimeout  = errors.New("The captcha wasn't solved in time.")
+)
+
+// The kinds of captchas.
+const (
+	// An image with text to type in.
+	CaptchaImage = "image"
+	// Google's reCAPTCHA v2.
+	CaptchaReCaptcha = "recaptcha"
+	CaptchaHCaptcha  = "hcaptcha"
+)
+
+// A captcha a site wants solved, usually when logging in.
+type Captcha struct {
+	Kind string
+	// The image for image captchas.
+	Image []byte
+	// For the others, the site key from the page and the URL of the page.
+	SiteKey string
+	PageURL string
+}
+
+// Something that can solve captchas, like the user or an external service.
+// The answer is either the text in the image or the response token.
+type CaptchaSolver interface {
+	SolveCaptcha(c *Captcha) (string, error)
+}
+
+var captchaSolver CaptchaSolver
+
+// Sets what login flows use to solve captchas.
+func SetCaptchaSolver(solver CaptchaSolver) {
+	captchaSolver = solver
+}
+
+// Solves the captcha with the solver set, for plugins to call when a site
+// presents one.
+func SolveCaptcha(c *Captcha) (string, error) {
+	if captchaSolver == nil {
+		return "", ErrNoCaptchaSolver
+	}
+	log.WithField("kind", c.Kind).Info("Got a captcha. Solving it...")
+
+	return captchaSolver.SolveCaptcha(c)
+}
+
+// Solves captchas with a service that has the same API as 2Captcha,
+// which most of them support.
+type CaptchaService struct {
+	// E.g. https://2captcha.com.
+	URL string
+	Key string
+	// How long to wait for a solution.
+	Timeout time.Duration
+}
+
+type captchaServiceResponse struct {
+	Status  int    `json:"status"`
+	Request string `json:"request"`
+}
+
+func (cs *CaptchaService) SolveCaptcha(c *Captcha) (string, error) {
+	form := url.Values{"key": {cs.Key}, "json": {"1"}}
+	switch c.Kind {
+	case CaptchaImage:
+		form.Set("method", "base64")
+		form.Set("body", base64.StdEncoding.EncodeToString(c.Image))
+	case CaptchaReCaptcha:
+		form.Set("method", "userrecaptcha")
+		form.Set("googlekey", c.SiteKey)
+		form.Set("pageurl", c.PageURL)
+	case CaptchaHCaptcha:
+		form.Set("method", "hcaptcha")
+		form.Set("sitekey", c.SiteKey)
+		form.Set("pageurl", c.PageURL)
+	default:
+		return "", fmt.Errorf("Unsupported captcha: %s", c.Kind)
+	}
+
+	base := strings.TrimSuffix(cs.URL, "/")
+	client := &http.Client{Timeout: 30 * time.Second}
+	id, err := cs.call(client.PostForm(base+"/in.php", form))
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(cs.Timeout)
+	query := url.Values{"key": {cs.Key}, "action": {"get"}, "id": {id}, "json": {"1"}}
+	for time.Now().Before(deadline) {
+		// Nothing is ever solved this fast, so wait before asking too.
+		time.Sleep(5 * time.Second)
+		answer, err := cs.call(client.Get(base + "/res.php?" + query.Encode()))
+		if err == errCaptchaNotReady {
+			continue
+		}
+		return answer, err
+	}
+
+	return "", ErrCaptchaTimeout
+}
+
+var errCaptchaNotReady = errors.New("CAPCHA_NOT_READY")
+
+func (cs *CaptchaService) call(resp *http.Response, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var res captchaServiceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("Invalid response from the captcha service: %s", err)
+	} else if res.Status != 1 {
+		if res.Request == errCaptchaNotReady.Error() {
+			return "", errCaptchaNotReady
+		}
+		return "", fmt.Errorf("The captcha service failed: %s", res.Request)
+	}
+
+	return res.Request, nil
+}
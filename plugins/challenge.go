@@ -0,0 +1,267 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+)
+
+var ErrChallengeFailed = errors.New("Failed to solve the anti-bot challenge.")
+
+// Something that can get past anti-bot challenges like Cloudflare's,
+// usually by solving them in a real browser.
+type ChallengeSolver interface {
+	// Solves the challenge at the URL, going through the proxy if it's
+	// not empty.
+	Solve(url, proxy string) (*ChallengeSolution, error)
+}
+
+// The cookies that show a challenge was solved, which only work along
+// with the user agent that solved it.
+type ChallengeSolution struct {
+	Cookies   []*http.Cookie
+	UserAgent string
+}
+
+var challengeSolver ChallengeSolver
+
+// Makes plugins' HTTP clients use the solver when they run into
+// an anti-bot challenge.
+func SetChallengeSolver(solver ChallengeSolver) {
+	challengeSolver = solver
+}
+
+// Solves challenges with a FlareSolverr instance, or anything else
+// with the same API.
+type FlareSolverr struct {
+	// The URL of the instance, e.g. http://localhost:8191.
+	URL string
+	// How long to let it try.
+	Timeout time.Duration
+}
+
+type flareSolverrResponse struct {
+	Status   string `json:"status"`
+	Message  string `json:"message"`
+	Solution struct {
+		Cookies []struct {
+			Name     string  `json:"name"`
+			Value    string  `json:"value"`
+			Domain   string  `json:"domain"`
+			Path     string  `json:"path"`
+			Expires  float64 `json:"expires"`
+			HTTPOnly bool    `json:"httpOnly"`
+			Secure   bool    `json:"secure"`
+		} `json:"cookies"`
+		UserAgent string `json:"userAgent"`
+	} `json:"solution"`
+}
+
+func (fs *FlareSolverr) Solve(u, proxy string) (*ChallengeSolution, error) {
+	cmd := map[string]interface{}{
+		"cmd":        "request.get",
+		"url":        u,
+		"maxTimeout": int(fs.Timeout / time.Millisecond),
+	}
+	if proxy != "" {
+		cmd["proxy"] = map[string]string{"url": proxy}
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// The solver is local and slow, so none of the plugins' transport applies.
+	client := &http.Client{Timeout: fs.Timeout + 10*time.Second}
+	resp, err := client.Post(strings.TrimSuffix(fs.URL, "/")+"/v1", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res flareSolverrResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("Invalid response from FlareSolverr: %s", err)
+	} else if res.Status != "ok" {
+		return nil, fmt.Errorf("FlareSolverr failed: %s", res.Message)
+	}
+
+	solution := &ChallengeSolution{UserAgent: res.Solution.UserAgent}
+	for _, c := range res.Solution.Cookies {
+		cookie := &http.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			HttpOnly: c.HTTPOnly,
+			Secure:   c.Secure,
+		}
+		if c.Expires > 0 {
+			cookie.Expires = time.Unix(int64(c.Expires), 0)
+		}
+		solution.Cookies = append(solution.Cookies, cookie)
+	}
+
+	return solution, nil
+}
+
+type solvedChallenge struct {
+	*ChallengeSolution
+	at time.Time
+}
+
+// Solutions keyed by the lowercase plugin name and the host, so that other
+// clients of the plugin don't have to solve the challenge again.
+var (
+	solvedChallenges = make(map[string]solvedChallenge)
+	// The challenges being solved, with the same keys, so that workers
+	// don't all solve the same one at once.
+	solvingChallenges = make(map[string]chan struct{})
+	solvingM          sync.Mutex
+)
+
+// A RoundTripper that solves anti-bot challenges with the solver, puts the
+// cookies in the client's jar and sends the request again. Requests to hosts
+// with solved challenges use the solver's user agent from then on, since
+// the cookies are tied to it.
+type challengeTransport struct {
+	http.RoundTripper
+	plugin string
+	jar    http.CookieJar
+}
+
+func (t *challengeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	if s, ok := t.solution(req.URL.Host); ok {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", s.UserAgent)
+	}
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || !isChallenge(resp) {
+		return resp, err
+	} else if req.Method != http.MethodGet {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	s, err := t.solve(req, start)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", s.UserAgent)
+	req.Header.Del("Cookie")
+	for _, c := range t.jar.Cookies(req.URL) {
+		req.AddCookie(c)
+	}
+
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func (t *challengeTransport) solution(host string) (solvedChallenge, bool) {
+	solvingM.Lock()
+	defer solvingM.Unlock()
+	s, ok := solvedChallenges[strings.ToLower(t.plugin)+" "+host]
+	return s, ok
+}
+
+// Solves the challenge for the request unless it was solved after the
+// request was sent, then puts the cookies in the jar. Only one challenge
+// is solved at a time per host, and the rest wait for it to finish.
+func (t *challengeTransport) solve(req *http.Request, sent time.Time) (*ChallengeSolution, error) {
+	key := strings.ToLower(t.plugin) + " " + req.URL.Host
+	solvingM.Lock()
+	for {
+		if s, ok := solvedChallenges[key]; ok && !s.at.Before(sent) {
+			solvingM.Unlock()
+			t.jar.SetCookies(&url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: "/"}, s.Cookies)
+			return s.ChallengeSolution, nil
+		}
+		solving, ok := solvingChallenges[key]
+		if !ok {
+			break
+		}
+
+		solvingM.Unlock()
+		select {
+		case <-solving:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		solvingM.Lock()
+	}
+	done := make(chan struct{})
+	solvingChallenges[key] = done
+	solvingM.Unlock()
+
+	entry := log.WithField("url", req.URL.String())
+	entry.Info("Got an anti-bot challenge. Solving it...")
+	var proxy string
+	if u, _ := proxyFunc(t.plugin)(req); u != nil {
+		proxy = u.String()
+	}
+	solution, err := challengeSolver.Solve(req.URL.String(), proxy)
+
+	solvingM.Lock()
+	if err == nil {
+		solvedChallenges[key] = solvedChallenge{solution, time.Now()}
+	}
+	delete(solvingChallenges, key)
+	close(done)
+	solvingM.Unlock()
+	if err != nil {
+		entry.WithError(err).Error(ErrChallengeFailed)
+		return nil, ErrChallengeFailed
+	}
+	t.jar.SetCookies(&url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: "/"}, solution.Cookies)
+
+	return solution, nil
+}
+
+// Whether or not the response is a challenge page rather than what
+// was asked for.
+func isChallenge(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusServiceUnavailable {
+		return false
+	} else if resp.Header.Get("Cf-Mitigated") == "challenge" {
+		return true
+	} else if !strings.Contains(strings.ToLower(resp.Header.Get("Server")), "cloudflare") {
+		return false
+	}
+
+	// Older challenges can only be told apart by the page. Put back what
+	// was read, since it might be a regular error page.
+	peek, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peek), resp.Body), resp.Body}
+
+	return bytes.Contains(peek, []byte("challenge-platform")) || bytes.Contains(peek, []byte("Just a moment..."))
+}
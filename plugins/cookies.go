@@ -0,0 +1,357 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+
+	"github.com/MinoMino/mindl/logger"
+)
+
+// Cookies imported from the user's browser, given to the HTTP clients of
+// plugins so they can reuse a session instead of logging in.
+var browserCookies []*http.Cookie
+
+// Implemented by plugins that log in to sites, listing the domains whose
+// cookies are needed to reuse a session from the user's browser.
+type CookieUser interface {
+	CookieDomains() []string
+}
+
+// Saves the cookies of plugins between runs, keyed by the plugin name.
+// Domains of cookies only for a specific host have no leading dot.
+type CookieStore interface {
+	Load(plugin string) ([]*http.Cookie, error)
+	Save(plugin string, cookies []*http.Cookie) error
+}
+
+var cookieStore CookieStore
+
+func SetBrowserCookies(cookies []*http.Cookie) {
+	browserCookies = cookies
+}
+
+// Cookies set with plugins' Cookies option, keyed by the lowercase plugin name.
+var (
+	optionCookies  = make(map[string][]*http.Cookie)
+	optionCookiesM sync.Mutex
+)
+
+// Makes the plugin's HTTP clients start out with the cookies, e.g. the ones
+// of its CookiesOption.
+func SetPluginCookies(plugin string, cookies []*http.Cookie) {
+	optionCookiesM.Lock()
+	optionCookies[strings.ToLower(plugin)] = cookies
+	optionCookiesM.Unlock()
+}
+
+func pluginCookies(plugin string) []*http.Cookie {
+	optionCookiesM.Lock()
+	defer optionCookiesM.Unlock()
+	return optionCookies[strings.ToLower(plugin)]
+}
+
+var ErrNoCookies = errors.New("Found no cookies. Should be like a Cookie header or the path to a cookies.txt file.")
+
+// Parses cookies from a file in the Netscape cookies.txt format browser
+// extensions export, or from a Cookie header if there's no such file. The
+// cookies from a header have no domain.
+func ParseCookies(s string) ([]*http.Cookie, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if data, err := ioutil.ReadFile(s); err == nil {
+		return parseCookiesTxt(string(data))
+	}
+
+	// Anything else, like a mistyped path, isn't a header either.
+	header := strings.TrimSpace(strings.TrimPrefix(s, "Cookie:"))
+	cookies := (&http.Request{Header: http.Header{"Cookie": {header}}}).Cookies()
+	if len(cookies) == 0 || !strings.Contains(header, "=") {
+		return nil, ErrNoCookies
+	}
+	for _, c := range cookies {
+		c.Path = "/"
+	}
+
+	return cookies, nil
+}
+
+func parseCookiesTxt(data string) ([]*http.Cookie, error) {
+	var res []*http.Cookie
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		if httpOnly {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+		} else if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		// Domain, whether it's for subdomains too, path, secure, expiry,
+		// name and value.
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("Line %d of the cookies.txt file is invalid.", i+1)
+		}
+		c := &http.Cookie{
+			Domain:   fields[0],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		// Same as browsers, a leading dot means subdomains too.
+		if strings.EqualFold(fields[1], "TRUE") && !strings.HasPrefix(c.Domain, ".") {
+			c.Domain = "." + c.Domain
+		} else if strings.EqualFold(fields[1], "FALSE") {
+			c.Domain = strings.TrimPrefix(c.Domain, ".")
+		}
+		if expires, err := strconv.ParseInt(fields[4], 10, 64); err == nil && expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		res = append(res, c)
+	}
+	if len(res) == 0 {
+		return nil, ErrNoCookies
+	}
+
+	return res, nil
+}
+
+// Whether or not cookies were imported from a browser.
+func UsingBrowserCookies() bool {
+	return len(browserCookies) > 0
+}
+
+// Sets the store plugins' cookies are kept in between runs.
+func SetCookieStore(store CookieStore) {
+	cookieStore = store
+}
+
+// Whether or not cookies are kept between runs, in which case plugins
+// shouldn't log out when they're done.
+func PersistingCookies() bool {
+	return cookieStore != nil
+}
+
+// Returns a jar with the plugin's stored cookies in it that saves any
+// cookies set to the store.
+func newPersistentJar(plugin string, jar http.CookieJar) http.CookieJar {
+	stored := loadStoredCookies(plugin)
+	addCookies(jar, stored.list())
+
+	return &persistentJar{jar, stored}
+}
+
+// A cookie jar that keeps track of every cookie set so they can be saved.
+type persistentJar struct {
+	http.CookieJar
+	stored *storedCookies
+}
+
+func (pj *persistentJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	pj.CookieJar.SetCookies(u, cookies)
+	pj.stored.set(u, cookies)
+}
+
+// How long to wait for more cookies before saving them, since a response
+// tends to set several and logging in takes a few requests.
+const cookieSaveDelay = time.Second
+
+// The cookies of a plugin that are kept between runs. Every client of the
+// plugin shares them, so that their jars don't overwrite each other's.
+type storedCookies struct {
+	plugin  string
+	cookies map[string]*http.Cookie
+	// Set while a save is scheduled.
+	timer *time.Timer
+	m     sync.Mutex
+	// Held while saving, so that an older save can't finish last.
+	saveM sync.Mutex
+}
+
+// The stored cookies of each plugin, loaded by the first client.
+var (
+	storedCookiesByPlugin = make(map[string]*storedCookies)
+	storedCookiesM        sync.Mutex
+)
+
+func loadStoredCookies(plugin string) *storedCookies {
+	storedCookiesM.Lock()
+	defer storedCookiesM.Unlock()
+	if s, ok := storedCookiesByPlugin[plugin]; ok {
+		return s
+	}
+
+	s := &storedCookies{plugin: plugin, cookies: make(map[string]*http.Cookie)}
+	cookies, err := cookieStore.Load(plugin)
+	if err != nil {
+		log.WithField("plugin", plugin).Warnf("Failed to load the stored cookies: %s", err)
+	}
+	now := time.Now()
+	for _, c := range cookies {
+		if c.Expires.IsZero() || c.Expires.After(now) {
+			s.cookies[cookieKey(c)] = c
+		}
+	}
+	storedCookiesByPlugin[plugin] = s
+
+	return s
+}
+
+func (s *storedCookies) list() []*http.Cookie {
+	s.m.Lock()
+	defer s.m.Unlock()
+	res := make([]*http.Cookie, 0, len(s.cookies))
+	for _, c := range s.cookies {
+		res = append(res, c)
+	}
+
+	return res
+}
+
+// Records the cookies set for the URL and schedules a save.
+func (s *storedCookies) set(u *url.URL, cookies []*http.Cookie) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	now := time.Now()
+	for _, c := range cookies {
+		cookie := &http.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   strings.ToLower(c.Domain),
+			Expires:  c.Expires,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+		if cookie.Domain == "" {
+			cookie.Domain = u.Hostname()
+		} else if !strings.HasPrefix(cookie.Domain, ".") {
+			cookie.Domain = "." + cookie.Domain
+		}
+		if cookie.Path == "" {
+			cookie.Path = "/"
+		}
+		if c.MaxAge > 0 {
+			cookie.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		}
+
+		key := cookieKey(cookie)
+		if c.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(now)) {
+			delete(s.cookies, key)
+		} else {
+			s.cookies[key] = cookie
+		}
+	}
+
+	if s.timer == nil {
+		s.timer = time.AfterFunc(cookieSaveDelay, s.save)
+	}
+}
+
+func (s *storedCookies) save() {
+	s.saveM.Lock()
+	defer s.saveM.Unlock()
+	s.m.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.m.Unlock()
+
+	if err := cookieStore.Save(s.plugin, s.list()); err != nil {
+		log.WithField("plugin", s.plugin).Warnf("Failed to save cookies: %s", err)
+	}
+}
+
+// Saves the cookies that are waiting to be saved right away. Should be
+// called before exiting.
+func FlushCookies() {
+	storedCookiesM.Lock()
+	var pending []*storedCookies
+	for _, s := range storedCookiesByPlugin {
+		s.m.Lock()
+		if s.timer != nil {
+			pending = append(pending, s)
+		}
+		s.m.Unlock()
+	}
+	storedCookiesM.Unlock()
+
+	for _, s := range pending {
+		s.save()
+	}
+}
+
+func cookieKey(c *http.Cookie) string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+func addCookies(jar http.CookieJar, cookies []*http.Cookie) {
+	redactCookies(cookies)
+	for _, c := range cookies {
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		u := &url.URL{Scheme: scheme, Host: strings.TrimPrefix(c.Domain, "."), Path: "/"}
+		// Browsers mark cookies for subdomains with a leading dot, while
+		// the rest are only for the host itself.
+		cookie := *c
+		if !strings.HasPrefix(c.Domain, ".") {
+			cookie.Domain = ""
+		}
+		jar.SetCookies(u, []*http.Cookie{&cookie})
+	}
+}
+
+// Cookie values shorter than this are left in the logs, since they're
+// usually settings like a language rather than sessions.
+const minRedactedCookie = 8
+
+// Keeps the values of cookies, like sessions, out of the logs.
+func redactCookies(cookies []*http.Cookie) {
+	for _, c := range cookies {
+		if len(c.Value) >= minRedactedCookie {
+			logger.SetSecret("cookie "+c.Name, c.Value)
+		}
+	}
+}
+
+// A cookie jar that keeps the values of the cookies set out of the logs.
+type redactingJar struct {
+	http.CookieJar
+}
+
+func (j redactingJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	redactCookies(cookies)
+	j.CookieJar.SetCookies(u, cookies)
+}
@@ -0,0 +1,215 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var ErrDevToolsClosed = errors.New("The browser closed the DevTools connection.")
+
+// How long a call can take.
+const devToolsTimeout = 30 * time.Second
+
+// A connection to a browser's DevTools protocol, which is how Chrome and the
+// like are remote controlled. Only what logging in needs is implemented, and
+// calls are made one at a time.
+type devTools struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int
+}
+
+type devToolsMessage struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Connects to the WebSocket URL the browser gave, e.g.
+// ws://127.0.0.1:9222/devtools/browser/<id>.
+func dialDevTools(wsURL string) (*devTools, error) {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		u.RequestURI(), u.Host, base64.StdEncoding.EncodeToString(key))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	} else if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("The browser refused the DevTools connection: %s", resp.Status)
+	}
+
+	return &devTools{conn: conn, r: r}, nil
+}
+
+// Calls the method, in the target the session is attached to if it's not
+// empty, and decodes the result into res if it's not nil. Events that
+// arrive in the meantime are ignored.
+func (dt *devTools) Call(session, method string, params, res interface{}) error {
+	dt.id++
+	msg := map[string]interface{}{"id": dt.id, "method": method}
+	if params != nil {
+		msg["params"] = params
+	}
+	if session != "" {
+		msg["sessionId"] = session
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	// A browser that stopped responding shouldn't hang the login.
+	dt.conn.SetDeadline(time.Now().Add(devToolsTimeout))
+	if err := dt.writeFrame(0x1, data); err != nil {
+		return err
+	}
+
+	for {
+		data, err := dt.readMessage()
+		if err != nil {
+			return err
+		}
+		var m devToolsMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		} else if m.ID != dt.id {
+			continue
+		} else if m.Error != nil {
+			return fmt.Errorf("%s: %s", method, m.Error.Message)
+		} else if res != nil {
+			return json.Unmarshal(m.Result, res)
+		}
+
+		return nil
+	}
+}
+
+func (dt *devTools) Close() error {
+	return dt.conn.Close()
+}
+
+// Writes a single WebSocket frame, which clients have to mask.
+func (dt *devTools) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, 0x80|byte(n))
+	case n <= 0xffff:
+		header = append(header, 0x80|126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 0x80|127)
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	header = append(header, mask...)
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+
+	_, err := dt.conn.Write(append(header, masked...))
+	return err
+}
+
+// Reads a whole message, answering pings along the way.
+func (dt *devTools) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(dt.r, header[:]); err != nil {
+			return nil, err
+		}
+		fin, opcode := header[0]&0x80 != 0, header[0]&0x0f
+		n := uint64(header[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(dt.r, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(dt.r, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		var mask []byte
+		if header[1]&0x80 != 0 {
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(dt.r, mask); err != nil {
+				return nil, err
+			}
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(dt.r, payload); err != nil {
+			return nil, err
+		}
+		for i := range mask {
+			for j := i; j < len(payload); j += 4 {
+				payload[j] ^= mask[i]
+			}
+		}
+
+		switch opcode {
+		case 0x8:
+			return nil, ErrDevToolsClosed
+		case 0x9:
+			if err := dt.writeFrame(0xa, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case 0xa:
+			continue
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
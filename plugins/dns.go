@@ -0,0 +1,121 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// A DNS server to use instead of the system's, e.g. "1.1.1.1:53".
+	DNSServer string
+	// The URL of a DNS-over-HTTPS resolver to use instead of the system's.
+	// Takes precedence over DNSServer.
+	DoHURL string
+)
+
+// Returns the resolver for the shared dialer, or nil for the system's.
+func resolver() *net.Resolver {
+	if DoHURL != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, client: client}, nil
+			},
+		}
+	} else if DNSServer != "" {
+		server := DNSServer
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		var d net.Dialer
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return nil
+}
+
+// A fake connection that sends the DNS messages Go's resolver writes to it
+// to a DNS-over-HTTPS resolver. Since it isn't a net.PacketConn, the
+// resolver treats it as a stream, with messages prefixed by their length.
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	resp   bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, errors.New("Short DNS message.")
+	}
+	req, err := http.NewRequest(http.MethodPost, DoHURL, bytes.NewReader(b[2:]))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(c.ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/dns-message") {
+		return 0, fmt.Errorf("The DNS-over-HTTPS resolver responded with: %s", resp.Status)
+	}
+	msg, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	c.resp.Reset()
+	c.resp.Write([]byte{byte(len(msg) >> 8), byte(len(msg))})
+	c.resp.Write(msg)
+
+	return len(b), nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	return c.resp.Read(b)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "https" }
+func (dohAddr) String() string  { return DoHURL }
@@ -113,6 +113,12 @@ func (d *Dummy) DownloadGenerator(url string) (dlgen func() plugins.Downloader,
 	return
 }
 
+func (d *Dummy) Info(url string) (*plugins.ItemInfo, error) {
+	re := dummyUrlRegex.FindStringSubmatch(url)
+	length, _ := strconv.Atoi(re[1])
+	return &plugins.ItemInfo{Title: "Dummy", Pages: length}, nil
+}
+
 func (d *Dummy) Cleanup(err error) {
 
 }
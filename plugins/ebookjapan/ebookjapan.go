@@ -149,12 +149,12 @@ func (ebj *EBookJapan) DownloadGenerator(url string) (dlgen func() plugins.Downl
 				// PhantomJS sucks and forces us to reopen the page every now and then
 				// or else it'll like 1.5 GB memory and eventually crash.
 				if i != 0 && i%reopenCount == 0 {
-					log.Info("Closing and reopening reader...")
+					rep.Log().Info("Closing and reopening reader...")
 					// PhantomJS is shit and doesn't GC unless you close the page,
 					// so to reduce memory usage and prevent it from crashing we
 					// close the page and reopen it, run scripts again, etc. etc.
 					if err := page.Destroy(); err != nil {
-						log.Error("Failed to destroy the page.")
+						rep.Log().Error("Failed to destroy the page.")
 						panic(err)
 					}
 
@@ -173,7 +173,7 @@ func (ebj *EBookJapan) DownloadGenerator(url string) (dlgen func() plugins.Downl
 					} else if reopened {
 						reopened = false
 					}
-					log.Debugf("Prefetching page %d...", j+i+1)
+					rep.Log().Debugf("Prefetching page %d...", j+i+1)
 					// Asynchronously get pages.
 					if err := page.RunScript(fmt.Sprintf(futureScript, j+i+1), nil, nil); err != nil {
 						panic(err)
@@ -0,0 +1,111 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The encodings asked for when a request doesn't say which it accepts.
+// Go's transport only does gzip on its own, but some CDNs send a lot less
+// with the others.
+const acceptEncoding = "gzip, br, zstd"
+
+// A RoundTripper that asks for compressed responses and decompresses them,
+// unless the request already says which encodings it accepts, in which case
+// it's left to whoever sent it.
+type decodingTransport struct {
+	http.RoundTripper
+}
+
+func (t *decodingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Compressed ranges can't be decompressed on their own.
+	if req.Method == http.MethodHead || req.Header.Get("Accept-Encoding") != "" || req.Header.Get("Range") != "" {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		body = &lazyReader{src: resp.Body, open: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}}
+	case "br":
+		body = &lazyReader{src: resp.Body, open: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(brotli.NewReader(r)), nil
+		}}
+	case "zstd":
+		body = &lazyReader{src: resp.Body, open: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		}}
+	default:
+		return resp, nil
+	}
+
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return resp, nil
+}
+
+// Decompresses the body, only starting once it's read so that bodies that
+// are never read, like ones of error responses, don't need to be valid.
+type lazyReader struct {
+	src  io.ReadCloser
+	open func(io.Reader) (io.ReadCloser, error)
+	r    io.ReadCloser
+	err  error
+}
+
+func (lr *lazyReader) Read(p []byte) (int, error) {
+	if lr.r == nil && lr.err == nil {
+		lr.r, lr.err = lr.open(lr.src)
+	}
+	if lr.err != nil {
+		return 0, lr.err
+	}
+
+	return lr.r.Read(p)
+}
+
+func (lr *lazyReader) Close() error {
+	if lr.r != nil {
+		lr.r.Close()
+	}
+	return lr.src.Close()
+}
@@ -0,0 +1,221 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var ErrNoFormToken = errors.New("Found no token in the page. Did the login page change?")
+
+// A form on a page, along with the values its fields start out with, like
+// the hidden ones login pages put CSRF tokens in.
+type HTMLForm struct {
+	// Resolved against the page's URL if it was passed to ParseForms.
+	Action string
+	// Uppercase, e.g. POST. Defaults to GET like in browsers.
+	Method string
+	Fields url.Values
+}
+
+// Parses the forms on a page. The page's URL is used to resolve relative
+// actions against, and can be nil.
+func ParseForms(page []byte, base *url.URL) []*HTMLForm {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil
+	}
+
+	var forms []*HTMLForm
+	var walk func(n *html.Node, form *HTMLForm)
+	walk = func(n *html.Node, form *HTMLForm) {
+		if n.Type == html.ElementNode {
+			switch n.DataAtom {
+			case atom.Form:
+				form = &HTMLForm{Action: htmlAttr(n, "action"), Method: strings.ToUpper(htmlAttr(n, "method")),
+					Fields: make(url.Values)}
+				if form.Method == "" {
+					form.Method = "GET"
+				}
+				if base != nil {
+					if u, err := base.Parse(form.Action); err == nil {
+						form.Action = u.String()
+					}
+				}
+				forms = append(forms, form)
+			case atom.Input, atom.Select, atom.Textarea:
+				if form != nil {
+					if name, value, ok := fieldValue(n); ok {
+						form.Fields.Add(name, value)
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, form)
+		}
+	}
+	walk(doc, nil)
+
+	return forms
+}
+
+// Returns the first form on the page with a field by the name, e.g. the
+// login form by its password field.
+func FindForm(page []byte, base *url.URL, field string) (*HTMLForm, bool) {
+	for _, form := range ParseForms(page, base) {
+		if _, ok := form.Fields[field]; ok {
+			return form, true
+		}
+	}
+
+	return nil, false
+}
+
+// Returns the value of the first hidden field or <meta> tag with one of the
+// names, which is where most sites put CSRF tokens, e.g. "csrf-token" for
+// <meta name="csrf-token" content="...">.
+func FormToken(page []byte, names ...string) (string, error) {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return "", err
+	}
+
+	found := make(map[string]string)
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			var name, value string
+			switch {
+			case n.DataAtom == atom.Input && strings.EqualFold(htmlAttr(n, "type"), "hidden"):
+				name, value = htmlAttr(n, "name"), htmlAttr(n, "value")
+			case n.DataAtom == atom.Meta:
+				name, value = htmlAttr(n, "name"), htmlAttr(n, "content")
+			}
+			if _, ok := found[name]; !ok && name != "" && value != "" {
+				found[name] = value
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	for _, name := range names {
+		if value, ok := found[name]; ok {
+			return value, nil
+		}
+	}
+
+	return "", ErrNoFormToken
+}
+
+// Returns the name and value a field would be submitted with, if any.
+func fieldValue(n *html.Node) (string, string, bool) {
+	name := htmlAttr(n, "name")
+	if name == "" || hasHTMLAttr(n, "disabled") {
+		return "", "", false
+	}
+
+	switch n.DataAtom {
+	case atom.Select:
+		var first string
+		hasFirst := false
+		var walk func(c *html.Node) (string, bool)
+		walk = func(c *html.Node) (string, bool) {
+			for ; c != nil; c = c.NextSibling {
+				if c.Type == html.ElementNode && c.DataAtom == atom.Option {
+					value := htmlAttr(c, "value")
+					if !hasHTMLAttr(c, "value") {
+						value = strings.TrimSpace(htmlText(c))
+					}
+					if hasHTMLAttr(c, "selected") {
+						return value, true
+					} else if !hasFirst {
+						first, hasFirst = value, true
+					}
+				} else if v, ok := walk(c.FirstChild); ok {
+					return v, true
+				}
+			}
+			return "", false
+		}
+		if value, ok := walk(n.FirstChild); ok {
+			return name, value, true
+		}
+		return name, first, hasFirst
+	case atom.Textarea:
+		return name, htmlText(n), true
+	}
+
+	switch strings.ToLower(htmlAttr(n, "type")) {
+	case "submit", "button", "image", "reset", "file":
+		return "", "", false
+	case "checkbox", "radio":
+		if !hasHTMLAttr(n, "checked") {
+			return "", "", false
+		} else if !hasHTMLAttr(n, "value") {
+			return name, "on", true
+		}
+	}
+
+	return name, htmlAttr(n, "value"), true
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+
+	return ""
+}
+
+func hasHTMLAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the text inside the node.
+func htmlText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+
+	return b.String()
+}
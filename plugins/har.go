@@ -0,0 +1,356 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Names of headers, query parameters and form fields with secrets in them.
+var reSecret = regexp.MustCompile(`(?i)pass|secret|token|cookie|session|key|auth|pswd`)
+
+const redacted = "REDACTED"
+
+// String members of JSON objects, including ones cut off at the end of a
+// truncated body.
+var reJSONMember = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"(\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+
+// Records the HTTP traffic of plugins in the HAR format, which browsers'
+// developer tools can open.
+type harRecorder struct {
+	path      string
+	version   string
+	bodyLimit int
+	entries   []*harEntry
+	m         sync.Mutex
+}
+
+var har *harRecorder
+
+// Starts recording the requests and responses of plugins, to be written to
+// path by StopHAR. Bodies are cut off after bodyLimit bytes, and left out
+// if it's zero. Secrets like passwords and cookies are redacted.
+func StartHAR(path, version string, bodyLimit int) {
+	har = &harRecorder{path: path, version: version, bodyLimit: bodyLimit}
+}
+
+// Writes the recorded traffic to the HAR file.
+func StopHAR() error {
+	if har == nil {
+		return nil
+	}
+
+	har.m.Lock()
+	defer har.m.Unlock()
+	doc := map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]string{"name": "mindl", "version": har.version},
+			"pages":   []interface{}{},
+			"entries": har.entries,
+		},
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// It can have personal details in it even with secrets redacted.
+	return ioutil.WriteFile(har.path, data, 0600)
+}
+
+type harEntry struct {
+	Started  time.Time   `json:"startedDateTime"`
+	Time     float64     `json:"time"`
+	Request  harRequest  `json:"request"`
+	Response harResponse `json:"response"`
+	Cache    struct{}    `json:"cache"`
+	Timings  harTimings  `json:"timings"`
+	Plugin   string      `json:"_plugin,omitempty"`
+	Error    string      `json:"_error,omitempty"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Headers     []harNameVal `json:"headers"`
+	QueryString []harNameVal `json:"queryString"`
+	Cookies     []harNameVal `json:"cookies"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int          `json:"status"`
+	StatusText  string       `json:"statusText"`
+	HTTPVersion string       `json:"httpVersion"`
+	Headers     []harNameVal `json:"headers"`
+	Cookies     []harNameVal `json:"cookies"`
+	Content     harContent   `json:"content"`
+	RedirectURL string       `json:"redirectURL"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+}
+
+type harNameVal struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// A RoundTripper that records every request going through it.
+type harTransport struct {
+	http.RoundTripper
+	plugin string
+}
+
+func (t *harTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := &harEntry{
+		Started: time.Now(),
+		Plugin:  t.plugin,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         redactURL(req.URL.String()),
+			HTTPVersion: req.Proto,
+			Headers:     harHeaders(req.Header),
+			QueryString: harValues(req.URL.Query()),
+			Cookies:     harCookies(req.Cookies()),
+			HeadersSize: -1,
+			BodySize:    req.ContentLength,
+		},
+	}
+	if entry.Request.HTTPVersion == "" {
+		entry.Request.HTTPVersion = "HTTP/1.1"
+	}
+	if req.GetBody != nil && har.bodyLimit > 0 {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := ioutil.ReadAll(io.LimitReader(body, int64(har.bodyLimit)))
+			body.Close()
+			entry.Request.PostData = &harPostData{
+				MimeType: req.Header.Get("Content-Type"),
+				Text:     redactBody(req.Header.Get("Content-Type"), data),
+			}
+		}
+	}
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	wait := time.Since(entry.Started)
+	entry.Timings.Wait = float64(wait) / float64(time.Millisecond)
+	entry.Time = entry.Timings.Wait
+	if err != nil {
+		entry.Error = err.Error()
+		har.add(entry)
+		return resp, err
+	}
+
+	entry.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Headers:     harHeaders(resp.Header),
+		Cookies:     harCookies(resp.Cookies()),
+		Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    resp.ContentLength,
+	}
+	har.add(entry)
+	resp.Body = &harBody{ReadCloser: resp.Body, entry: entry, started: time.Now()}
+
+	return resp, nil
+}
+
+func (h *harRecorder) add(entry *harEntry) {
+	h.m.Lock()
+	h.entries = append(h.entries, entry)
+	h.m.Unlock()
+}
+
+// Records the response body as it's read, up to the limit.
+type harBody struct {
+	io.ReadCloser
+	entry   *harEntry
+	started time.Time
+	buf     bytes.Buffer
+	size    int64
+	once    sync.Once
+}
+
+func (b *harBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if room := har.bodyLimit - b.buf.Len(); room > 0 {
+		if n < room {
+			room = n
+		}
+		b.buf.Write(p[:room])
+	}
+	if err == io.EOF {
+		b.finish()
+	}
+
+	return n, err
+}
+
+func (b *harBody) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+func (b *harBody) finish() {
+	b.once.Do(func() {
+		har.m.Lock()
+		defer har.m.Unlock()
+		c := &b.entry.Response.Content
+		c.Size = b.size
+		receive := float64(time.Since(b.started)) / float64(time.Millisecond)
+		b.entry.Timings.Receive = receive
+		b.entry.Time += receive
+
+		data := b.buf.Bytes()
+		if len(data) == 0 {
+			return
+		} else if isText(c.MimeType) && utf8.Valid(data) {
+			c.Text = redactBody(c.MimeType, data)
+		} else {
+			c.Text = base64.StdEncoding.EncodeToString(data)
+			c.Encoding = "base64"
+		}
+		if int64(len(data)) < b.size {
+			c.Comment = "Truncated."
+		}
+	})
+}
+
+func isText(mime string) bool {
+	return strings.HasPrefix(mime, "text/") || strings.Contains(mime, "json") ||
+		strings.Contains(mime, "javascript") || strings.Contains(mime, "xml") ||
+		strings.Contains(mime, "x-www-form-urlencoded")
+}
+
+func harHeaders(h http.Header) []harNameVal {
+	res := make([]harNameVal, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			if reSecret.MatchString(name) {
+				v = redacted
+			}
+			res = append(res, harNameVal{name, v})
+		}
+	}
+
+	return res
+}
+
+func harValues(values map[string][]string) []harNameVal {
+	res := make([]harNameVal, 0, len(values))
+	for name, vs := range values {
+		for _, v := range vs {
+			if reSecret.MatchString(name) {
+				v = redacted
+			}
+			res = append(res, harNameVal{name, v})
+		}
+	}
+
+	return res
+}
+
+// Cookie values are all left out, since any of them could be a session.
+func harCookies(cookies []*http.Cookie) []harNameVal {
+	res := make([]harNameVal, len(cookies))
+	for i, c := range cookies {
+		res[i] = harNameVal{c.Name, redacted}
+	}
+
+	return res
+}
+
+func redactURL(u string) string {
+	split := strings.SplitN(u, "?", 2)
+	if len(split) != 2 {
+		return u
+	}
+
+	return split[0] + "?" + redactForm(split[1])
+}
+
+func redactBody(mime string, data []byte) string {
+	if strings.Contains(mime, "x-www-form-urlencoded") {
+		return redactForm(string(data))
+	} else if strings.Contains(mime, "json") {
+		return redactJSON(string(data))
+	}
+
+	return string(data)
+}
+
+// Redacts the secret string values in JSON, like OAuth2 tokens, without
+// parsing it, since the body might have been truncated.
+func redactJSON(text string) string {
+	return reJSONMember.ReplaceAllStringFunc(text, func(member string) string {
+		m := reJSONMember.FindStringSubmatch(member)
+		if !reSecret.MatchString(m[1]) {
+			return member
+		}
+
+		return `"` + m[1] + `"` + m[2] + `"` + redacted + `"`
+	})
+}
+
+// Redacts the secret values in a URL encoded form without re-encoding
+// the rest of it.
+func redactForm(form string) string {
+	pairs := strings.Split(form, "&")
+	for i, pair := range pairs {
+		if split := strings.SplitN(pair, "=", 2); len(split) == 2 && reSecret.MatchString(split[0]) {
+			pairs[i] = split[0] + "=" + redacted
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
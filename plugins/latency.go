@@ -0,0 +1,118 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// The upper bounds of the latency histogram buckets. The last bucket holds
+// everything slower.
+var LatencyBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// How long requests to an endpoint took to get a response, not counting
+// reading the body.
+type LatencyHistogram struct {
+	Endpoint string
+	// The number of requests in each of the LatencyBuckets, plus one for
+	// the slower ones.
+	Counts []int64
+	Count  int64
+	Total  time.Duration
+}
+
+// Returns the upper bound of the bucket the quantile, e.g. 0.95, falls
+// in, or zero if it's in the last one.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	target := int64(float64(h.Count)*q + 0.5)
+	var seen int64
+	for i, n := range h.Counts {
+		seen += n
+		if seen >= target && i < len(LatencyBuckets) {
+			return LatencyBuckets[i]
+		} else if seen >= target {
+			break
+		}
+	}
+
+	return 0
+}
+
+var (
+	latencies  = make(map[string]*LatencyHistogram)
+	latenciesM sync.Mutex
+)
+
+// Returns copies of the histogram of every endpoint requests have been sent
+// to, sorted by endpoint.
+func Latencies() []LatencyHistogram {
+	latenciesM.Lock()
+	defer latenciesM.Unlock()
+	res := make([]LatencyHistogram, 0, len(latencies))
+	for _, h := range latencies {
+		c := *h
+		c.Counts = append([]int64(nil), h.Counts...)
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Endpoint < res[j].Endpoint })
+
+	return res
+}
+
+func recordLatency(u *url.URL, d time.Duration) {
+	endpoint := EndpointPattern(u)
+	latenciesM.Lock()
+	defer latenciesM.Unlock()
+	h, ok := latencies[endpoint]
+	if !ok {
+		h = &LatencyHistogram{Endpoint: endpoint, Counts: make([]int64, len(LatencyBuckets)+1)}
+		latencies[endpoint] = h
+	}
+	i := sort.Search(len(LatencyBuckets), func(i int) bool { return d <= LatencyBuckets[i] })
+	h.Counts[i]++
+	h.Count++
+	h.Total += d
+}
+
+// Turns a URL into a pattern for the endpoint it's for by leaving out the
+// query and replacing parts of the path that look like IDs, e.g.
+// "https://example.com/books/1234/page/5.jpg" into "example.com/books/:id/page/:id".
+func EndpointPattern(u *url.URL) string {
+	parts := strings.Split(u.EscapedPath(), "/")
+	for i, part := range parts {
+		if len(part) >= 16 || strings.IndexFunc(part, unicode.IsDigit) != -1 {
+			parts[i] = ":id"
+		}
+	}
+
+	return u.Host + strings.Join(parts, "/")
+}
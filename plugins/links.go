@@ -0,0 +1,85 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// A link on a page.
+type HTMLLink struct {
+	// Resolved against the page's URL if it was passed to ParseLinks.
+	URL string
+	// The link's title attribute, its text, or the alt text of an image in
+	// it, whichever isn't empty first, with whitespace collapsed.
+	Text string
+}
+
+// Parses the links on a page, in the order they appear. The page's URL is
+// used to resolve relative links against, and can be nil.
+func ParseLinks(page []byte, base *url.URL) []HTMLLink {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil
+	}
+
+	var links []HTMLLink
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.A && hasHTMLAttr(n, "href") {
+			link := HTMLLink{URL: htmlAttr(n, "href"), Text: linkText(n)}
+			if base != nil {
+				if u, err := base.Parse(link.URL); err == nil {
+					link.URL = u.String()
+				}
+			}
+			links = append(links, link)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return links
+}
+
+func linkText(n *html.Node) string {
+	text := htmlAttr(n, "title")
+	if strings.TrimSpace(text) == "" {
+		text = htmlText(n)
+	}
+	if strings.TrimSpace(text) == "" {
+		var walk func(n *html.Node)
+		walk = func(n *html.Node) {
+			if n.Type == html.ElementNode && n.DataAtom == atom.Img && text == "" {
+				text = htmlAttr(n, "alt")
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				walk(c)
+			}
+		}
+		walk(n)
+	}
+
+	return strings.Join(strings.Fields(text), " ")
+}
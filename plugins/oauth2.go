@@ -0,0 +1,453 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+
+	"github.com/MinoMino/mindl/logger"
+)
+
+var (
+	ErrOAuth2Denied  = NewAuthError("Access was denied.")
+	ErrOAuth2Expired = NewAuthError("Access wasn't allowed in time.")
+	ErrOAuth2NoUser  = NewAuthError("Access has to be allowed once, which needs mindl to be run in a terminal.")
+	ErrOAuth2Revoked = NewAuthError("Access was revoked or has expired and has to be allowed again, which needs mindl to be run in a terminal.")
+)
+
+// How the user is asked to allow access.
+type OAuth2Flow int
+
+const (
+	// The user goes to a URL on any device and enters a code shown by mindl,
+	// which then polls until access is allowed. Works without a browser on
+	// the same machine, e.g. on servers.
+	OAuth2DeviceFlow OAuth2Flow = iota
+	// The user opens a URL in a browser, which is redirected to a listener on
+	// 127.0.0.1 once access is allowed.
+	OAuth2RedirectFlow
+	// The user opens a URL and pastes the code they get back into mindl.
+	OAuth2PasteFlow
+)
+
+// The client and endpoints of an OAuth2 provider. Flows other than the
+// device flow use PKCE, so public clients need no secret.
+type OAuth2Config struct {
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	// Only needed for the device flow.
+	DeviceURL string
+	Scopes    []string
+	// Extra parameters for the authorization URL, like access_type=offline.
+	AuthParams url.Values
+	Flow       OAuth2Flow
+}
+
+// Keeps refresh tokens between runs, keyed by the name of what they're for.
+// Saving an empty token removes it.
+type TokenStore interface {
+	LoadToken(name string) string
+	SaveToken(name, token string) error
+}
+
+var tokenStore TokenStore
+
+// Sets the store refresh tokens are kept in between runs.
+func SetTokenStore(store TokenStore) {
+	tokenStore = store
+}
+
+// Shows the user where to allow access, like the CLI.
+type OAuth2Prompter interface {
+	// Tells the user to go to the URL, and to enter the code there if there is
+	// one.
+	OAuth2Visit(name, url, code string)
+	// Asks for the code the user gets after allowing access at the URL.
+	OAuth2Code(name, url string) (string, error)
+}
+
+var oauth2Prompter OAuth2Prompter
+
+// Sets what OAuth2 flows use to ask the user for access.
+func SetOAuth2Prompter(p OAuth2Prompter) {
+	oauth2Prompter = p
+}
+
+// Gets and refreshes access tokens for an API, asking the user for access
+// the first time. The refresh token is kept in the token store under the
+// name, so it should be unique, e.g. the plugin name.
+type OAuth2 struct {
+	Name   string
+	Config *OAuth2Config
+	// Used for token requests. The default client is used if nil.
+	Client  *http.Client
+	token   string
+	expires time.Time
+	refresh string
+	m       sync.Mutex
+}
+
+func NewOAuth2(name string, config *OAuth2Config, client *http.Client) *OAuth2 {
+	return &OAuth2{Name: name, Config: config, Client: client}
+}
+
+type oauth2Token struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+func (o *OAuth2) client() *http.Client {
+	if o.Client == nil {
+		return http.DefaultClient
+	}
+	return o.Client
+}
+
+func (o *OAuth2) logger() *log.Entry {
+	return log.WithField("oauth2", o.Name)
+}
+
+func (o *OAuth2) requestToken(form url.Values) (*oauth2Token, error) {
+	form.Set("client_id", o.Config.ClientID)
+	if o.Config.ClientSecret != "" {
+		form.Set("client_secret", o.Config.ClientSecret)
+	}
+	resp, err := o.client().PostForm(o.Config.TokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var token oauth2Token
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		// Likely an error page rather than an OAuth2 error.
+		if resp.StatusCode >= 400 {
+			return nil, fmt.Errorf("%s: %s", o.Name, resp.Status)
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Returns a valid access token, refreshing it or asking for access if needed.
+func (o *OAuth2) AccessToken() (string, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if o.token != "" && time.Until(o.expires) > time.Minute {
+		return o.token, nil
+	}
+
+	if o.refresh == "" && tokenStore != nil {
+		o.refresh = tokenStore.LoadToken(o.Name)
+	}
+	var token *oauth2Token
+	var err error
+	revoked := false
+	if o.refresh != "" {
+		token, err = o.requestToken(url.Values{
+			"refresh_token": {o.refresh},
+			"grant_type":    {"refresh_token"},
+		})
+		if err != nil {
+			return "", err
+		} else if token.Error == "invalid_grant" {
+			// Only the refresh token itself being rejected means asking
+			// again, since it's revoked or expired. Other errors, like the
+			// server being down, keep it for next time.
+			o.logger().WithField("reason", token.Description).Warn("Access was revoked or has expired. Asking for it again.")
+			o.forget()
+			revoked, token = true, nil
+		} else if token.Error != "" {
+			return "", fmt.Errorf("%s: Failed to refresh the token: %s", o.Name, token.Error)
+		}
+	}
+	if token == nil {
+		if token, err = o.authorize(); err == ErrOAuth2NoUser && revoked {
+			return "", ErrOAuth2Revoked
+		} else if err != nil {
+			return "", err
+		}
+		o.logger().Info("Access granted.")
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("%s: Got no access token.", o.Name)
+	}
+	// Providers may or may not rotate refresh tokens when refreshing.
+	if token.RefreshToken != "" && token.RefreshToken != o.refresh {
+		o.refresh = token.RefreshToken
+		if tokenStore != nil {
+			if err := tokenStore.SaveToken(o.Name, o.refresh); err != nil {
+				o.logger().Warnf("Failed to save the token: %s", err)
+			}
+		}
+	}
+
+	o.token = token.AccessToken
+	o.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	logger.SetSecret("oauth2 access "+o.Name, o.token)
+	logger.SetSecret("oauth2 refresh "+o.Name, o.refresh)
+	return o.token, nil
+}
+
+// Throws away the refresh token, including the stored one.
+func (o *OAuth2) forget() {
+	o.refresh = ""
+	if tokenStore != nil {
+		if err := tokenStore.SaveToken(o.Name, ""); err != nil {
+			o.logger().Warnf("Failed to remove the token: %s", err)
+		}
+	}
+}
+
+// Makes the next call to AccessToken get a new token, e.g. after the API
+// responded with 401.
+func (o *OAuth2) Invalidate() {
+	o.m.Lock()
+	o.token = ""
+	o.m.Unlock()
+}
+
+// Sets the Authorization header of the request.
+func (o *OAuth2) Authorize(req *http.Request) error {
+	token, err := o.AccessToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return nil
+}
+
+func (o *OAuth2) authorize() (*oauth2Token, error) {
+	switch o.Config.Flow {
+	case OAuth2RedirectFlow:
+		return o.authorizeRedirect()
+	case OAuth2PasteFlow:
+		return o.authorizePaste()
+	default:
+		return o.authorizeDevice()
+	}
+}
+
+func (o *OAuth2) visit(u, code string) {
+	if oauth2Prompter != nil {
+		oauth2Prompter.OAuth2Visit(o.Name, u, code)
+	} else if code != "" {
+		o.logger().Warnf("To allow access, go to %s and enter the code: %s", u, code)
+	} else {
+		o.logger().Warnf("To allow access, open %s in a browser on this computer.", u)
+	}
+}
+
+func (o *OAuth2) authorizeDevice() (*oauth2Token, error) {
+	resp, err := o.client().PostForm(o.Config.DeviceURL, url.Values{
+		"client_id": {o.Config.ClientID},
+		"scope":     {strings.Join(o.Config.Scopes, " ")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var device struct {
+		DeviceCode string `json:"device_code"`
+		UserCode   string `json:"user_code"`
+		// Google uses the former, RFC 8628 the latter.
+		VerificationURL string `json:"verification_url"`
+		VerificationURI string `json:"verification_uri"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+		Error           string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&device); err != nil {
+		return nil, err
+	} else if device.Error != "" {
+		return nil, fmt.Errorf("%s: %s", o.Name, device.Error)
+	}
+	if device.VerificationURL == "" {
+		device.VerificationURL = device.VerificationURI
+	}
+	if device.Interval == 0 {
+		device.Interval = 5
+	}
+
+	o.visit(device.VerificationURL, device.UserCode)
+	interval := time.Duration(device.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		token, err := o.requestToken(url.Values{
+			"device_code": {device.DeviceCode},
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		switch token.Error {
+		case "":
+			return token, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied":
+			return nil, ErrOAuth2Denied
+		default:
+			return nil, fmt.Errorf("%s: %s", o.Name, token.Error)
+		}
+	}
+
+	return nil, ErrOAuth2Expired
+}
+
+// Returns the authorization URL along with the PKCE verifier.
+func (o *OAuth2) authURL(redirect, state string) (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	verifier := base64.RawURLEncoding.EncodeToString(secret)
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"client_id":             {o.Config.ClientID},
+		"response_type":         {"code"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if len(o.Config.Scopes) > 0 {
+		params.Set("scope", strings.Join(o.Config.Scopes, " "))
+	}
+	if redirect != "" {
+		params.Set("redirect_uri", redirect)
+		params.Set("state", state)
+	}
+	for k, v := range o.Config.AuthParams {
+		params[k] = v
+	}
+
+	return o.Config.AuthURL + "?" + params.Encode(), verifier, nil
+}
+
+func (o *OAuth2) exchange(code, verifier, redirect string) (*oauth2Token, error) {
+	form := url.Values{
+		"code":          {code},
+		"grant_type":    {"authorization_code"},
+		"code_verifier": {verifier},
+	}
+	if redirect != "" {
+		form.Set("redirect_uri", redirect)
+	}
+	token, err := o.requestToken(form)
+	if err != nil {
+		return nil, err
+	} else if token.Error != "" {
+		return nil, fmt.Errorf("%s: %s", o.Name, token.Error)
+	}
+
+	return token, nil
+}
+
+func (o *OAuth2) authorizePaste() (*oauth2Token, error) {
+	if oauth2Prompter == nil {
+		return nil, ErrOAuth2NoUser
+	}
+	authURL, verifier, err := o.authURL("", "")
+	if err != nil {
+		return nil, err
+	}
+	code, err := oauth2Prompter.OAuth2Code(o.Name, authURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.exchange(strings.TrimSpace(code), verifier, "")
+}
+
+// How long to wait for the browser to be redirected back.
+const oauth2RedirectTimeout = 10 * time.Minute
+
+func (o *OAuth2) authorizeRedirect() (*oauth2Token, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	redirect := fmt.Sprintf("http://127.0.0.1:%d/", ln.Addr().(*net.TCPAddr).Port)
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	authURL, verifier, err := o.authURL(redirect, base64.RawURLEncoding.EncodeToString(state))
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	type result struct {
+		code, err string
+	}
+	results := make(chan result, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		// Ignores anything else the browser asks for, like the favicon.
+		if q.Get("state") != base64.RawURLEncoding.EncodeToString(state) {
+			http.NotFound(w, r)
+			return
+		}
+		res := result{q.Get("code"), q.Get("error")}
+		if res.err != "" {
+			fmt.Fprintln(w, "Access wasn't allowed. You can close this page.")
+		} else {
+			fmt.Fprintln(w, "Access was allowed. You can close this page.")
+		}
+		select {
+		case results <- res:
+		default:
+		}
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	o.visit(authURL, "")
+	select {
+	case res := <-results:
+		if res.err == "access_denied" {
+			return nil, ErrOAuth2Denied
+		} else if res.err != "" {
+			return nil, fmt.Errorf("%s: %s", o.Name, res.err)
+		}
+		return o.exchange(res.code, verifier, redirect)
+	case <-time.After(oauth2RedirectTimeout):
+		return nil, ErrOAuth2Expired
+	}
+}
@@ -0,0 +1,401 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+)
+
+const (
+	// How often spans are sent to the collector.
+	otlpInterval = 5 * time.Second
+	// Spans are sent right away once this many are waiting.
+	otlpBatchSize = 512
+	// How many spans are kept when the collector can't be reached.
+	otlpMaxQueued = 8192
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+	statusCodeOK     = 1
+	statusCodeError  = 2
+)
+
+// A timed operation, like a job, a downloader or an HTTP request, that is
+// sent to an OpenTelemetry collector when tracing is on. All methods can be
+// called on a nil span, which is what StartSpan returns when it's off.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	attrs    map[string]interface{}
+	ended    bool
+	m        sync.Mutex
+}
+
+// Starts a span as a child of parent, or of a new trace if parent is nil.
+// Returns nil if tracing is off.
+func StartSpan(parent *Span, name string) *Span {
+	if otlp == nil {
+		return nil
+	}
+
+	s := &Span{name: name, kind: spanKindInternal, start: time.Now(), attrs: make(map[string]interface{})}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+
+	return s
+}
+
+// Sets an attribute of the span. The value should be a string, bool,
+// integer or float.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.m.Lock()
+	s.attrs[key] = value
+	s.m.Unlock()
+}
+
+// Ends the span, marking it as failed if err isn't nil, and queues it to
+// be sent. Only the first call does anything.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+	otlp.add(s.encode(time.Now(), err))
+}
+
+type spanContextKey struct{}
+
+// Returns a copy of ctx that carries the span, making it the parent of the
+// spans of HTTP requests made with it.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, s)
+}
+
+// Returns the span ctx carries, if any.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+var (
+	// The span of what each plugin is currently doing, used as the parent of
+	// requests that don't carry one in their context.
+	pluginSpans  = make(map[string]*Span)
+	pluginSpansM sync.Mutex
+)
+
+// Makes the span the parent of the plugin's requests that don't carry one in
+// their context, which is most of them, since plugins rarely pass contexts
+// around. A nil span clears it.
+func SetPluginSpan(plugin string, s *Span) {
+	if otlp == nil {
+		return
+	}
+
+	plugin = strings.ToLower(plugin)
+	pluginSpansM.Lock()
+	defer pluginSpansM.Unlock()
+	if s == nil {
+		delete(pluginSpans, plugin)
+	} else {
+		pluginSpans[plugin] = s
+	}
+}
+
+func pluginSpan(plugin string) *Span {
+	pluginSpansM.Lock()
+	defer pluginSpansM.Unlock()
+	return pluginSpans[strings.ToLower(plugin)]
+}
+
+// Sends spans to an OpenTelemetry collector using OTLP over HTTP with JSON.
+type otlpExporter struct {
+	url     string
+	header  http.Header
+	version string
+	client  *http.Client
+	spans   []json.RawMessage
+	flush   chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	m       sync.Mutex
+}
+
+var otlp *otlpExporter
+
+// Starts sending spans to the OTLP/HTTP collector at endpoint, e.g.
+// http://localhost:4318. The headers are sent with every request, which
+// hosted collectors tend to want API keys in.
+func StartTracing(endpoint, version string, header http.Header) {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	otlp = &otlpExporter{
+		url:     url,
+		header:  header,
+		version: version,
+		// Not one of the plugins' clients, since those would trace this too.
+		client:  &http.Client{Timeout: 10 * time.Second},
+		flush:   make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go otlp.run()
+}
+
+// Sends the spans that haven't been sent yet and stops tracing.
+func StopTracing() error {
+	if otlp == nil {
+		return nil
+	}
+
+	close(otlp.stop)
+	<-otlp.stopped
+	return otlp.send()
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(otlpInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.flush:
+		case <-e.stop:
+			return
+		}
+		if err := e.send(); err != nil {
+			log.Debugf("Failed to send spans to the collector: %s", err)
+		}
+	}
+}
+
+func (e *otlpExporter) add(span json.RawMessage) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if len(e.spans) >= otlpMaxQueued {
+		// Keep the newest ones if the collector is down.
+		e.spans = e.spans[1:]
+	}
+	e.spans = append(e.spans, span)
+	if len(e.spans) >= otlpBatchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Sends the queued spans. They're put back if it fails.
+func (e *otlpExporter) send() error {
+	e.m.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.m.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	err := e.post(spans)
+	if err != nil {
+		e.m.Lock()
+		e.spans = append(spans, e.spans...)
+		if len(e.spans) > otlpMaxQueued {
+			e.spans = e.spans[len(e.spans)-otlpMaxQueued:]
+		}
+		e.m.Unlock()
+	}
+	return err
+}
+
+func (e *otlpExporter) post(spans []json.RawMessage) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{
+					"service.name":    "mindl",
+					"service.version": e.version,
+				}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "mindl"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range e.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("The collector returned status code %d.", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Encodes the span the way OTLP/JSON wants it. Must be called with the lock held.
+func (s *Span) encode(end time.Time, err error) json.RawMessage {
+	status := map[string]interface{}{"code": statusCodeOK}
+	if err != nil {
+		status = map[string]interface{}{"code": statusCodeError, "message": err.Error()}
+	}
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+		"status":            status,
+	}
+	if s.parentID != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	data, _ := json.Marshal(span)
+
+	return data
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	res := make([]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		res = append(res, map[string]interface{}{"key": k, "value": value})
+	}
+
+	return res
+}
+
+// A RoundTripper that makes a span of every request, ending it once the
+// body is closed so that reading it counts too.
+type spanTransport struct {
+	http.RoundTripper
+	plugin string
+}
+
+func (t *spanTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent := SpanFromContext(req.Context())
+	if parent == nil {
+		parent = pluginSpan(t.plugin)
+	}
+	span := StartSpan(parent, "HTTP "+req.Method)
+	if span == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	span.kind = spanKindClient
+	// Not the whole URL, since queries tend to have tokens in them.
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("server.address", req.URL.Host)
+	span.SetAttribute("url.path", req.URL.Path)
+	span.SetAttribute("mindl.plugin", t.plugin)
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		span.End(err)
+		return nil, err
+	}
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	var statusErr error
+	if resp.StatusCode >= 400 {
+		statusErr = fmt.Errorf("HTTP request returned error code: %d", resp.StatusCode)
+	}
+	resp.Body = &spanBody{resp.Body, span, statusErr}
+
+	return resp, nil
+}
+
+type spanBody struct {
+	io.ReadCloser
+	span *Span
+	err  error
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.span.End(b.err)
+	return err
+}
@@ -0,0 +1,148 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrProxyChainHop = errors.New("Only HTTP and HTTPS proxies can come before another one in a chain.")
+
+// The proxies to go through to reach a proxy that's last in a chain, keyed
+// by the lowercase plugin name like proxies, and then by the address of the
+// last proxy.
+var proxyChains = make(map[string]map[string][]*url.URL)
+
+// Parses a comma-separated chain of proxies and returns the last one, which
+// the transport uses as its proxy, recording the others to tunnel through
+// to reach it.
+func parseProxyChain(plugin string, chain []string) (*url.URL, error) {
+	hops := make([]*url.URL, len(chain))
+	for i, proxy := range chain {
+		u, err := url.Parse(strings.TrimSpace(proxy))
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("Invalid proxy URL: %s", proxy)
+		} else if i < len(chain)-1 && u.Scheme != "http" && u.Scheme != "https" {
+			return nil, ErrProxyChainHop
+		}
+		hops[i] = u
+	}
+
+	last := hops[len(hops)-1]
+	if len(hops) > 1 {
+		if proxyChains[plugin] == nil {
+			proxyChains[plugin] = make(map[string][]*url.URL)
+		}
+		proxyChains[plugin][proxyAddr(last)] = hops[:len(hops)-1]
+	}
+
+	return last, nil
+}
+
+// Whether the proxy is reached through other proxies, which only the
+// plugin's own transport knows how to do.
+func IsProxyChain(plugin string, u *url.URL) bool {
+	return u != nil && proxyChain(plugin, proxyAddr(u)) != nil
+}
+
+func proxyChain(plugin, addr string) []*url.URL {
+	plugin = strings.ToLower(plugin)
+	if _, ok := proxies[plugin]; !ok {
+		plugin = ""
+	}
+
+	return proxyChains[plugin][addr]
+}
+
+// Wraps a dial function so that connections to a proxy at the end of
+// a chain tunnel through the proxies before it.
+func chainDial(plugin string, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		hops := proxyChain(plugin, addr)
+		if hops == nil {
+			return dial(ctx, network, addr)
+		}
+
+		conn, err := dial(ctx, network, proxyAddr(hops[0]))
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		for i, hop := range hops {
+			if hop.Scheme == "https" {
+				config := tlsConfig()
+				config.ServerName = hop.Hostname()
+				conn = tls.Client(conn, config)
+			}
+			target := addr
+			if i < len(hops)-1 {
+				target = proxyAddr(hops[i+1])
+			}
+			if err := connectThrough(conn, hop, target); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		conn.SetDeadline(time.Time{})
+
+		return conn, nil
+	}
+}
+
+// Asks the proxy on the other end of the connection to tunnel it to the
+// address.
+func connectThrough(conn net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// Nothing is sent through the tunnel before it's up, so the reader
+	// can't take anything past the response.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("The proxy %s refused to connect to %s: %s", proxy.Host, addr, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+)
+
+// How proxies in a pool are picked.
+const (
+	// A different proxy for every request.
+	ProxyRoundRobin = "round-robin"
+	// The same proxy for every request to a host, as long as it works.
+	ProxySticky = "sticky"
+)
+
+var (
+	ProxyRotation = ProxyRoundRobin
+	// How long to stop using a proxy for after failing to connect to it.
+	ProxyDeadTime = 5 * time.Minute
+)
+
+// When proxies failed to connect, keyed by their address.
+var (
+	deadProxies  = make(map[string]time.Time)
+	deadProxiesM sync.Mutex
+	// The addresses of proxies in pools, which are the only ones
+	// worth keeping track of.
+	pooledProxies = make(map[string]bool)
+)
+
+// Several proxies that requests are spread over.
+type proxyPool struct {
+	proxies []*url.URL
+	next    int
+	// The proxy of each host when sticky.
+	hosts map[string]*url.URL
+	m     sync.Mutex
+}
+
+func newProxyPool(proxies []*url.URL) *proxyPool {
+	deadProxiesM.Lock()
+	for _, u := range proxies {
+		if u != nil {
+			pooledProxies[proxyAddr(u)] = true
+		}
+	}
+	deadProxiesM.Unlock()
+
+	return &proxyPool{proxies: proxies, hosts: make(map[string]*url.URL)}
+}
+
+func (p *proxyPool) proxy(req *http.Request) (*url.URL, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if ProxyRotation == ProxySticky {
+		if u, ok := p.hosts[req.URL.Host]; ok && !isDeadProxy(u) {
+			return u, nil
+		}
+	}
+
+	// Take the next one that's alive, or just the next one if they're all dead.
+	u := p.proxies[p.next%len(p.proxies)]
+	for i := 0; i < len(p.proxies); i++ {
+		candidate := p.proxies[(p.next+i)%len(p.proxies)]
+		if !isDeadProxy(candidate) {
+			u = candidate
+			p.next += i
+			break
+		}
+	}
+	p.next++
+	if ProxyRotation == ProxySticky {
+		p.hosts[req.URL.Host] = u
+	}
+
+	return u, nil
+}
+
+func isDeadProxy(u *url.URL) bool {
+	if u == nil {
+		return false
+	}
+	deadProxiesM.Lock()
+	defer deadProxiesM.Unlock()
+
+	return time.Since(deadProxies[proxyAddr(u)]) < ProxyDeadTime
+}
+
+// Returns the address that's dialed to connect to the proxy.
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	switch u.Scheme {
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Wraps a dial function so that proxies in pools that can't be connected
+// to are left out for a while.
+func proxyHealthDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+
+		deadProxiesM.Lock()
+		defer deadProxiesM.Unlock()
+		if pooledProxies[addr] {
+			if time.Since(deadProxies[addr]) >= ProxyDeadTime {
+				log.WithField("proxy", addr).WithError(err).Warnf("Failed to connect to the proxy. Not using it for %s.", ProxyDeadTime)
+			}
+			deadProxies[addr] = time.Now()
+		}
+		return conn, err
+	}
+}
@@ -0,0 +1,159 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+)
+
+// A client's way of logging in again, and whether it's doing so.
+type sessionRefresher struct {
+	check   func(*http.Client) bool
+	refresh func(*http.Client) error
+	// Bumped after every refresh, letting requests that were sent with the
+	// old session tell that it has been refreshed since.
+	generation int
+	failed     bool
+	// Held for writing while refreshing, which pauses every other request.
+	m sync.RWMutex
+}
+
+// Refreshers keyed by the jar of the client they're for.
+var (
+	refreshers  = make(map[http.CookieJar]*sessionRefresher)
+	refreshersM sync.Mutex
+)
+
+// Makes the client call refresh to log in again if its requests start
+// getting 401 or 403 responses and check says the session is no longer
+// valid, like when it expires during a long download. Other requests wait
+// until it's done, and the failed requests are sent again. The client passed
+// to check and refresh shares the cookies of the original one, and must be
+// used to check the session and log in. A refresh that fails isn't tried
+// again. The refresher is forgotten once the client is garbage collected.
+func OnSessionExpired(client *http.Client, check func(*http.Client) bool, refresh func(*http.Client) error) {
+	if client.Jar == nil {
+		return
+	}
+
+	s := &sessionRefresher{check: check, refresh: refresh}
+	jar := client.Jar
+	refreshersM.Lock()
+	refreshers[jar] = s
+	refreshersM.Unlock()
+	runtime.SetFinalizer(client, nil)
+	runtime.SetFinalizer(client, func(*http.Client) {
+		refreshersM.Lock()
+		if refreshers[jar] == s {
+			delete(refreshers, jar)
+		}
+		refreshersM.Unlock()
+	})
+}
+
+// Calls a login function that panics on errors, like most plugins' do, and
+// returns the panic as an error instead, for use with OnSessionExpired.
+func RecoverLogin(login func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+	login()
+
+	return nil
+}
+
+// A RoundTripper that logs in again with the client's refresher when the
+// session seems to have expired.
+type reauthTransport struct {
+	http.RoundTripper
+	jar     http.CookieJar
+	timeout time.Duration
+}
+
+func (t *reauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	refreshersM.Lock()
+	s := refreshers[t.jar]
+	refreshersM.Unlock()
+	if s == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	// Waits for any refresh in progress.
+	s.m.RLock()
+	generation, failed := s.generation, s.failed
+	s.m.RUnlock()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || failed || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) ||
+		!isIdempotent(req) {
+		return resp, err
+	}
+
+	s.m.Lock()
+	if s.generation == generation && !s.failed {
+		// Bypasses this transport, since it'd wait for itself otherwise.
+		client := &http.Client{
+			Jar:           t.jar,
+			Transport:     &retryTransport{t.RoundTripper, t.timeout, ""},
+			CheckRedirect: checkRedirect,
+		}
+		// A 403 can just as well be something the user isn't allowed to see.
+		if s.check(client) {
+			s.m.Unlock()
+			return resp, nil
+		}
+		entry := log.WithField("status", resp.StatusCode)
+		entry.Warn("The session has expired. Logging in again...")
+		if err := s.refresh(client); err != nil {
+			entry.WithError(err).Error("Failed to log in again.")
+			s.failed = true
+		} else {
+			entry.Info("Logged in again.")
+		}
+		s.generation++
+	}
+	failed = s.failed
+	s.m.Unlock()
+	if failed {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	if req.Body != nil && req.Body != http.NoBody {
+		if req, err = rewindRequest(req); err != nil {
+			return nil, err
+		}
+	}
+	req = req.Clone(req.Context())
+	req.Header.Del("Cookie")
+	for _, c := range t.jar.Cookies(req.URL) {
+		req.AddCookie(c)
+	}
+
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,156 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What was sent to a host and how long it took.
+type HostStat struct {
+	Requests int64 `json:"requests"`
+	// Bytes of response bodies read.
+	Bytes int64 `json:"bytes"`
+	// Total time spent on requests, from sending them until their bodies
+	// were closed, in seconds.
+	Seconds float64 `json:"seconds"`
+	// Requests that failed and were sent again.
+	Retries int64 `json:"retries,omitempty"`
+}
+
+// Stats of every host for every plugin since the program started.
+var (
+	hostStats  = make(map[string]map[string]*HostStat)
+	hostStatsM sync.Mutex
+)
+
+// Returns a copy of the stats of each host the plugin has sent requests to.
+func HostStats(plugin string) map[string]HostStat {
+	hostStatsM.Lock()
+	defer hostStatsM.Unlock()
+	res := make(map[string]HostStat)
+	for host, stat := range hostStats[strings.ToLower(plugin)] {
+		res[host] = *stat
+	}
+
+	return res
+}
+
+// Returns the stats in after that aren't in before, leaving out hosts
+// without any new requests.
+func DiffHostStats(before, after map[string]HostStat) map[string]HostStat {
+	res := make(map[string]HostStat)
+	for host, a := range after {
+		b := before[host]
+		if a.Requests == b.Requests {
+			continue
+		}
+		res[host] = HostStat{
+			Requests: a.Requests - b.Requests,
+			Bytes:    a.Bytes - b.Bytes,
+			Seconds:  a.Seconds - b.Seconds,
+			Retries:  a.Retries - b.Retries,
+		}
+	}
+
+	return res
+}
+
+// Counts a request to the host being sent again after it failed, e.g. by
+// the transport or a download that got cut off.
+func RecordRetry(plugin, host string) {
+	if plugin == "" {
+		return
+	}
+
+	plugin = strings.ToLower(plugin)
+	hostStatsM.Lock()
+	defer hostStatsM.Unlock()
+	hostStat(plugin, host).Retries++
+}
+
+func addHostStat(plugin, host string, requests, bytes int64, elapsed time.Duration) {
+	plugin = strings.ToLower(plugin)
+	hostStatsM.Lock()
+	defer hostStatsM.Unlock()
+	stat := hostStat(plugin, host)
+	stat.Requests += requests
+	stat.Bytes += bytes
+	stat.Seconds += elapsed.Seconds()
+}
+
+// Returns the stats of the host, adding them if there are none yet.
+// Must be called with the lock held.
+func hostStat(plugin, host string) *HostStat {
+	if hostStats[plugin] == nil {
+		hostStats[plugin] = make(map[string]*HostStat)
+	}
+	stat, ok := hostStats[plugin][host]
+	if !ok {
+		stat = &HostStat{}
+		hostStats[plugin][host] = stat
+	}
+
+	return stat
+}
+
+// A RoundTripper that keeps the stats of every host for the plugin.
+type statsTransport struct {
+	http.RoundTripper
+	plugin string
+}
+
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	recordLatency(req.URL, time.Since(start))
+	if err != nil {
+		addHostStat(t.plugin, req.URL.Host, 1, 0, time.Since(start))
+		return nil, err
+	}
+	resp.Body = &statsBody{ReadCloser: resp.Body, plugin: t.plugin, host: req.URL.Host, start: start}
+
+	return resp, nil
+}
+
+// Counts the bytes read and records them along with the time taken
+// once the body is closed.
+type statsBody struct {
+	io.ReadCloser
+	plugin, host string
+	start        time.Time
+	bytes        int64
+	once         sync.Once
+}
+
+func (b *statsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+func (b *statsBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		addHostStat(b.plugin, b.host, 1, b.bytes, time.Since(b.start))
+	})
+	return err
+}
@@ -0,0 +1,123 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request rates set by the user in requests per second, keyed like proxies.
+var rateLimits = make(map[string]float64)
+
+// The buckets of each plugin, shared by all their clients.
+var (
+	buckets  = make(map[string]*tokenBucket)
+	bucketsM sync.Mutex
+)
+
+// Limits how many requests per second the plugin's HTTP clients send, or
+// every plugin's without one of their own if the name is empty. Every
+// plugin gets its own limit, no matter how many workers or clients it has.
+func SetRateLimit(plugin string, perSecond float64) {
+	rateLimits[strings.ToLower(plugin)] = perSecond
+}
+
+// Returns the plugin's bucket, or nil if its requests aren't limited.
+func pluginBucket(plugin string) *tokenBucket {
+	plugin = strings.ToLower(plugin)
+	rate, ok := rateLimits[plugin]
+	if !ok {
+		rate = rateLimits[""]
+	}
+	if rate <= 0 {
+		return nil
+	}
+
+	bucketsM.Lock()
+	defer bucketsM.Unlock()
+	if b, ok := buckets[plugin]; ok {
+		return b
+	}
+	// Allow bursts of up to a second's worth, so that a slow start
+	// doesn't waste what could've been sent.
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	b := &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+	buckets[plugin] = b
+
+	return b
+}
+
+// A token bucket that fills up at a steady rate, with a request taking
+// a token to be sent.
+type tokenBucket struct {
+	rate, burst, tokens float64
+	last                time.Time
+	m                   sync.Mutex
+}
+
+// Waits until there's a token and takes it.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	b.m.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	// Take the token right away, going into debt if need be, so that
+	// waiting requests are let through in the order they came in.
+	b.tokens--
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.m.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// Give the token back.
+		b.m.Lock()
+		b.tokens++
+		b.m.Unlock()
+		return ctx.Err()
+	}
+}
+
+// A RoundTripper that keeps the plugin's requests under its rate limit.
+type throttleTransport struct {
+	http.RoundTripper
+	bucket *tokenBucket
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.bucket.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+
+	return t.RoundTripper.RoundTrip(req)
+}
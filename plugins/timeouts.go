@@ -0,0 +1,71 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrUnknownTimeout = errors.New("Unknown timeout. Should be connect, tls, header, idle or request.")
+
+// The kinds of timeouts.
+const (
+	// Connecting to the server.
+	TimeoutConnect = "connect"
+	// The TLS handshake after connecting.
+	TimeoutTLS = "tls"
+	// Waiting for the response headers after sending the request.
+	TimeoutHeader = "header"
+	// How long idle connections are kept for reuse.
+	TimeoutIdle = "idle"
+	// Every attempt at a request as a whole, including reading the body.
+	TimeoutRequest = "request"
+)
+
+// Timeouts set by the user, keyed like proxies and then by kind.
+var timeouts = make(map[string]map[string]time.Duration)
+
+// Sets a timeout for the plugin's HTTP clients, or for every plugin without
+// one of their own if the name is empty.
+func SetTimeout(plugin, kind string, d time.Duration) error {
+	switch kind {
+	case TimeoutConnect, TimeoutTLS, TimeoutHeader, TimeoutIdle, TimeoutRequest:
+	default:
+		return ErrUnknownTimeout
+	}
+
+	plugin = strings.ToLower(plugin)
+	if timeouts[plugin] == nil {
+		timeouts[plugin] = make(map[string]time.Duration)
+	}
+	timeouts[plugin][kind] = d
+
+	return nil
+}
+
+// Returns the timeout the user set for the plugin, or def if none.
+func timeout(plugin, kind string, def time.Duration) time.Duration {
+	if d, ok := timeouts[strings.ToLower(plugin)][kind]; ok {
+		return d
+	} else if d, ok := timeouts[""][kind]; ok {
+		return d
+	}
+
+	return def
+}
@@ -0,0 +1,106 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	ErrNoCertificates = errors.New("Found no certificates in the CA file.")
+	ErrInvalidPin     = errors.New("Invalid certificate pin. Should be host=sha256/<base64 hash of the public key>.")
+)
+
+var (
+	// Turns off certificate verification. Only for debugging.
+	InsecureTLS bool
+	// Extra CA certificates added by the user on top of the system's.
+	extraCAs *x509.CertPool
+	// SHA-256 hashes of the public keys allowed for a host, base64 encoded.
+	pins = make(map[string][]string)
+)
+
+// Adds the CA certificates in a PEM file to the ones trusted.
+func LoadCAFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if extraCAs == nil {
+		if extraCAs, err = x509.SystemCertPool(); err != nil {
+			// Not available on Windows before Go 1.18.
+			extraCAs = x509.NewCertPool()
+		}
+	}
+	if !extraCAs.AppendCertsFromPEM(data) {
+		return ErrNoCertificates
+	}
+
+	return nil
+}
+
+// Pins a host to a public key, making connections to it fail unless one
+// of the certificates it presents has a pinned key. Pins are in the
+// "sha256/<base64>" format used by HPKP and curl.
+func AddPin(host, pin string) error {
+	pin = strings.TrimPrefix(pin, "sha256/")
+	if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size || host == "" {
+		return ErrInvalidPin
+	}
+	host = strings.ToLower(host)
+	pins[host] = append(pins[host], pin)
+
+	return nil
+}
+
+func tlsConfig() *tls.Config {
+	config := &tls.Config{
+		RootCAs:            extraCAs,
+		InsecureSkipVerify: InsecureTLS,
+	}
+	if len(pins) > 0 {
+		config.VerifyConnection = verifyPins
+	}
+
+	return config
+}
+
+func verifyPins(cs tls.ConnectionState) error {
+	allowed, ok := pins[strings.ToLower(cs.ServerName)]
+	if !ok {
+		return nil
+	}
+
+	for _, cert := range cs.PeerCertificates {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		pin := base64.StdEncoding.EncodeToString(hash[:])
+		for _, p := range allowed {
+			if p == pin {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("The certificate of %s doesn't match any of its pins.", cs.ServerName)
+}
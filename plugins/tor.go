@@ -0,0 +1,78 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The default address of Tor's SOCKS port.
+const DefaultTorAddress = "127.0.0.1:9050"
+
+var (
+	// Tor's SOCKS port if traffic should go through Tor.
+	torAddress string
+	// How many circuits each plugin has asked for, used to keep the
+	// streams of separate jobs apart.
+	torCircuits  = make(map[string]int)
+	torCircuitsM sync.Mutex
+)
+
+// Routes the traffic of every plugin without a proxy of its own through
+// Tor's SOCKS port at the address.
+func SetTor(address string) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("Invalid Tor address: %s", address)
+	}
+	torAddress = address
+
+	return nil
+}
+
+// Whether or not traffic goes through Tor.
+func UsingTor() bool {
+	return torAddress != ""
+}
+
+// Makes the plugin's requests go through a new Tor circuit. Called at the
+// start of every job so that sites can't link jobs together by exit node.
+func NewTorCircuit(plugin string) {
+	torCircuitsM.Lock()
+	torCircuits[strings.ToLower(plugin)]++
+	torCircuitsM.Unlock()
+}
+
+// Tor puts streams with different SOCKS credentials on different circuits,
+// so the credentials are made unique per plugin and circuit. Connections
+// are pooled per proxy URL too, so no connections are shared either.
+func torProxy(plugin string) func(*http.Request) (*url.URL, error) {
+	return func(*http.Request) (*url.URL, error) {
+		torCircuitsM.Lock()
+		n := torCircuits[strings.ToLower(plugin)]
+		torCircuitsM.Unlock()
+		return &url.URL{
+			Scheme: "socks5",
+			Host:   torAddress,
+			User:   url.UserPassword(fmt.Sprintf("mindl-%s-%d", strings.ToLower(plugin), n), "mindl"),
+		}, nil
+	}
+}
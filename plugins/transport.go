@@ -0,0 +1,580 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+
+	"github.com/MinoMino/mindl/logger"
+)
+
+var (
+	// How many idle connections to keep per host. Go's default of two
+	// makes workers keep reconnecting to the same CDN.
+	MaxIdleConnsPerHost = 32
+	// The default timeouts, which can be changed per plugin with SetTimeout().
+	ConnectTimeout      = 30 * time.Second
+	TLSHandshakeTimeout = 10 * time.Second
+	// Zero means no timeout other than the one for the request.
+	ResponseHeaderTimeout = time.Duration(0)
+	// How long idle connections are kept for reuse. Zero turns reuse off.
+	IdleConnTimeout = 90 * time.Second
+	HTTP2           = true
+	// The most connections open at the same time across every plugin
+	// and job. Zero means no limit.
+	MaxConnections = 0
+	// 4 or 6 to only connect over IPv4 or IPv6. Zero means either.
+	IPVersion = 0
+)
+
+var (
+	// The transports of each plugin, shared by their clients so that
+	// connections are reused and can be limited.
+	transports  = make(map[string]*http.Transport)
+	connSlots   chan struct{}
+	transportsM sync.Mutex
+)
+
+// Builds the transport for the plugin's HTTP clients. The jar is the
+// client's, which solved challenges put their cookies in.
+func newTransport(plugin string, jar http.CookieJar, requestTimeout time.Duration) http.RoundTripper {
+	var rt http.RoundTripper = &lengthTransport{baseTransport(plugin)}
+	rt = &statsTransport{rt, plugin}
+	rt = &decodingTransport{rt}
+	if har != nil {
+		rt = &harTransport{rt, plugin}
+	}
+	if challengeSolver != nil {
+		rt = &challengeTransport{rt, plugin, jar}
+	}
+	rt = &headerTransport{rt, pluginHeaders(plugin)}
+	if cacheDir != "" {
+		rt = &cacheTransport{rt, plugin}
+	}
+	if jar != nil {
+		rt = &reauthTransport{rt, jar, timeout(plugin, TimeoutRequest, requestTimeout)}
+	}
+	if logger.Tracing() {
+		rt = &tracingTransport{rt}
+	}
+	if otlp != nil {
+		rt = &spanTransport{rt, plugin}
+	}
+	if b := pluginBucket(plugin); b != nil {
+		rt = &throttleTransport{rt, b}
+	}
+
+	return &retryTransport{rt, timeout(plugin, TimeoutRequest, requestTimeout), plugin}
+}
+
+func baseTransport(plugin string) *http.Transport {
+	transportsM.Lock()
+	defer transportsM.Unlock()
+	plugin = strings.ToLower(plugin)
+	if t, ok := transports[plugin]; ok {
+		return t
+	}
+	if MaxConnections > 0 && connSlots == nil {
+		connSlots = make(chan struct{}, MaxConnections)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   timeout(plugin, TimeoutConnect, ConnectTimeout),
+		KeepAlive: 30 * time.Second,
+		Resolver:  resolver(),
+	}
+	transport.DialContext = limitedDial(proxyHealthDial(chainDial(plugin, ipDial(dialer.DialContext))))
+	transport.Proxy = proxyFunc(plugin)
+	transport.MaxIdleConnsPerHost = MaxIdleConnsPerHost
+	if transport.MaxIdleConns < MaxIdleConnsPerHost {
+		transport.MaxIdleConns = MaxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = timeout(plugin, TimeoutIdle, IdleConnTimeout)
+	transport.DisableKeepAlives = transport.IdleConnTimeout <= 0
+	transport.TLSHandshakeTimeout = timeout(plugin, TimeoutTLS, TLSHandshakeTimeout)
+	transport.ResponseHeaderTimeout = timeout(plugin, TimeoutHeader, ResponseHeaderTimeout)
+	transport.TLSClientConfig = tlsConfig()
+	if !HTTP2 {
+		// A non-nil empty map is what turns HTTP/2 off.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	transports[plugin] = transport
+
+	return transport
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Wraps a dial function so that it only uses the IP version set, if any.
+func ipDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" && (IPVersion == 4 || IPVersion == 6) {
+			network = "tcp" + strconv.Itoa(IPVersion)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// Wraps a dial function so that it waits for a free slot if
+// MaxConnections are already open.
+func limitedDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if connSlots == nil {
+			return dial(ctx, network, addr)
+		}
+
+		select {
+		case connSlots <- struct{}{}:
+		default:
+			// Idle connections take up slots too, so get rid of them
+			// before waiting for one to be closed.
+			closeIdleConnections()
+			select {
+			case connSlots <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			<-connSlots
+			return nil, err
+		}
+
+		return &limitedConn{Conn: conn}, nil
+	}
+}
+
+func closeIdleConnections() {
+	transportsM.Lock()
+	defer transportsM.Unlock()
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// A connection that frees up its slot when closed.
+type limitedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { <-connSlots })
+	return c.Conn.Close()
+}
+
+var (
+	// How many times to retry failed requests.
+	MaxRetries = 3
+	// The delay before the first retry, which doubles with each retry.
+	RetryDelay = time.Second
+	// The longest to ever wait between retries.
+	MaxRetryDelay = 30 * time.Second
+	// The longest to pause a host for when it rate limits us.
+	MaxRateLimitWait = 15 * time.Minute
+)
+
+// Hosts that have rate limited us, and when we can send requests again.
+var (
+	hostPauses  = make(map[string]time.Time)
+	hostPausesM sync.Mutex
+)
+
+// A RoundTripper that retries idempotent requests that fail because of a
+// network error or a server error, waiting longer after every attempt.
+// The timeout applies to each attempt rather than the request as a whole,
+// and if a host rate limits us, requests to it are paused for as long as
+// it asks.
+type retryTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+	plugin  string
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := MaxRetries
+	if !isIdempotent(req) {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := waitForHost(req); err != nil {
+			return nil, err
+		}
+		resp, err := t.attempt(req)
+		if resp != nil {
+			checkRateLimit(req, resp)
+		}
+		if attempt >= retries || req.Context().Err() != nil || !shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		wait := retryDelay(attempt, resp)
+		RecordRetry(t.plugin, req.URL.Host)
+		entry := log.WithFields(map[string]interface{}{
+			"url":     logURL(req.URL),
+			"attempt": attempt + 1,
+			"wait":    wait.String(),
+		})
+		if err != nil {
+			entry.WithError(err).Debug("Request failed. Retrying...")
+		} else {
+			entry.WithField("status", resp.StatusCode).Debug("Request failed. Retrying...")
+			// Read the body so that the connection can be reused.
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req, err = rewindRequest(req); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (t *retryTransport) attempt(req *http.Request) (*http.Response, error) {
+	if t.timeout <= 0 {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The timeout covers reading the body as well.
+	resp.Body = &cancelBody{resp.Body, cancel}
+
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Waits until the request's host is no longer paused.
+func waitForHost(req *http.Request) error {
+	hostPausesM.Lock()
+	until := hostPauses[req.URL.Host]
+	hostPausesM.Unlock()
+	wait := time.Until(until)
+	if wait <= 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// Pauses requests to the host if the response says we're rate limited.
+func checkRateLimit(req *http.Request, resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	wait, ok := retryAfter(resp)
+	if !ok {
+		if resp.StatusCode != http.StatusTooManyRequests {
+			return
+		}
+		// Rate limited without being told for how long.
+		wait = RetryDelay
+	}
+	if wait > MaxRateLimitWait {
+		wait = MaxRateLimitWait
+	}
+
+	until := time.Now().Add(wait)
+	hostPausesM.Lock()
+	defer hostPausesM.Unlock()
+	// Only log it once when lots of workers get limited at the same time.
+	if until.Sub(hostPauses[req.URL.Host]) > time.Second {
+		log.WithField("host", req.URL.Host).Warnf("Rate limited. Pausing requests to the host for %s.", wait)
+		hostPauses[req.URL.Host] = until
+	}
+}
+
+// Parses the Retry-After header, which is either seconds or a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	header := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if header == "" {
+		return 0, false
+	} else if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	} else if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// Whether or not a request can safely be sent again.
+func isIdempotent(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+		return true
+	}
+
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// Returns how long to wait before a retry. Rate limited hosts are paused
+// instead, so there's no wait if the server says how long to wait.
+// Otherwise the delay doubles with each attempt and is randomized so that
+// workers don't all retry at once.
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if _, ok := retryAfter(resp); ok {
+			return 0
+		}
+	}
+
+	// A delay of 0 turns waiting off.
+	if RetryDelay <= 0 {
+		return 0
+	}
+	d := RetryDelay << uint(attempt)
+	// Enough attempts overflow the shift.
+	if d > MaxRetryDelay || d < RetryDelay {
+		d = MaxRetryDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = body
+
+	return req, nil
+}
+
+// Sets the user agent of every request made by the plugin's HTTP clients,
+// or by every plugin if the name is empty. The user agent can be the name
+// of one of the presets.
+func SetUserAgent(plugin, userAgent string) {
+	if ua, ok := UserAgentPresets[strings.ToLower(userAgent)]; ok {
+		userAgent = ua
+	}
+	plugin = strings.ToLower(plugin)
+	if headers[plugin] == nil {
+		headers[plugin] = make(http.Header)
+	}
+	headers[plugin].Set("User-Agent", userAgent)
+}
+
+// Headers set by the user, keyed like proxies.
+var headers = make(map[string]http.Header)
+
+// Adds a header to every request made by the plugin's HTTP clients, or
+// by every plugin if the name is empty. Headers set for a plugin take
+// precedence over the ones for every plugin.
+func AddHeader(plugin, name, value string) {
+	plugin = strings.ToLower(plugin)
+	if headers[plugin] == nil {
+		headers[plugin] = make(http.Header)
+	}
+	headers[plugin].Add(name, value)
+}
+
+func pluginHeaders(plugin string) http.Header {
+	res := make(http.Header)
+	for k, v := range headers[""] {
+		res[k] = v
+	}
+	if plugin != "" {
+		for k, v := range headers[strings.ToLower(plugin)] {
+			res[k] = v
+		}
+	}
+
+	return res
+}
+
+// A RoundTripper that sets headers on every request, replacing any the
+// plugin set itself. Requests without a user agent get the default one.
+type headerTransport struct {
+	http.RoundTripper
+	header http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.header {
+		req.Header[k] = v
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", DefaultUserAgent)
+	}
+
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// Returns the headers the plugin's client would send with the request,
+// including its cookies, for handing the request to another program.
+func RequestHeaders(plugin string, client *http.Client, req *http.Request) http.Header {
+	h := req.Header.Clone()
+	for k, v := range pluginHeaders(plugin) {
+		h[k] = v
+	}
+	if h.Get("User-Agent") == "" {
+		h.Set("User-Agent", DefaultUserAgent)
+	}
+	if client.Jar != nil {
+		var cookies []string
+		for _, c := range client.Jar.Cookies(req.URL) {
+			cookies = append(cookies, c.String())
+		}
+		if len(cookies) != 0 {
+			h.Set("Cookie", strings.Join(cookies, "; "))
+		}
+	}
+
+	return h
+}
+
+// Proxies set by the user, keyed by the lowercase plugin name, with the
+// empty string being the ones for every plugin. A nil URL means no proxy.
+// Plugins with more than one rotate between them.
+var proxies = make(map[string][]*url.URL)
+
+// Adds a proxy for the plugin's HTTP clients, or for every plugin without
+// one of their own if the name is empty. "direct" turns off proxying,
+// including proxies from the environment. Several comma-separated proxies
+// are chained, with requests going through them in order.
+func SetProxy(plugin, proxy string) error {
+	plugin = strings.ToLower(plugin)
+	var u *url.URL
+	if !strings.EqualFold(proxy, "direct") {
+		var err error
+		if u, err = parseProxyChain(plugin, strings.Split(proxy, ",")); err != nil {
+			return err
+		}
+	}
+	proxies[plugin] = append(proxies[plugin], u)
+
+	return nil
+}
+
+// Returns the proxy function for the plugin's HTTP clients. Without
+// a proxy set by the user, Tor is used if set, and otherwise the usual
+// environment variables.
+func proxyFunc(plugin string) func(*http.Request) (*url.URL, error) {
+	us, ok := proxies[strings.ToLower(plugin)]
+	if !ok {
+		if UsingTor() {
+			return torProxy(plugin)
+		} else if us, ok = proxies[""]; !ok {
+			return http.ProxyFromEnvironment
+		}
+	}
+	if len(us) == 1 {
+		return http.ProxyURL(us[0])
+	}
+
+	return newProxyPool(us).proxy
+}
+
+// Returns the proxy the plugin's request would go through, or nil if none.
+// For handing requests over to something else, like an external downloader.
+func ProxyFor(plugin string, req *http.Request) (*url.URL, error) {
+	return proxyFunc(plugin)(req)
+}
+
+// A RoundTripper that logs every request going through it along with
+// the response status and how long it took. Used when tracing is on.
+type tracingTransport struct {
+	http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	entry := log.WithFields(map[string]interface{}{
+		"method":  req.Method,
+		"url":     logURL(req.URL),
+		"elapsed": time.Since(start).String(),
+	})
+	if err != nil {
+		entry.WithError(err).Debug("HTTP request failed.")
+	} else {
+		entry.WithField("status", resp.StatusCode).Debug("HTTP request.")
+	}
+
+	return resp, err
+}
+
+// Returns the URL without the query, user info or fragment, which can have
+// tokens and such in them, for logging.
+func logURL(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawPath: u.RawPath}).String()
+}
@@ -0,0 +1,82 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Returned when reading a response body that ends before its Content-Length,
+// which would otherwise leave a broken file that looks like it downloaded
+// fine.
+type ErrTruncated struct {
+	URL                string
+	Expected, Received int64
+}
+
+func (e *ErrTruncated) Error() string {
+	return fmt.Sprintf("The response was cut off after %d of %d bytes: %s", e.Received, e.Expected, e.URL)
+}
+
+// A RoundTripper that makes response bodies fail with ErrTruncated if they
+// don't match their Content-Length. It has to be below anything that
+// decodes the body, since decoding changes the length.
+type lengthTransport struct {
+	http.RoundTripper
+}
+
+func (t *lengthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = CheckLength(req, resp)
+
+	return resp, nil
+}
+
+// Returns the response's body, made to fail with ErrTruncated if it doesn't
+// match the Content-Length. Responses from the network are already checked,
+// but not ones served from the HTTP cache.
+func CheckLength(req *http.Request, resp *http.Response) io.ReadCloser {
+	if req.Method == http.MethodHead || resp.ContentLength < 0 {
+		return resp.Body
+	} else if _, ok := resp.Body.(*lengthBody); ok {
+		return resp.Body
+	}
+
+	return &lengthBody{ReadCloser: resp.Body, url: req.URL.String(), expected: resp.ContentLength}
+}
+
+type lengthBody struct {
+	io.ReadCloser
+	url      string
+	expected int64
+	received int64
+}
+
+func (b *lengthBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.received += int64(n)
+	if (err == io.EOF || err == io.ErrUnexpectedEOF) && b.received != b.expected {
+		err = &ErrTruncated{b.url, b.expected, b.received}
+	}
+
+	return n, err
+}
@@ -0,0 +1,92 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+)
+
+var (
+	ErrNoTwoFactor       = NewAuthError("The site wants a two-factor code, but there's no way to get one. Set the TOTPSecret option or run mindl in a terminal.")
+	ErrInvalidTOTPSecret = errors.New("The TOTP secret isn't valid base32.")
+)
+
+// The option plugins with two-factor logins should have, holding the secret
+// an authenticator app would be set up with. It's hidden so that users without
+// two-factor logins aren't asked for it, and like other secrets it can be kept
+// in the keyring.
+const TOTPSecretOption = "TOTPSecret"
+
+func NewTOTPSecretOption() Option {
+	return &SecretOption{StringOption{K: TOTPSecretOption, Hidden: true,
+		C: "The secret from setting up two-factor authentication, to log in without being asked for codes."}}
+}
+
+// Something that can give the code for a two-factor login, like the user.
+type TwoFactorPrompter interface {
+	TwoFactorCode(plugin string) (string, error)
+}
+
+var twoFactorPrompter TwoFactorPrompter
+
+// Sets what login flows use to get two-factor codes without a TOTP secret.
+func SetTwoFactorPrompter(p TwoFactorPrompter) {
+	twoFactorPrompter = p
+}
+
+// Returns the code for a two-factor login, for plugins to call when a site
+// asks for one. It's made from the TOTP secret if there is one, and otherwise
+// asked for, e.g. for codes sent by email.
+func TwoFactorCode(plugin, secret string) (string, error) {
+	if secret != "" {
+		log.WithField("plugin", plugin).Debug("Generating a two-factor code...")
+		return TOTP(secret, time.Now())
+	} else if twoFactorPrompter == nil {
+		return "", ErrNoTwoFactor
+	}
+
+	return twoFactorPrompter.TwoFactorCode(plugin)
+}
+
+// Generates the 6-digit code for the time from a base32 secret, as described
+// in RFC 6238 and used by authenticator apps.
+func TOTP(secret string, t time.Time) (string, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return "", ErrInvalidTOTPSecret
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
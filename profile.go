@@ -0,0 +1,161 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+var ErrUnknownProfile = errors.New("No profile with that name.")
+
+// A named bundle of flags and plugin options, e.g. for a device.
+type Profile struct {
+	// Flag values by their long names, e.g. "zip": "true".
+	Flags map[string]string `json:"flags"`
+	// Plugin options, just like with -o.
+	Options map[string]string `json:"options"`
+}
+
+// Profiles that are always available. The profiles file can override them.
+var builtinProfiles = map[string]Profile{
+	"archive": {
+		Flags:   map[string]string{"zip": "true", "zip-extension": "cbz"},
+		Options: map[string]string{"Lossless": "true"},
+	},
+	"phone": {
+		Options: map[string]string{"Lossless": "false", "JPEGQuality": "80", "MaxHeight": "1600"},
+	},
+}
+
+var (
+	profileName  string
+	profilesPath string
+)
+
+func init() {
+	commonFlags.StringVar(&profileName, "profile", "",
+		"The name of a profile to use, which sets flags and options not set otherwise.")
+	commonFlags.StringVar(&profilesPath, "profiles-file", DefaultProfilesPath(),
+		"The file with the user's profiles.")
+}
+
+// The default location of the profiles file, in the user's config directory.
+func DefaultProfilesPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "mindl-profiles.json"
+	}
+
+	return filepath.Join(dir, "mindl", "profiles.json")
+}
+
+// Loads the profiles from a JSON object with profile names as keys, on top
+// of the built-in ones. A missing file just means there are no user profiles.
+func LoadProfiles(path string) (map[string]Profile, error) {
+	res := make(map[string]Profile)
+	for name, p := range builtinProfiles {
+		res[name] = p
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var profiles map[string]Profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for name, p := range profiles {
+		res[name] = p
+	}
+
+	return res, nil
+}
+
+// Applies the selected profile, if any, to the flags and options
+// that weren't set on the command line or through the environment.
+func applyProfile(fs *flag.FlagSet) {
+	if profileName == "" {
+		return
+	}
+
+	profiles, err := LoadProfiles(profilesPath)
+	if err != nil {
+		fatal(err)
+	}
+	profile, ok := profiles[profileName]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Errorf("Available profiles: %v", names)
+		fatal(ErrUnknownProfile)
+	}
+
+	for name, val := range profile.Flags {
+		f := fs.Lookup(name)
+		if f == nil {
+			// Profiles are shared between commands, not all of which have every flag.
+			log.Debugf("Profile flag --%s doesn't apply to this command.", name)
+			continue
+		} else if f.Changed {
+			continue
+		}
+		if err := fs.Set(name, val); err != nil {
+			fatalUsage("Invalid value for --%s in profile \"%s\": %s", name, profileName, err)
+		}
+	}
+	for key, val := range profile.Options {
+		if !optionGiven(key) {
+			options.Set(key + "=" + val)
+		}
+	}
+	log.Debugf("Using profile \"%s\".", profileName)
+}
+
+// Whether or not an option with the same key, scoped or not, was passed with -o.
+// Otherwise "Lossless" from a profile could override "BookLive.Lossless".
+func optionGiven(key string) bool {
+	base := func(k string) string {
+		if split := strings.SplitN(k, ".", 2); len(split) == 2 {
+			return split[1]
+		}
+		return k
+	}
+
+	for given := range options {
+		if strings.EqualFold(base(given), base(key)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,210 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/MinoMino/minterm"
+)
+
+// Ways of displaying the progress of a download.
+const (
+	// Picks bar if stdout is a terminal and none otherwise.
+	ProgressAuto = "auto"
+	// A single line with the overall progress.
+	ProgressBar = "bar"
+	// A line with the totals and a line for each worker below it with
+	// how far along its file it is and how fast it's going.
+	ProgressRich = "rich"
+	// A full-screen view of the jobs, workers and log. See startTUI().
+	ProgressTUI  = "tui"
+	ProgressNone = "none"
+	// Progress events as JSON, one per line, on stdout.
+	ProgressJSON = "json"
+)
+
+var (
+	ErrInvalidProgressMode = errors.New("Invalid progress mode. Should be auto, bar, rich, tui, none or json.")
+	ErrProgressJSONOutput  = errors.New("--progress json can't be combined with --json, since both write to stdout.")
+)
+
+var progressMode string
+
+func init() {
+	commonFlags.StringVar(&progressMode, "progress", ProgressAuto,
+		"How to display progress: auto, bar, rich, tui, none or json.")
+}
+
+// Resolves the auto mode and validates the flag.
+func setupProgress() {
+	switch progressMode {
+	case ProgressAuto:
+		if jsonOutput || !isTerminal(os.Stdout) {
+			progressMode = ProgressNone
+		} else {
+			progressMode = ProgressBar
+		}
+	case ProgressTUI:
+		if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+			fatal(ErrTUINotTerminal)
+		}
+	case ProgressJSON:
+		if jsonOutput {
+			fatal(ErrProgressJSONOutput)
+		}
+	case ProgressBar, ProgressRich, ProgressNone:
+	default:
+		fatal(ErrInvalidProgressMode)
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// A progress event for the json mode.
+type progressEvent struct {
+	Event   string           `json:"event"`
+	URL     string           `json:"url"`
+	Time    time.Time        `json:"time"`
+	Workers []WorkerProgress `json:"workers,omitempty"`
+	Progress
+}
+
+// Displays the progress of the download in regular intervals
+// until the returned function is called. Workers is how many the
+// download uses, for the rich mode's lines.
+func showProgress(dm *DownloadManager, url string, workers int) (stop func()) {
+	var update func()
+	var release func()
+	switch progressMode {
+	case ProgressBar:
+		lr, _ := minterm.NewLineReserver()
+		update = func() {
+			lr.Set(dm.ProgressString())
+			lr.Refresh()
+		}
+		release = lr.Release
+	case ProgressTUI:
+		// Only downloads started by the download command get the TUI.
+		if tui != nil {
+			return tui.Watch(dm)
+		}
+		fallthrough
+	case ProgressRich:
+		// One line for the total and one for each worker.
+		lines := make([]*minterm.LineReserver, workers+1)
+		for i := range lines {
+			lines[i], _ = minterm.NewLineReserver()
+		}
+		update = func() {
+			active := dm.Workers()
+			lines[0].Set(totalLine(dm.Progress(), len(active)))
+			for i, lr := range lines[1:] {
+				if i < len(active) {
+					lr.Set(workerLine(active[i]))
+				} else {
+					lr.Set("")
+				}
+			}
+			for _, lr := range lines {
+				lr.Refresh()
+			}
+		}
+		release = func() {
+			for i := len(lines) - 1; i >= 0; i-- {
+				lines[i].Release()
+			}
+		}
+	case ProgressJSON:
+		enc := json.NewEncoder(os.Stdout)
+		emit := func(event string) {
+			enc.Encode(progressEvent{
+				Event:    event,
+				URL:      url,
+				Time:     time.Now(),
+				Workers:  dm.Workers(),
+				Progress: dm.Progress(),
+			})
+		}
+		emit("start")
+		update = func() { emit("progress") }
+		release = func() { emit("end") }
+	default:
+		return func() {}
+	}
+
+	ticker := time.NewTicker(time.Millisecond * 500)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				update()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		done <- struct{}{}
+		release()
+	}
+}
+
+func totalLine(p Progress, workers int) string {
+	files := fmt.Sprintf("%d files", p.Files)
+	if p.Total > 0 {
+		files = fmt.Sprintf("%d/%d files (%d%%)", p.Files, p.Total, 100*p.Files/p.Total)
+	}
+	res := fmt.Sprintf("%s | %s | %s | %d workers", files, formatBytes(p.Bytes), formatSpeed(p.Speed), workers)
+	if eta := time.Duration(p.ETA) * time.Second; eta > 0 {
+		res += " | ETA " + eta.String()
+	}
+	return res
+}
+
+func workerLine(w WorkerProgress) string {
+	file := "starting..."
+	if w.File != "" {
+		file = filepath.Base(w.File)
+	}
+	if w.Stalled {
+		file += " (stalled)"
+	}
+	// The size isn't always known, e.g. for compressed responses.
+	percent, size := "", formatBytes(w.FileBytes)
+	if w.FileSize > 0 && w.FileBytes <= w.FileSize {
+		percent = fmt.Sprintf("%d%%", 100*w.FileBytes/w.FileSize)
+		size += "/" + formatBytes(w.FileSize)
+	}
+	elapsed := time.Since(w.Started).Truncate(time.Second)
+	return fmt.Sprintf("  #%-4d %4s %21s %12s %6s  %s", w.N, percent, size, formatSpeed(w.Speed), elapsed, file)
+}
+
+func formatSpeed(bytesPerSecond float64) string {
+	return formatBytes(int64(bytesPerSecond)) + "/s"
+}
@@ -0,0 +1,72 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var (
+	ErrTorAndProxy          = errors.New("--tor can only be combined with proxies for specific plugins.")
+	ErrInvalidProxyRotation = errors.New("Invalid proxy rotation. Should be round-robin or sticky.")
+)
+
+var (
+	proxyFlags []string
+	torAddress string
+)
+
+func init() {
+	commonFlags.StringArrayVar(&proxyFlags, "proxy", nil,
+		"A proxy URL for plugins to use, or \"direct\" for none. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated, in which case plugins rotate between the proxies.")
+	commonFlags.StringVar(&plugins.ProxyRotation, "proxy-rotation", plugins.ProxyRoundRobin,
+		"How to rotate between several proxies: round-robin for a different one every request, or sticky to keep using the same one for a site until it stops working.")
+	commonFlags.StringVar(&torAddress, "tor", "",
+		"Route plugin traffic through Tor's SOCKS port at the given address, with a separate circuit for every job.")
+	commonFlags.Lookup("tor").NoOptDefVal = plugins.DefaultTorAddress
+}
+
+// Sets the proxies passed with --proxy. Values are either a URL for every
+// plugin or "Plugin=URL" for a single one.
+func setupProxies() {
+	if plugins.ProxyRotation != plugins.ProxyRoundRobin && plugins.ProxyRotation != plugins.ProxySticky {
+		fatal(ErrInvalidProxyRotation)
+	}
+	for _, p := range proxyFlags {
+		var plugin string
+		// URLs can have = in them, so only treat it as a plugin name if
+		// it comes before any ://.
+		if i := strings.Index(p, "="); i != -1 && !strings.Contains(p[:i], "://") {
+			plugin, p = p[:i], p[i+1:]
+		}
+		if plugin == "" && torAddress != "" {
+			fatal(ErrTorAndProxy)
+		}
+		if err := plugins.SetProxy(plugin, p); err != nil {
+			fatal(err)
+		}
+	}
+
+	if torAddress != "" {
+		if err := plugins.SetTor(torAddress); err != nil {
+			fatal(err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var rcloneCommand string
+
+func init() {
+	commonFlags.StringVar(&rcloneCommand, "rclone", "rclone",
+		"The rclone executable to use for outputs like remote:path.")
+}
+
+var (
+	// A remote followed by a path, like gdrive:Books. Single letters are left
+	// alone since they're drives on Windows.
+	rcloneRemoteRegex = regexp.MustCompile(`^([\w.@ -]{2,}):`)
+	rcloneRemotes     map[string]bool
+	rcloneRemotesOnce sync.Once
+)
+
+// Returns whether the output is a path on a remote configured in rclone.
+func isRcloneRemote(output string) bool {
+	m := rcloneRemoteRegex.FindStringSubmatch(output)
+	if m == nil || strings.HasPrefix(output[len(m[0]):], "//") {
+		return false
+	}
+	rcloneRemotesOnce.Do(func() {
+		rcloneRemotes = make(map[string]bool)
+		out, err := exec.Command(rcloneCommand, "listremotes").Output()
+		if err != nil {
+			return
+		}
+		for _, remote := range strings.Split(string(out), "\n") {
+			rcloneRemotes[strings.TrimSuffix(strings.TrimSpace(remote), ":")] = true
+		}
+	})
+
+	return rcloneRemotes[m[1]]
+}
+
+// Files on anything rclone supports, by having it upload what's piped to it.
+type RcloneStorage struct {
+	// The remote and path, like gdrive:Books.
+	Root string
+}
+
+func newRcloneStorage(output string) (Storage, error) {
+	return &RcloneStorage{Root: strings.TrimSuffix(output, "/")}, nil
+}
+
+func (s *RcloneStorage) Create(p string) (StorageWriter, error) {
+	cmd := exec.Command(rcloneCommand, "rcat", s.Location(p))
+	w := &rcloneWriter{storage: s, path: p, cmd: cmd}
+	cmd.Stderr = &w.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	w.stdin = stdin
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (s *RcloneStorage) Remove(p string) error {
+	return s.run("deletefile", s.Location(p))
+}
+
+func (s *RcloneStorage) Location(p string) string {
+	remote := s.Root[:strings.Index(s.Root, ":")+1]
+	return remote + joinKey(s.Root[len(remote):], p)
+}
+
+func (s *RcloneStorage) run(args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(rcloneCommand, args...)
+	cmd.Stderr = &stderr
+	return rcloneError(cmd.Run(), &stderr)
+}
+
+// Adds what rclone printed to an error, since its exit code says little.
+func rcloneError(err error, stderr *bytes.Buffer) error {
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("rclone: %s", msg)
+	}
+
+	return fmt.Errorf("rclone: %s", err)
+}
+
+type rcloneWriter struct {
+	storage *RcloneStorage
+	path    string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stderr  bytes.Buffer
+}
+
+func (w *rcloneWriter) Write(p []byte) (int, error) {
+	n, err := w.stdin.Write(p)
+	if err != nil {
+		// rclone quit early, so wait for it to say why.
+		return n, rcloneError(w.cmd.Wait(), &w.stderr)
+	}
+
+	return n, nil
+}
+
+func (w *rcloneWriter) Close() error {
+	w.stdin.Close()
+	return rcloneError(w.cmd.Wait(), &w.stderr)
+}
+
+func (w *rcloneWriter) Abort() error {
+	w.cmd.Process.Kill()
+	w.stdin.Close()
+	w.cmd.Wait()
+	// Small files might have been uploaded before it was killed.
+	w.storage.run("deletefile", w.storage.Location(w.path))
+	return nil
+}
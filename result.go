@@ -0,0 +1,173 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+const (
+	StatusDone     = "done"
+	StatusFailed   = "failed"
+	StatusCanceled = "canceled"
+	StatusSkipped  = "skipped"
+)
+
+// The outcome of a single job (one URL). Used for the --json output.
+type JobResult struct {
+	URL    string   `json:"url"`
+	Plugin string   `json:"plugin,omitempty"`
+	Status string   `json:"status"`
+	Error  string   `json:"error,omitempty"`
+	Files  []string `json:"files"`
+	Bytes  int64    `json:"bytes"`
+	// Requests sent to each host.
+	Hosts map[string]plugins.HostStat `json:"hosts,omitempty"`
+	// Duration in seconds.
+	Duration float64 `json:"duration"`
+	// Average bytes per second over the whole job.
+	Speed float64 `json:"speed"`
+	// Requests that were sent again after failing.
+	Retries int64 `json:"retries"`
+
+	start time.Time
+	err   error
+}
+
+func NewJobResult(url string) *JobResult {
+	return &JobResult{
+		URL:   url,
+		Files: []string{},
+		start: time.Now(),
+	}
+}
+
+// Marks the job as finished, setting the status and duration. A nil error
+// means the job was successful.
+func (res *JobResult) Finish(err error) {
+	res.Duration = time.Since(res.start).Seconds()
+	if res.Duration > 0 {
+		res.Speed = float64(res.Bytes) / res.Duration
+	}
+	res.Retries = 0
+	for _, stat := range res.Hosts {
+		res.Retries += stat.Retries
+	}
+	res.Status = resultStatus(err)
+	res.err = err
+	if err != nil {
+		res.Error = err.Error()
+	}
+}
+
+// Returns the status of a job that finished with the given error.
+func resultStatus(err error) string {
+	switch err {
+	case nil:
+		return StatusDone
+	case ErrCanceled:
+		return StatusCanceled
+	default:
+		return StatusFailed
+	}
+}
+
+// A one-line summary of how the job went, for the log.
+func (res *JobResult) Summary() string {
+	return i18n.Tf("%d file(s), %s in %s at %s with %d retries.", len(res.Files), formatBytes(res.Bytes),
+		formatSeconds(res.Duration), formatSpeed(res.Speed), res.Retries)
+}
+
+// The totals of a batch of jobs.
+type RunSummary struct {
+	Jobs     int   `json:"jobs"`
+	Done     int   `json:"done"`
+	Failed   int   `json:"failed"`
+	Canceled int   `json:"canceled"`
+	Skipped  int   `json:"skipped"`
+	Files    int   `json:"files"`
+	Bytes    int64 `json:"bytes"`
+	Retries  int64 `json:"retries"`
+	// From when the first job started until the last one finished, in seconds.
+	Duration float64 `json:"duration"`
+	// Average bytes per second over the duration.
+	Speed float64 `json:"speed"`
+}
+
+func Summarize(results []*JobResult) RunSummary {
+	var sum RunSummary
+	var first, last time.Time
+	for _, res := range results {
+		sum.Jobs++
+		switch res.Status {
+		case StatusDone:
+			sum.Done++
+		case StatusCanceled:
+			sum.Canceled++
+		case StatusSkipped:
+			sum.Skipped++
+		default:
+			sum.Failed++
+		}
+		sum.Files += len(res.Files)
+		sum.Bytes += res.Bytes
+		sum.Retries += res.Retries
+		if first.IsZero() || res.start.Before(first) {
+			first = res.start
+		}
+		if end := res.start.Add(time.Duration(res.Duration * float64(time.Second))); end.After(last) {
+			last = end
+		}
+	}
+	if sum.Duration = last.Sub(first).Seconds(); sum.Duration > 0 {
+		sum.Speed = float64(sum.Bytes) / sum.Duration
+	}
+
+	return sum
+}
+
+// Logs the totals of a batch of jobs.
+func logSummary(results []*JobResult) {
+	sum := Summarize(results)
+	log.Info(i18n.Tf("Summary: %d job(s), %d done, %d failed, %d canceled and %d skipped.",
+		sum.Jobs, sum.Done, sum.Failed, sum.Canceled, sum.Skipped))
+	log.Info(i18n.Tf("%d file(s), %s in %s at %s with %d retries.", sum.Files, formatBytes(sum.Bytes),
+		formatSeconds(sum.Duration), formatSpeed(sum.Speed), sum.Retries))
+}
+
+func formatSeconds(s float64) string {
+	d := time.Duration(s * float64(time.Second))
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// Writes the results as a single JSON document along with their totals.
+func WriteResults(w io.Writer, results []*JobResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Jobs    []*JobResult `json:"jobs"`
+		Summary RunSummary   `json:"summary"`
+	}{results, Summarize(results)})
+}
@@ -0,0 +1,342 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var ErrS3Credentials = errors.New("Set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to save to S3.")
+
+var (
+	s3Endpoint string
+	s3Region   string
+)
+
+// The size of each part of a multipart upload. Files smaller than this are
+// uploaded in one request. S3 needs every part but the last to be at least
+// 5 MiB.
+const s3PartSize = 8 << 20
+
+func init() {
+	commonFlags.StringVar(&s3Endpoint, "s3-endpoint", "",
+		"The URL of an S3-compatible server, like MinIO, to use instead of AWS.")
+	commonFlags.StringVar(&s3Region, "s3-region", "",
+		"The region of the S3 bucket. Defaults to $AWS_REGION or us-east-1.")
+	storageSchemes["s3"] = newS3Storage
+}
+
+// Objects in an S3 bucket, with keys starting with the URL's path, e.g.
+// s3://bucket/prefix. Credentials are taken from the usual AWS environment
+// variables.
+type S3Storage struct {
+	Bucket   string
+	Prefix   string
+	Endpoint string
+	Region   string
+	// Credentials.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	client       *http.Client
+}
+
+func newS3Storage(u *url.URL) (Storage, error) {
+	s := &S3Storage{
+		Bucket:       u.Host,
+		Prefix:       strings.Trim(u.Path, "/"),
+		Endpoint:     strings.TrimSuffix(s3Endpoint, "/"),
+		Region:       s3Region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, ErrS3Credentials
+	}
+	for _, region := range []string{os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"} {
+		if s.Region == "" {
+			s.Region = region
+		}
+	}
+
+	return s, nil
+}
+
+func (s *S3Storage) Create(path string) (StorageWriter, error) {
+	return &s3Writer{s: s, key: joinKey(s.Prefix, path)}, nil
+}
+
+func (s *S3Storage) Remove(path string) error {
+	_, err := s.do(http.MethodDelete, joinKey(s.Prefix, path), nil, nil)
+	return err
+}
+
+func (s *S3Storage) Location(path string) string {
+	return "s3://" + s.Bucket + "/" + joinKey(s.Prefix, path)
+}
+
+// Returns the URL of the object. Custom endpoints use path-style URLs, since
+// that's what MinIO and the like support out of the box.
+func (s *S3Storage) objectURL(key string, query url.Values) *url.URL {
+	var u *url.URL
+	if s.Endpoint != "" {
+		u, _ = url.Parse(s.Endpoint + "/" + s.Bucket + "/" + escapeKey(key))
+	} else {
+		u, _ = url.Parse(fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.Bucket, s.Region, escapeKey(key)))
+	}
+	u.RawQuery = query.Encode()
+
+	return u
+}
+
+// Sends a signed request, retrying network and server errors. The body is
+// kept in memory so that it can be sent again.
+func (s *S3Storage) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, s.objectURL(key, query).String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		s.sign(req, body, time.Now().UTC())
+
+		resp, err := s.client.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		} else if err == nil {
+			err = s3Error(resp)
+			if resp.StatusCode < 500 {
+				return nil, err
+			}
+		}
+		if attempt >= plugins.MaxRetries {
+			return nil, err
+		}
+		log.WithField("key", key).Debugf("S3 request failed, retrying: %s", err)
+		time.Sleep(plugins.RetryDelay << uint(attempt))
+	}
+}
+
+// Signs the request with AWS Signature Version 4.
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	names := []string{"host"}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" {
+			names = append(names, name)
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		// Encode() sorts by key and escapes spaces as "+", which AWS wants as "%20".
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Escapes every segment of the key the way S3 expects.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = strings.Replace(url.QueryEscape(seg), "+", "%20", -1)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func s3Error(resp *http.Response) error {
+	defer resp.Body.Close()
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("S3: %s: %s", e.Code, e.Message)
+	}
+
+	return fmt.Errorf("S3 returned error code: %d", resp.StatusCode)
+}
+
+// Uploads the object in parts as they're written, so that large files
+// don't have to be kept in memory or on disk.
+type s3Writer struct {
+	s        *S3Storage
+	key      string
+	buf      bytes.Buffer
+	uploadID string
+	etags    []string
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for w.buf.Len() >= s3PartSize {
+		if err := w.uploadPart(w.buf.Next(s3PartSize)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *s3Writer) uploadPart(part []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var res struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return err
+		}
+		w.uploadID = res.UploadID
+	}
+
+	query := url.Values{
+		"partNumber": {fmt.Sprint(len(w.etags) + 1)},
+		"uploadId":   {w.uploadID},
+	}
+	resp, err := w.s.do(http.MethodPut, w.key, query, part)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.etags = append(w.etags, resp.Header.Get("ETag"))
+
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.uploadID == "" {
+		resp, err := w.s.do(http.MethodPut, w.key, nil, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(w.buf.Bytes()); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range w.etags {
+		complete.Parts = append(complete.Parts, part{i + 1, etag})
+	}
+	data, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, data)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	// Completing can fail even with a 200.
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	} else if bytes.Contains(data, []byte("<Error>")) {
+		w.Abort()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return s3Error(resp)
+	}
+
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	w.buf.Reset()
+	if w.uploadID == "" {
+		return nil
+	}
+
+	resp, err := w.s.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,311 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var (
+	ErrScheduleNotFound = errors.New("No schedule with that ID.")
+	ErrNeverRuns        = errors.New("The schedule never runs.")
+)
+
+// A source like a series that the daemon checks for new items on a
+// cron-style schedule. New items are added to the job queue.
+type ScheduledSource struct {
+	ID   string `json:"id"`
+	Cron string `json:"cron"`
+	WatchSource
+	// Plugin options on top of the daemon's, used both for checking
+	// the source and for the queued jobs.
+	Options map[string]string `json:"options,omitempty"`
+	// Overrides the daemon's output directory if set.
+	Directory string `json:"directory,omitempty"`
+	// If set, the items found on the first check are not downloaded.
+	SkipExisting bool      `json:"skip_existing,omitempty"`
+	NextRun      time.Time `json:"next_run"`
+	schedule     *CronSchedule
+}
+
+// Keeps track of the scheduled sources and checks them when they're due.
+// The sources are saved to disk whenever they change.
+type Scheduler struct {
+	queue   *JobQueue
+	sources []*ScheduledSource
+	path    string
+	nextID  int
+	wake    chan struct{}
+	m       sync.Mutex
+}
+
+func NewScheduler(path string, queue *JobQueue) (*Scheduler, error) {
+	s := &Scheduler{
+		queue:  queue,
+		path:   path,
+		nextID: 1,
+		wake:   make(chan struct{}, 1),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.sources); err != nil {
+		return nil, fmt.Errorf("Failed to load the schedules: %s", err)
+	}
+	for _, src := range s.sources {
+		if src.schedule, err = ParseCron(src.Cron); err != nil {
+			return nil, fmt.Errorf("Failed to load the schedule for %s: %s", src.URL, err)
+		}
+		// Checks that were missed while the daemon was down are
+		// done right away since NextRun is in the past.
+		if src.NextRun.IsZero() {
+			src.NextRun = src.schedule.Next(time.Now())
+		}
+		if id, err := strconv.Atoi(src.ID); err == nil && id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+
+	return s, nil
+}
+
+// Adds a scheduled source. If the same URL is already on the same
+// schedule, that one is returned instead.
+func (s *Scheduler) Add(url, cron, plugin string, options map[string]string, directory string, skipExisting bool) (*ScheduledSource, error) {
+	url = strings.TrimSpace(url)
+	schedule, err := ParseCron(cron)
+	if err != nil {
+		return nil, err
+	}
+	next := schedule.Next(time.Now())
+	if next.IsZero() {
+		return nil, ErrNeverRuns
+	}
+	if p := s.findLister(url, plugin); p == nil {
+		return nil, ErrNoLister
+	}
+	if _, err := jobDirectory(s.queue.Directory, directory); err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, src := range s.sources {
+		if src.URL == url && src.Cron == cron {
+			return src, nil
+		}
+	}
+	src := &ScheduledSource{
+		ID:           strconv.Itoa(s.nextID),
+		Cron:         cron,
+		WatchSource:  WatchSource{URL: url, Plugin: plugin, Seen: []string{}},
+		Options:      options,
+		Directory:    directory,
+		SkipExisting: skipExisting,
+		NextRun:      next,
+		schedule:     schedule,
+	}
+	s.nextID++
+	s.sources = append(s.sources, src)
+	err = s.save()
+
+	log.WithField("schedule", src.ID).Infof("Scheduled \"%s\": %s", cron, url)
+	s.notify()
+	return src, err
+}
+
+func (s *Scheduler) Remove(id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for i, src := range s.sources {
+		if src.ID == id {
+			s.sources = append(s.sources[:i], s.sources[i+1:]...)
+			return s.save()
+		}
+	}
+
+	return ErrScheduleNotFound
+}
+
+// Returns copies of all the scheduled sources.
+func (s *Scheduler) Sources() []ScheduledSource {
+	s.m.Lock()
+	defer s.m.Unlock()
+	res := make([]ScheduledSource, len(s.sources))
+	for i, src := range s.sources {
+		res[i] = *src
+		res[i].Seen = append([]string(nil), src.Seen...)
+	}
+
+	return res
+}
+
+// Checks sources as they become due until stop is closed.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	for {
+		due, next := s.due(time.Now())
+		for _, src := range due {
+			s.check(src)
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		// With nothing scheduled, just wait for a source to be added.
+		timer := time.NewTimer(time.Until(next))
+		if next.IsZero() {
+			timer.Stop()
+		}
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// Returns the sources that are due and the time the next one is due.
+func (s *Scheduler) due(now time.Time) (due []*ScheduledSource, next time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, src := range s.sources {
+		if src.NextRun.IsZero() {
+			continue
+		} else if !src.NextRun.After(now) {
+			due = append(due, src)
+		} else if next.IsZero() || src.NextRun.Before(next) {
+			next = src.NextRun
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextRun.Before(due[j].NextRun) })
+
+	return due, next
+}
+
+// Lists the items of a source and queues the new ones.
+func (s *Scheduler) check(src *ScheduledSource) {
+	slog := log.WithFields(map[string]interface{}{
+		"schedule": src.ID,
+		"source":   src.URL,
+	})
+	s.m.Lock()
+	src.NextRun = src.schedule.Next(time.Now())
+	ws := src.WatchSource
+	ws.Seen = append([]string(nil), src.Seen...)
+	skip := src.LastCheck.IsZero() && src.SkipExisting
+	s.m.Unlock()
+
+	items, err := s.list(&ws, src.Plugin, src.Options)
+	if err != nil {
+		slog.Error(err)
+	} else if skip {
+		slog.Infof("New source. Skipping %d existing item(s).", len(items))
+	} else {
+		slog.Infof("Found %d new item(s).", len(items))
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, item := range items {
+		if !skip {
+			if _, err := s.queue.Add(item, ws.Plugin, src.Options, src.Directory); err != nil {
+				slog.WithField("url", item).Error(err)
+				continue
+			}
+		}
+		src.Seen = append(src.Seen, item)
+	}
+	if err == nil {
+		src.LastCheck = ws.LastCheck
+		src.Plugin = ws.Plugin
+	}
+	if err := s.save(); err != nil {
+		slog.Error(err)
+	}
+}
+
+// Lists the new items of a source with the plugin locked so no job can
+// change its options in the meantime.
+func (s *Scheduler) list(ws *WatchSource, plugin string, options map[string]string) ([]string, error) {
+	p := s.findLister(ws.URL, plugin)
+	if p == nil {
+		return nil, ErrNoLister
+	}
+	ws.Plugin = p.Name()
+
+	defer s.queue.lockPlugin(p)()
+	if err := s.queue.setOptions(p, options); err != nil {
+		return nil, err
+	}
+
+	return CheckSource(p.(plugins.Lister), ws)
+}
+
+// Finds a plugin that can list the URL, by name if one is given.
+func (s *Scheduler) findLister(url, plugin string) plugins.Plugin {
+	if plugin == "" {
+		return findLister(s.queue.plugins, url)
+	}
+	for _, p := range s.queue.plugins {
+		if l, ok := p.(plugins.Lister); ok && p.Name() == plugin && l.CanList(url) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Writes the sources to disk. Must be called with the lock held.
+func (s *Scheduler) save() error {
+	data, err := json.MarshalIndent(s.sources, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	// The options can contain credentials.
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,218 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrApiNoToken = errors.New("The API needs --api-token to listen on anything other than a loopback address.")
+
+var (
+	serveJobs          int
+	serveQueueFile     string
+	serveWatchDir      string
+	serveWatchInterval time.Duration
+	serveListen        string
+	serveApiToken      string
+	serveScheduleFile  string
+	serveSchedules     []string
+	serveSkipExisting  bool
+	serveCommand       = &Command{
+		Name:  "serve",
+		Usage: "[flags]",
+		Short: "Run as a daemon that downloads queued jobs.",
+		Flags: NewCommandFlags("serve"),
+	}
+)
+
+func init() {
+	serveCommand.Run = runServe
+	fs := serveCommand.Flags
+	fs.VarP(&options, "option", "o",
+		"Options in a key=value format passed to plugins for every job.")
+	fs.IntVarP(&workers, "workers", "w", 10,
+		"The number of workers to use per job.")
+	fs.IntVarP(&serveJobs, "jobs", "j", 1,
+		"The number of jobs to run at the same time.")
+	fs.BoolVarP(&zipit, "zip", "z", false,
+		"Set to ZIP the files after each job finishes.")
+	addOutputFlag(fs)
+	fs.StringVar(&serveQueueFile, "queue-file", "mindl-queue.json",
+		"The file the job queue is saved to, letting the daemon resume after a restart.")
+	fs.StringVar(&serveWatchDir, "watch-dir", "",
+		"A directory to watch for files with URLs, one per line, to queue.")
+	fs.DurationVar(&serveWatchInterval, "watch-interval", 10*time.Second,
+		"How often to check the watched directory for new files.")
+	fs.StringVar(&serveListen, "listen", "",
+		"The address to serve the HTTP API on, e.g. 127.0.0.1:8420. Disabled if empty.")
+	fs.StringVar(&serveApiToken, "api-token", "",
+		"If set, API requests need an \"Authorization: Bearer <token>\" header.")
+	fs.StringVar(&serveScheduleFile, "schedule-file", "mindl-schedules.json",
+		"The file scheduled sources and what has been queued from them are saved to.")
+	fs.StringArrayVar(&serveSchedules, "schedule", nil,
+		"A source to check on a cron-style schedule, e.g. \"0 3 * * * <url>\" to check it every day at 03:00. Can be repeated.")
+	fs.BoolVar(&serveSkipExisting, "skip-existing", false,
+		"When a scheduled source is checked for the first time, only queue items published after that.")
+}
+
+func runServe(args []string) {
+	dldir = outputDirectory(dldir)
+	queue, err := NewJobQueue(serveQueueFile, Plugins[:])
+	if err != nil {
+		fatal(err)
+	}
+	queue.Options = map[string]string(options)
+	queue.Directory = dldir
+	queue.Workers = workers
+	queue.Zip = zipit
+	queue.MaxSize = int64(maxSize)
+	queue.StallTimeout = stallTimeout
+	queue.RestartStalled = restartStalled
+	sched, err := NewScheduler(serveScheduleFile, queue)
+	if err != nil {
+		fatal(err)
+	}
+	for _, s := range serveSchedules {
+		cron, url := splitSchedule(s)
+		if _, err := sched.Add(url, cron, "", nil, "", serveSkipExisting); err != nil {
+			log.WithField("schedule", s).Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	go sched.Run(stop)
+	if serveWatchDir != "" {
+		go watchDirectory(queue, serveWatchDir, serveWatchInterval, stop)
+	}
+	if serveListen != "" {
+		credentialRequests = NewCredentialRequests()
+		if serveApiToken == "" && !isLoopback(serveListen) {
+			fatal(ErrApiNoToken)
+		}
+		go func() {
+			log.Infof("Serving the API on: %s", serveListen)
+			if err := http.ListenAndServe(serveListen, NewApiServer(queue, sched, serveApiToken)); err != nil {
+				fatal(err)
+			}
+		}()
+	}
+
+	// The queue stops its jobs itself, so keep the managers from
+	// reacting to the interrupt on their own.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	signal.Stop(interrupt)
+	go func() {
+		<-sig
+		log.Info("Interrupted! Stopping running jobs...")
+		close(stop)
+	}()
+
+	log.Infof("Running up to %d job(s) at a time.", serveJobs)
+	queue.Run(serveJobs, stop)
+	log.Info("Stopped.")
+}
+
+// Splits a --schedule value into the cron schedule and the URL at the end.
+func splitSchedule(s string) (cron, url string) {
+	s = strings.TrimSpace(s)
+	i := strings.LastIndexAny(s, " \t")
+	if i == -1 {
+		return "", s
+	}
+
+	return strings.TrimSpace(s[:i]), s[i+1:]
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	} else if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Periodically checks a directory for files with URLs in them and queues
+// them. Empty lines and lines starting with # are ignored. Files are renamed
+// with a ".queued" suffix once they have been processed.
+func watchDirectory(queue *JobQueue, dir string, interval time.Duration, stop <-chan struct{}) {
+	wlog := log.WithField("dir", dir)
+	wlog.Info("Watching directory for URL files.")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			wlog.Error(err)
+		}
+		for _, f := range files {
+			if f.IsDir() || strings.HasSuffix(f.Name(), ".queued") ||
+				strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			queueFile(queue, filepath.Join(dir, f.Name()))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func queueFile(queue *JobQueue, path string) {
+	flog := log.WithField("file", path)
+	f, err := os.Open(path)
+	if err != nil {
+		flog.Error(err)
+		return
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := queue.Add(line, "", nil, ""); err != nil {
+			flog.WithField("url", line).Error(err)
+		}
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		flog.Error(err)
+	}
+
+	if err := os.Rename(path, path+".queued"); err != nil {
+		flog.Error(err)
+	}
+}
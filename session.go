@@ -0,0 +1,311 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var (
+	ErrSessionNotFound = errors.New("No session with that ID.")
+	ErrSessionPlugin   = errors.New("The plugin the session was using no longer exists.")
+	ErrSessionSecrets  = errors.New("The session needs credentials that aren't stored anywhere, and prompting is turned off.")
+)
+
+// The state of a download, saved as it goes so that it can be resumed if
+// it's interrupted. Removed once the download finishes successfully.
+type Session struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Plugin string `json:"plugin"`
+	// The values of the plugin's options when the session started.
+	Options   map[string]string `json:"options"`
+	Directory string            `json:"directory"`
+	Workers   int               `json:"workers"`
+	Zip       bool              `json:"zip"`
+	// The secret options that were set. Sessions are saved in plaintext, so
+	// they're left out of Options and read from the environment, the keyring
+	// or the credentials file again on resume, or prompted for.
+	Secrets []string `json:"secrets,omitempty"`
+	// Indices of the downloaders that have finished.
+	Completed []int `json:"completed"`
+	// The files saved by every run so far, and their total size.
+	Files   []string  `json:"files"`
+	Bytes   int64     `json:"bytes"`
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+	// The files in Files as a set.
+	saved map[string]bool
+	m     sync.Mutex
+}
+
+// The directory sessions are saved in, in the user's config directory.
+func SessionDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "mindl-sessions"
+	}
+
+	return filepath.Join(dir, "mindl", "sessions")
+}
+
+// Creates a session for a plugin whose options have already been set.
+func NewSession(url string, p plugins.Plugin) *Session {
+	now := time.Now()
+	sess := &Session{
+		ID:        fmt.Sprintf("%s-%04x", now.Format("20060102-150405"), rand.Intn(0x10000)),
+		URL:       url,
+		Plugin:    p.Name(),
+		Options:   make(map[string]string),
+		Directory: dldir,
+		Workers:   workers,
+		Zip:       zipit,
+		Completed: []int{},
+		Files:     []string{},
+		Started:   now,
+	}
+	for _, opt := range p.Options() {
+		if strings.HasPrefix(opt.Key(), "!") {
+			continue
+		} else if isSecretOption(opt) {
+			if fmt.Sprint(opt.Value()) != "" {
+				sess.Secrets = append(sess.Secrets, opt.Key())
+			}
+			continue
+		}
+		sess.Options[opt.Key()] = fmt.Sprint(opt.Value())
+	}
+
+	return sess
+}
+
+// Sets the secret options that were set when the session started, but that
+// SetOptions couldn't find anywhere, by prompting for them.
+func (sess *Session) restoreSecrets(p plugins.Plugin) error {
+	wanted := make(map[string]bool, len(sess.Secrets))
+	for _, key := range sess.Secrets {
+		wanted[key] = true
+	}
+
+	var missing []plugins.Option
+	for _, opt := range p.Options() {
+		if wanted[opt.Key()] && fmt.Sprint(opt.Value()) == "" {
+			missing = append(missing, opt)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	} else if noprompt || !isTerminal(os.Stdin) {
+		for _, opt := range missing {
+			log.Errorf("%s: \"%s\" was set when the session started, but is not stored anywhere.",
+				pluginName(p), opt.Key())
+		}
+		return ErrSessionSecrets
+	}
+
+	fmt.Println(i18n.Tf("The session needs the plugin \"%s\"'s credentials again:", pluginName(p)))
+	for _, opt := range missing {
+		optionPrompt(opt)
+	}
+	redactSecretOptions([]plugins.Plugin{p})
+
+	return nil
+}
+
+func LoadSession(id string) (*Session, error) {
+	data, err := ioutil.ReadFile(filepath.Join(SessionDir(), id+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sess Session
+	if err := json.Unmarshal(data, &sess); err != nil {
+		return nil, err
+	}
+
+	return &sess, nil
+}
+
+// Returns every saved session, oldest first.
+func ListSessions() ([]*Session, error) {
+	files, err := ioutil.ReadDir(SessionDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Session, 0, len(files))
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		sess, err := LoadSession(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			log.WithField("file", f.Name()).Warnf("Failed to load session: %s", err)
+			continue
+		}
+		res = append(res, sess)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Started.Before(res[j].Started) })
+
+	return res, nil
+}
+
+// Records a downloader as finished along with the files saved so far.
+// Files from earlier runs are kept, since they aren't saved again.
+func (sess *Session) Complete(n int, files []SavedFile) error {
+	sess.m.Lock()
+	sess.Completed = append(sess.Completed, n)
+	if sess.saved == nil {
+		sess.saved = make(map[string]bool, len(sess.Files))
+		for _, path := range sess.Files {
+			sess.saved[path] = true
+		}
+	}
+	for _, f := range files {
+		if !sess.saved[f.Path] {
+			sess.saved[f.Path] = true
+			sess.Files = append(sess.Files, f.Path)
+			sess.Bytes += f.Size
+		}
+	}
+	sess.m.Unlock()
+
+	return sess.Save()
+}
+
+// Returns the indices of the finished downloaders as a set.
+func (sess *Session) CompletedSet() map[int]bool {
+	sess.m.Lock()
+	defer sess.m.Unlock()
+	res := make(map[int]bool, len(sess.Completed))
+	for _, n := range sess.Completed {
+		res[n] = true
+	}
+
+	return res
+}
+
+func (sess *Session) Save() error {
+	sess.m.Lock()
+	sess.Updated = time.Now()
+	data, err := json.MarshalIndent(sess, "", "  ")
+	sess.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	dir := SessionDir()
+	if err := os.MkdirAll(dir, os.FileMode(permission)); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, sess.ID+".json")
+	// Older sessions can still have credentials in their options.
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func (sess *Session) Remove() error {
+	return os.Remove(filepath.Join(SessionDir(), sess.ID+".json"))
+}
+
+var resumeCommand = &Command{
+	Name:  "resume",
+	Usage: "[flags] [session]",
+	Short: "Resume an interrupted download, or list them if no session is given.",
+	Flags: NewCommandFlags("resume"),
+}
+
+func init() {
+	resumeCommand.Run = runResume
+	resumeCommand.Flags.BoolVarP(&noprompt, "no-prompt", "n", false,
+		"Set to turn off prompts for options and instead throw an error if a required option is left unset.")
+	resumeCommand.Flags.BoolVar(&jsonOutput, "json", false,
+		"Print the result as a JSON document to stdout when done. Logs go to stderr.")
+}
+
+func runResume(args []string) {
+	if len(args) == 0 {
+		sessions, err := ListSessions()
+		if err != nil {
+			fatal(err)
+		} else if len(sessions) == 0 {
+			fmt.Println(i18n.T("There are no interrupted sessions."))
+			return
+		}
+
+		for _, sess := range sessions {
+			fmt.Printf("%s  %-12s %4d done  %s\n", sess.ID, sess.Plugin, len(sess.Completed), sess.URL)
+		}
+		return
+	}
+
+	sess, err := LoadSession(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	var p plugins.Plugin
+	for _, plugin := range Plugins {
+		if plugin.Name() == sess.Plugin && plugin.CanHandle(sess.URL) {
+			p = plugin
+		}
+	}
+	if p == nil {
+		fatal(ErrSessionPlugin)
+	}
+
+	// Restore everything as it was.
+	pm := PluginManager(Plugins[:])
+	if err := pm.SetOptions([]plugins.Plugin{p}, sess.Options, true, noprompt); err != nil {
+		fatal(err)
+	}
+	if err := sess.restoreSecrets(p); err != nil {
+		fatal(err)
+	}
+	dldir = sess.Directory
+	workers = sess.Workers
+	zipit = sess.Zip
+
+	log.Info(i18n.Tf("Resuming %s with %d downloader(s) already done...", sess.URL, len(sess.Completed)))
+	res := downloadSession(sess, p)
+	writeSpeedHistory()
+	if jsonOutput {
+		if err := WriteResults(os.Stdout, []*JobResult{res}); err != nil {
+			fatal(err)
+		}
+	}
+	exitCode = resultsExitCode([]*JobResult{res})
+}
@@ -0,0 +1,277 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	ErrSFTPNoAuth   = errors.New("No SSH key or agent found for SFTP. Use --sftp-key to point to a private key.")
+	ErrSFTPNoHost   = errors.New("The SFTP server isn't in known_hosts. Connect to it once with ssh to add it.")
+	ErrSFTPNoServer = errors.New("The SFTP URL has no host.")
+)
+
+var (
+	sftpKey           string
+	sftpKeyPassphrase string
+	sftpKnownHosts    string
+)
+
+func init() {
+	commonFlags.StringVar(&sftpKey, "sftp-key", "",
+		"The private key to log in to an SFTP output with. Defaults to ssh-agent or the usual keys in ~/.ssh.")
+	commonFlags.StringVar(&sftpKeyPassphrase, "sftp-key-passphrase", "",
+		"The passphrase of the SFTP key, if it has one. Preferably set with MINDL_SFTP_KEY_PASSPHRASE.")
+	commonFlags.StringVar(&sftpKnownHosts, "sftp-known-hosts", "",
+		"The known_hosts file to verify SFTP servers with. Defaults to ~/.ssh/known_hosts.")
+	storageSchemes["sftp"] = newSFTPStorage
+}
+
+// Files on a server over SFTP, e.g. sftp://user@nas/volume1/books. Paths
+// starting with /~/ are relative to the user's home directory. Only keys
+// are used to log in, and the server has to be in known_hosts.
+type SFTPStorage struct {
+	Host      string
+	User      string
+	Directory string
+	config    *ssh.ClientConfig
+	client    *sftp.Client
+	m         sync.Mutex
+}
+
+func newSFTPStorage(u *url.URL) (Storage, error) {
+	if u.Hostname() == "" {
+		return nil, ErrSFTPNoServer
+	}
+	s := &SFTPStorage{
+		Host:      u.Host,
+		User:      u.User.Username(),
+		Directory: strings.TrimSuffix(u.Path, "/"),
+	}
+	if u.Port() == "" {
+		s.Host = net.JoinHostPort(u.Hostname(), "22")
+	}
+	if s.User == "" {
+		s.User = os.Getenv("USER")
+	}
+	if strings.HasPrefix(s.Directory, "/~") {
+		s.Directory = strings.TrimPrefix(strings.TrimPrefix(s.Directory, "/~"), "/")
+	}
+
+	auth, err := sftpAuth()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := sftpHostKeys()
+	if err != nil {
+		return nil, err
+	}
+	s.config = &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	}
+
+	return s, nil
+}
+
+func homeFile(name string) string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".ssh", name)
+}
+
+// Uses the key given with --sftp-key, or otherwise ssh-agent and the
+// default keys.
+func sftpAuth() ([]ssh.AuthMethod, error) {
+	keys := []string{sftpKey}
+	var res []ssh.AuthMethod
+	if sftpKey == "" {
+		keys = []string{homeFile("id_ed25519"), homeFile("id_ecdsa"), homeFile("id_rsa")}
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			if conn, err := net.Dial("unix", sock); err == nil {
+				res = append(res, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			}
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, key := range keys {
+		data, err := ioutil.ReadFile(key)
+		if os.IsNotExist(err) && sftpKey == "" {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var signer ssh.Signer
+		if sftpKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(sftpKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(data)
+		}
+		if _, ok := err.(*ssh.PassphraseMissingError); ok && sftpKey == "" {
+			log.WithField("path", key).Debug("Skipping SSH key with a passphrase.")
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) != 0 {
+		res = append(res, ssh.PublicKeys(signers...))
+	}
+	if len(res) == 0 {
+		return nil, ErrSFTPNoAuth
+	}
+
+	return res, nil
+}
+
+func sftpHostKeys() (ssh.HostKeyCallback, error) {
+	path := sftpKnownHosts
+	if path == "" {
+		path = homeFile("known_hosts")
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if keyErr, ok := err.(*knownhosts.KeyError); ok && len(keyErr.Want) == 0 {
+			return ErrSFTPNoHost
+		}
+		return err
+	}, nil
+}
+
+// Returns the connection, connecting first if needed. It's kept open and
+// shared by every worker.
+func (s *SFTPStorage) connect() (*sftp.Client, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	conn, err := ssh.Dial("tcp", s.Host, s.config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.WithField("host", s.Host).Debug("Connected to the SFTP server.")
+	s.client = client
+	// Connect again next time if the connection is lost.
+	go func() {
+		conn.Wait()
+		s.m.Lock()
+		if s.client == client {
+			s.client = nil
+		}
+		s.m.Unlock()
+	}()
+
+	return client, nil
+}
+
+func (s *SFTPStorage) path(p string) string {
+	return path.Join(s.Directory, p)
+}
+
+func (s *SFTPStorage) Create(p string) (StorageWriter, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	p = s.path(p)
+	if err := client.MkdirAll(path.Dir(p)); err != nil {
+		return nil, err
+	}
+	// Written under another name first so that nothing on the other end
+	// picks up a file that's only partly there.
+	f, err := client.Create(p + ".part")
+	if err != nil {
+		return nil, err
+	}
+
+	return &sftpWriter{File: f, client: client, path: p}, nil
+}
+
+func (s *SFTPStorage) Remove(p string) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	return client.Remove(s.path(p))
+}
+
+func (s *SFTPStorage) Location(p string) string {
+	u := url.URL{Scheme: "sftp", User: url.User(s.User), Host: s.Host, Path: "/" + strings.TrimPrefix(s.path(p), "/")}
+	if !strings.HasPrefix(s.Directory, "/") {
+		u.Path = "/~" + u.Path
+	}
+
+	return u.String()
+}
+
+type sftpWriter struct {
+	*sftp.File
+	client *sftp.Client
+	path   string
+}
+
+func (w *sftpWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		w.client.Remove(w.Name())
+		return err
+	}
+
+	// Not every server supports replacing files when renaming.
+	if err := w.client.PosixRename(w.Name(), w.path); err != nil {
+		w.client.Remove(w.path)
+		return w.client.Rename(w.Name(), w.path)
+	}
+
+	return nil
+}
+
+func (w *sftpWriter) Abort() error {
+	w.File.Close()
+	return w.client.Remove(w.Name())
+}
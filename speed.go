@@ -0,0 +1,106 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// How quickly the smoothed speed follows changes. After this long at a new
+	// speed, it has moved about two thirds of the way there.
+	speedSmoothing = 5 * time.Second
+	// How much time has to pass between samples. Shorter samples are mostly noise
+	// from reads arriving in bursts.
+	speedInterval = 500 * time.Millisecond
+)
+
+// Measures how fast bytes are coming in, smoothing it with an exponentially
+// weighted moving average so that it doesn't jump around with every burst.
+// Safe to use from multiple goroutines.
+type speedMeter struct {
+	// The smoothed speed in bytes per second.
+	rate float64
+	// Bytes added since the last sample, and when that was.
+	pending int64
+	last    time.Time
+	primed  bool
+	m       sync.Mutex
+}
+
+func (s *speedMeter) Add(n int64) {
+	now := time.Now()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.last.IsZero() {
+		s.last = now
+	}
+	s.sample(now)
+	s.pending += n
+}
+
+// Returns the speed in bytes per second.
+func (s *speedMeter) Speed() float64 {
+	now := time.Now()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.last.IsZero() {
+		return 0
+	}
+	s.sample(now)
+	return s.rate
+}
+
+// Folds the bytes since the last sample into the average if enough time has
+// passed. Must be called with the lock held.
+func (s *speedMeter) sample(now time.Time) {
+	elapsed := now.Sub(s.last)
+	if elapsed < speedInterval {
+		return
+	}
+
+	rate := float64(s.pending) / elapsed.Seconds()
+	if !s.primed {
+		// Start at the first sample instead of climbing up from zero.
+		s.rate = rate
+		s.primed = true
+	} else {
+		// Weighted by how long the sample is, so that irregular calls don't skew it.
+		alpha := 1 - math.Exp(-elapsed.Seconds()/speedSmoothing.Seconds())
+		s.rate += alpha * (rate - s.rate)
+	}
+	s.pending = 0
+	s.last = now
+}
+
+// Estimates how long is left in seconds from the bytes saved so far, using
+// the average size of the finished files for the ones left. Returns 0 if
+// there's nothing to go on yet.
+func estimateETA(p Progress, inFlight int64) float64 {
+	if p.Total <= 0 || p.Files <= 0 || p.Speed <= 0 || p.Files >= p.Total {
+		return 0
+	}
+
+	average := float64(p.Bytes) / float64(p.Files)
+	left := average*float64(p.Total-p.Files) - float64(inFlight)
+	if left < 0 {
+		left = 0
+	}
+	return left / p.Speed
+}
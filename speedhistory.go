@@ -0,0 +1,178 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// How often throughput is sampled for --speed-history.
+const speedHistoryInterval = time.Second
+
+var speedHistoryPath string
+
+var (
+	// Samples from every download in this run, written out at the end.
+	speedHistory  []SpeedSample
+	speedHistoryM sync.Mutex
+)
+
+func init() {
+	commonFlags.StringVar(&speedHistoryPath, "speed-history", "",
+		"Save how fast downloads went every second to a file when done, as CSV if it ends in .csv and JSON otherwise.")
+}
+
+// The throughput of a download at a point in time.
+type SpeedSample struct {
+	Time time.Time `json:"time"`
+	URL  string    `json:"url"`
+	// Seconds since the download started.
+	Elapsed float64 `json:"elapsed"`
+	// Bytes saved so far, and per second smoothed over the last few seconds.
+	Bytes   int64   `json:"bytes"`
+	Speed   float64 `json:"speed"`
+	Workers int     `json:"workers"`
+	// Bytes of responses from each host that finished since the last sample.
+	Hosts map[string]int64 `json:"hosts,omitempty"`
+}
+
+// Samples the download's throughput until the returned function is called.
+// Does nothing without --speed-history.
+func sampleSpeed(dm *DownloadManager, url string, p plugins.Plugin) (stop func()) {
+	if speedHistoryPath == "" {
+		return func() {}
+	}
+
+	started := time.Now()
+	hosts := plugins.HostStats(p.Name())
+	sample := func() {
+		now := plugins.HostStats(p.Name())
+		progress := dm.Progress()
+		s := SpeedSample{
+			Time:    time.Now(),
+			URL:     url,
+			Elapsed: time.Since(started).Seconds(),
+			Bytes:   progress.Bytes,
+			Speed:   progress.Speed,
+			Workers: len(dm.Workers()),
+		}
+		for host, stat := range now {
+			if n := stat.Bytes - hosts[host].Bytes; n > 0 {
+				if s.Hosts == nil {
+					s.Hosts = make(map[string]int64)
+				}
+				s.Hosts[host] = n
+			}
+		}
+		hosts = now
+		speedHistoryM.Lock()
+		speedHistory = append(speedHistory, s)
+		speedHistoryM.Unlock()
+	}
+
+	ticker := time.NewTicker(speedHistoryInterval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				sample()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		sample()
+	}
+}
+
+// Writes the samples taken so far to the --speed-history file.
+func writeSpeedHistory() {
+	if speedHistoryPath == "" {
+		return
+	}
+
+	f, err := os.Create(speedHistoryPath)
+	if err != nil {
+		log.Errorf("Failed to save the speed history: %s", err)
+		return
+	}
+	defer f.Close()
+	speedHistoryM.Lock()
+	defer speedHistoryM.Unlock()
+	if strings.EqualFold(filepath.Ext(speedHistoryPath), ".csv") {
+		err = writeSpeedCSV(f, speedHistory)
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(speedHistory)
+	}
+	if err != nil {
+		log.Errorf("Failed to save the speed history: %s", err)
+	}
+}
+
+// Writes the samples as CSV with a column for each host, since spreadsheets
+// can't do much with nested values.
+func writeSpeedCSV(w io.Writer, samples []SpeedSample) error {
+	hostSet := make(map[string]bool)
+	for _, s := range samples {
+		for host := range s.Hosts {
+			hostSet[host] = true
+		}
+	}
+	hosts := make([]string, 0, len(hostSet))
+	for host := range hostSet {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	cw := csv.NewWriter(w)
+	cw.Write(append([]string{"time", "url", "elapsed", "bytes", "speed", "workers"}, hosts...))
+	for _, s := range samples {
+		row := []string{
+			s.Time.Format(time.RFC3339),
+			s.URL,
+			strconv.FormatFloat(s.Elapsed, 'f', 1, 64),
+			strconv.FormatInt(s.Bytes, 10),
+			strconv.FormatFloat(s.Speed, 'f', 0, 64),
+			strconv.Itoa(s.Workers),
+		}
+		for _, host := range hosts {
+			row = append(row, strconv.FormatInt(s.Hosts[host], 10))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
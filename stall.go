@@ -0,0 +1,125 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/logger"
+)
+
+var ErrStalled = errors.New("The download stalled.")
+
+// Checks for stalled workers until the returned function is called.
+func (dm *DownloadManager) watchStalls() (stop func()) {
+	if dm.StallTimeout <= 0 {
+		return func() {}
+	}
+
+	interval := dm.StallTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				dm.checkStalls()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// Warns about workers that haven't written anything for longer than the
+// timeout, and restarts what they're downloading if set to. Each stall is
+// only dealt with once, until the worker gets going again.
+func (dm *DownloadManager) checkStalls() {
+	type stall struct {
+		n        int
+		file     string
+		reporter *DownloadReporter
+	}
+	if dm.Paused() {
+		return
+	}
+
+	var stalls []stall
+	dm.m.Lock()
+	for _, w := range dm.active {
+		if !w.Stalled && time.Since(w.active) > dm.StallTimeout {
+			w.Stalled = true
+			stalls = append(stalls, stall{w.N, w.File, w.reporter})
+		}
+	}
+	dm.m.Unlock()
+
+	for _, s := range stalls {
+		entry := log.WithField(logger.WorkerField, s.n)
+		if s.file != "" {
+			entry = entry.WithField("file", filepath.Base(s.file))
+		}
+		if dm.RestartStalled && s.reporter != nil && s.reporter.abortStalled() {
+			entry.Warn(i18n.Tf("No data for %s. Retrying...", dm.StallTimeout))
+		} else {
+			entry.Warn(i18n.Tf("No data for %s. The worker seems to have stalled.", dm.StallTimeout))
+		}
+	}
+}
+
+// Aborts the request SaveURL() is waiting on, making it try again.
+// Returns false if there's no such request, e.g. because the plugin is
+// making its own requests.
+func (dr *DownloadReporter) abortStalled() bool {
+	dr.dirm.Lock()
+	defer dr.dirm.Unlock()
+	if dr.abort == nil {
+		return false
+	}
+
+	dr.stalled = true
+	dr.abort()
+	return true
+}
+
+// Sets what abortStalled() calls, or nil if there's nothing to abort.
+func (dr *DownloadReporter) setAbort(abort func()) {
+	dr.dirm.Lock()
+	dr.abort = abort
+	dr.dirm.Unlock()
+}
+
+// Returns whether the last request was aborted because it stalled,
+// resetting it.
+func (dr *DownloadReporter) takeStalled() bool {
+	dr.dirm.Lock()
+	defer dr.dirm.Unlock()
+	stalled := dr.stalled
+	dr.stalled = false
+	return stalled
+}
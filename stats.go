@@ -0,0 +1,260 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/mindl/i18n"
+)
+
+// How a job went, kept to tell how well each plugin has been doing.
+type StatsEntry struct {
+	Plugin string    `json:"plugin"`
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+	// In seconds.
+	Duration float64 `json:"duration"`
+	Files    int     `json:"files"`
+	Bytes    int64   `json:"bytes"`
+	Retries  int64   `json:"retries"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// The outcome of every job, kept next to the history and stored the same
+// way, as JSON with one entry per line.
+type StatsLog struct {
+	path string
+	m    sync.Mutex
+}
+
+func OpenStatsLog(path string) *StatsLog {
+	return &StatsLog{path: path}
+}
+
+// Where the stats are kept for a history file, e.g. history-stats.jsonl
+// for history.jsonl.
+func StatsPath(historyPath string) string {
+	ext := filepath.Ext(historyPath)
+	return strings.TrimSuffix(historyPath, ext) + "-stats" + ext
+}
+
+func (s *StatsLog) Add(entry *StatsEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.path), os.FileMode(permission)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Returns every entry, oldest first.
+func (s *StatsLog) Entries() ([]*StatsEntry, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []*StatsEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry StatsEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.WithField("path", s.path).Warnf("Skipping malformed stats entry: %s", err)
+			continue
+		}
+		res = append(res, &entry)
+	}
+
+	return res, scanner.Err()
+}
+
+// How a plugin has been doing over a number of jobs.
+type PluginStats struct {
+	Plugin   string `json:"plugin"`
+	Jobs     int    `json:"jobs"`
+	Done     int    `json:"done"`
+	Failed   int    `json:"failed"`
+	Canceled int    `json:"canceled"`
+	// Done out of done and failed jobs, from 0 to 1. Canceled jobs don't count.
+	SuccessRate float64 `json:"success_rate"`
+	// Average bytes per second over the jobs that finished.
+	Speed   float64 `json:"speed"`
+	Retries int64   `json:"retries"`
+	// When the last failed job finished, and why it failed.
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// Adds up the entries per plugin, sorted by name.
+func SummarizeStats(entries []*StatsEntry) []PluginStats {
+	type totals struct {
+		PluginStats
+		bytes    int64
+		duration float64
+	}
+	byPlugin := make(map[string]*totals)
+	for _, entry := range entries {
+		t := byPlugin[entry.Plugin]
+		if t == nil {
+			t = &totals{PluginStats: PluginStats{Plugin: entry.Plugin}}
+			byPlugin[entry.Plugin] = t
+		}
+		t.Jobs++
+		t.Retries += entry.Retries
+		switch entry.Status {
+		case StatusDone:
+			t.Done++
+			t.bytes += entry.Bytes
+			t.duration += entry.Duration
+		case StatusFailed:
+			t.Failed++
+			at := entry.Time
+			t.LastFailure = &at
+			t.LastError = entry.Error
+		case StatusCanceled:
+			t.Canceled++
+		}
+	}
+
+	res := make([]PluginStats, 0, len(byPlugin))
+	for _, t := range byPlugin {
+		if t.Done+t.Failed > 0 {
+			t.SuccessRate = float64(t.Done) / float64(t.Done+t.Failed)
+		}
+		if t.duration > 0 {
+			t.Speed = float64(t.bytes) / t.duration
+		}
+		res = append(res, t.PluginStats)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Plugin < res[j].Plugin })
+
+	return res
+}
+
+// Adds a finished job to the stats if they're enabled.
+func recordStats(res *JobResult) {
+	if stats == nil || res.Plugin == "" || res.Status == "" || res.Status == StatusSkipped {
+		return
+	}
+
+	err := stats.Add(&StatsEntry{
+		Plugin:   res.Plugin,
+		Status:   res.Status,
+		Time:     time.Now(),
+		Duration: res.Duration,
+		Files:    len(res.Files),
+		Bytes:    res.Bytes,
+		Retries:  res.Retries,
+		Error:    res.Error,
+	})
+	if err != nil {
+		log.WithField("url", res.URL).Errorf("Failed to add to the stats: %s", err)
+	}
+}
+
+var (
+	// nil if the history is disabled.
+	stats        *StatsLog
+	statsSince   time.Duration
+	statsJSON    bool
+	statsCommand = &Command{
+		Name:  "stats",
+		Usage: "[flags] [plugin]",
+		Short: "Show how often downloads with each plugin succeeded, how fast they were and how many retries they needed.",
+		Flags: NewCommandFlags("stats"),
+		Setup: SetupNone,
+	}
+)
+
+func init() {
+	statsCommand.Run = runStats
+	statsCommand.Flags.DurationVar(&statsSince, "since", 0,
+		"Only count jobs that finished within this long, like 168h for the last week. 0 for all of them.")
+	statsCommand.Flags.BoolVar(&statsJSON, "json", false,
+		"Print the stats as a JSON array.")
+}
+
+func runStats(args []string) {
+	entries, err := OpenStatsLog(StatsPath(historyPath)).Entries()
+	if err != nil {
+		fatal(err)
+	}
+
+	search := strings.ToLower(strings.Join(args, " "))
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if statsSince > 0 && time.Since(entry.Time) > statsSince {
+			continue
+		} else if search != "" && !strings.Contains(strings.ToLower(entry.Plugin), search) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	summary := SummarizeStats(filtered)
+
+	if statsJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(summary); err != nil {
+			fatal(err)
+		}
+		return
+	} else if len(summary) == 0 {
+		log.Info(i18n.T("No jobs have been recorded yet."))
+		return
+	}
+
+	for _, s := range summary {
+		var lastFailure string
+		if s.LastFailure != nil {
+			lastFailure = "  last failed " + s.LastFailure.Local().Format("2006-01-02 15:04")
+			if s.LastError != "" {
+				lastFailure += ": " + s.LastError
+			}
+		}
+		fmt.Printf("%-12s %4d job(s) %4.0f%% done %4d failed %12s %5.1f retries/job%s\n", s.Plugin, s.Jobs,
+			100*s.SuccessRate, s.Failed, formatSpeed(s.Speed), float64(s.Retries)/float64(s.Jobs), lastFailure)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/MinoMino/mindl/i18n"
+)
+
+var ErrUnknownStorage = errors.New("Unsupported output URL. Use a local directory or one of the supported schemes.")
+
+// Where downloaded files are written to. Paths are relative to the output
+// directory and always use forward slashes.
+type Storage interface {
+	// Creates the file, and any directories it's in. Nothing is saved until
+	// the writer is closed.
+	Create(path string) (StorageWriter, error)
+	Remove(path string) error
+	// Returns the path or URL to show for a file.
+	Location(path string) string
+}
+
+type StorageWriter interface {
+	io.WriteCloser
+	// Throws away what's been written instead of saving it.
+	Abort() error
+}
+
+// How much of a file is kept in memory by a spool before the rest goes to
+// a temporary file.
+const spoolMemory = 8 << 20
+
+// Opens the storage for each output URL scheme other than local paths.
+var storageSchemes = map[string]func(u *url.URL) (Storage, error){
+	"memory": func(u *url.URL) (Storage, error) {
+		s := NewMemoryStorage()
+		s.Discard = true
+		return s, nil
+	},
+}
+
+// Returns whether the output is a URL or an rclone remote rather than a
+// local directory.
+func isOutputURL(output string) bool {
+	return strings.Contains(output, "://") || isRcloneRemote(output)
+}
+
+// Opens the storage for an output directory or URL.
+func OpenStorage(output string) (Storage, error) {
+	if !isOutputURL(output) {
+		return &LocalStorage{Directory: output}, nil
+	} else if isRcloneRemote(output) {
+		return newRcloneStorage(output)
+	}
+
+	u, err := url.Parse(output)
+	if err != nil {
+		return nil, err
+	}
+	open, ok := storageSchemes[u.Scheme]
+	if !ok {
+		return nil, ErrUnknownStorage
+	}
+
+	return open(u)
+}
+
+// Files in a directory on the local disk.
+type LocalStorage struct {
+	Directory string
+	m         sync.Mutex
+}
+
+func (s *LocalStorage) Create(path string) (StorageWriter, error) {
+	path = s.Location(path)
+	if err := s.makeDirectories(path); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localWriter{f}, nil
+}
+
+func (s *LocalStorage) Remove(path string) error {
+	return os.Remove(s.Location(path))
+}
+
+func (s *LocalStorage) Location(path string) string {
+	return filepath.Join(s.Directory, filepath.FromSlash(path))
+}
+
+func (s *LocalStorage) makeDirectories(path string) error {
+	dir := filepath.Dir(path)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			log.WithField("path", dir).Debug("Creating non-existing directories.")
+			if err = os.MkdirAll(dir, os.FileMode(permission)); err != nil {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type localWriter struct {
+	*os.File
+}
+
+func (w *localWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
+
+// Files kept in memory, for when nothing should touch the disk, like when
+// testing plugins. memory:// outputs use one to preview downloads.
+type MemoryStorage struct {
+	// Set to only keep the sizes of files, throwing away their contents.
+	Discard bool
+	files   map[string][]byte
+	sizes   map[string]int64
+	m       sync.Mutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string][]byte), sizes: make(map[string]int64)}
+}
+
+func (s *MemoryStorage) Create(path string) (StorageWriter, error) {
+	return &memoryWriter{storage: s, path: path}, nil
+}
+
+func (s *MemoryStorage) Remove(path string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.sizes[path]; !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	delete(s.files, path)
+	delete(s.sizes, path)
+
+	return nil
+}
+
+func (s *MemoryStorage) Location(path string) string {
+	return path
+}
+
+// Returns the contents of a saved file, which are empty when discarding.
+func (s *MemoryStorage) File(path string) ([]byte, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, ok := s.sizes[path]
+	return s.files[path], ok
+}
+
+// Returns the size of a saved file, or -1 if there's no such file.
+func (s *MemoryStorage) Size(path string) int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if size, ok := s.sizes[path]; ok {
+		return size
+	}
+
+	return -1
+}
+
+// Returns the paths of all saved files, sorted.
+func (s *MemoryStorage) Paths() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	res := make([]string, 0, len(s.sizes))
+	for path := range s.sizes {
+		res = append(res, path)
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+type memoryWriter struct {
+	buf     bytes.Buffer
+	size    int64
+	storage *MemoryStorage
+	path    string
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	if w.storage.Discard {
+		return len(p), nil
+	}
+
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	w.storage.m.Lock()
+	if !w.storage.Discard {
+		w.storage.files[w.path] = w.buf.Bytes()
+	}
+	w.storage.sizes[w.path] = w.size
+	w.storage.m.Unlock()
+	return nil
+}
+
+func (w *memoryWriter) Abort() error {
+	w.buf.Reset()
+	return nil
+}
+
+// Returns whether the download is only being previewed with a memory://
+// output, meaning nothing was really saved.
+func (dm *DownloadManager) Preview() bool {
+	mem, ok := dm.storage.(*MemoryStorage)
+	return ok && mem.Discard
+}
+
+// Prints the files in the storage with their sizes.
+func (s *MemoryStorage) Print(w io.Writer) {
+	var total int64
+	paths := s.Paths()
+	for _, path := range paths {
+		size := s.Size(path)
+		total += size
+		fmt.Fprintf(w, "%10s  %s\n", formatBytes(size), path)
+	}
+	fmt.Fprint(w, i18n.Tf("Total: %d file(s), %s\n", len(paths), formatBytes(total)))
+}
+
+// Keeps track of the size and optionally the hash of what's written to a
+// storage, since it can't always be read back cheaply.
+type savedWriter struct {
+	StorageWriter
+	file SavedFile
+	hash hash.Hash
+}
+
+func newSavedWriter(w StorageWriter, s Storage, path string, hashIt bool) *savedWriter {
+	res := &savedWriter{StorageWriter: w, file: SavedFile{Path: s.Location(path), rel: path}}
+	if hashIt {
+		res.hash = sha256.New()
+	}
+
+	return res
+}
+
+func (w *savedWriter) Write(p []byte) (int, error) {
+	n, err := w.StorageWriter.Write(p)
+	w.file.Size += int64(n)
+	if w.hash != nil {
+		w.hash.Write(p[:n])
+	}
+
+	return n, err
+}
+
+// Returns the file as saved. Only valid after a successful Close().
+func (w *savedWriter) Saved() SavedFile {
+	if w.hash != nil {
+		w.file.SHA256 = hex.EncodeToString(w.hash.Sum(nil))
+	}
+
+	return w.file
+}
+
+func writeStorageFile(s Storage, path string, data []byte) error {
+	w, err := s.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Close()
+}
+
+// Keeps what's written to it in memory, or in a temporary file once it's
+// too big, so that uploads can be sent again.
+type spool struct {
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	s.size += int64(len(p))
+	if s.file == nil && s.buf.Len()+len(p) <= spoolMemory {
+		return s.buf.Write(p)
+	}
+
+	if s.file == nil {
+		f, err := ioutil.TempFile("", "mindl-spool-")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+
+	return s.file.Write(p)
+}
+
+// Returns a reader for everything written so far, starting at the offset.
+func (s *spool) Reader(offset int64) (io.Reader, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.buf.Bytes()[offset:]), nil
+	}
+
+	_, err := s.file.Seek(offset, io.SeekStart)
+	return ioutil.NopCloser(s.file), err
+}
+
+func (s *spool) Close() error {
+	s.buf.Reset()
+	if s.file == nil {
+		return nil
+	}
+
+	s.file.Close()
+	err := os.Remove(s.file.Name())
+	s.file = nil
+	return err
+}
+
+// Loads a token a storage needs to log in, like an OAuth refresh token,
+// from the keyring, the credentials file or a file in the config directory,
+// in that order.
+func loadStorageToken(account, file string) string {
+	if !noKeyring {
+		if token, err := KeyringGet(account); err == nil {
+			auditCredential(account, "the keyring")
+			return token
+		}
+	}
+	credentialsM.Lock()
+	if store := openCredentials(); store != nil {
+		if token, ok := store.Get(account); ok {
+			credentialsM.Unlock()
+			auditCredential(account, "the credentials file")
+			return token
+		}
+	}
+	credentialsM.Unlock()
+	path := storageTokenPath(file)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	auditCredential(account, path)
+	return strings.TrimSpace(string(data))
+}
+
+// Saves a token in the keyring, or in the credentials file without one. It's
+// only written to a file as is if neither can be used. An empty token is
+// removed from all of them.
+func saveStorageToken(account, file, token string) error {
+	path := storageTokenPath(file)
+	if token == "" {
+		if !noKeyring {
+			KeyringDelete(account)
+		}
+		credentialsM.Lock()
+		defer credentialsM.Unlock()
+		if store := openCredentials(); store != nil && store.Delete(account) {
+			if err := store.Save(); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if !noKeyring && KeyringSet(account, token) == nil {
+		// Any copy from before there was a keyring is stale now.
+		os.Remove(path)
+		return nil
+	}
+	credentialsM.Lock()
+	defer credentialsM.Unlock()
+	store := openCredentials()
+	if store == nil && credentialsPassphrase != "" {
+		var err error
+		if store, err = OpenCredentialStore(credentialsFile); err != nil {
+			return err
+		}
+		credentials = store
+	}
+	if store != nil {
+		store.Set(account, token)
+		if err := store.Save(); err != nil {
+			return err
+		}
+		os.Remove(path)
+		return nil
+	}
+
+	log.Warnf("There's no keyring to keep the token in, so it's saved unencrypted to %s. "+
+		"Set --credentials-passphrase to keep it in the credentials file instead.", path)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(token), 0600)
+}
+
+func storageTokenPath(file string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "mindl-" + file
+	}
+
+	return filepath.Join(dir, "mindl", file)
+}
+
+// Joins a prefix from an output URL with a relative path.
+func joinKey(prefix, p string) string {
+	return strings.TrimPrefix(path.Join(prefix, p), "/")
+}
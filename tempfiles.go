@@ -0,0 +1,176 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	tempDir     string
+	maxTempSize SizeFlag
+)
+
+func init() {
+	commonFlags.StringVar(&tempDir, "temp-dir", "",
+		"The directory for temporary files. By default, they're kept in the output directory if it's local, so that they can be moved instead of copied.")
+	commonFlags.Var(&maxTempSize, "max-temp-size",
+		"How much space temporary files may take up, like 2G. Workers wait for others to finish when there's no more room.")
+}
+
+// Temporary files are named mindl-<pid>-<plugin>-<random>, so that the ones
+// left behind by runs that crashed can be told apart from ones in use.
+var tempFileRegex = regexp.MustCompile(`^mindl-(\d+)-`)
+
+// How old temporary files from before they were named after the process
+// have to be before they're removed.
+const legacyTempAge = 24 * time.Hour
+
+var (
+	// The temporary files created by this process, and the worker that
+	// created each of them.
+	tempFiles = make(map[string]int)
+	tempM     sync.Mutex
+)
+
+// Returns the directory for temporary files when saving to the storage.
+// They always go in a directory of their own, since anything in it can end
+// up being cleaned up.
+func tempDirectory(s Storage) string {
+	if tempDir != "" {
+		return filepath.Join(outputDirectory(tempDir), "mindl-tmp")
+	} else if local, ok := s.(*LocalStorage); ok {
+		return filepath.Join(local.Directory, ".tmp")
+	}
+
+	return filepath.Join(os.TempDir(), "mindl")
+}
+
+// Creates a temporary file for a worker, waiting for room if they're
+// limited in size.
+func createTempFile(dir, plugin string, n int, cancel <-chan struct{}) (*os.File, error) {
+	if err := waitForTempSpace(n, cancel); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, os.FileMode(permission)); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, fmt.Sprintf("mindl-%d-%s-", os.Getpid(), plugin))
+	if err != nil {
+		return nil, err
+	}
+
+	tempM.Lock()
+	tempFiles[f.Name()] = n
+	tempM.Unlock()
+	return f, nil
+}
+
+// Returns how much space the temporary files of this process take up, and
+// whether a worker before the given one has any. Files that have been moved
+// or removed are forgotten.
+func tempUsage(n int) (size int64, earlier bool) {
+	tempM.Lock()
+	defer tempM.Unlock()
+	for path, worker := range tempFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(tempFiles, path)
+			continue
+		}
+		size += info.Size()
+		earlier = earlier || worker < n
+	}
+
+	return
+}
+
+// Blocks while the temporary files are taking up all the space they may.
+// Only workers that started after one with temporary files wait, so that
+// they can't end up waiting on each other.
+func waitForTempSpace(n int, cancel <-chan struct{}) error {
+	for logged := false; maxTempSize > 0; logged = true {
+		size, earlier := tempUsage(n)
+		if size < int64(maxTempSize) || !earlier {
+			return nil
+		}
+		if !logged {
+			log.Debugf("Worker #%d is waiting for temporary files to take up less than %s.", n, &maxTempSize)
+		}
+
+		select {
+		case <-cancel:
+			return ErrCanceled
+		case <-time.After(time.Second):
+		}
+	}
+
+	return nil
+}
+
+// Removes temporary files left behind by runs that didn't get to clean up
+// after themselves, along with the directory if it ends up empty.
+func cleanTempFiles(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	removed := 0
+	for _, info := range files {
+		m := tempFileRegex.FindStringSubmatch(info.Name())
+		if m == nil {
+			if !isLegacyTempFile(info) {
+				continue
+			}
+		} else if pid, _ := strconv.Atoi(m[1]); processRunning(pid) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+			log.WithField("path", filepath.Join(dir, info.Name())).Warnf("Failed to remove a temporary file: %s", err)
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		log.Debugf("Removed %d temporary file(s) left behind in %s.", removed, dir)
+	}
+	if removed == len(files) {
+		os.Remove(dir)
+	}
+}
+
+func isLegacyTempFile(info os.FileInfo) bool {
+	return !info.IsDir() && len(info.Name()) > 6 && info.Name()[:6] == "mindl-" &&
+		time.Since(info.ModTime()) > legacyTempAge
+}
+
+// Cleans up the directories temporary files could have been left in.
+func setupTempFiles() {
+	cleanTempFiles(tempDirectory(nil))
+	if !isOutputURL(dldir) {
+		cleanTempFiles(tempDirectory(&LocalStorage{Directory: outputDirectory(dldir)}))
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var ErrIPv4AndIPv6 = errors.New("--force-ipv4 and --force-ipv6 can't be used together.")
+
+var (
+	retries             int
+	retryDelay          time.Duration
+	maxIdleConnsPerHost int
+	connectTimeouts     []string
+	tlsTimeouts         []string
+	headerTimeouts      []string
+	idleTimeouts        []string
+	requestTimeouts     []string
+	http2               bool
+	maxConnections      int
+	dnsServer, dohURL   string
+	caFiles, pinFlags   []string
+	insecure            bool
+	harFile             string
+	harBodyLimit        int
+	otlpEndpoint        string
+	otlpHeaders         []string
+	flareSolverr        string
+	flareSolverrTimeout time.Duration
+	httpCache           string
+	forceIPv4           bool
+	forceIPv6           bool
+	rateLimitFlags      []string
+)
+
+func init() {
+	commonFlags.IntVar(&retries, "retries", plugins.MaxRetries,
+		"How many times to retry requests that fail because of network or server errors.")
+	commonFlags.DurationVar(&retryDelay, "retry-delay", plugins.RetryDelay,
+		"How long to wait before the first retry. The wait doubles with every retry.")
+	commonFlags.IntVar(&maxIdleConnsPerHost, "max-idle-conns-per-host", plugins.MaxIdleConnsPerHost,
+		"How many idle connections to keep open per host for reuse.")
+	commonFlags.StringArrayVar(&idleTimeouts, "keep-alive", nil,
+		"How long idle connections are kept open for reuse, 90s by default. 0 turns reusing connections off. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.")
+	commonFlags.StringArrayVar(&connectTimeouts, "connect-timeout", nil,
+		"How long to wait for connections to be made, 30s by default. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.")
+	commonFlags.StringArrayVar(&tlsTimeouts, "tls-handshake-timeout", nil,
+		"How long to wait for TLS handshakes, 10s by default. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.")
+	commonFlags.StringArrayVar(&headerTimeouts, "response-header-timeout", nil,
+		"How long to wait for the response after sending a request, with no limit by default. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.")
+	commonFlags.StringArrayVar(&requestTimeouts, "timeout", nil,
+		"How long every attempt at a request can take, including reading the response. Plugins pick their own by default, usually 20s. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.")
+	commonFlags.BoolVar(&http2, "http2", plugins.HTTP2,
+		"Use HTTP/2 with servers that support it. Use --http2=false to turn it off.")
+	commonFlags.IntVar(&maxConnections, "max-connections", plugins.MaxConnections,
+		"The most connections to have open at the same time across all plugins and jobs. 0 means no limit.")
+	commonFlags.StringArrayVar(&rateLimitFlags, "rate-limit", nil,
+		"The most requests per second a plugin can send, e.g. 2 or 0.5. Prefix it with \"Plugin=\" to only use it for that plugin. Can be repeated.")
+	commonFlags.BoolVar(&forceIPv4, "force-ipv4", false,
+		"Set to only connect to sites over IPv4.")
+	commonFlags.BoolVar(&forceIPv6, "force-ipv6", false,
+		"Set to only connect to sites over IPv6.")
+	commonFlags.StringVar(&dnsServer, "dns-server", "",
+		"A DNS server to look up hosts with instead of the system's, e.g. 1.1.1.1.")
+	commonFlags.StringVar(&dohURL, "doh", "",
+		"The URL of a DNS-over-HTTPS resolver to look up hosts with, e.g. https://1.1.1.1/dns-query.")
+	commonFlags.StringArrayVar(&caFiles, "ca-file", nil,
+		"A PEM file with CA certificates to trust on top of the system's. Can be repeated.")
+	commonFlags.StringArrayVar(&pinFlags, "pin", nil,
+		"Only accept certificates with a specific public key for a host, given as host=sha256/<base64 hash>. Can be repeated.")
+	commonFlags.BoolVar(&insecure, "insecure", false,
+		"Set to not verify TLS certificates at all. Only for debugging, since anyone in between can read and change the traffic.")
+	commonFlags.StringVar(&harFile, "har", "",
+		"Record the HTTP traffic of plugins to a HAR file for debugging. Passwords and cookies are redacted.")
+	commonFlags.IntVar(&harBodyLimit, "har-body-limit", 64*1024,
+		"How many bytes of each request and response body to record in the HAR file. 0 leaves bodies out.")
+	commonFlags.StringVar(&otlpEndpoint, "otlp-endpoint", "",
+		"Send traces of jobs, downloaders, HTTP requests and post-processing to an OpenTelemetry collector over OTLP/HTTP, e.g. http://localhost:4318.")
+	commonFlags.StringArrayVar(&otlpHeaders, "otlp-header", nil,
+		"A header to send to the OpenTelemetry collector as \"Name: Value\", e.g. for an API key. Can be repeated.")
+	commonFlags.StringVar(&flareSolverr, "flaresolverr", "",
+		"The URL of a FlareSolverr instance to solve anti-bot challenges like Cloudflare's with, e.g. http://localhost:8191.")
+	commonFlags.DurationVar(&flareSolverrTimeout, "flaresolverr-timeout", time.Minute,
+		"How long to let FlareSolverr try to solve a challenge.")
+	commonFlags.StringVar(&httpCache, "http-cache", "",
+		"Cache API responses and pages in the given directory, and only ask the server whether they changed when they're needed again.")
+	commonFlags.Lookup("http-cache").NoOptDefVal = DefaultHTTPCacheDir()
+}
+
+// Where responses are cached by default, e.g. ~/.cache/mindl/http on Linux.
+func DefaultHTTPCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "mindl-cache"
+	}
+
+	return filepath.Join(dir, "mindl", "http")
+}
+
+// Configures the HTTP transport shared by the plugins.
+func setupTransport() {
+	if retries < 0 {
+		retries = 0
+	}
+	plugins.MaxRetries = retries
+	plugins.RetryDelay = retryDelay
+	plugins.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	setupTimeouts()
+	for _, v := range rateLimitFlags {
+		var plugin string
+		if i := strings.Index(v, "="); i != -1 {
+			plugin, v = v[:i], v[i+1:]
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || rate < 0 {
+			fatalUsage("Invalid rate limit: %s", v)
+		}
+		plugins.SetRateLimit(plugin, rate)
+	}
+	plugins.HTTP2 = http2
+	plugins.MaxConnections = maxConnections
+	if forceIPv4 && forceIPv6 {
+		fatal(ErrIPv4AndIPv6)
+	} else if forceIPv4 {
+		plugins.IPVersion = 4
+	} else if forceIPv6 {
+		plugins.IPVersion = 6
+	}
+	plugins.DNSServer = dnsServer
+	plugins.DoHURL = dohURL
+
+	for _, path := range caFiles {
+		if err := plugins.LoadCAFile(path); err != nil {
+			log.WithField("file", path).Fatal(err)
+		}
+	}
+	for _, pin := range pinFlags {
+		split := strings.SplitN(pin, "=", 2)
+		if len(split) != 2 {
+			fatal(plugins.ErrInvalidPin)
+		}
+		if err := plugins.AddPin(strings.TrimSpace(split[0]), strings.TrimSpace(split[1])); err != nil {
+			fatal(err)
+		}
+	}
+	if insecure {
+		log.Warn("TLS certificate verification is OFF! Anyone between you and the sites can read and change " +
+			"the traffic, including passwords. Only use --insecure for debugging.")
+		plugins.InsecureTLS = true
+	}
+	if harFile != "" {
+		plugins.StartHAR(harFile, version, harBodyLimit)
+	}
+	if otlpEndpoint != "" {
+		header := make(http.Header)
+		for _, h := range otlpHeaders {
+			split := strings.SplitN(h, ":", 2)
+			if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+				fatalUsage("Invalid header. Should be \"Name: Value\": %s", h)
+			}
+			header.Add(strings.TrimSpace(split[0]), strings.TrimSpace(split[1]))
+		}
+		plugins.StartTracing(otlpEndpoint, version, header)
+	}
+	if httpCache != "" {
+		if err := plugins.SetHTTPCache(httpCache); err != nil {
+			fatal(fmt.Errorf("Failed to create the HTTP cache: %s", err))
+		}
+	}
+	if flareSolverr != "" {
+		plugins.SetChallengeSolver(&plugins.FlareSolverr{URL: flareSolverr, Timeout: flareSolverrTimeout})
+	}
+}
+
+// Sets the timeouts passed as "[Plugin=]duration".
+func setupTimeouts() {
+	for kind, values := range map[string][]string{
+		plugins.TimeoutConnect: connectTimeouts,
+		plugins.TimeoutTLS:     tlsTimeouts,
+		plugins.TimeoutHeader:  headerTimeouts,
+		plugins.TimeoutIdle:    idleTimeouts,
+		plugins.TimeoutRequest: requestTimeouts,
+	} {
+		for _, v := range values {
+			var plugin string
+			if i := strings.Index(v, "="); i != -1 {
+				plugin, v = v[:i], v[i+1:]
+			}
+			d, err := time.ParseDuration(strings.TrimSpace(v))
+			if err != nil {
+				fatalUsage("Invalid timeout: %s", v)
+			}
+			plugins.SetTimeout(plugin, kind, d)
+		}
+	}
+}
+
+// Writes the HAR file if traffic is being recorded.
+func stopTransport() {
+	plugins.FlushCookies()
+	if err := plugins.StopHAR(); err != nil {
+		log.Errorf("Failed to write the HAR file: %s", err)
+	}
+	if err := plugins.StopTracing(); err != nil {
+		log.Errorf("Failed to send traces to the collector: %s", err)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/MinoMino/mindl/i18n"
+	"github.com/MinoMino/mindl/logger"
+	"golang.org/x/term"
+)
+
+var ErrTUINotTerminal = errors.New("The TUI needs both stdin and stdout to be terminals.")
+
+// How many lines of the log the TUI keeps around.
+const tuiLogLines = 1000
+
+// A full-screen view of a batch of downloads, with a pane for the jobs,
+// one for the workers of the current job and one for the log. Keys can be
+// pressed to pause or cancel the current job, or to quit.
+type TUI struct {
+	jobs []tuiJob
+	// The manager of the job being downloaded, if any.
+	dm *DownloadManager
+	// Lines of the log, and what's been written of the next one.
+	logs    []string
+	partial []byte
+	// Set once the user asks to quit.
+	quitting bool
+	m        sync.Mutex
+
+	state       *term.State
+	stopCapture func()
+	ticker      *time.Ticker
+	done        chan struct{}
+	once        sync.Once
+}
+
+type tuiJob struct {
+	URL    string
+	Status string
+	Files  int
+	Err    string
+}
+
+// The TUI while it's up. Nil otherwise.
+var tui *TUI
+
+// Takes over the terminal for the given URLs if the progress mode is tui.
+func startTUI(urls []string) {
+	if progressMode != ProgressTUI {
+		return
+	}
+
+	t := &TUI{done: make(chan struct{})}
+	for _, url := range urls {
+		t.jobs = append(t.jobs, tuiJob{URL: url})
+	}
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		fatal(err)
+	}
+	t.state = state
+	// Switch to the alternate screen and hide the cursor.
+	fmt.Fprint(os.Stdout, "\x1b[?1049h\x1b[?25l")
+	t.stopCapture = logger.Capture(t, stopTUI)
+	tui = t
+
+	t.ticker = time.NewTicker(250 * time.Millisecond)
+	go func() {
+		for {
+			select {
+			case <-t.ticker.C:
+				t.draw()
+			case <-t.done:
+				return
+			}
+		}
+	}()
+	go t.readKeys()
+	t.draw()
+}
+
+// Gives the terminal back. Safe to call when the TUI isn't up.
+func stopTUI() {
+	t := tui
+	if t == nil {
+		return
+	}
+
+	t.once.Do(func() {
+		t.ticker.Stop()
+		close(t.done)
+		t.stopCapture()
+		fmt.Fprint(os.Stdout, "\x1b[?25h\x1b[?1049l")
+		term.Restore(int(os.Stdin.Fd()), t.state)
+		// Whatever was logged last is usually what the user wants to see,
+		// e.g. why a job failed, so leave it on the terminal.
+		t.m.Lock()
+		logs := t.logs
+		if len(logs) > 20 {
+			logs = logs[len(logs)-20:]
+		}
+		t.m.Unlock()
+		for _, line := range logs {
+			fmt.Fprintln(os.Stdout, line)
+		}
+	})
+	tui = nil
+}
+
+// Collects the log for the log pane.
+func (t *TUI) Write(p []byte) (int, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.logs = append(t.logs, strings.TrimRight(string(t.partial[:i]), " \r"))
+		t.partial = t.partial[i+1:]
+	}
+	if len(t.logs) > tuiLogLines {
+		t.logs = append([]string(nil), t.logs[len(t.logs)-tuiLogLines:]...)
+	}
+
+	return len(p), nil
+}
+
+func (t *TUI) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, key := range buf[:n] {
+			select {
+			case <-t.done:
+				return
+			default:
+			}
+			t.handleKey(key)
+		}
+	}
+}
+
+func (t *TUI) handleKey(key byte) {
+	t.m.Lock()
+	dm := t.dm
+	if key == 'q' || key == 3 { // Ctrl+C
+		t.quitting = true
+	}
+	t.m.Unlock()
+
+	switch key {
+	case 'p':
+		if dm == nil {
+			return
+		} else if dm.Paused() {
+			log.Info(i18n.T("Resuming the download..."))
+			dm.Resume()
+		} else {
+			log.Info(i18n.T("Pausing the download..."))
+			dm.Pause()
+		}
+	case 'c':
+		if dm != nil {
+			log.Info(i18n.T("Canceling the download..."))
+			dm.Cancel()
+		}
+	case 'q', 3:
+		log.Info(i18n.T("Canceling the remaining downloads..."))
+		if dm != nil {
+			dm.Cancel()
+		}
+	}
+}
+
+// Whether the user has asked to quit, in which case the remaining jobs
+// should be skipped. False if the TUI isn't up.
+func (t *TUI) Quitting() bool {
+	if t == nil {
+		return false
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.quitting
+}
+
+// Marks the i-th job as being downloaded. Does nothing if the TUI isn't up.
+func (t *TUI) StartJob(i int) {
+	if t == nil {
+		return
+	}
+
+	t.m.Lock()
+	t.jobs[i].Status = "running"
+	t.m.Unlock()
+}
+
+// Marks the i-th job as finished. Does nothing if the TUI isn't up.
+func (t *TUI) FinishJob(i int, res *JobResult) {
+	if t == nil {
+		return
+	}
+
+	t.m.Lock()
+	t.jobs[i].Status = res.Status
+	t.jobs[i].Files = len(res.Files)
+	t.jobs[i].Err = res.Error
+	t.m.Unlock()
+}
+
+// Shows the workers of the manager until the returned function is called.
+func (t *TUI) Watch(dm *DownloadManager) (stop func()) {
+	t.m.Lock()
+	t.dm = dm
+	t.m.Unlock()
+
+	return func() {
+		t.m.Lock()
+		if t.dm == dm {
+			t.dm = nil
+		}
+		t.m.Unlock()
+	}
+}
+
+func (t *TUI) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	t.m.Lock()
+	dm := t.dm
+	jobs := append([]tuiJob(nil), t.jobs...)
+	logs := t.logs
+	quitting := t.quitting
+	t.m.Unlock()
+
+	var workers []WorkerProgress
+	var p Progress
+	paused := false
+	if dm != nil {
+		workers = dm.Workers()
+		p = dm.Progress()
+		paused = dm.Paused()
+	}
+
+	finished := 0
+	for _, job := range jobs {
+		if job.Status != "" && job.Status != "running" {
+			finished++
+		}
+	}
+	header := fmt.Sprintf("mindl | %s", i18n.Tf("%d/%d jobs", finished, len(jobs)))
+	if paused {
+		header += " | " + i18n.T("PAUSED")
+	}
+	if quitting {
+		header += " | " + i18n.T("Quitting...")
+	}
+	// The header, the separators and the help take up 4 lines, and the
+	// rest is shared by the panes. The log gets whatever's left.
+	lines := []string{header}
+	room := height - 4
+	jobRows := room / 4
+	if jobRows < 1 {
+		jobRows = 1
+	}
+	if jobRows > len(jobs) {
+		jobRows = len(jobs)
+	}
+	lines = append(lines, tuiJobLines(jobs, jobRows, p)...)
+	lines = append(lines, strings.Repeat("─", width))
+
+	workerRows := (room - jobRows) / 2
+	if workerRows < 1 {
+		workerRows = 1
+	}
+	if workerRows > len(workers)+1 {
+		workerRows = len(workers) + 1
+	}
+	if dm != nil {
+		lines = append(lines, totalLine(p, len(workers)))
+		for _, w := range workers {
+			if len(lines) >= 2+jobRows+workerRows {
+				break
+			}
+			lines = append(lines, workerLine(w))
+		}
+	}
+	for len(lines) < 2+jobRows+workerRows {
+		lines = append(lines, "")
+	}
+	lines = append(lines, strings.Repeat("─", width))
+
+	logRows := height - len(lines) - 1
+	if logRows <= 0 {
+		logs = nil
+	} else if logRows < len(logs) {
+		logs = logs[len(logs)-logRows:]
+	}
+	lines = append(lines, logs...)
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, i18n.T("p: pause/resume | c: cancel the current job | q: quit"))
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	for i, line := range lines {
+		buf.WriteString(truncateLine(line, width))
+		buf.WriteString("\x1b[K")
+		if i < len(lines)-1 {
+			buf.WriteString("\r\n")
+		}
+	}
+	buf.WriteString("\x1b[J")
+	os.Stdout.Write(buf.Bytes())
+}
+
+// Lines for the jobs, scrolled so that the one being downloaded is shown.
+func tuiJobLines(jobs []tuiJob, rows int, p Progress) []string {
+	start := 0
+	for i, job := range jobs {
+		if job.Status == "running" || job.Status == "" {
+			start = i - rows/2
+			break
+		}
+	}
+	if start > len(jobs)-rows {
+		start = len(jobs) - rows
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	lines := make([]string, 0, rows)
+	for _, job := range jobs[start : start+rows] {
+		var status string
+		switch job.Status {
+		case "":
+			status = i18n.T("waiting")
+		case "running":
+			status = i18n.T("running")
+			if p.Total > 0 {
+				status += fmt.Sprintf(" %d%%", 100*p.Files/p.Total)
+			}
+		case StatusDone:
+			status = i18n.Tf("done (%d files)", job.Files)
+		default:
+			status = job.Status
+		}
+		line := fmt.Sprintf("  %-20s %s", status, job.URL)
+		if job.Err != "" {
+			line += ": " + job.Err
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// Cuts the line down to the given number of characters.
+func truncateLine(line string, width int) string {
+	if utf8.RuneCountInString(line) <= width {
+		return line
+	}
+
+	return string([]rune(line)[:width])
+}
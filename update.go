@@ -0,0 +1,284 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var (
+	ErrNoReleaseAsset    = errors.New("The latest release has no build for this platform.")
+	ErrNoChecksums       = errors.New("The latest release has no checksums to verify the download with.")
+	ErrChecksumMismatch  = errors.New("The checksum of the download doesn't match. Not updating.")
+	ErrNoBinaryInArchive = errors.New("Found no executable in the downloaded archive.")
+	ErrUnknownVersion    = errors.New("This build has no version, so it can't tell if it's outdated. Use --force to update anyway.")
+)
+
+// Where releases are published, and the name of the checksums asset
+// generated by "make dist".
+const (
+	releasesURL    = "https://api.github.com/repos/MinoMino/mindl/releases/latest"
+	checksumsAsset = "SHA256SUMS"
+)
+
+var (
+	updateCheck, updateForce bool
+	updateCommand            = &Command{
+		Name:  "update",
+		Usage: "[flags]",
+		Short: "Update mindl to the latest release.",
+		Flags: NewCommandFlags("update"),
+		Setup: SetupNetwork,
+	}
+)
+
+func init() {
+	updateCommand.Run = runUpdate
+	updateCommand.Flags.BoolVar(&updateCheck, "check", false,
+		"Set to only check if there's a newer release.")
+	updateCommand.Flags.BoolVar(&updateForce, "force", false,
+		"Set to update even if already up to date.")
+}
+
+type release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r *release) assetURL(name string) string {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.URL
+		}
+	}
+
+	return ""
+}
+
+// Returns the name of the release archive for this platform, following
+// the naming of the makefile's dist target.
+func releaseAssetName() string {
+	goos := runtime.GOOS
+	if goos == "darwin" {
+		goos = "osx"
+	}
+	bits := "64"
+	if runtime.GOARCH == "386" {
+		bits = "32"
+	}
+	if goos == "windows" {
+		return fmt.Sprintf("mindl-%s%s.zip", goos, bits)
+	}
+
+	return fmt.Sprintf("mindl-%s%s.tar.gz", goos, bits)
+}
+
+// Whether or not the running version was built from the tag. Versions are
+// from "git describe --long", so they look like "v1.2-0-gabcdef-master".
+func isCurrentVersion(tag string) bool {
+	return strings.HasPrefix(version, tag+"-0-")
+}
+
+func runUpdate(args []string) {
+	client := plugins.NewHTTPClient(60)
+	var rel release
+	if err := getJSON(client, releasesURL, &rel); err != nil {
+		fatal(err)
+	}
+
+	if version == "UNSET" && !updateForce {
+		fatal(ErrUnknownVersion)
+	} else if isCurrentVersion(rel.Tag) && !updateForce {
+		log.Infof("Already up to date (%s).", rel.Tag)
+		return
+	}
+	log.Infof("Found a newer release: %s (currently %s)", rel.Tag, version)
+	if updateCheck {
+		return
+	}
+
+	name := releaseAssetName()
+	archiveURL := rel.assetURL(name)
+	if archiveURL == "" {
+		fatal(ErrNoReleaseAsset)
+	}
+	sumsURL := rel.assetURL(checksumsAsset)
+	if sumsURL == "" {
+		fatal(ErrNoChecksums)
+	}
+
+	sums, err := download(client, sumsURL)
+	if err != nil {
+		fatal(err)
+	}
+	expected, err := findChecksum(sums, name)
+	if err != nil {
+		fatal(err)
+	}
+
+	log.Infof("Downloading %s...", name)
+	archive, err := download(client, archiveURL)
+	if err != nil {
+		fatal(err)
+	}
+	sum := sha256.Sum256(archive)
+	if hex.EncodeToString(sum[:]) != expected {
+		fatal(ErrChecksumMismatch)
+	}
+	log.Debug("Checksum verified.")
+
+	bin, err := extractBinary(name, archive)
+	if err != nil {
+		fatal(err)
+	}
+	if err := replaceExecutable(bin); err != nil {
+		fatal(err)
+	}
+	log.Infof("Updated to %s.", rel.Tag)
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	data, err := download(client, url)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func download(client *http.Client, url string) ([]byte, error) {
+	r, err := client.Do(plugins.NewGetRequest(url))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, r.Status)
+	}
+
+	return ioutil.ReadAll(r.Body)
+}
+
+// Finds the checksum of a file in the output of sha256sum.
+func findChecksum(sums []byte, name string) (string, error) {
+	s := bufio.NewScanner(bytes.NewReader(sums))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		// sha256sum prefixes the name with * in binary mode.
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("%s has no checksum for %s.", checksumsAsset, name)
+}
+
+func extractBinary(name string, archive []byte) ([]byte, error) {
+	if strings.HasSuffix(name, ".zip") {
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if path.Base(f.Name) != "mindl.exe" {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
+		}
+		return nil, ErrNoBinaryInArchive
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, ErrNoBinaryInArchive
+		} else if err != nil {
+			return nil, err
+		}
+		if path.Base(header.Name) == "mindl" && header.Typeflag == tar.TypeReg {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// Replaces the running executable. The new one is written next to it first,
+// and the old one is moved out of the way rather than deleted, since Windows
+// doesn't allow deleting a running executable but does allow renaming it.
+func replaceExecutable(bin []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	newPath, oldPath := exe+".new", exe+".old"
+	if err := ioutil.WriteFile(newPath, bin, 0755); err != nil {
+		return err
+	}
+	os.Remove(oldPath)
+	if err := os.Rename(exe, oldPath); err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	if err := os.Rename(newPath, exe); err != nil {
+		// Put the old one back.
+		os.Rename(oldPath, exe)
+		return err
+	}
+	if err := os.Remove(oldPath); err != nil {
+		log.Debugf("Couldn't remove the old executable: %s", err)
+	}
+
+	return nil
+}
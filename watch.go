@@ -0,0 +1,255 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var ErrNoLister = errors.New("Found no plugin that can watch the URL.")
+
+// What we know about a watched source, like a series.
+type WatchSource struct {
+	URL    string `json:"url"`
+	Plugin string `json:"plugin"`
+	// Items that have been downloaded or skipped.
+	Seen      []string  `json:"seen"`
+	LastCheck time.Time `json:"last_check"`
+}
+
+func (src *WatchSource) HasSeen(item string) bool {
+	for _, s := range src.Seen {
+		if s == item {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The state of every watched source, saved to disk between checks.
+type WatchState struct {
+	Sources map[string]*WatchSource `json:"sources"`
+	path    string
+}
+
+func LoadWatchState(path string) (*WatchState, error) {
+	ws := &WatchState{
+		Sources: make(map[string]*WatchSource),
+		path:    path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ws, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, ws); err != nil {
+		return nil, err
+	}
+	if ws.Sources == nil {
+		ws.Sources = make(map[string]*WatchSource)
+	}
+
+	return ws, nil
+}
+
+func (ws *WatchState) Save() error {
+	data, err := json.MarshalIndent(ws, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := ws.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ws.path)
+}
+
+// Gets the state of a source, adding it if it's new.
+func (ws *WatchState) Source(url string, p plugins.Plugin) (src *WatchSource, isNew bool) {
+	if src, ok := ws.Sources[url]; ok {
+		return src, false
+	}
+
+	src = &WatchSource{URL: url, Plugin: p.Name(), Seen: []string{}}
+	ws.Sources[url] = src
+	return src, true
+}
+
+// Lists the items of a source and returns the ones that haven't been seen.
+func CheckSource(p plugins.Lister, src *WatchSource) (res []string, err error) {
+	// Plugins tend to panic on errors, and one source shouldn't keep the
+	// others from being checked.
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, &PanicError{r}
+		}
+	}()
+
+	items, err := p.List(src.URL)
+	if err != nil {
+		return nil, err
+	}
+	src.LastCheck = time.Now()
+
+	res = make([]string, 0, 5)
+	for _, item := range items {
+		if !src.HasSeen(item) {
+			res = append(res, item)
+		}
+	}
+
+	return res, nil
+}
+
+func findLister(ps []plugins.Plugin, url string) plugins.Plugin {
+	for _, p := range ps {
+		if l, ok := p.(plugins.Lister); ok && l.CanList(url) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+var (
+	watchInterval     time.Duration
+	watchOnce         bool
+	watchSkipExisting bool
+	watchStateFile    string
+	watchCommand      = &Command{
+		Name:  "watch",
+		Usage: "[flags] <url>...",
+		Short: "Periodically check sources like series and download new items.",
+		Flags: NewCommandFlags("watch"),
+	}
+)
+
+func init() {
+	watchCommand.Run = runWatch
+	fs := watchCommand.Flags
+	fs.VarP(&options, "option", "o",
+		"Options in a key=value format passed to plugins.")
+	fs.IntVarP(&workers, "workers", "w", 10,
+		"The number of workers to use.")
+	fs.BoolVarP(&defaults, "defaults", "d", false,
+		"Set to use default values for options whenever possible. No effect if --no-prompt is on.")
+	fs.BoolVarP(&noprompt, "no-prompt", "n", false,
+		"Set to turn off prompts for options and instead throw an error if a required option is left unset.")
+	fs.BoolVarP(&zipit, "zip", "z", false,
+		"Set to ZIP the files after each download finishes.")
+	addOutputFlag(fs)
+	fs.DurationVar(&watchInterval, "interval", time.Hour,
+		"How long to wait between checks.")
+	fs.BoolVar(&watchOnce, "once", false,
+		"Check once and exit instead of checking periodically. Useful with cron.")
+	fs.BoolVar(&watchSkipExisting, "skip-existing", false,
+		"When a source is checked for the first time, only download items published after that.")
+	fs.StringVar(&watchStateFile, "state", "mindl-watch.json",
+		"The file to keep track of what has already been downloaded in.")
+}
+
+func runWatch(args []string) {
+	if len(args) == 0 {
+		watchCommand.Flags.Usage()
+		os.Exit(0)
+	}
+	dldir = outputDirectory(dldir)
+
+	state, err := LoadWatchState(watchStateFile)
+	if err != nil {
+		fatal(err)
+	}
+
+	listers := make([]plugins.Plugin, len(args))
+	for i, url := range args {
+		if listers[i] = findLister(Plugins[:], url); listers[i] == nil {
+			log.WithField("url", url).Fatal(ErrNoLister)
+		}
+	}
+	pm := PluginManager(Plugins[:])
+	if err := pm.SetOptions(listers, map[string]string(options), defaults, noprompt); err != nil {
+		fatal(err)
+	}
+
+	for {
+		for i, url := range args {
+			if !checkAndDownload(state, url, listers[i]) {
+				return
+			}
+		}
+		if watchOnce {
+			return
+		}
+
+		log.Infof("Checking again in %s.", watchInterval)
+		select {
+		case <-time.After(watchInterval):
+		case <-interrupt:
+			log.Info("Interrupted!")
+			return
+		}
+	}
+}
+
+// Returns false if interrupted.
+func checkAndDownload(state *WatchState, url string, p plugins.Plugin) bool {
+	wlog := log.WithField("source", url)
+	src, isNew := state.Source(url, p)
+	wlog.Info("Checking for new items...")
+	items, err := CheckSource(p.(plugins.Lister), src)
+	if err != nil {
+		wlog.Error(err)
+		return true
+	}
+
+	if isNew && watchSkipExisting {
+		wlog.Infof("New source. Skipping %d existing item(s).", len(items))
+		src.Seen = append(src.Seen, items...)
+		items = nil
+	} else {
+		wlog.Infof("Found %d new item(s).", len(items))
+	}
+	if err := state.Save(); err != nil {
+		wlog.Error(err)
+	}
+
+	for _, item := range items {
+		log.Infof("Starting download of %s using \"%s\"...", item, pluginName(p))
+		res := startDownloading(item, p)
+		if res.Status == StatusDone {
+			src.Seen = append(src.Seen, item)
+			if err := state.Save(); err != nil {
+				wlog.Error(err)
+			}
+		} else if errors.Is(res.err, ErrInterrupted) {
+			return false
+		}
+	}
+
+	return true
+}
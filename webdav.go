@@ -0,0 +1,284 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+var webdavPassword string
+
+func init() {
+	commonFlags.StringVar(&webdavPassword, "webdav-password", "",
+		"The password for a WebDAV output, if it's not in the URL. Preferably set with MINDL_WEBDAV_PASSWORD.")
+	for _, scheme := range []string{"webdav", "webdavs", "dav", "davs"} {
+		storageSchemes[scheme] = newWebDAVStorage
+	}
+}
+
+// Files on a WebDAV server, like Nextcloud or a NAS. webdavs:// and davs://
+// use HTTPS, and the user and password can be given in the URL.
+type WebDAVStorage struct {
+	Root     *url.URL
+	User     string
+	Password string
+	client   *http.Client
+	// Directories that are known to exist.
+	dirs map[string]bool
+	m    sync.Mutex
+}
+
+func newWebDAVStorage(u *url.URL) (Storage, error) {
+	root := *u
+	root.Scheme = "http"
+	if strings.HasSuffix(u.Scheme, "s") {
+		root.Scheme = "https"
+	}
+	root.User = nil
+	root.Path = strings.TrimSuffix(root.Path, "/")
+	s := &WebDAVStorage{
+		Root:     &root,
+		Password: webdavPassword,
+		client:   &http.Client{},
+		dirs:     make(map[string]bool),
+	}
+	if u.User != nil {
+		s.User = u.User.Username()
+		if pass, ok := u.User.Password(); ok {
+			s.Password = pass
+		}
+	}
+
+	return s, nil
+}
+
+func (s *WebDAVStorage) Create(p string) (StorageWriter, error) {
+	if err := s.makeDirectories(path.Dir(p)); err != nil {
+		return nil, err
+	}
+
+	return &webdavWriter{s: s, path: p}, nil
+}
+
+func (s *WebDAVStorage) Remove(p string) error {
+	resp, err := s.do(http.MethodDelete, p, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("WebDAV DELETE returned error code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *WebDAVStorage) Location(p string) string {
+	u := s.url(p)
+	if s.User != "" {
+		u.User = url.User(s.User)
+	}
+
+	return u.String()
+}
+
+func (s *WebDAVStorage) url(p string) *url.URL {
+	u := *s.Root
+	u.Path = strings.TrimSuffix(u.Path+"/"+p, "/")
+	return &u
+}
+
+func (s *WebDAVStorage) do(method, p string, body io.Reader, length int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(p).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = length
+	if s.User != "" || s.Password != "" {
+		req.SetBasicAuth(s.User, s.Password)
+	}
+
+	return s.client.Do(req)
+}
+
+// Whether a request should be sent again. 423 is sent while a file or
+// directory is locked, e.g. while a sync client is using it.
+func webdavRetriable(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode == http.StatusLocked || resp.StatusCode >= 500
+}
+
+// Waits before another attempt, returning false if there are no more.
+func webdavRetry(attempt int, p string, resp *http.Response, err error) bool {
+	if attempt >= plugins.MaxRetries || !webdavRetriable(resp, err) {
+		return false
+	}
+	if err == nil {
+		err = fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	log.WithField("path", p).Debugf("WebDAV request failed, retrying: %s", err)
+	time.Sleep(plugins.RetryDelay << uint(attempt))
+
+	return true
+}
+
+// Creates the directory and its parents below the root, one at a time,
+// since MKCOL can't create parents.
+func (s *WebDAVStorage) makeDirectories(dir string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var p string
+	for _, part := range append([]string{""}, strings.Split(dir, "/")...) {
+		p = strings.TrimPrefix(p+"/"+part, "/")
+		if s.dirs[p] || part == "." {
+			continue
+		}
+
+		for attempt := 0; ; attempt++ {
+			resp, err := s.do("MKCOL", p, nil, 0)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if webdavRetry(attempt, p, resp, err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			// 405 means it already exists.
+			if resp.StatusCode >= 300 && resp.StatusCode != http.StatusMethodNotAllowed {
+				return fmt.Errorf("WebDAV MKCOL returned error code: %d", resp.StatusCode)
+			}
+			break
+		}
+		log.WithField("path", s.Location(p)).Debug("Created WebDAV directory.")
+		s.dirs[p] = true
+	}
+
+	return nil
+}
+
+// Streams the file to the server as it's written, while also keeping a copy
+// so that it can be sent again if the server fails.
+type webdavWriter struct {
+	s     *WebDAVStorage
+	path  string
+	pipe  *io.PipeWriter
+	done  chan error
+	spool spool
+}
+
+func (w *webdavWriter) Write(p []byte) (int, error) {
+	if w.pipe == nil {
+		var r *io.PipeReader
+		r, w.pipe = io.Pipe()
+		w.done = make(chan error, 1)
+		go func() {
+			resp, err := w.s.do(http.MethodPut, w.path, r, -1)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 300 {
+					err = &webdavStatusError{resp}
+				}
+			}
+			// Let Write() fail if the request did.
+			r.CloseWithError(err)
+			w.done <- err
+		}()
+	}
+
+	if _, err := w.spool.Write(p); err != nil {
+		return 0, err
+	}
+	// Errors are left for Close(), which can still retry from the spool.
+	w.pipe.Write(p)
+
+	return len(p), nil
+}
+
+func (w *webdavWriter) Close() error {
+	defer w.spool.Close()
+	var err error
+	if w.pipe == nil {
+		// Nothing was written, so it's an empty file.
+		err = w.put()
+	} else {
+		w.pipe.Close()
+		err = <-w.done
+	}
+
+	for attempt := 0; err != nil; attempt++ {
+		var resp *http.Response
+		if statusErr, ok := err.(*webdavStatusError); ok {
+			resp, err = statusErr.resp, nil
+		}
+		if !webdavRetry(attempt, w.path, resp, err) {
+			if err == nil {
+				err = fmt.Errorf("WebDAV PUT returned error code: %d", resp.StatusCode)
+			}
+			return err
+		}
+		err = w.put()
+	}
+
+	return nil
+}
+
+// Sends the whole file from the spool.
+func (w *webdavWriter) put() error {
+	r, err := w.spool.Reader(0)
+	if err != nil {
+		return err
+	}
+	resp, err := w.s.do(http.MethodPut, w.path, r, w.spool.size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &webdavStatusError{resp}
+	}
+
+	return nil
+}
+
+func (w *webdavWriter) Abort() error {
+	defer w.spool.Close()
+	if w.pipe == nil {
+		return nil
+	}
+
+	w.pipe.CloseWithError(ErrCanceled)
+	<-w.done
+	// Some servers keep what they got.
+	return w.s.Remove(w.path)
+}
+
+type webdavStatusError struct {
+	resp *http.Response
+}
+
+func (e *webdavStatusError) Error() string {
+	return fmt.Sprintf("WebDAV PUT returned error code: %d", e.resp.StatusCode)
+}